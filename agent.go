@@ -0,0 +1,567 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/timberio/cli/api"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// Name of the default agent config, in ~/.timber
+const agentConfigName = "agent.yml"
+
+// The agent checkpoints are tail cursors named after the mirror with this
+// prefix, so `timber tail --list-cursors` shows them
+const agentCursorPrefix = "agent."
+
+var defaultRotation = rotation{MaxSize: 100 << 20, Compress: true, Keep: 10}
+
+// Time to wait before tailing again after a mirror failed, doubled on each
+// consecutive failure
+var (
+	agentRetryMin = time.Second
+	agentRetryMax = time.Minute
+)
+
+var byteSizeRegexp = regexp.MustCompile(`^(\d+)\s*([KMG]?)(i?B)?$`)
+
+type agentOptions struct {
+	ConfigPath string
+	Check      bool // only validate the config
+}
+
+// agentMirror tails a selection of log lines to a local file
+type agentMirror struct {
+	Name      string
+	SourceIds []string
+	ViewID    string
+	Query     string
+	Format    string
+	Transport string
+	File      string
+	Rotation  rotation
+
+	loc       *time.Location
+	formatter *logLineFormatter
+	out       *rotatingFile
+	cursor    *tailCursor
+	seen      *api.IDWindow
+	since     time.Time // where tailing starts again after a failure
+	dirty     bool      // the cursor changed since it was saved
+	savedAt   time.Time
+}
+
+var agentMirrorColumns = []column{
+	{"name", func(i interface{}) string { return i.(*agentMirror).Name }},
+	{"sources", func(i interface{}) string { return strings.Join(i.(*agentMirror).SourceIds, ",") }},
+	{"query", func(i interface{}) string { return i.(*agentMirror).Query }},
+	{"file", func(i interface{}) string { return i.(*agentMirror).File }},
+}
+
+func getAgentConfigPath() (string, error) {
+	timberDir, err := getTimberDirPath()
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(timberDir, agentConfigName), nil
+}
+
+// agent tails each mirror of the config to its file until interrupted.
+// Lines are written before the checkpoint of their mirror is saved, so a
+// restarted agent continues where it stopped without missing lines. After a
+// crash the lines of the last second may be written twice.
+func agent(options *agentOptions) error {
+	mirrors, err := loadAgentConfig(options.ConfigPath)
+	if err != nil {
+		return err
+	}
+
+	loc, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range mirrors {
+		err = m.prepare(loc)
+		if err != nil {
+			return err
+		}
+	}
+
+	if options.Check {
+		return printList(os.Stdout, mirrors, agentMirrorColumns)
+	}
+
+	for _, m := range mirrors {
+		err = m.open()
+		if err != nil {
+			return err
+		}
+		defer m.close()
+	}
+
+	logger.Infof("Starting the agent with %d mirrors from %s", len(mirrors), options.ConfigPath)
+
+	var wg sync.WaitGroup
+	for _, m := range mirrors {
+		wg.Add(1)
+		go func(m *agentMirror) {
+			defer wg.Done()
+			m.run(rootContext)
+		}(m)
+	}
+	wg.Wait()
+
+	logger.Info("Stopping the agent")
+	return nil
+}
+
+// prepare applies the saved view of the mirror and checks its log format
+func (m *agentMirror) prepare(loc *time.Location) error {
+	if m.ViewID != "" {
+		view, err := client.GetSavedViewContext(rootContext, m.ViewID)
+		if err != nil {
+			return fmt.Errorf("Could not get the view of the mirror %s: %s", m.Name, err)
+		}
+
+		if len(m.SourceIds) == 0 {
+			m.SourceIds = view.ConsoleSettings.SourceIds
+		}
+		if m.Query == "" && view.ConsoleSettings.Query != nil {
+			m.Query = *view.ConsoleSettings.Query
+		}
+		if m.Format == "" {
+			m.Format = view.ConsoleSettings.LogLineFormat
+		}
+	}
+
+	if m.Format == "" {
+		m.Format = defaultLogFormat
+	}
+
+	if len(m.SourceIds) == 0 {
+		message := fmt.Sprintf("The mirror %s has no sources, set source-id or a view-id with sources", m.Name)
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return cli.NewExitError(message, 65)
+	}
+
+	formatter, err := newLogLineFormatter(m.Format, loc, false)
+	if err != nil {
+		message := fmt.Sprintf("Invalid log-format of the mirror %s: %s", m.Name, err)
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return cli.NewExitError(message, 65)
+	}
+
+	m.loc = loc
+	m.formatter = formatter
+	return nil
+}
+
+// open opens the file of the mirror and loads its checkpoint. A mirror
+// without a checkpoint starts with the lines logged from now on.
+func (m *agentMirror) open() error {
+	cursor, err := loadTailCursor(agentCursorPrefix + m.Name)
+	if err != nil {
+		return err
+	}
+
+	m.cursor = cursor
+	m.seen = api.NewIDWindow(tailScrollback)
+	m.since = time.Now()
+
+	if cursor.Dt != nil {
+		m.since = *cursor.Dt
+		for _, id := range cursor.SeenIDs {
+			m.seen.Add(id)
+		}
+		logger.Infof("Resuming the mirror %s from %s", m.Name, cursor.Dt.Format(time.RFC3339Nano))
+	}
+
+	m.out, err = openRotatingFile(m.File, m.Rotation)
+	if err != nil {
+		return fmt.Errorf("Could not open %s: %s", m.File, err)
+	}
+
+	logger.Infof("Mirroring %s to %s", m.Name, m.File)
+	return nil
+}
+
+func (m *agentMirror) close() {
+	if err := m.out.Close(); err != nil {
+		logger.Errorf("Could not close %s: %s", m.File, err)
+	}
+	if err := m.saveCursor(true); err != nil {
+		logger.Errorf("Could not save the checkpoint of the mirror %s: %s", m.Name, err)
+	}
+}
+
+// run tails the mirror until ctx is done, starting again after failures
+func (m *agentMirror) run(ctx context.Context) {
+	wait := agentRetryMin
+
+	for {
+		progressed, err := m.mirror(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if progressed {
+			wait = agentRetryMin
+		}
+		logger.Warnf("The mirror %s stopped, retrying in %s: %s", m.Name, wait, err)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+
+		wait *= 2
+		if wait > agentRetryMax {
+			wait = agentRetryMax
+		}
+	}
+}
+
+// mirror searches the lines logged since the last one written, then writes
+// new lines as they are tailed. progressed is true when lines were written
+// before it failed.
+func (m *agentMirror) mirror(ctx context.Context) (bool, error) {
+	var mirrorErr error
+	progressed := false
+
+	send := func(batch *api.LogBatch, err error) bool {
+		if err == nil {
+			err = m.write(batch)
+		}
+		if err != nil {
+			mirrorErr = err
+			return false
+		}
+
+		progressed = progressed || len(batch.LogLines) > 0
+		return true
+	}
+
+	newest, ok := backfillLogBatches(ctx, m.SourceIds, m.Query, m.since, send)
+	if ok {
+		streamLogBatches(ctx, m.SourceIds, m.Query, m.Transport, &newest, send)
+	}
+
+	return progressed, mirrorErr
+}
+
+// write appends the new lines of a batch to the file and advances the
+// checkpoint once they are flushed. Files rotated every period are rotated
+// when the first lines of a new period arrive.
+func (m *agentMirror) write(batch *api.LogBatch) error {
+	if batch.Gap != nil {
+		logger.Warnf("The mirror %s missed lines: %s", m.Name, strings.TrimPrefix(gapMessage(batch.Gap, m.loc), "⚠  "))
+	}
+
+	err := m.out.RotateIfDue(time.Now())
+	if err != nil {
+		return err
+	}
+
+	for _, line := range batch.LogLines {
+		if !m.seen.Add(line.ID) {
+			continue
+		}
+
+		formatted, err := m.formatter.Format(line)
+		if err != nil {
+			return err
+		}
+
+		err = m.out.WriteLine(formatted)
+		if err != nil {
+			return err
+		}
+
+		// Lines arriving late don't move the checkpoint back
+		if m.cursor.Dt == nil || line.Datetime.After(*m.cursor.Dt) {
+			dt := line.Datetime
+			m.cursor.Dt = &dt
+			m.cursor.SeenIDs = nil
+			m.since = dt
+		}
+		if line.Datetime.Equal(*m.cursor.Dt) {
+			m.cursor.SeenIDs = append(m.cursor.SeenIDs, line.ID)
+		}
+		m.dirty = true
+	}
+
+	err = m.out.Flush()
+	if err != nil {
+		return err
+	}
+
+	return m.saveCursor(false)
+}
+
+// saveCursor saves the checkpoint at most once per tailCursorSaveInterval
+// unless force is set
+func (m *agentMirror) saveCursor(force bool) error {
+	if !m.dirty || (!force && time.Since(m.savedAt) < tailCursorSaveInterval) {
+		return nil
+	}
+
+	m.cursor.SourceIds = m.SourceIds
+	m.cursor.Query = m.Query
+	m.cursor.UpdatedAt = time.Now().UTC()
+
+	m.dirty = false
+	m.savedAt = time.Now()
+	return saveTailCursor(m.cursor)
+}
+
+// loadAgentConfig reads the mirrors of an agent config. Relative paths in
+// the config are relative to its directory.
+func loadAgentConfig(filename string) ([]*agentMirror, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		message := fmt.Sprintf("There is no agent config at %s, create it or use --config", filename)
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return nil, cli.NewExitError(message, 65)
+	} else if err != nil {
+		return nil, err
+	}
+
+	value, err := parseYAML(data)
+	if err == nil {
+		var mirrors []*agentMirror
+		mirrors, err = decodeAgentConfig(value, filepath.Dir(filename))
+		if err == nil {
+			return mirrors, nil
+		}
+	}
+
+	message := fmt.Sprintf("Invalid agent config %s: %s", filename, err)
+	// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+	return nil, cli.NewExitError(message, 65)
+}
+
+func decodeAgentConfig(value interface{}, base string) ([]*agentMirror, error) {
+	root, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected dir and mirrors settings")
+	}
+
+	err := checkAgentKeys(root, "", "dir", "log-format", "transport", "rotate", "mirrors")
+	if err != nil {
+		return nil, err
+	}
+
+	dir := agentString(root, "dir")
+	if dir == "" {
+		return nil, fmt.Errorf("dir, the directory of the mirrored files, is required")
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(base, dir)
+	}
+
+	defaults := &agentMirror{
+		Format:    agentString(root, "log-format"),
+		Transport: agentString(root, "transport"),
+		Rotation:  defaultRotation,
+	}
+	if defaults.Transport == "" {
+		defaults.Transport = api.TransportAuto
+	}
+
+	err = decodeRotation(root["rotate"], &defaults.Rotation, "rotate")
+	if err != nil {
+		return nil, err
+	}
+
+	list, ok := root["mirrors"].([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("mirrors must list at least one mirror")
+	}
+
+	mirrors := []*agentMirror{}
+	names := map[string]bool{}
+	files := map[string]bool{}
+
+	for i, item := range list {
+		prefix := fmt.Sprintf("mirrors[%d]", i)
+
+		values, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: expected name, source-id, view-id, query, log-format, transport, file and rotate settings", prefix)
+		}
+
+		err = checkAgentKeys(values, prefix+".", "name", "source-id", "view-id", "query", "log-format", "transport", "file", "rotate")
+		if err != nil {
+			return nil, err
+		}
+
+		m := *defaults
+		m.Name = agentString(values, "name")
+		m.ViewID = agentString(values, "view-id")
+		m.Query = agentString(values, "query")
+		m.File = agentString(values, "file")
+
+		if values["source-id"] != nil {
+			m.SourceIds, _ = configStrings(values, "source-id")
+		}
+		if format := agentString(values, "log-format"); format != "" {
+			m.Format = format
+		}
+		if transport := agentString(values, "transport"); transport != "" {
+			m.Transport = transport
+		}
+
+		if !tailCursorNameRegexp.MatchString(m.Name) {
+			return nil, fmt.Errorf("%s: name is required and may only use letters, digits, _, . and -", prefix)
+		}
+		if names[m.Name] {
+			return nil, fmt.Errorf("%s: there are two mirrors named %s", prefix, m.Name)
+		}
+		names[m.Name] = true
+
+		if len(m.SourceIds) == 0 && m.ViewID == "" {
+			return nil, fmt.Errorf("%s: set source-id or view-id", prefix)
+		}
+
+		switch m.Transport {
+		case api.TransportAuto, api.TransportSSE, api.TransportPoll:
+		default:
+			return nil, fmt.Errorf("%s: transport must be auto, sse or poll", prefix)
+		}
+
+		if m.File == "" {
+			m.File = m.Name + ".log"
+		}
+		if !filepath.IsAbs(m.File) {
+			m.File = filepath.Join(dir, m.File)
+		}
+		if files[m.File] {
+			return nil, fmt.Errorf("%s: %s is the file of another mirror", prefix, m.File)
+		}
+		files[m.File] = true
+
+		err = decodeRotation(values["rotate"], &m.Rotation, prefix+".rotate")
+		if err != nil {
+			return nil, err
+		}
+
+		mirrors = append(mirrors, &m)
+	}
+
+	return mirrors, nil
+}
+
+// decodeRotation overrides the settings of r that are set in value
+func decodeRotation(value interface{}, r *rotation, prefix string) error {
+	if value == nil {
+		return nil
+	}
+
+	values, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s: expected max-size, every, compress, keep and max-age settings", prefix)
+	}
+
+	err := checkAgentKeys(values, prefix+".", "max-size", "every", "compress", "keep", "max-age")
+	if err != nil {
+		return err
+	}
+
+	if s := agentString(values, "max-size"); s != "" {
+		r.MaxSize, err = parseByteSize(s)
+		if err != nil {
+			return fmt.Errorf("%s.max-size: %s", prefix, err)
+		}
+	}
+
+	if s := agentString(values, "every"); s != "" {
+		r.Every, err = parseDuration(s)
+		if err != nil {
+			return fmt.Errorf("%s.every: %s", prefix, err)
+		}
+	}
+
+	if s := agentString(values, "max-age"); s != "" {
+		r.MaxAge, err = parseDuration(s)
+		if err != nil {
+			return fmt.Errorf("%s.max-age: %s", prefix, err)
+		}
+	}
+
+	if s := agentString(values, "compress"); s != "" {
+		r.Compress, err = strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%s.compress: expected true or false", prefix)
+		}
+	}
+
+	if s := agentString(values, "keep"); s != "" {
+		r.Keep, err = strconv.Atoi(s)
+		if err != nil || r.Keep < 0 {
+			return fmt.Errorf("%s.keep: expected a number of files", prefix)
+		}
+	}
+
+	return nil
+}
+
+// checkAgentKeys rejects unknown settings, which are usually typos
+func checkAgentKeys(values map[string]interface{}, prefix string, keys ...string) error {
+	for key := range values {
+		known := false
+		for _, k := range keys {
+			known = known || k == key
+		}
+		if !known {
+			return fmt.Errorf("unknown setting %s%s", prefix, key)
+		}
+	}
+	return nil
+}
+
+// agentString returns an empty string for settings that aren't set or are
+// null
+func agentString(values map[string]interface{}, key string) string {
+	if values[key] == nil {
+		return ""
+	}
+	s, _ := configString(values, key)
+	return s
+}
+
+// parseByteSize parses sizes such as 512KB, 100MB or 1GiB, in powers of 1024
+func parseByteSize(value string) (int64, error) {
+	match := byteSizeRegexp.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(value)))
+	if match == nil {
+		return 0, fmt.Errorf("invalid size %q, use a number of bytes, KB, MB or GB", value)
+	}
+
+	size, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	switch match[2] {
+	case "K":
+		size <<= 10
+	case "M":
+		size <<= 20
+	case "G":
+		size <<= 30
+	}
+
+	return size, nil
+}
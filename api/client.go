@@ -2,9 +2,11 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
 	"path"
 	"strconv"
@@ -20,29 +22,65 @@ type Client struct {
 	Host   string
 
 	httpClient *retryablehttp.Client
+	logger     Logger
 }
 
 type Logger interface {
 	Printf(string, ...interface{})
 }
 
-func NewClient(host string, apiKey string) *Client {
+// ClientOption configures a Client created with NewClient
+type ClientOption func(*Client)
+
+// WithTimeout sets the timeout of each HTTP request attempt, retries get a
+// fresh timeout. Use a context deadline to bound a whole call.
+func WithTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.httpClient.HTTPClient.Timeout = timeout
+	}
+}
+
+// WithRetryPolicy sets the number of times failed requests are retried and
+// the bounds of the exponential backoff between attempts
+func WithRetryPolicy(retryMax int, waitMin time.Duration, waitMax time.Duration) ClientOption {
+	return func(c *Client) {
+		c.httpClient.RetryMax = retryMax
+		c.httpClient.RetryWaitMin = waitMin
+		c.httpClient.RetryWaitMax = waitMax
+	}
+}
+
+// WithLogger logs requests and retries
+func WithLogger(l Logger) ClientOption {
+	return func(c *Client) {
+		c.SetLogger(l)
+	}
+}
+
+func NewClient(host string, apiKey string, options ...ClientOption) *Client {
 	httpClient := retryablehttp.NewClient()
 
 	httpClient.Logger = nil
 
 	httpClient.HTTPClient.Timeout = 10 * time.Second
 
-	return &Client{
+	c := &Client{
 		APIKey: apiKey,
 		Host:   host,
 
 		httpClient: httpClient,
 	}
+
+	for _, option := range options {
+		option(c)
+	}
+
+	return c
 }
 
 func (c *Client) SetLogger(l Logger) {
 	c.httpClient.Logger = l
+	c.logger = l
 }
 
 //
@@ -50,11 +88,14 @@ func (c *Client) SetLogger(l Logger) {
 //
 
 type searchRequest struct {
-	ApplicationIds []string  `json:"application_ids"`
-	DtGt           time.Time `json:"dt_gt"`
-	Limit          int       `json:"limit"`
-	Query          string    `json:"query"`
-	Sort           string    `json:"sort"` // TODO maybe make this an "enum"
+	ApplicationIds []string   `json:"application_ids"`
+	DtGt           *time.Time `json:"dt_gt,omitempty"`
+	DtGte          *time.Time `json:"dt_gte,omitempty"`
+	DtLt           *time.Time `json:"dt_lt,omitempty"`
+	DtLte          *time.Time `json:"dt_lte,omitempty"`
+	Limit          int        `json:"limit"`
+	Query          string     `json:"query"`
+	Sort           string     `json:"sort"` // TODO maybe make this an "enum"
 }
 
 func NewSearchRequest() *searchRequest {
@@ -65,28 +106,26 @@ func NewSearchRequest() *searchRequest {
 }
 
 func (c *Client) Search(request *searchRequest) ([]*LogLine, error) {
+	return c.SearchContext(context.Background(), request)
+}
+
+// SearchContext is Search with a context that cancels the request
+func (c *Client) SearchContext(ctx context.Context, request *searchRequest) ([]*LogLine, error) {
 	response := struct {
 		RawLines []*json.RawMessage `json:"data"`
 	}{
 		make([]*json.RawMessage, 0, request.Limit),
 	}
 
-	err := c.Request("POST", "/log_lines/search", nil, request, &response)
+	err := c.RequestContext(ctx, "POST", "/log_lines/search", nil, request, &response)
 	if err != nil {
 		return nil, err
 	}
 
 	logLines := make([]*LogLine, len(response.RawLines))
 	for i, rawLine := range response.RawLines {
-		// unmarshal twice, once to fill structured fields, once to unmarshal the unknown fields
-		// TODO it'd be better to only unmarshal once
-		logLine := &LogLine{}
-
-		if err := json.Unmarshal(*rawLine, logLine); err != nil {
-			return nil, err
-		}
-
-		if err := json.Unmarshal(*rawLine, &logLine.Fields); err != nil {
+		logLine, err := decodeLogLine(*rawLine)
+		if err != nil {
 			return nil, err
 		}
 
@@ -96,16 +135,37 @@ func (c *Client) Search(request *searchRequest) ([]*LogLine, error) {
 	return logLines, nil
 }
 
+func decodeLogLine(rawLine []byte) (*LogLine, error) {
+	// unmarshal twice, once to fill structured fields, once to unmarshal the unknown fields
+	// TODO it'd be better to only unmarshal once
+	logLine := &LogLine{}
+
+	if err := json.Unmarshal(rawLine, logLine); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(rawLine, &logLine.Fields); err != nil {
+		return nil, err
+	}
+
+	return logLine, nil
+}
+
 //
 // Sources
 //
 
 func (c *Client) ListSources() ([]*Application, error) {
+	return c.ListSourcesContext(context.Background())
+}
+
+// ListSourcesContext is ListSources with a context that cancels the request
+func (c *Client) ListSourcesContext(ctx context.Context) ([]*Application, error) {
 	response := struct {
 		Applications []*Application `json:"data"`
 	}{}
 
-	err := c.Request("GET", "/applications", nil, nil, &response)
+	err := c.RequestContext(ctx, "GET", "/applications", nil, nil, &response)
 	if err != nil {
 		return nil, err
 	}
@@ -113,16 +173,64 @@ func (c *Client) ListSources() ([]*Application, error) {
 	return response.Applications, nil
 }
 
+// GetSourceSchema returns the SQL table a source is stored in and the fields
+// that have been seen in its log lines
+func (c *Client) GetSourceSchema(id string) (*SourceSchema, error) {
+	return c.GetSourceSchemaContext(context.Background(), id)
+}
+
+// GetSourceSchemaContext is GetSourceSchema with a context that cancels the request
+func (c *Client) GetSourceSchemaContext(ctx context.Context, id string) (*SourceSchema, error) {
+	response := struct {
+		Schema *SourceSchema `json:"data"`
+	}{}
+
+	err := c.RequestContext(ctx, "GET", path.Join("/applications", id, "schema"), nil, nil, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Schema, nil
+}
+
+//
+// API keys
+//
+
+// GetCurrentAPIKey describes the API key of the client
+func (c *Client) GetCurrentAPIKey() (*APIKey, error) {
+	return c.GetCurrentAPIKeyContext(context.Background())
+}
+
+// GetCurrentAPIKeyContext is GetCurrentAPIKey with a context that cancels the request
+func (c *Client) GetCurrentAPIKeyContext(ctx context.Context) (*APIKey, error) {
+	response := struct {
+		APIKey *APIKey `json:"data"`
+	}{}
+
+	err := c.RequestContext(ctx, "GET", "/api_keys/current", nil, nil, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	return response.APIKey, nil
+}
+
 //
 // Organizations
 //
 
 func (c *Client) GetOrganization(id string) (*Organization, error) {
+	return c.GetOrganizationContext(context.Background(), id)
+}
+
+// GetOrganizationContext is GetOrganization with a context that cancels the request
+func (c *Client) GetOrganizationContext(ctx context.Context, id string) (*Organization, error) {
 	response := struct {
 		Organization *Organization `json:"data"`
 	}{}
 
-	err := c.Request("GET", path.Join("/organizations/", id), nil, nil, &response)
+	err := c.RequestContext(ctx, "GET", path.Join("/organizations/", id), nil, nil, &response)
 	if err != nil {
 		return nil, err
 	}
@@ -131,11 +239,16 @@ func (c *Client) GetOrganization(id string) (*Organization, error) {
 }
 
 func (c *Client) ListOrganizations() ([]*Organization, error) {
+	return c.ListOrganizationsContext(context.Background())
+}
+
+// ListOrganizationsContext is ListOrganizations with a context that cancels the request
+func (c *Client) ListOrganizationsContext(ctx context.Context) ([]*Organization, error) {
 	response := struct {
 		Organizations []*Organization `json:"data"`
 	}{}
 
-	err := c.Request("GET", "/organizations", nil, nil, &response)
+	err := c.RequestContext(ctx, "GET", "/organizations", nil, nil, &response)
 	if err != nil {
 		return nil, err
 	}
@@ -148,11 +261,16 @@ func (c *Client) ListOrganizations() ([]*Organization, error) {
 //
 
 func (c *Client) GetSavedView(id string) (*SavedView, error) {
+	return c.GetSavedViewContext(context.Background(), id)
+}
+
+// GetSavedViewContext is GetSavedView with a context that cancels the request
+func (c *Client) GetSavedViewContext(ctx context.Context, id string) (*SavedView, error) {
 	response := struct {
 		SavedView *SavedView `json:"data"`
 	}{}
 
-	err := c.Request("GET", path.Join("/saved_views", id), nil, nil, &response)
+	err := c.RequestContext(ctx, "GET", path.Join("/saved_views", id), nil, nil, &response)
 	if err != nil {
 		return nil, err
 	}
@@ -161,11 +279,16 @@ func (c *Client) GetSavedView(id string) (*SavedView, error) {
 }
 
 func (c *Client) ListSavedViews() ([]*SavedView, error) {
+	return c.ListSavedViewsContext(context.Background())
+}
+
+// ListSavedViewsContext is ListSavedViews with a context that cancels the request
+func (c *Client) ListSavedViewsContext(ctx context.Context) ([]*SavedView, error) {
 	response := struct {
 		SavedViews []*SavedView `json:"data"`
 	}{}
 
-	err := c.Request("GET", "/saved_views?type=CONSOLE", nil, nil, &response)
+	err := c.RequestContext(ctx, "GET", "/saved_views?type=CONSOLE", nil, nil, &response)
 	if err != nil {
 		return nil, err
 	}
@@ -178,6 +301,11 @@ func (c *Client) ListSavedViews() ([]*SavedView, error) {
 //
 
 func (c *Client) CreateSQLQuery(organizationID string, body string) (*SQLQuery, error) {
+	return c.CreateSQLQueryContext(context.Background(), organizationID, body)
+}
+
+// CreateSQLQueryContext is CreateSQLQuery with a context that cancels the request
+func (c *Client) CreateSQLQueryContext(ctx context.Context, organizationID string, body string) (*SQLQuery, error) {
 	request := struct {
 		OrganizationID string `json:"organization_id"`
 		Body           string `json:"body"`
@@ -190,7 +318,7 @@ func (c *Client) CreateSQLQuery(organizationID string, body string) (*SQLQuery,
 		SQLQuery *SQLQuery `json:"data"`
 	}{}
 
-	err := c.Request("POST", "/sql_queries", nil, &request, &response)
+	err := c.RequestContext(ctx, "POST", "/sql_queries", nil, &request, &response)
 	if err != nil {
 		return nil, err
 	}
@@ -199,11 +327,36 @@ func (c *Client) CreateSQLQuery(organizationID string, body string) (*SQLQuery,
 }
 
 func (c *Client) GetSQLQuery(id string) (*SQLQuery, error) {
+	return c.GetSQLQueryContext(context.Background(), id)
+}
+
+// GetSQLQueryContext is GetSQLQuery with a context that cancels the request
+func (c *Client) GetSQLQueryContext(ctx context.Context, id string) (*SQLQuery, error) {
 	response := struct {
 		SQLQuery *SQLQuery `json:"data"`
 	}{}
 
-	err := c.Request("GET", path.Join("/sql_queries", id), nil, nil, &response)
+	err := c.RequestContext(ctx, "GET", path.Join("/sql_queries", id), nil, nil, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	return response.SQLQuery, nil
+}
+
+// CancelSQLQuery stops a running query, the returned query has the status it
+// had once cancelled
+func (c *Client) CancelSQLQuery(id string) (*SQLQuery, error) {
+	return c.CancelSQLQueryContext(context.Background(), id)
+}
+
+// CancelSQLQueryContext is CancelSQLQuery with a context that cancels the request
+func (c *Client) CancelSQLQueryContext(ctx context.Context, id string) (*SQLQuery, error) {
+	response := struct {
+		SQLQuery *SQLQuery `json:"data"`
+	}{}
+
+	err := c.RequestContext(ctx, "POST", path.Join("/sql_queries", id, "cancel"), nil, nil, &response)
 	if err != nil {
 		return nil, err
 	}
@@ -216,10 +369,24 @@ type GetSQLQueryResultsRequest struct {
 	NextToken  string `json:"next_token"`
 }
 
-func (c *Client) GetSQLQueryResults(id string, request *GetSQLQueryResultsRequest) ([]map[string]interface{}, string, error) {
+// SQLQueryResults is a page of results. Columns are in the order the server
+// returned them.
+type SQLQueryResults struct {
+	Columns   []*SQLColumn
+	Rows      []*SQLRow
+	NextToken string
+}
+
+func (c *Client) GetSQLQueryResults(id string, request *GetSQLQueryResultsRequest) (*SQLQueryResults, error) {
+	return c.GetSQLQueryResultsContext(context.Background(), id, request)
+}
+
+// GetSQLQueryResultsContext is GetSQLQueryResults with a context that cancels the request
+func (c *Client) GetSQLQueryResultsContext(ctx context.Context, id string, request *GetSQLQueryResultsRequest) (*SQLQueryResults, error) {
 	response := struct {
-		NextToken string                   `json:"next_token"`
-		Results   []map[string]interface{} `json:"data"`
+		Columns   []*SQLColumn `json:"columns"`
+		NextToken string       `json:"next_token"`
+		Results   []*SQLRow    `json:"data"`
 	}{}
 
 	query := url.Values{}
@@ -232,12 +399,25 @@ func (c *Client) GetSQLQueryResults(id string, request *GetSQLQueryResultsReques
 		query.Set("next_token", request.NextToken)
 	}
 
-	err := c.Request("GET", path.Join("/sql_queries", id, "results"), &query, nil, &response)
+	err := c.RequestContext(ctx, "GET", path.Join("/sql_queries", id, "results"), &query, nil, &response)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
 
-	return response.Results, response.NextToken, nil
+	results := &SQLQueryResults{
+		Columns:   response.Columns,
+		Rows:      response.Results,
+		NextToken: response.NextToken,
+	}
+
+	// Without a schema, the columns are taken from the first row
+	if len(results.Columns) == 0 && len(results.Rows) > 0 {
+		for _, name := range results.Rows[0].Columns {
+			results.Columns = append(results.Columns, &SQLColumn{Name: name})
+		}
+	}
+
+	return results, nil
 }
 
 type ListSQLQueriesRequest struct {
@@ -253,6 +433,11 @@ func NewListSQLQueriesRequest() *ListSQLQueriesRequest {
 }
 
 func (c *Client) ListSQLQueries(request *ListSQLQueriesRequest) ([]*SQLQuery, error) {
+	return c.ListSQLQueriesContext(context.Background(), request)
+}
+
+// ListSQLQueriesContext is ListSQLQueries with a context that cancels the request
+func (c *Client) ListSQLQueriesContext(ctx context.Context, request *ListSQLQueriesRequest) ([]*SQLQuery, error) {
 	response := struct {
 		SQLQueries []*SQLQuery `json:"data"`
 	}{}
@@ -267,7 +452,7 @@ func (c *Client) ListSQLQueries(request *ListSQLQueriesRequest) ([]*SQLQuery, er
 		query.Set("sort", request.Sort)
 	}
 
-	err := c.Request("GET", "/sql_queries", &query, nil, &response)
+	err := c.RequestContext(ctx, "GET", "/sql_queries", &query, nil, &response)
 	if err != nil {
 		return nil, err
 	}
@@ -279,7 +464,14 @@ func (c *Client) ListSQLQueries(request *ListSQLQueriesRequest) ([]*SQLQuery, er
 // Util
 //
 
+// Request sends a request to the Timber API, the response is decoded into
+// responseStruct when it isn't nil
 func (c *Client) Request(method string, path string, query *url.Values, requestStruct interface{}, responseStruct interface{}) error {
+	return c.RequestContext(context.Background(), method, path, query, requestStruct, responseStruct)
+}
+
+// RequestContext is Request with a context that cancels the request
+func (c *Client) RequestContext(ctx context.Context, method string, path string, query *url.Values, requestStruct interface{}, responseStruct interface{}) error {
 	if c.Host == "" {
 		return errors.New("A host is required to make a request to the Timber API")
 	}
@@ -306,11 +498,9 @@ func (c *Client) Request(method string, path string, query *url.Values, requestS
 		return err
 	}
 
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", c.APIKey))
-	req.Header.Add("User-Agent", userAgent)
+	c.setHeaders(req.Header)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(ctx, req)
 	if err != nil {
 		return err
 	}
@@ -326,22 +516,62 @@ func (c *Client) Request(method string, path string, query *url.Values, requestS
 
 		return nil
 	} else {
-		response := struct {
-			Error  *Error   `json:"error"`
-			Errors []*Error `json:"errors"`
-		}{}
+		return decodeError(resp)
+	}
+}
 
-		err = json.NewDecoder(resp.Body).Decode(&response)
-		if err != nil {
-			return err
-		}
+// do sends a request, returning as soon as ctx is done. retryablehttp stops
+// retrying once the context is done but sleeps between attempts regardless,
+// so the request is left to finish in the background.
+func (c *Client) do(ctx context.Context, req *retryablehttp.Request) (*http.Response, error) {
+	type result struct {
+		resp *http.Response
+		err  error
+	}
 
-		error := response.Error
+	done := make(chan result, 1)
+	go func() {
+		resp, err := c.httpClient.Do(req.WithContext(ctx))
+		done <- result{resp, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.resp, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.resp != nil {
+				r.resp.Body.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
 
-		if error == nil && len(response.Errors) > 0 {
-			error = response.Errors[0]
-		}
+func (c *Client) setHeaders(header http.Header) {
+	header.Add("Content-Type", "application/json")
+	header.Add("Authorization", fmt.Sprintf("Bearer %s", c.APIKey))
+	header.Add("User-Agent", userAgent)
+}
+
+func decodeError(resp *http.Response) error {
+	response := struct {
+		Error  *Error   `json:"error"`
+		Errors []*Error `json:"errors"`
+	}{}
+
+	// Bodies that aren't JSON, e.g. from a proxy, are reported by status
+	json.NewDecoder(resp.Body).Decode(&response)
+
+	error := response.Error
 
-		return &ServiceError{StatusCode: resp.StatusCode, ErrorStruct: error}
+	if error == nil && len(response.Errors) > 0 {
+		error = response.Errors[0]
 	}
+
+	if error == nil {
+		error = &Error{Message: http.StatusText(resp.StatusCode)}
+	}
+
+	return &ServiceError{StatusCode: resp.StatusCode, ErrorStruct: error}
 }
@@ -0,0 +1,177 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	retryablehttp "github.com/hashicorp/go-retryablehttp"
+)
+
+// Errors returned by the token endpoint while a device authorization is
+// pending, see RFC 8628
+const (
+	OAuthAuthorizationPending = "authorization_pending"
+	OAuthSlowDown             = "slow_down"
+	OAuthAccessDenied         = "access_denied"
+	OAuthExpiredToken         = "expired_token"
+)
+
+// DeviceAuthorization is the code a user enters in their browser to let the
+// CLI log in
+type DeviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// Token is an OAuth access token, used as an API key, and the refresh token
+// that renews it
+type Token struct {
+	AccessToken  string    `json:"access_token"`
+	TokenType    string    `json:"token_type"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresIn    int       `json:"expires_in"`
+	Scope        string    `json:"scope"`
+	ExpiresAt    time.Time `json:"-"`
+}
+
+// OAuthError is an error response of the OAuth endpoints, see RFC 6749
+type OAuthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *OAuthError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("%s: %s", e.Code, e.Description)
+	}
+	return e.Code
+}
+
+// RequestDeviceAuthorization starts a device authorization, the user then
+// enters the returned user code at the verification URI
+func (c *Client) RequestDeviceAuthorization(clientID string, scope string) (*DeviceAuthorization, error) {
+	return c.RequestDeviceAuthorizationContext(context.Background(), clientID, scope)
+}
+
+// RequestDeviceAuthorizationContext is RequestDeviceAuthorization with a context that cancels the request
+func (c *Client) RequestDeviceAuthorizationContext(ctx context.Context, clientID string, scope string) (*DeviceAuthorization, error) {
+	form := url.Values{"client_id": {clientID}}
+	if scope != "" {
+		form.Set("scope", scope)
+	}
+
+	authorization := &DeviceAuthorization{}
+	err := c.postForm(ctx, "/oauth/device/code", form, authorization)
+	if err != nil {
+		return nil, err
+	}
+
+	return authorization, nil
+}
+
+// PollDeviceToken asks once for the token of a device authorization. An
+// *OAuthError with the code OAuthAuthorizationPending is returned until the
+// user has approved it.
+func (c *Client) PollDeviceToken(clientID string, deviceCode string) (*Token, error) {
+	return c.PollDeviceTokenContext(context.Background(), clientID, deviceCode)
+}
+
+// PollDeviceTokenContext is PollDeviceToken with a context that cancels the request
+func (c *Client) PollDeviceTokenContext(ctx context.Context, clientID string, deviceCode string) (*Token, error) {
+	return c.requestToken(ctx, url.Values{
+		"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+		"device_code": {deviceCode},
+		"client_id":   {clientID},
+	})
+}
+
+// RefreshToken exchanges a refresh token for a new access token
+func (c *Client) RefreshToken(clientID string, refreshToken string) (*Token, error) {
+	return c.RefreshTokenContext(context.Background(), clientID, refreshToken)
+}
+
+// RefreshTokenContext is RefreshToken with a context that cancels the request
+func (c *Client) RefreshTokenContext(ctx context.Context, clientID string, refreshToken string) (*Token, error) {
+	return c.requestToken(ctx, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {clientID},
+	})
+}
+
+// RevokeToken revokes an access or refresh token, see RFC 7009
+func (c *Client) RevokeToken(clientID string, token string, tokenTypeHint string) error {
+	return c.RevokeTokenContext(context.Background(), clientID, token, tokenTypeHint)
+}
+
+// RevokeTokenContext is RevokeToken with a context that cancels the request
+func (c *Client) RevokeTokenContext(ctx context.Context, clientID string, token string, tokenTypeHint string) error {
+	form := url.Values{"token": {token}, "client_id": {clientID}}
+	if tokenTypeHint != "" {
+		form.Set("token_type_hint", tokenTypeHint)
+	}
+
+	return c.postForm(ctx, "/oauth/revoke", form, nil)
+}
+
+func (c *Client) requestToken(ctx context.Context, form url.Values) (*Token, error) {
+	token := &Token{}
+	err := c.postForm(ctx, "/oauth/token", form, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if token.ExpiresIn > 0 {
+		token.ExpiresAt = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+
+	return token, nil
+}
+
+// postForm sends a form encoded request to an OAuth endpoint, these are not
+// authenticated with the API key
+func (c *Client) postForm(ctx context.Context, path string, form url.Values, responseStruct interface{}) error {
+	if c.Host == "" {
+		return errors.New("A host is required to make a request to the Timber API")
+	}
+
+	req, err := retryablehttp.NewRequest("POST", c.Host+path, []byte(form.Encode()))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("User-Agent", userAgent)
+
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		if responseStruct != nil {
+			return json.NewDecoder(resp.Body).Decode(responseStruct)
+		}
+		return nil
+	}
+
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized {
+		oauthErr := &OAuthError{}
+		if json.NewDecoder(resp.Body).Decode(oauthErr) == nil && oauthErr.Code != "" {
+			return oauthErr
+		}
+	}
+
+	return &ServiceError{StatusCode: resp.StatusCode, ErrorStruct: &Error{Message: http.StatusText(resp.StatusCode)}}
+}
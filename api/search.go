@@ -0,0 +1,106 @@
+package api
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// SearchPager walks through every log line matching a search request, one
+// page at a time, in the order given by the request's sort. Pages are
+// requested by time relative to the last line returned, with the bound kept
+// inclusive and lines de-duplicated by id so that lines sharing a timestamp
+// with a page boundary aren't lost.
+type SearchPager struct {
+	client  *Client
+	request searchRequest
+	seen    *IDWindow
+	done    bool
+	skipped []time.Time
+}
+
+func (c *Client) NewSearchPager(request *searchRequest) *SearchPager {
+	return &SearchPager{
+		client:  c,
+		request: *request,
+		seen:    NewIDWindow(seenWindowSize),
+	}
+}
+
+// Next returns the next page of log lines, or an empty page once every
+// matching line has been returned
+func (p *SearchPager) Next() ([]*LogLine, error) {
+	return p.NextContext(context.Background())
+}
+
+// NextContext is Next with a context that cancels the request
+func (p *SearchPager) NextContext(ctx context.Context) ([]*LogLine, error) {
+	for !p.done {
+		page, err := p.client.SearchContext(ctx, &p.request)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(page) < p.request.Limit {
+			p.done = true
+		}
+
+		if len(page) == 0 {
+			break
+		}
+
+		fresh := make([]*LogLine, 0, len(page))
+		for _, logLine := range page {
+			if p.seen.Add(logLine.ID) {
+				fresh = append(fresh, logLine)
+			}
+		}
+
+		last := page[len(page)-1].Datetime
+		p.advance(last, len(fresh) == 0)
+
+		if len(fresh) > 0 {
+			return fresh, nil
+		}
+	}
+
+	return []*LogLine{}, nil
+}
+
+// Skipped returns the timestamps shared by at least a page of log lines.
+// Paging by time can't get past them, so lines at these timestamps beyond the
+// first page may have been skipped.
+func (p *SearchPager) Skipped() []time.Time {
+	return p.skipped
+}
+
+// advance moves the time bound to the last line of a page. If a whole page
+// was already seen, more lines share that timestamp than fit in a page, so
+// the bound is made exclusive to move past them.
+func (p *SearchPager) advance(last time.Time, stuck bool) {
+	// A short page is the last one, nothing is left to skip
+	if stuck && !p.done {
+		p.skipped = append(p.skipped, last)
+	}
+
+	if p.ascending() {
+		if stuck {
+			p.request.DtGte = nil
+			p.request.DtGt = &last
+		} else {
+			p.request.DtGt = nil
+			p.request.DtGte = &last
+		}
+	} else {
+		if stuck {
+			p.request.DtLte = nil
+			p.request.DtLt = &last
+		} else {
+			p.request.DtLte = &last
+		}
+	}
+}
+
+func (p *SearchPager) ascending() bool {
+	return strings.HasSuffix(p.request.Sort, ".asc")
+}
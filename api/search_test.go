@@ -0,0 +1,106 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSearchPagerReportsSkippedTimestamps(t *testing.T) {
+	start := time.Date(2019, 3, 20, 15, 4, 5, 0, time.UTC)
+	crowded := start.Add(time.Second)
+
+	// Three lines share a timestamp, more than fit in a page of two
+	logLines := []*LogLine{
+		{ID: "a", Datetime: crowded},
+		{ID: "b", Datetime: crowded},
+		{ID: "c", Datetime: crowded},
+		{ID: "d", Datetime: crowded.Add(time.Second)},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := searchRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("invalid request: %v", err)
+		}
+
+		data := []map[string]string{}
+		for _, line := range logLines {
+			if request.DtGte != nil && line.Datetime.Before(*request.DtGte) ||
+				request.DtGt != nil && !line.Datetime.After(*request.DtGt) {
+				continue
+			}
+			if len(data) < request.Limit {
+				data = append(data, map[string]string{"id": line.ID, "dt": line.Datetime.Format(time.RFC3339)})
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+	defer server.Close()
+
+	request := NewSearchRequest()
+	request.DtGte = &start
+	request.Sort = "dt.asc"
+	request.Limit = 2
+	pager := newTestClient(server).NewSearchPager(request)
+
+	ids := []string{}
+	for {
+		page, err := pager.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, line := range page {
+			ids = append(ids, line.ID)
+		}
+	}
+
+	if len(ids) != 3 || ids[0] != "a" || ids[1] != "b" || ids[2] != "d" {
+		t.Fatalf("expected lines a, b and d, got %v", ids)
+	}
+
+	skipped := pager.Skipped()
+	if len(skipped) != 1 || !skipped[0].Equal(crowded) {
+		t.Fatalf("expected the shared timestamp to be reported as skipped, got %v", skipped)
+	}
+}
+
+func TestSearchPagerReportsNoSkipsForShortPages(t *testing.T) {
+	// The second page is short and already seen, nothing is left after it
+	pages := []string{
+		`{"data":[{"id":"a","dt":"2019-03-20T15:04:05Z"},{"id":"b","dt":"2019-03-20T15:04:05Z"}]}`,
+		`{"data":[{"id":"b","dt":"2019-03-20T15:04:05Z"}]}`,
+	}
+	requests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(pages[requests%len(pages)]))
+		requests++
+	}))
+	defer server.Close()
+
+	request := NewSearchRequest()
+	request.Limit = 2
+	pager := newTestClient(server).NewSearchPager(request)
+	for {
+		page, err := pager.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+	}
+
+	if skipped := pager.Skipped(); len(skipped) != 0 {
+		t.Fatalf("expected no skipped timestamps, got %v", skipped)
+	}
+}
@@ -0,0 +1,543 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transports for live tailing
+const (
+	TransportAuto = "auto" // stream when the server supports it, poll otherwise
+	TransportSSE  = "sse"
+	TransportPoll = "poll"
+)
+
+var ErrStreamingUnsupported = errors.New("The Timber API does not support streaming log lines, use the poll transport instead")
+
+// LogStream delivers log lines matching a search as they arrive, oldest first
+type LogStream interface {
+	// Next blocks until log lines are available. It may return an empty
+	// batch when there was nothing new, so that callers can show progress.
+	Next() (*LogBatch, error)
+
+	// Close can be called from another goroutine to end a blocked Next
+	Close() error
+}
+
+type LogBatch struct {
+	LogLines []*LogLine
+
+	// Set when lines older than LogLines could not be fetched
+	Gap *Gap
+}
+
+// Gap is a time range in which log lines were skipped
+type Gap struct {
+	From time.Time
+	To   time.Time
+
+	// Estimated from the rate of the lines fetched before giving up, 0 when
+	// the number is unknown
+	Skipped int
+}
+
+// newGap estimates the lines skipped between from and to, assuming they were
+// logged at the rate of the fetched lines, which go from to up to newest
+func newGap(from time.Time, to time.Time, newest time.Time, fetched int) *Gap {
+	gap := &Gap{From: from, To: to, Skipped: fetched}
+
+	// Lines fetched within a single timestamp give no rate, at least as many
+	// share the timestamp the gap ends at
+	if span := newest.Sub(to); span > 0 {
+		gap.Skipped = int(float64(fetched) * float64(to.Sub(from)) / float64(span))
+	}
+
+	if gap.Skipped < 1 {
+		gap.Skipped = 1
+	}
+	return gap
+}
+
+// Tail opens a LogStream for the search request using the given transport.
+// With TransportAuto a server sent events stream is attempted first, falling
+// back to polling when the server doesn't support streaming.
+func (c *Client) Tail(request *searchRequest, transport string) (LogStream, error) {
+	return c.TailContext(context.Background(), request, transport)
+}
+
+// TailContext is Tail with a context, the stream ends with the context's error
+// once it is done
+func (c *Client) TailContext(ctx context.Context, request *searchRequest, transport string) (LogStream, error) {
+	switch transport {
+	case TransportPoll:
+		return newPollingStream(ctx, c, request), nil
+	case TransportSSE:
+		return newSSEStream(ctx, c, request)
+	case TransportAuto, "":
+		stream, err := newSSEStream(ctx, c, request)
+		if err == ErrStreamingUnsupported {
+			return newPollingStream(ctx, c, request), nil
+		}
+		return stream, err
+	default:
+		return nil, fmt.Errorf("Unknown transport %q, must be one of %s, %s or %s", transport, TransportAuto, TransportSSE, TransportPoll)
+	}
+}
+
+//
+// Polling
+//
+
+var (
+	pollInterval = 500 * time.Millisecond
+
+	// Maximum number of pages fetched within a single poll to catch up with
+	// a burst of log lines before giving up and reporting a gap
+	maxBackfillPages = 20
+
+	// Number of log line ids remembered to drop lines returned twice
+	seenWindowSize = 10000
+)
+
+// pollingStream repeatedly searches for log lines at or after the newest one
+// seen. Lines sharing a timestamp can arrive across two polls, so the cursor
+// is inclusive and lines are de-duplicated by id. When a poll returns a full
+// page, older pages are fetched until they meet the previous cursor. A
+// request with DtGte starts there instead of at the most recent lines.
+type pollingStream struct {
+	ctx     context.Context
+	client  *Client
+	request searchRequest
+	cursor  *time.Time
+	seen    *IDWindow
+	polled  bool
+}
+
+func newPollingStream(ctx context.Context, c *Client, request *searchRequest) *pollingStream {
+	return &pollingStream{
+		ctx:     ctx,
+		client:  c,
+		request: *request,
+		cursor:  request.DtGte,
+		seen:    NewIDWindow(seenWindowSize),
+	}
+}
+
+func (s *pollingStream) Next() (*LogBatch, error) {
+	// The cursor stays unset until a line matches, so it can't tell whether
+	// this is the first poll
+	if s.polled {
+		select {
+		case <-time.After(pollInterval):
+		case <-s.ctx.Done():
+			return nil, s.ctx.Err()
+		}
+	}
+
+	request := s.request
+	request.Sort = "dt.desc"
+	request.DtGte = s.cursor
+
+	page, err := s.client.SearchContext(s.ctx, &request)
+	s.polled = true
+	if err != nil {
+		return nil, err
+	}
+
+	batch := &LogBatch{LogLines: s.unseen(page)}
+	first, fetched := page, len(page)
+
+	// The first poll only shows the most recent lines, there is nothing to
+	// catch up with yet
+	for pages := 1; s.cursor != nil && len(page) == request.Limit; pages++ {
+		oldest := page[len(page)-1].Datetime
+		if !oldest.After(*s.cursor) {
+			break
+		}
+
+		newest := first[0].Datetime
+		if pages >= maxBackfillPages {
+			batch.Gap = newGap(*s.cursor, oldest, newest, fetched)
+			break
+		}
+
+		request.DtLte = &oldest
+		page, err = s.client.SearchContext(s.ctx, &request)
+		if err != nil {
+			return nil, err
+		}
+
+		older := s.unseen(page)
+		fetched += len(older)
+
+		// More lines share a timestamp than fit in a page, paginating by
+		// time can't get past them
+		if len(older) == 0 && len(page) == request.Limit {
+			batch.Gap = newGap(*s.cursor, oldest, newest, fetched)
+			break
+		}
+
+		batch.LogLines = append(batch.LogLines, older...)
+	}
+
+	batch.LogLines = reverseLogLines(batch.LogLines)
+
+	if len(batch.LogLines) > 0 {
+		newest := batch.LogLines[len(batch.LogLines)-1].Datetime
+		if s.cursor == nil || newest.After(*s.cursor) {
+			s.cursor = &newest
+		}
+	}
+
+	return batch, nil
+}
+
+// unseen filters out the log lines that were already returned and records
+// the remaining ones as seen
+func (s *pollingStream) unseen(logLines []*LogLine) []*LogLine {
+	fresh := make([]*LogLine, 0, len(logLines))
+	for _, logLine := range logLines {
+		if s.seen.Add(logLine.ID) {
+			fresh = append(fresh, logLine)
+		}
+	}
+	return fresh
+}
+
+func (s *pollingStream) Close() error {
+	return nil
+}
+
+// IDWindow is a set that remembers only the most recently added ids, used to
+// drop log lines that are returned twice
+type IDWindow struct {
+	ids   map[string]struct{}
+	order []string
+	next  int
+}
+
+// NewIDWindow returns an IDWindow remembering the last size ids, at least one
+func NewIDWindow(size int) *IDWindow {
+	if size < 1 {
+		size = 1
+	}
+
+	return &IDWindow{
+		ids:   make(map[string]struct{}, size),
+		order: make([]string, 0, size),
+	}
+}
+
+// Has reports whether the id is among the ones remembered
+func (w *IDWindow) Has(id string) bool {
+	_, ok := w.ids[id]
+	return ok
+}
+
+// Add records the id, returning false if it was already present
+func (w *IDWindow) Add(id string) bool {
+	if w.Has(id) {
+		return false
+	}
+
+	if len(w.order) < cap(w.order) {
+		w.order = append(w.order, id)
+	} else {
+		delete(w.ids, w.order[w.next])
+		w.order[w.next] = id
+		w.next = (w.next + 1) % len(w.order)
+	}
+
+	w.ids[id] = struct{}{}
+	return true
+}
+
+func reverseLogLines(logLines []*LogLine) []*LogLine {
+	for i := 0; i < len(logLines)/2; i++ {
+		j := len(logLines) - i - 1
+		logLines[i], logLines[j] = logLines[j], logLines[i]
+	}
+	return logLines
+}
+
+//
+// Server sent events
+//
+
+var (
+	sseMaxReconnectAttempts = 10
+	sseMinReconnectWait     = 500 * time.Millisecond
+	sseMaxReconnectWait     = 30 * time.Second
+)
+
+// sseStream receives log lines pushed by the server as server sent events.
+// Dropped connections are reestablished with the id of the last event
+// received so that the server resumes where the stream stopped.
+type sseStream struct {
+	ctx        context.Context
+	client     *Client
+	httpClient *http.Client
+	request    *searchRequest
+
+	reader      *bufio.Reader
+	lastEventID string
+	retryWait   time.Duration
+
+	// Close is called from other goroutines than Next
+	done      chan struct{}
+	closeOnce sync.Once
+	mu        sync.Mutex // guards body
+	body      io.ReadCloser
+}
+
+func newSSEStream(ctx context.Context, c *Client, request *searchRequest) (*sseStream, error) {
+	s := &sseStream{
+		ctx:    ctx,
+		client: c,
+		// Streams are long lived, the regular client timeout would cut them off
+		httpClient: &http.Client{Transport: c.httpClient.HTTPClient.Transport},
+		request:    request,
+		done:       make(chan struct{}),
+	}
+
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *sseStream) connect() error {
+	if s.client.Host == "" {
+		return errors.New("A host is required to make a request to the Timber API")
+	}
+
+	b, err := json.Marshal(s.request)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", s.client.Host+"/log_lines/stream", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(s.ctx)
+
+	s.client.setHeaders(req.Header)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+	if s.lastEventID != "" {
+		req.Header.Set("Last-Event-ID", s.lastEventID)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound ||
+		resp.StatusCode == http.StatusMethodNotAllowed ||
+		resp.StatusCode == http.StatusNotAcceptable ||
+		resp.StatusCode == http.StatusNotImplemented:
+		resp.Body.Close()
+		return ErrStreamingUnsupported
+
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		defer resp.Body.Close()
+		return decodeError(resp)
+
+	case !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream"):
+		resp.Body.Close()
+		return ErrStreamingUnsupported
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed() {
+		resp.Body.Close()
+		return io.EOF
+	}
+
+	s.body = resp.Body
+	s.reader = bufio.NewReader(resp.Body)
+
+	return nil
+}
+
+func (s *sseStream) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *sseStream) reconnect() error {
+	s.mu.Lock()
+	if s.body != nil {
+		s.body.Close()
+		s.body = nil
+	}
+	s.mu.Unlock()
+
+	var err error
+	for attempt := 0; attempt < sseMaxReconnectAttempts; attempt++ {
+		wait := s.retryWait
+		if wait == 0 {
+			wait = sseMinReconnectWait << uint(attempt)
+		}
+		if wait > sseMaxReconnectWait {
+			wait = sseMaxReconnectWait
+		}
+		select {
+		case <-time.After(wait):
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		case <-s.done:
+			return io.EOF
+		}
+
+		err = s.connect()
+		if err == nil || err == io.EOF {
+			return err
+		}
+
+		if s.client.logger != nil {
+			s.client.logger.Printf("[DEBUG] reconnecting log stream failed: %v", err)
+		}
+
+		// Anything but a server or connection error won't get better by retrying
+		if serviceErr, ok := err.(*ServiceError); ok && serviceErr.StatusCode < 500 {
+			return err
+		}
+	}
+
+	return fmt.Errorf("Lost connection to the log stream, giving up after %d attempts: %v", sseMaxReconnectAttempts, err)
+}
+
+func (s *sseStream) Next() (*LogBatch, error) {
+	for {
+		if s.closed() {
+			return nil, io.EOF
+		}
+
+		event, err := s.readEvent()
+		if err != nil {
+			if s.closed() {
+				return nil, io.EOF
+			}
+
+			if s.ctx.Err() != nil {
+				return nil, s.ctx.Err()
+			}
+
+			if err := s.reconnect(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		switch event.name {
+		case "", "log_line":
+			logLine, err := decodeLogLine(event.data)
+			if err != nil {
+				return nil, err
+			}
+			return &LogBatch{LogLines: []*LogLine{logLine}}, nil
+
+		case "log_lines":
+			raw := []json.RawMessage{}
+			if err := json.Unmarshal(event.data, &raw); err != nil {
+				return nil, err
+			}
+
+			logLines := make([]*LogLine, len(raw))
+			for i, rawLine := range raw {
+				if logLines[i], err = decodeLogLine(rawLine); err != nil {
+					return nil, err
+				}
+			}
+			return &LogBatch{LogLines: logLines}, nil
+
+		case "heartbeat":
+			return &LogBatch{}, nil
+		}
+	}
+}
+
+func (s *sseStream) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.body != nil {
+		return s.body.Close()
+	}
+	return nil
+}
+
+type sseEvent struct {
+	name string
+	data []byte
+}
+
+// readEvent reads the next event that carries data, following
+// https://html.spec.whatwg.org/multipage/server-sent-events.html
+func (s *sseStream) readEvent() (*sseEvent, error) {
+	event := &sseEvent{}
+	data := []string{}
+
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if line == "" {
+			if len(data) == 0 {
+				event = &sseEvent{}
+				continue
+			}
+
+			event.data = []byte(strings.Join(data, "\n"))
+			return event, nil
+		}
+
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			field = line[:i]
+			value = strings.TrimPrefix(line[i+1:], " ")
+		}
+
+		switch field {
+		case "event":
+			event.name = value
+		case "data":
+			data = append(data, value)
+		case "id":
+			s.lastEventID = value
+		case "retry":
+			if ms, err := strconv.Atoi(value); err == nil {
+				s.retryWait = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+}
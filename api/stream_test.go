@@ -0,0 +1,338 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestClient(server *httptest.Server) *Client {
+	return NewClient(server.URL, "test-key", WithRetryPolicy(0, time.Millisecond, time.Millisecond))
+}
+
+// contextForTest bounds a test that would otherwise block forever on a stream
+func contextForTest(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// withReconnectWait sets the backoff between reconnect attempts for the
+// duration of a test
+func withReconnectWait(t *testing.T, wait time.Duration) {
+	maxAttempts, minWait := sseMaxReconnectAttempts, sseMinReconnectWait
+	sseMaxReconnectAttempts, sseMinReconnectWait = 3, wait
+	t.Cleanup(func() {
+		sseMaxReconnectAttempts, sseMinReconnectWait = maxAttempts, minWait
+	})
+}
+
+func startEventStream(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+}
+
+func writeLogLineEvent(w http.ResponseWriter, id string) {
+	fmt.Fprintf(w, "id: %s\nevent: log_line\ndata: {\"id\":%q,\"dt\":\"2019-03-20T15:04:05Z\",\"message\":\"line %s\"}\n\n", id, id, id)
+	w.(http.Flusher).Flush()
+}
+
+// expectLogLine reads the next batch from the stream and checks that it holds
+// only the log line with the given id
+func expectLogLine(t *testing.T, stream LogStream, id string) {
+	t.Helper()
+
+	batch, err := stream.Next()
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	if len(batch.LogLines) != 1 || batch.LogLines[0].ID != id {
+		t.Fatalf("expected log line %s, got %+v", id, batch.LogLines)
+	}
+}
+
+// droppingServer serves an event stream that sends first, then drops the
+// connection. Later connections send log line 2 and stay open. The
+// Last-Event-ID header of every connection is recorded.
+type droppingServer struct {
+	*httptest.Server
+	first func(w http.ResponseWriter)
+	done  chan struct{}
+
+	mu           sync.Mutex
+	lastEventIDs []string
+}
+
+func newDroppingServer(first func(w http.ResponseWriter)) *droppingServer {
+	s := &droppingServer{first: first, done: make(chan struct{})}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.lastEventIDs = append(s.lastEventIDs, r.Header.Get("Last-Event-ID"))
+		connection := len(s.lastEventIDs)
+		s.mu.Unlock()
+
+		startEventStream(w)
+		if connection == 1 {
+			s.first(w)
+			return
+		}
+
+		writeLogLineEvent(w, "2")
+		select {
+		case <-r.Context().Done():
+		case <-s.done:
+		}
+	}))
+	return s
+}
+
+// Close ends the open streams, the server waits for them to finish
+func (s *droppingServer) Close() {
+	close(s.done)
+	s.Server.Close()
+}
+
+func (s *droppingServer) LastEventIDs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.lastEventIDs...)
+}
+
+func TestSSEStreamReconnectsWithLastEventID(t *testing.T) {
+	withReconnectWait(t, time.Millisecond)
+
+	server := newDroppingServer(func(w http.ResponseWriter) {
+		writeLogLineEvent(w, "1")
+	})
+	defer server.Close()
+
+	stream, err := newTestClient(server.Server).TailContext(contextForTest(t), NewSearchRequest(), TransportSSE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	expectLogLine(t, stream, "1")
+	expectLogLine(t, stream, "2")
+
+	lastEventIDs := server.LastEventIDs()
+	if len(lastEventIDs) != 2 || lastEventIDs[0] != "" || lastEventIDs[1] != "1" {
+		t.Fatalf("expected Last-Event-ID to be sent on reconnect only, got %q", lastEventIDs)
+	}
+}
+
+func TestSSEStreamHonorsRetry(t *testing.T) {
+	// The default backoff would outlast the test, only the server's retry
+	// field lets the stream reconnect in time
+	withReconnectWait(t, time.Hour)
+
+	server := newDroppingServer(func(w http.ResponseWriter) {
+		fmt.Fprint(w, "retry: 10\n\n")
+		writeLogLineEvent(w, "1")
+	})
+	defer server.Close()
+
+	stream, err := newTestClient(server.Server).TailContext(contextForTest(t), NewSearchRequest(), TransportSSE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	expectLogLine(t, stream, "1")
+	expectLogLine(t, stream, "2")
+
+	if retryWait := stream.(*sseStream).retryWait; retryWait != 10*time.Millisecond {
+		t.Fatalf("expected a retry wait of 10ms, got %s", retryWait)
+	}
+}
+
+func TestSSEStreamCloseEndsBlockedNext(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		startEventStream(w)
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+
+	stream, err := newTestClient(server).TailContext(contextForTest(t), NewSearchRequest(), TransportSSE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		stream.Close()
+	}()
+
+	if _, err := stream.Next(); err != io.EOF {
+		t.Fatalf("expected io.EOF once closed, got %v", err)
+	}
+}
+
+func TestTailFallsBackToPolling(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/log_lines/stream":
+			http.NotFound(w, r)
+		case "/log_lines/search":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"data":[{"id":"1","dt":"2019-03-20T15:04:05Z","message":"line 1"}]}`)
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	for _, transport := range []string{TransportAuto, ""} {
+		stream, err := newTestClient(server).TailContext(contextForTest(t), NewSearchRequest(), transport)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := stream.(*pollingStream); !ok {
+			t.Fatalf("expected transport %q to fall back to polling, got %T", transport, stream)
+		}
+
+		expectLogLine(t, stream, "1")
+		stream.Close()
+	}
+}
+
+func TestSSETransportReportsUnsupportedStreaming(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	_, err := newTestClient(server).TailContext(contextForTest(t), NewSearchRequest(), TransportSSE)
+	if err != ErrStreamingUnsupported {
+		t.Fatalf("expected ErrStreamingUnsupported, got %v", err)
+	}
+}
+
+func TestPollingStreamWaitsWhenNothingMatches(t *testing.T) {
+	interval := pollInterval
+	pollInterval = 20 * time.Millisecond
+	defer func() { pollInterval = interval }()
+
+	var mu sync.Mutex
+	polls := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		polls++
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"data":[]}`)
+	}))
+	defer server.Close()
+
+	stream, err := newTestClient(server).TailContext(contextForTest(t), NewSearchRequest(), TransportPoll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := stream.Next(); err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < 2*pollInterval {
+		t.Fatalf("expected empty polls to wait %s between them, 3 polls took %s", pollInterval, elapsed)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if polls != 3 {
+		t.Fatalf("expected 3 polls, got %d", polls)
+	}
+}
+
+func TestIDWindowForgetsOldestIDs(t *testing.T) {
+	w := NewIDWindow(2)
+
+	for _, id := range []string{"1", "2"} {
+		if !w.Add(id) {
+			t.Fatalf("expected %s to be new", id)
+		}
+	}
+	if w.Add("1") {
+		t.Fatal("expected 1 to be remembered")
+	}
+
+	w.Add("3")
+	if w.Has("1") || !w.Has("2") || !w.Has("3") {
+		t.Fatal("expected the window to keep only the 2 most recent ids")
+	}
+}
+
+func TestPollingStreamEstimatesSkippedLines(t *testing.T) {
+	maxPages, interval := maxBackfillPages, pollInterval
+	maxBackfillPages, pollInterval = 2, time.Millisecond
+	defer func() { maxBackfillPages, pollInterval = maxPages, interval }()
+
+	// A line a second up to 100s, pages go back in time from dt_lte
+	start := time.Date(2019, 3, 20, 0, 0, 0, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := searchRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("invalid request: %v", err)
+		}
+
+		seconds := []int{0}
+		if request.DtGte != nil {
+			top := 100
+			if request.DtLte != nil {
+				top = int(request.DtLte.Sub(start) / time.Second)
+			}
+			seconds = []int{top, top - 1}
+		}
+
+		data := []map[string]string{}
+		for _, second := range seconds {
+			dt := start.Add(time.Duration(second) * time.Second)
+			data = append(data, map[string]string{"id": fmt.Sprint(second), "dt": dt.Format(time.RFC3339)})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+	defer server.Close()
+
+	request := NewSearchRequest()
+	request.Limit = 2
+	stream, err := newTestClient(server).TailContext(contextForTest(t), request, TransportPoll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	expectLogLine(t, stream, "0")
+
+	batch, err := stream.Next()
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	if batch.Gap == nil {
+		t.Fatal("expected a gap")
+	}
+
+	// 3 lines were fetched over the 2s before the gap, which lasts 98s
+	if !batch.Gap.From.Equal(start) || !batch.Gap.To.Equal(start.Add(98*time.Second)) || batch.Gap.Skipped != 147 {
+		t.Fatalf("expected about 147 lines skipped in the 98s gap, got %+v", batch.Gap)
+	}
+}
@@ -1,7 +1,11 @@
 package api
 
-import "fmt"
-import "time"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
 
 // TODO maybe handle nullable fields better
 
@@ -11,7 +15,17 @@ type ServiceError struct {
 }
 
 func (e *ServiceError) Error() string {
-	return fmt.Sprintf("Request to Timber API failed!\nResponse Status: %d\n\n%s", e.StatusCode, e.ErrorStruct.Message)
+	message := ""
+	if e.ErrorStruct != nil {
+		message = e.ErrorStruct.Message
+	}
+	return fmt.Sprintf("Request to Timber API failed!\nResponse Status: %d\n\n%s", e.StatusCode, message)
+}
+
+// Unauthorized reports whether the API key was rejected, because it was
+// revoked or has expired
+func (e *ServiceError) Unauthorized() bool {
+	return e.StatusCode == 401 || e.StatusCode == 403
 }
 
 type Application struct {
@@ -31,8 +45,24 @@ type Application struct {
 	UpdatedAt             time.Time `json:"updated_at"`
 }
 
+// SourceSchema describes the SQL table holding the log lines of a source
+type SourceSchema struct {
+	TableName string       `json:"table_name"`
+	Fields    []*SQLColumn `json:"fields"`
+}
+
 type Error struct {
-	Message string `json:message`
+	Message string `json:"message"`
+}
+
+// APIKey describes the API key a client authenticates with
+type APIKey struct {
+	ID              string     `json:"id"`
+	Name            string     `json:"name"`
+	Scopes          []string   `json:"scopes"`
+	OrganizationIDs []string   `json:"organization_ids"`
+	ExpiresAt       *time.Time `json:"expires_at"`
+	InsertedAt      time.Time  `json:"inserted_at"`
 }
 
 type Organization struct {
@@ -88,3 +118,88 @@ type SQLQuery struct {
 	ResultsURL           string    `json:"results_url"`
 	Status               string    `json:"status"`
 }
+
+type SQLColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// SQLRow is a row of SQL query results which keeps its columns in the order
+// they were received. Numbers are decoded as json.Number.
+type SQLRow struct {
+	Columns []string
+	Values  []interface{}
+}
+
+// Get returns the value of a column and whether the row has it
+func (r *SQLRow) Get(column string) (interface{}, bool) {
+	for i, name := range r.Columns {
+		if name == column {
+			return r.Values[i], true
+		}
+	}
+	return nil, false
+}
+
+func (r *SQLRow) UnmarshalJSON(b []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+
+	if token != json.Delim('{') {
+		return fmt.Errorf("SQL result row must be an object, got %v", token)
+	}
+
+	r.Columns = []string{}
+	r.Values = []interface{}{}
+
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			return err
+		}
+
+		r.Columns = append(r.Columns, key.(string))
+		r.Values = append(r.Values, value)
+	}
+
+	_, err = decoder.Token()
+	return err
+}
+
+func (r *SQLRow) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+
+	for i, column := range r.Columns {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		key, err := json.Marshal(column)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := json.Marshal(r.Values[i])
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/timberio/cli/api"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// Placeholders of `timber assert --sql` replaced by the bounds of the window
+var assertSQLPlaceholderRegexp = regexp.MustCompile(`\{\{\s*(since|until)\s*\}\}`)
+
+var assertRateRegexp = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*(?:/\s*(s|m|h))?$`)
+
+var assertRateUnits = map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}
+
+var assertRateUnitNames = map[time.Duration]string{time.Second: "per second", time.Minute: "per minute", time.Hour: "per hour"}
+
+type assertOptions struct {
+	SourceIds []string
+	Query     string
+	SQL       string // counts with the first value of the results instead of searching
+	Since     time.Time
+	Until     time.Time
+	Limit     int // log lines counted per window at most
+	Timeout   time.Duration
+
+	MaxCount    *int64
+	MaxRate     *float64
+	RateUnit    time.Duration
+	MaxIncrease *float64 // percent
+	CompareTo   time.Duration
+}
+
+// assertReport is printed by `timber assert`, as JSON unless --output is set
+type assertReport struct {
+	Passed    bool           `json:"passed"`
+	SourceIds []string       `json:"source_ids,omitempty"`
+	Query     string         `json:"query,omitempty"`
+	SQL       string         `json:"sql,omitempty"`
+	Window    *assertWindow  `json:"window"`
+	Previous  *assertWindow  `json:"previous_window,omitempty"`
+	Checks    []*assertCheck `json:"checks"`
+}
+
+type assertWindow struct {
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+	Count int64     `json:"count"`
+	// Counting stopped at --limit, the window has at least Count log lines
+	Truncated bool `json:"truncated,omitempty"`
+	// Log lines sharing a timestamp may have been skipped, the window has
+	// at least Count log lines
+	Incomplete bool `json:"incomplete,omitempty"`
+}
+
+type assertCheck struct {
+	Name      string   `json:"name"`
+	Value     *float64 `json:"value"` // null for an infinite increase over no log lines
+	Threshold float64  `json:"threshold"`
+	Unit      string   `json:"unit,omitempty"`
+	Passed    bool     `json:"passed"`
+}
+
+var assertCheckColumns = []column{
+	{"check", func(i interface{}) string { return i.(*assertCheck).Name }},
+	{"value", func(i interface{}) string {
+		if value := i.(*assertCheck).Value; value != nil {
+			return formatAssertValue(*value)
+		}
+		return "inf"
+	}},
+	{"threshold", func(i interface{}) string { return formatAssertValue(i.(*assertCheck).Threshold) }},
+	{"unit", func(i interface{}) string { return i.(*assertCheck).Unit }},
+	{"status", func(i interface{}) string {
+		if i.(*assertCheck).Passed {
+			return "passed"
+		}
+		return "failed"
+	}},
+}
+
+// assert counts the log lines of a window and compares the count, its rate
+// and its increase over an earlier window with the thresholds. It returns an
+// exit error with exitCodeAssertFailed when a threshold is exceeded.
+func assert(w io.Writer, options *assertOptions) error {
+	ctx := rootContext
+	if options.Timeout > 0 && options.SQL == "" {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(rootContext, options.Timeout)
+		defer cancel()
+	}
+
+	report := &assertReport{
+		SourceIds: options.SourceIds,
+		Query:     options.Query,
+		SQL:       options.SQL,
+		Window:    &assertWindow{Since: options.Since.UTC(), Until: options.Until.UTC()},
+	}
+
+	err := countAssertWindow(ctx, options, report.Window)
+	if err != nil {
+		return assertError(ctx, options, err)
+	}
+
+	if options.MaxIncrease != nil {
+		report.Previous = &assertWindow{
+			Since: report.Window.Since.Add(-options.CompareTo),
+			Until: report.Window.Until.Add(-options.CompareTo),
+		}
+
+		err = countAssertWindow(ctx, options, report.Previous)
+		if err != nil {
+			return assertError(ctx, options, err)
+		}
+	}
+
+	// A truncated or incomplete count is only a lower bound, which can't
+	// show that a threshold isn't exceeded
+	truncated := report.Window.Truncated || (report.Previous != nil && report.Previous.Truncated)
+	incomplete := report.Window.Incomplete || (report.Previous != nil && report.Previous.Incomplete)
+
+	report.Checks = assertChecks(options, report)
+	report.Passed = true
+	failed := 0
+	for _, check := range report.Checks {
+		if truncated || incomplete {
+			check.Passed = false
+		}
+		if !check.Passed {
+			report.Passed = false
+			failed++
+		}
+	}
+
+	err = printAssertReport(w, report)
+	if err != nil {
+		return err
+	}
+
+	// Structured output on stdout stays parseable
+	warn := warningWriter
+	if !isTableOutput() {
+		warn = os.Stderr
+	}
+
+	if truncated {
+		fmt.Fprintf(warn, "⚠  Counting stopped at %d log lines so the checks failed, count more with --limit or use --sql\n", options.Limit)
+	}
+
+	if incomplete {
+		fmt.Fprintln(warn, "⚠  A page of log lines or more share a timestamp, some of them may not have been counted so the checks failed. Use --sql to count them")
+	}
+
+	if failed > 0 {
+		message := fmt.Sprintf("%d of %d checks failed", failed, len(report.Checks))
+		return cli.NewExitError(message, exitCodeAssertFailed)
+	}
+
+	return nil
+}
+
+func assertError(ctx context.Context, options *assertOptions, err error) error {
+	if ctx.Err() == context.DeadlineExceeded && rootContext.Err() == nil {
+		message := fmt.Sprintf("The log lines could not be counted within %s", options.Timeout)
+		return cli.NewExitError(message, exitCodeTimeout)
+	}
+	return err
+}
+
+func assertChecks(options *assertOptions, report *assertReport) []*assertCheck {
+	checks := []*assertCheck{}
+	count := float64(report.Window.Count)
+
+	if options.MaxCount != nil {
+		checks = append(checks, &assertCheck{
+			Name:      "max-count",
+			Value:     &count,
+			Threshold: float64(*options.MaxCount),
+			Passed:    count <= float64(*options.MaxCount),
+		})
+	}
+
+	if options.MaxRate != nil {
+		window := report.Window.Until.Sub(report.Window.Since)
+		rate := math.Round(count/(float64(window)/float64(options.RateUnit))*1000) / 1000
+		checks = append(checks, &assertCheck{
+			Name:      "max-rate",
+			Value:     &rate,
+			Threshold: *options.MaxRate,
+			Unit:      assertRateUnitNames[options.RateUnit],
+			Passed:    rate <= *options.MaxRate,
+		})
+	}
+
+	if options.MaxIncrease != nil {
+		check := &assertCheck{Name: "max-increase", Threshold: *options.MaxIncrease, Unit: "%"}
+
+		// Any log line is an infinite increase over none
+		previous := float64(report.Previous.Count)
+		if previous > 0 || count == 0 {
+			increase := 0.0
+			if previous > 0 {
+				increase = math.Round((count-previous)/previous*100*10) / 10
+			}
+			check.Value = &increase
+			check.Passed = increase <= *options.MaxIncrease
+		}
+
+		checks = append(checks, check)
+	}
+
+	return checks
+}
+
+// countAssertWindow counts the log lines of a window by searching, or with
+// the SQL query when there is one
+func countAssertWindow(ctx context.Context, options *assertOptions, window *assertWindow) error {
+	if options.SQL != "" {
+		count, err := countSQL(ctx, options, window)
+		window.Count = count
+		return err
+	}
+
+	searchRequest := api.NewSearchRequest()
+	searchRequest.ApplicationIds = options.SourceIds
+	searchRequest.Query = options.Query
+	searchRequest.DtGte = &window.Since
+	searchRequest.DtLt = &window.Until
+	searchRequest.Sort = "dt.asc"
+
+	pager := client.NewSearchPager(searchRequest)
+
+	for {
+		logLines, err := pager.NextContext(ctx)
+		if err != nil {
+			return err
+		}
+
+		if len(logLines) == 0 {
+			window.Incomplete = len(pager.Skipped()) > 0
+			return nil
+		}
+
+		window.Count += int64(len(logLines))
+		if options.Limit > 0 && window.Count >= int64(options.Limit) {
+			window.Count = int64(options.Limit)
+			window.Truncated = true
+			return nil
+		}
+	}
+}
+
+// countSQL runs the SQL query with the placeholders replaced by the bounds of
+// the window, the count is the first value of the results
+func countSQL(ctx context.Context, options *assertOptions, window *assertWindow) (int64, error) {
+	organization, err := getCurrentOrganization(client)
+	if err != nil {
+		return 0, err
+	}
+
+	query := assertSQLPlaceholderRegexp.ReplaceAllStringFunc(options.SQL, func(placeholder string) string {
+		t := window.Since
+		if strings.Contains(placeholder, "until") {
+			t = window.Until
+		}
+		return "'" + t.UTC().Format("2006-01-02 15:04:05.000") + "'"
+	})
+
+	sqlQuery, err := client.CreateSQLQueryContext(ctx, organization.ID, query)
+	if err != nil {
+		return 0, err
+	}
+
+	sqlQuery, err = awaitSQLQuery(ctx, sqlQuery, options.Timeout)
+	if err != nil {
+		return 0, err
+	}
+
+	if sqlQuery.Status != "SUCCEEDED" {
+		return 0, fmt.Errorf("SQL query %s %s: %s", sqlQuery.ID, strings.ToLower(sqlQuery.Status), sqlQuery.FailureReason)
+	}
+
+	results, err := client.GetSQLQueryResultsContext(ctx, sqlQuery.ID, &api.GetSQLQueryResultsRequest{MaxResults: 1})
+	if err != nil {
+		return 0, err
+	}
+
+	if len(results.Rows) == 0 || len(results.Rows[0].Values) == 0 {
+		return 0, fmt.Errorf("SQL query %s returned no results, it should return a count", sqlQuery.ID)
+	}
+
+	value := fmt.Sprint(results.Rows[0].Values[0])
+	count, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("SQL query %s returned %q, it should return a count", sqlQuery.ID, value)
+	}
+
+	return int64(count), nil
+}
+
+func printAssertReport(w io.Writer, report *assertReport) error {
+	switch output.Format {
+	case outputJSON, outputNDJSON:
+		var data []byte
+		var err error
+		if output.Format == outputJSON {
+			data, err = json.MarshalIndent(report, "", "  ")
+		} else {
+			data, err = json.Marshal(report)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+
+	case outputYAML:
+		return writeYAML(w, report)
+	}
+
+	return printList(w, report.Checks, assertCheckColumns)
+}
+
+func formatAssertValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// parseAssertRate parses --max-rate values such as 10, 10/m or 0.5/s, per
+// minute by default
+func parseAssertRate(value string) (float64, time.Duration, error) {
+	match := assertRateRegexp.FindStringSubmatch(strings.TrimSpace(value))
+	if match == nil {
+		return 0, 0, fmt.Errorf("Invalid --max-rate %q, use a number of log lines per second, minute or hour, e.g. 10/m", value)
+	}
+
+	rate, _ := strconv.ParseFloat(match[1], 64)
+	unit := time.Minute
+	if match[2] != "" {
+		unit = assertRateUnits[match[2]]
+	}
+
+	return rate, unit, nil
+}
+
+// parseAssertPercent parses --max-increase values such as 50 or 50%
+func parseAssertPercent(value string) (float64, error) {
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(value), "%"), 64)
+	if err != nil || percent < 0 {
+		return 0, fmt.Errorf("Invalid --max-increase %q, use a percentage such as 50%%", value)
+	}
+	return percent, nil
+}
@@ -1,16 +1,16 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path"
-	"text/tabwriter"
+	"strings"
+	"time"
 
 	"github.com/mitchellh/go-homedir"
 	"github.com/timberio/cli/api"
+	"gopkg.in/urfave/cli.v1"
 )
 
 type Credential struct {
@@ -18,6 +18,26 @@ type Credential struct {
 	OrganizationID   string
 	OrganizationName string
 	APIKey           string
+	Host             string `json:",omitempty"`
+
+	// Set for credentials added with `timber auth login`, the API key is
+	// then an access token renewed with the refresh token
+	RefreshToken string     `json:",omitempty"`
+	ExpiresAt    *time.Time `json:",omitempty"`
+}
+
+// Matches reports whether the credential is for the organization on host,
+// credentials without a host are for the default host
+func (c *Credential) Matches(orgID string, host string) bool {
+	return c.OrganizationID == orgID && credentialHost(c.Host) == credentialHost(host)
+}
+
+func credentialHost(host string) string {
+	host = strings.TrimSuffix(host, "/")
+	if host == defaultHost {
+		return ""
+	}
+	return host
 }
 
 var credentialsFileName = "credentials"
@@ -34,43 +54,99 @@ func auth(apiKey string) (*api.Organization, error) {
 	// to build the credentials file and it also validates the
 	// API key.
 	organization, err := getCurrentOrganization(client)
+	if err != nil {
+		return nil, err
+	}
 
-	// Load the current credentials
-	credentials, err := loadCredentials()
+	err = storeCredential(organization, &Credential{APIKey: apiKey})
 	if err != nil {
 		return nil, err
 	}
 
+	return organization, nil
+}
+
+// storeCredential adds the credential of an organization on the current
+// host, replacing any existing one. When a profile is in use the credential
+// is saved for the profile, and the active credential is left as is.
+func storeCredential(organization *api.Organization, credential *Credential) error {
+	credentials, err := loadCredentials()
+	if err != nil {
+		return err
+	}
+
+	credential.OrganizationID = organization.ID
+	credential.OrganizationName = organization.Name
+	credential.Host = credentialHost(host)
+
 	credentialSet := false
+	activate := currentProfile == nil || getActive(credentials) == nil
 
-	for _, credential := range credentials {
-		credential.Active = false
-		if credential.OrganizationID == organization.ID {
-			credential.OrganizationName = organization.Name
-			credential.APIKey = apiKey
-			credential.Active = true
+	for i, existing := range credentials {
+		if activate {
+			existing.Active = false
+		}
+		if existing.Matches(organization.ID, host) {
+			credential.Active = existing.Active || activate
+			credentials[i] = credential
 			credentialSet = true
 		}
 	}
 
 	// Add the new credential
 	if !credentialSet {
-		credential := &Credential{
-			Active:           true,
-			OrganizationID:   organization.ID,
-			OrganizationName: organization.Name,
-			APIKey:           apiKey,
-		}
-
+		credential.Active = activate
 		credentials = append(credentials, credential)
 	}
 
 	err = saveCredentials(credentials)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return organization, nil
+	if currentProfile != nil {
+		values, err := userConfig.ProfileTable(currentProfile.Name)
+		if err != nil {
+			return err
+		}
+
+		// The key now lives in the credential store
+		delete(values, "api-key")
+		values["organization-id"] = organization.ID
+		values["host"] = host
+
+		err = userConfig.Save()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// credentialOutput is how a credential is listed, API keys are never
+// printed in full
+type credentialOutput struct {
+	Active           bool     `json:"active"`
+	OrganizationID   string   `json:"organization_id"`
+	OrganizationName string   `json:"organization_name"`
+	APIKey           string   `json:"api_key"`
+	Host             string   `json:"host"`
+	Profiles         []string `json:"profiles"`
+}
+
+var credentialColumns = []column{
+	{"Active", func(i interface{}) string {
+		if i.(*credentialOutput).Active {
+			return "  *  "
+		}
+		return ""
+	}},
+	{"Org ID", func(i interface{}) string { return i.(*credentialOutput).OrganizationID }},
+	{"Org Name", func(i interface{}) string { return i.(*credentialOutput).OrganizationName }},
+	{"API Key", func(i interface{}) string { return i.(*credentialOutput).APIKey }},
+	{"Host", func(i interface{}) string { return i.(*credentialOutput).Host }},
+	{"Profiles", func(i interface{}) string { return strings.Join(i.(*credentialOutput).Profiles, ", ") }},
 }
 
 // Lists all credentials stored on the user's machine
@@ -80,21 +156,60 @@ func listCredentials() error {
 		return err
 	}
 
-	w := new(tabwriter.Writer)
-	w.Init(os.Stdout, 0, 8, 0, '\t', 0)
+	config := mergedConfig()
+
+	outputs := make([]*credentialOutput, len(credentials))
+	for i, credential := range credentials {
+		outputs[i] = &credentialOutput{
+			Active:           credential.Active,
+			OrganizationID:   credential.OrganizationID,
+			OrganizationName: credential.OrganizationName,
+			APIKey:           maskAPIKey(credential.APIKey),
+			Host:             credential.Host,
+			Profiles:         []string{},
+		}
+	}
 
-	fmt.Fprintln(w, "Active\tOrg ID\tOrg Name\tAPI Key")
-	for _, credential := range credentials {
-		activeMarker := ""
-		if credential.Active {
-			activeMarker = "  *  "
+	// Profiles are listed next to their credential, profiles with their own
+	// API key get a row of their own
+	for _, name := range config.ProfileNames() {
+		p := config.Profile(name)
+		label := name
+		if name == config.DefaultProfile() {
+			label += " (default)"
+		}
+
+		orgID, _ := p.String("organization-id")
+		profileHost, _ := p.String("host")
+		apiKey, hasAPIKey := p.String("api-key")
+
+		found := false
+		for i, credential := range credentials {
+			if !hasAPIKey && orgID != "" && credential.Matches(orgID, profileHost) {
+				outputs[i].Profiles = append(outputs[i].Profiles, label)
+				found = true
+				break
+			}
 		}
 
-		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", activeMarker, credential.OrganizationID, credential.OrganizationName, credential.APIKey[0:8]+"...")
+		if !found {
+			outputs = append(outputs, &credentialOutput{
+				OrganizationID: orgID,
+				APIKey:         maskAPIKey(apiKey),
+				Host:           credentialHost(profileHost),
+				Profiles:       []string{label},
+			})
+		}
 	}
-	w.Flush()
 
-	return nil
+	return printList(os.Stdout, outputs, credentialColumns)
+}
+
+func maskAPIKey(apiKey string) string {
+	if len(apiKey) <= 8 {
+		return "..."
+	}
+	return apiKey[0:8] + "..."
 }
 
 func deleteCredential(orgID string) error {
@@ -116,16 +231,49 @@ func deleteCredential(orgID string) error {
 	return saveCredentials(credentials)
 }
 
-func switchActiveCredentials(orgID string) error {
+// deleteProfile removes a profile from the config file, it returns false if
+// there is no profile with that name
+func deleteProfile(name string) (bool, error) {
+	if !userConfig.DeleteProfile(name) {
+		return false, nil
+	}
+
+	return true, userConfig.Save()
+}
+
+// switchActiveCredentials makes a profile the default profile, or makes the
+// credential of an organization the active one
+func switchActiveCredentials(target string) error {
+	config := userConfig
+
+	if mergedConfig().Profile(target) != nil {
+		config.values["profile"] = target
+
+		err := config.Save()
+		if err != nil {
+			return err
+		}
+
+		successWriter.Write([]byte(fmt.Sprintf("Default profile switched to %s", target)))
+		return nil
+	}
+
 	credentials, err := loadCredentials()
 	if err != nil {
 		return err
 	}
 
+	found := false
 	for _, credential := range credentials {
-		if credential.OrganizationID == orgID {
-			credential.Active = true
-		}
+		credential.Active = !found && credential.OrganizationID == target
+		found = found || credential.Active
+	}
+
+	if !found {
+		message := fmt.Sprintf("There is no profile or credential for %q\n", target) +
+			"Run `timber auth list` to list all credentials and profiles"
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return cli.NewExitError(message, 65)
 	}
 
 	err = saveCredentials(credentials)
@@ -133,6 +281,16 @@ func switchActiveCredentials(orgID string) error {
 		return err
 	}
 
+	// A default profile would take precedence over the active credential
+	if config.DefaultProfile() != "" {
+		delete(config.values, "profile")
+
+		err = config.Save()
+		if err != nil {
+			return err
+		}
+	}
+
 	successWriter.Write([]byte("Active credential successfully switched"))
 
 	return nil
@@ -164,17 +322,50 @@ func getActiveCredential() (*Credential, error) {
 // Util
 //
 
+// getCurrentOrganization returns the organization given with
+// --organization-id or stored with the credential, or the only organization
+// the API key has access to
 func getCurrentOrganization(client *api.Client) (*api.Organization, error) {
 	// Grab the organization for the API key. This is required
 	// to build the credentials file and it also validates the
 	// API key.
-	organizations, err := client.ListOrganizations()
+	organizations, err := client.ListOrganizationsContext(rootContext)
 	if err != nil {
 		return nil, err
 	}
 
-	organization := organizations[0]
-	return organization, nil
+	return selectOrganization(organizations, organizationID)
+}
+
+func selectOrganization(organizations []*api.Organization, id string) (*api.Organization, error) {
+	if len(organizations) == 0 {
+		message := "The API key does not have access to any organization"
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return nil, cli.NewExitError(message, 65)
+	}
+
+	if id != "" {
+		for _, organization := range organizations {
+			if organization.ID == id {
+				return organization, nil
+			}
+		}
+
+		message := fmt.Sprintf("The API key does not have access to organization %s", id)
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return nil, cli.NewExitError(message, 65)
+	}
+
+	if len(organizations) == 1 {
+		return organizations[0], nil
+	}
+
+	message := "The API key has access to several organizations, pick one with --organization-id:"
+	for _, organization := range organizations {
+		message += fmt.Sprintf("\n  %s  %s", organization.ID, organization.Name)
+	}
+	// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+	return nil, cli.NewExitError(message, 65)
 }
 
 func getTimberDirPath() (string, error) {
@@ -191,56 +382,9 @@ func getTimberDirPath() (string, error) {
 }
 
 func saveCredentials(credentials []*Credential) error {
-	// Ensure the timber directory exists
-	timberDir, err := getTimberDirPath()
-	err = os.MkdirAll(timberDir, os.ModePerm)
-	if err != nil {
-		return err
-	}
-
-	// Ensure that the credentials file exists
-	credentialsPath := path.Join(timberDir, credentialsFileName)
-	f, err := os.Create(credentialsPath)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	// Save the credentials
-	json, err := json.MarshalIndent(credentials, "", "	")
-	if err != nil {
-		return err
-	}
-
-	_, err = f.Write(json)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return credentialStorage.Save(credentials)
 }
 
 func loadCredentials() ([]*Credential, error) {
-	var credentials []*Credential
-
-	timberDirPath, err := getTimberDirPath()
-	if err != nil {
-		return nil, err
-	}
-
-	credentialsPath := path.Join(timberDirPath, credentialsFileName)
-
-	credentialsJson, err := ioutil.ReadFile(credentialsPath)
-	if os.IsNotExist(err) {
-		return credentials, nil
-	} else if err != nil {
-		return nil, err
-	}
-
-	err = json.Unmarshal(credentialsJson, &credentials)
-	if err != nil {
-		return nil, err
-	}
-
-	return credentials, nil
+	return credentialStorage.Load()
 }
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/timberio/cli/api"
+	"github.com/tj/go-spin"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// The OAuth client the CLI logs in as
+const oauthClientID = "timber-cli"
+
+// Access tokens are refreshed when they expire within this margin
+var tokenRefreshMargin = time.Minute
+
+// The device token is polled every 5 seconds unless the server asks for
+// another interval, which grows by 5 seconds on each slow_down, see RFC 8628
+var (
+	deviceTokenInterval = 5 * time.Second
+	deviceTokenSlowDown = 5 * time.Second
+)
+
+// login runs the OAuth device authorization flow: the user enters a code in
+// their browser while the CLI polls for the token, which is then stored like
+// an API key along with its refresh token
+func login() (*api.Organization, error) {
+	client = api.NewClient(host, "")
+
+	authorization, err := client.RequestDeviceAuthorizationContext(rootContext, oauthClientID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	uri := authorization.VerificationURI
+	if authorization.VerificationURIComplete != "" {
+		uri = authorization.VerificationURIComplete
+	}
+
+	fmt.Fprintf(infoWriter, "Open %s in your browser and enter the code:\n\n", uri)
+	fmt.Fprintf(writer, "    %s\n\n", authorization.UserCode)
+
+	token, err := pollDeviceToken(rootContext, client, authorization)
+	clearSpinner()
+	if err != nil {
+		return nil, err
+	}
+
+	client = api.NewClient(host, token.AccessToken)
+
+	organization, err := getCurrentOrganization(client)
+	if err != nil {
+		return nil, err
+	}
+
+	credential := &Credential{APIKey: token.AccessToken, RefreshToken: token.RefreshToken}
+	if !token.ExpiresAt.IsZero() {
+		credential.ExpiresAt = &token.ExpiresAt
+	}
+
+	err = storeCredential(organization, credential)
+	if err != nil {
+		return nil, err
+	}
+
+	return organization, nil
+}
+
+// pollDeviceToken polls the token endpoint at the interval asked for by the
+// server until the user approves or denies the login, or the code expires
+func pollDeviceToken(ctx context.Context, client *api.Client, authorization *api.DeviceAuthorization) (*api.Token, error) {
+	interval := time.Duration(authorization.Interval) * time.Second
+	if interval <= 0 {
+		interval = deviceTokenInterval
+	}
+
+	var expired <-chan time.Time
+	if authorization.ExpiresIn > 0 {
+		expired = time.After(time.Duration(authorization.ExpiresIn) * time.Second)
+	}
+
+	s := spin.New()
+	wait := time.After(interval)
+
+	for {
+		// The spinner goes to stderr so that the code can be piped
+		fmt.Fprintf(os.Stderr, "\r%s \033[36mWaiting for the login to be approved\033[m", s.Next())
+
+		select {
+		case <-ctx.Done():
+			clearSpinner()
+			return nil, cli.NewExitError("Interrupted, login was cancelled", exitCodeInterrupted)
+		case <-expired:
+			clearSpinner()
+			// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+			return nil, cli.NewExitError("The login code expired, run `timber auth login` to try again", 65)
+		case <-time.After(100 * time.Millisecond):
+			continue
+		case <-wait:
+		}
+
+		token, err := client.PollDeviceTokenContext(ctx, oauthClientID, authorization.DeviceCode)
+		if err == nil {
+			return token, nil
+		}
+
+		if ctx.Err() != nil {
+			continue
+		}
+
+		oauthErr, ok := err.(*api.OAuthError)
+		if !ok {
+			return nil, err
+		}
+
+		switch oauthErr.Code {
+		case api.OAuthAuthorizationPending:
+		case api.OAuthSlowDown:
+			interval += deviceTokenSlowDown
+		case api.OAuthAccessDenied:
+			clearSpinner()
+			// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+			return nil, cli.NewExitError("The login was denied", 65)
+		case api.OAuthExpiredToken:
+			clearSpinner()
+			// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+			return nil, cli.NewExitError("The login code expired, run `timber auth login` to try again", 65)
+		default:
+			return nil, err
+		}
+
+		wait = time.After(interval)
+	}
+}
+
+// refreshCredential renews the access token of a credential added with
+// `timber auth login` when it is about to expire, and saves it
+func refreshCredential(credential *Credential) error {
+	if credential.RefreshToken == "" || credential.ExpiresAt == nil ||
+		time.Until(*credential.ExpiresAt) > tokenRefreshMargin {
+		return nil
+	}
+
+	refreshHost := credential.Host
+	if refreshHost == "" {
+		refreshHost = defaultHost
+	}
+
+	token, err := api.NewClient(refreshHost, "").RefreshTokenContext(rootContext, oauthClientID, credential.RefreshToken)
+	if oauthErr, ok := err.(*api.OAuthError); ok {
+		message := fmt.Sprintf("The login for %s has expired: %s\n", credential.OrganizationID, oauthErr) +
+			"Run `timber auth login` to log in again"
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return cli.NewExitError(message, 65)
+	} else if err != nil {
+		return err
+	}
+
+	logger.Debugf("Refreshed the access token for %s", credential.OrganizationID)
+
+	credential.APIKey = token.AccessToken
+	if token.RefreshToken != "" {
+		credential.RefreshToken = token.RefreshToken
+	}
+	credential.ExpiresAt = nil
+	if !token.ExpiresAt.IsZero() {
+		credential.ExpiresAt = &token.ExpiresAt
+	}
+
+	credentials, err := loadCredentials()
+	if err != nil {
+		return err
+	}
+
+	for i, existing := range credentials {
+		if existing.Matches(credential.OrganizationID, credential.Host) {
+			credential.Active = existing.Active
+			credentials[i] = credential
+		}
+	}
+
+	return saveCredentials(credentials)
+}
+
+// logout revokes the tokens of a credential added with `timber auth login`
+// and deletes it. The credential is kept when revoking fails. API keys can't
+// be revoked from the CLI and are only deleted.
+func logout(orgID string) (*Credential, error) {
+	credentials, err := loadCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	var credential *Credential
+	if orgID == "" {
+		credential = getActive(credentials)
+		if credential == nil && len(credentials) > 0 {
+			credential = credentials[0]
+		}
+	}
+	for _, c := range credentials {
+		if credential == nil && c.Matches(orgID, host) {
+			credential = c
+		}
+	}
+
+	if credential == nil {
+		message := "You are not logged in"
+		if orgID != "" {
+			message = fmt.Sprintf("There is no credential for %q on %s\n", orgID, host) +
+				"Run `timber auth list` to list all credentials"
+		}
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return nil, cli.NewExitError(message, 65)
+	}
+
+	if credential.RefreshToken != "" {
+		revokeHost := credential.Host
+		if revokeHost == "" {
+			revokeHost = defaultHost
+		}
+		client := api.NewClient(revokeHost, "")
+
+		// Revoking the refresh token also invalidates the access tokens it
+		// issued on most servers, the access token is revoked to be sure
+		err = client.RevokeTokenContext(rootContext, oauthClientID, credential.RefreshToken, "refresh_token")
+		if err == nil {
+			err = client.RevokeTokenContext(rootContext, oauthClientID, credential.APIKey, "access_token")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Could not revoke the login, the credential was kept: %s", err)
+		}
+	}
+
+	i := 0 // output index
+	for _, c := range credentials {
+		if c != credential {
+			credentials[i] = c
+			i++
+		}
+	}
+
+	err = saveCredentials(credentials[:i])
+	if err != nil {
+		return nil, err
+	}
+
+	return credential, nil
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/timberio/cli/api"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// fakeAuthServer is an OAuth authorization server. Token requests are
+// answered with the queued error codes in order, then with a new token.
+type fakeAuthServer struct {
+	*httptest.Server
+
+	mu            sync.Mutex
+	tokenErrors   []string
+	tokenRequests []url.Values
+	tokenTimes    []time.Time
+	revokeError   string
+	revoked       []url.Values
+}
+
+func newFakeAuthServer(t *testing.T, tokenErrors ...string) *fakeAuthServer {
+	s := &fakeAuthServer{tokenErrors: tokenErrors}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("invalid form: %v", err)
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/oauth/token":
+			s.tokenRequests = append(s.tokenRequests, r.PostForm)
+			s.tokenTimes = append(s.tokenTimes, time.Now())
+
+			if len(s.tokenErrors) > 0 {
+				code := s.tokenErrors[0]
+				s.tokenErrors = s.tokenErrors[1:]
+				writeOAuthError(w, code)
+				return
+			}
+
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token":  "new-access-token",
+				"refresh_token": "new-refresh-token",
+				"token_type":    "bearer",
+				"expires_in":    3600,
+			})
+
+		case "/oauth/revoke":
+			if s.revokeError != "" {
+				writeOAuthError(w, s.revokeError)
+				return
+			}
+			s.revoked = append(s.revoked, r.PostForm)
+
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func writeOAuthError(w http.ResponseWriter, code string) {
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+func (s *fakeAuthServer) TokenRequests() ([]url.Values, []time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokenRequests, s.tokenTimes
+}
+
+func (s *fakeAuthServer) Revoked() []url.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.revoked
+}
+
+// withAuthTestGlobals points the globals used by the auth commands at the
+// server and an empty credentials file for the duration of a test
+func withAuthTestGlobals(t *testing.T, server *fakeAuthServer) {
+	savedContext, savedHost, savedStorage := rootContext, host, credentialStorage
+	savedInterval, savedSlowDown := deviceTokenInterval, deviceTokenSlowDown
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	rootContext = ctx
+	host = server.URL
+	credentialStorage = &fileCredentialStore{path: filepath.Join(t.TempDir(), credentialsFileName)}
+	deviceTokenInterval, deviceTokenSlowDown = 10*time.Millisecond, 50*time.Millisecond
+
+	t.Cleanup(func() {
+		cancel()
+		rootContext, host, credentialStorage = savedContext, savedHost, savedStorage
+		deviceTokenInterval, deviceTokenSlowDown = savedInterval, savedSlowDown
+	})
+}
+
+func pollTestDeviceToken(server *fakeAuthServer) (*api.Token, error) {
+	authorization := &api.DeviceAuthorization{DeviceCode: "device-code", UserCode: "ABCD-EFGH"}
+	return pollDeviceToken(rootContext, api.NewClient(server.URL, ""), authorization)
+}
+
+func expectExitCode(t *testing.T, err error, code int) {
+	t.Helper()
+
+	exitErr, ok := err.(cli.ExitCoder)
+	if !ok {
+		t.Fatalf("expected an exit error with code %d, got %v", code, err)
+	}
+	if exitErr.ExitCode() != code {
+		t.Fatalf("expected exit code %d, got %d: %v", code, exitErr.ExitCode(), err)
+	}
+}
+
+func TestPollDeviceTokenWaitsWhileAuthorizationIsPending(t *testing.T) {
+	server := newFakeAuthServer(t, api.OAuthAuthorizationPending, api.OAuthAuthorizationPending)
+	withAuthTestGlobals(t, server)
+
+	token, err := pollTestDeviceToken(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "new-access-token" || token.RefreshToken != "new-refresh-token" {
+		t.Fatalf("unexpected token %+v", token)
+	}
+
+	requests, _ := server.TokenRequests()
+	if len(requests) != 3 {
+		t.Fatalf("expected 3 token requests, got %d", len(requests))
+	}
+	for _, request := range requests {
+		if request.Get("device_code") != "device-code" || request.Get("grant_type") != "urn:ietf:params:oauth:grant-type:device_code" {
+			t.Fatalf("unexpected token request %v", request)
+		}
+	}
+}
+
+func TestPollDeviceTokenSlowsDown(t *testing.T) {
+	server := newFakeAuthServer(t, api.OAuthSlowDown, api.OAuthSlowDown)
+	withAuthTestGlobals(t, server)
+
+	if _, err := pollTestDeviceToken(server); err != nil {
+		t.Fatal(err)
+	}
+
+	_, times := server.TokenRequests()
+	if len(times) != 3 {
+		t.Fatalf("expected 3 token requests, got %d", len(times))
+	}
+
+	// Each slow_down adds to the interval before the next request
+	for i, expected := range []time.Duration{
+		deviceTokenInterval + deviceTokenSlowDown,
+		deviceTokenInterval + 2*deviceTokenSlowDown,
+	} {
+		if wait := times[i+1].Sub(times[i]); wait < expected {
+			t.Fatalf("expected to wait at least %s after slow_down %d, waited %s", expected, i+1, wait)
+		}
+	}
+}
+
+func TestPollDeviceTokenStopsWhenDeniedOrExpired(t *testing.T) {
+	for _, code := range []string{api.OAuthAccessDenied, api.OAuthExpiredToken} {
+		t.Run(code, func(t *testing.T) {
+			server := newFakeAuthServer(t, api.OAuthAuthorizationPending, code)
+			withAuthTestGlobals(t, server)
+
+			_, err := pollTestDeviceToken(server)
+			expectExitCode(t, err, 65)
+
+			if requests, _ := server.TokenRequests(); len(requests) != 2 {
+				t.Fatalf("expected polling to stop after %s, got %d token requests", code, len(requests))
+			}
+		})
+	}
+}
+
+// saveLoginCredential stores a credential added with `timber auth login`
+// whose access token expires after expiresIn
+func saveLoginCredential(t *testing.T, server *fakeAuthServer, expiresIn time.Duration) *Credential {
+	expiresAt := time.Now().Add(expiresIn)
+	credential := &Credential{
+		OrganizationID: "org",
+		Host:           server.URL,
+		APIKey:         "old-access-token",
+		RefreshToken:   "old-refresh-token",
+		ExpiresAt:      &expiresAt,
+		Active:         true,
+	}
+
+	other := &Credential{OrganizationID: "other-org", Host: server.URL, APIKey: "api-key"}
+	if err := saveCredentials([]*Credential{other, credential}); err != nil {
+		t.Fatal(err)
+	}
+
+	copied := *credential
+	return &copied
+}
+
+func loadCredential(t *testing.T, orgID string) *Credential {
+	t.Helper()
+
+	credentials, err := loadCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, credential := range credentials {
+		if credential.OrganizationID == orgID {
+			return credential
+		}
+	}
+	return nil
+}
+
+func TestRefreshCredential(t *testing.T) {
+	server := newFakeAuthServer(t)
+	withAuthTestGlobals(t, server)
+
+	credential := saveLoginCredential(t, server, 10*time.Second)
+	if err := refreshCredential(credential); err != nil {
+		t.Fatal(err)
+	}
+
+	requests, _ := server.TokenRequests()
+	if len(requests) != 1 || requests[0].Get("grant_type") != "refresh_token" || requests[0].Get("refresh_token") != "old-refresh-token" {
+		t.Fatalf("expected a single refresh token request, got %v", requests)
+	}
+
+	saved := loadCredential(t, "org")
+	if saved == nil || saved.APIKey != "new-access-token" || saved.RefreshToken != "new-refresh-token" {
+		t.Fatalf("expected the refreshed tokens to be saved, got %+v", saved)
+	}
+	if saved.ExpiresAt == nil || time.Until(*saved.ExpiresAt) < 59*time.Minute {
+		t.Fatalf("expected the new expiry to be saved, got %v", saved.ExpiresAt)
+	}
+	if !saved.Active {
+		t.Fatal("expected the credential to stay active")
+	}
+	if other := loadCredential(t, "other-org"); other == nil || other.APIKey != "api-key" {
+		t.Fatalf("expected other credentials to be kept, got %+v", other)
+	}
+}
+
+func TestRefreshCredentialSkipsTokensNotAboutToExpire(t *testing.T) {
+	server := newFakeAuthServer(t)
+	withAuthTestGlobals(t, server)
+
+	credential := saveLoginCredential(t, server, time.Hour)
+	if err := refreshCredential(credential); err != nil {
+		t.Fatal(err)
+	}
+
+	if requests, _ := server.TokenRequests(); len(requests) != 0 {
+		t.Fatalf("expected no refresh, got %d token requests", len(requests))
+	}
+}
+
+func TestRefreshCredentialReportsExpiredLogins(t *testing.T) {
+	server := newFakeAuthServer(t, "invalid_grant")
+	withAuthTestGlobals(t, server)
+
+	credential := saveLoginCredential(t, server, 10*time.Second)
+	expectExitCode(t, refreshCredential(credential), 65)
+
+	if saved := loadCredential(t, "org"); saved == nil || saved.APIKey != "old-access-token" {
+		t.Fatalf("expected the credential to be left alone, got %+v", saved)
+	}
+}
+
+func TestCredentialStatusReportsExpiredLoginsWithoutRefreshing(t *testing.T) {
+	server := newFakeAuthServer(t)
+	withAuthTestGlobals(t, server)
+
+	saveLoginCredential(t, server, -time.Minute)
+
+	p := &profile{Name: "login", values: map[string]interface{}{"organization-id": "org"}}
+	credential, err := p.Credential(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credential == nil || credential.APIKey != "old-access-token" {
+		t.Fatalf("expected the stored credential, got %+v", credential)
+	}
+
+	// The fake server fails the test if the API is called
+	status := &credentialStatus{
+		Host:           credential.Host,
+		apiKey:         credential.APIKey,
+		tokenExpiresAt: credential.ExpiresAt,
+		refreshable:    true,
+	}
+	checkCredential(rootContext, status)
+
+	if status.Status != credentialExpired || status.formatExpiry() == "unknown" {
+		t.Fatalf("expected the login to be reported as expired, got %+v", status)
+	}
+	if requests, _ := server.TokenRequests(); len(requests) != 0 {
+		t.Fatalf("expected no refresh, got %d token requests", len(requests))
+	}
+}
+
+func TestLogoutRevokesTokens(t *testing.T) {
+	server := newFakeAuthServer(t)
+	withAuthTestGlobals(t, server)
+
+	saveLoginCredential(t, server, time.Hour)
+	if _, err := logout("org"); err != nil {
+		t.Fatal(err)
+	}
+
+	revoked := server.Revoked()
+	if len(revoked) != 2 ||
+		revoked[0].Get("token") != "old-refresh-token" || revoked[0].Get("token_type_hint") != "refresh_token" ||
+		revoked[1].Get("token") != "old-access-token" || revoked[1].Get("token_type_hint") != "access_token" {
+		t.Fatalf("expected the refresh then the access token to be revoked, got %v", revoked)
+	}
+
+	if saved := loadCredential(t, "org"); saved != nil {
+		t.Fatalf("expected the credential to be deleted, got %+v", saved)
+	}
+	if other := loadCredential(t, "other-org"); other == nil {
+		t.Fatal("expected other credentials to be kept")
+	}
+}
+
+func TestLogoutKeepsCredentialWhenRevokingFails(t *testing.T) {
+	server := newFakeAuthServer(t)
+	server.revokeError = "invalid_client"
+	withAuthTestGlobals(t, server)
+
+	saveLoginCredential(t, server, time.Hour)
+	if _, err := logout("org"); err == nil {
+		t.Fatal("expected logout to fail")
+	}
+
+	if saved := loadCredential(t, "org"); saved == nil {
+		t.Fatal("expected the credential to be kept")
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/timberio/cli/api"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// Statuses of a credential checked by `timber auth status`
+const (
+	credentialValid    = "valid"
+	credentialRevoked  = "revoked"
+	credentialExpired  = "expired"
+	credentialNoAccess = "no access"
+	credentialError    = "error"
+)
+
+// How long checking a single credential can take
+var credentialCheckTimeout = 15 * time.Second
+
+// credentialStatus is a stored credential, or the API key in use, checked
+// against the API
+type credentialStatus struct {
+	Current          bool       `json:"current"`
+	Profiles         []string   `json:"profiles"`
+	OrganizationID   string     `json:"organization_id"`
+	OrganizationName string     `json:"organization_name"`
+	Organizations    int        `json:"organizations"`
+	Host             string     `json:"host"`
+	APIKey           string     `json:"api_key"`
+	Source           string     `json:"source"`
+	Status           string     `json:"status"`
+	Error            string     `json:"error,omitempty"`
+	Scopes           []string   `json:"scopes"`
+	ExpiresAt        *time.Time `json:"expires_at"`
+
+	apiKey    string
+	described bool
+
+	// Expiry of an access token from `timber auth login`, which can be
+	// refreshed when it is next used
+	tokenExpiresAt *time.Time
+	refreshable    bool
+}
+
+var credentialStatusColumns = []column{
+	{"Current", func(i interface{}) string {
+		if i.(*credentialStatus).Current {
+			return "  *  "
+		}
+		return ""
+	}},
+	{"Org ID", func(i interface{}) string { return i.(*credentialStatus).OrganizationID }},
+	{"Org Name", func(i interface{}) string { return i.(*credentialStatus).OrganizationName }},
+	{"Host", func(i interface{}) string { return credentialHost(i.(*credentialStatus).Host) }},
+	{"Profiles", func(i interface{}) string { return strings.Join(i.(*credentialStatus).Profiles, ", ") }},
+	{"Status", func(i interface{}) string { return i.(*credentialStatus).Status }},
+	{"Scopes", func(i interface{}) string { return i.(*credentialStatus).formatScopes() }},
+	{"Expires", func(i interface{}) string { return i.(*credentialStatus).formatExpiry() }},
+}
+
+// authStatus checks every stored credential in parallel. With currentOnly,
+// only the API key in use is checked. It fails when the API key in use is
+// missing or isn't valid.
+func authStatus(ctx *cli.Context, currentOnly bool) error {
+	// A missing API key is reported after the stored credentials
+	currentErr := setAPIKey(ctx)
+
+	statuses, err := collectCredentialStatuses(ctx, currentOnly)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for _, status := range statuses {
+		wg.Add(1)
+		go func(status *credentialStatus) {
+			defer wg.Done()
+			checkCredential(rootContext, status)
+		}(status)
+	}
+	wg.Wait()
+
+	if rootContext.Err() != nil {
+		return rootContext.Err()
+	}
+
+	var current *credentialStatus
+	for _, status := range statuses {
+		if status.Current {
+			current = status
+		}
+	}
+
+	if isTableOutput() && current != nil {
+		printCurrentCredential(current)
+		if !currentOnly {
+			fmt.Println()
+		}
+	}
+
+	if !isTableOutput() || !currentOnly {
+		err = printList(os.Stdout, statuses, credentialStatusColumns)
+		if err != nil {
+			return err
+		}
+	}
+
+	if currentErr != nil {
+		return currentErr
+	}
+
+	if current.Status != credentialValid {
+		message := fmt.Sprintf("The API key in use is %s", current.Status)
+		if current.Error != "" {
+			message += ": " + current.Error
+		}
+		if current.Status == credentialRevoked || current.Status == credentialExpired {
+			message += "\nRun `timber auth [api_key]` with a new API key"
+		}
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return cli.NewExitError(message, 65)
+	}
+
+	return nil
+}
+
+// collectCredentialStatuses lists the stored credentials, profiles with their
+// own API key, and the API key in use when it comes from a flag or the
+// environment. Stored credentials are listed as they are, without refreshing
+// them.
+func collectCredentialStatuses(ctx *cli.Context, currentOnly bool) ([]*credentialStatus, error) {
+	statuses := []*credentialStatus{}
+
+	add := func(status *credentialStatus) *credentialStatus {
+		if status.Host == "" {
+			status.Host = defaultHost
+		}
+
+		for _, existing := range statuses {
+			if existing.apiKey == status.apiKey && credentialHost(existing.Host) == credentialHost(status.Host) &&
+				(existing.OrganizationID == status.OrganizationID || status.OrganizationID == "") {
+				return existing
+			}
+		}
+
+		status.APIKey = maskAPIKey(status.apiKey)
+		status.Profiles = []string{}
+		statuses = append(statuses, status)
+		return status
+	}
+
+	if !currentOnly {
+		credentials, err := loadCredentials()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, credential := range credentials {
+			add(&credentialStatus{
+				OrganizationID:   credential.OrganizationID,
+				OrganizationName: credential.OrganizationName,
+				Host:             credential.Host,
+				Source:           "credential",
+				apiKey:           credential.APIKey,
+				tokenExpiresAt:   credential.ExpiresAt,
+				refreshable:      credential.RefreshToken != "",
+			})
+		}
+
+		config := mergedConfig()
+		for _, name := range config.ProfileNames() {
+			p := config.Profile(name)
+			profileHost, _ := p.String("host")
+
+			profileAPIKey, ok := p.String("api-key")
+			if !ok {
+				credential, err := p.Credential(profileHost)
+				if err != nil {
+					return nil, err
+				}
+				if credential == nil {
+					continue
+				}
+
+				// Listed above, the profile is added to its status
+				profileAPIKey = credential.APIKey
+			}
+
+			orgID, _ := p.String("organization-id")
+			status := add(&credentialStatus{
+				OrganizationID: orgID,
+				Host:           profileHost,
+				Source:         "profile " + name,
+				apiKey:         profileAPIKey,
+			})
+			status.Profiles = append(status.Profiles, name)
+		}
+	}
+
+	if apiKey != "" {
+		source := "active credential"
+		if currentProfile != nil {
+			source = "profile " + currentProfile.Name
+		}
+		if setting, ok := configSettings["api-key"]; ok && ctx.GlobalString("api-key") != "" {
+			_, source = setting.resolve(ctx)
+		}
+
+		current := add(&credentialStatus{
+			OrganizationID: organizationID,
+			Host:           host,
+			Source:         source,
+			apiKey:         apiKey,
+		})
+		current.Current = true
+		current.Source = source
+		if current.OrganizationID == "" {
+			current.OrganizationID = organizationID
+		}
+	}
+
+	return statuses, nil
+}
+
+// checkCredential lists the organizations of the API key and fetches its
+// scopes and expiry. Scopes and expiry are left empty when the API doesn't
+// describe keys.
+func checkCredential(parent context.Context, status *credentialStatus) {
+	// An expired access token would only be reported as revoked
+	if status.tokenExpiresAt != nil && status.tokenExpiresAt.Before(time.Now()) {
+		status.Status = credentialExpired
+		status.ExpiresAt = status.tokenExpiresAt
+		if status.refreshable {
+			status.Error = "the login is refreshed when it is next used"
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(parent, credentialCheckTimeout)
+	defer cancel()
+
+	client := api.NewClient(status.Host, status.apiKey, api.WithRetryPolicy(1, 500*time.Millisecond, 2*time.Second))
+
+	var (
+		wg       sync.WaitGroup
+		orgs     []*api.Organization
+		orgsErr  error
+		key      *api.APIKey
+		keyError error
+	)
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		orgs, orgsErr = client.ListOrganizationsContext(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		key, keyError = client.GetCurrentAPIKeyContext(ctx)
+	}()
+	wg.Wait()
+
+	if orgsErr != nil {
+		if serviceErr, ok := orgsErr.(*api.ServiceError); ok && serviceErr.Unauthorized() {
+			status.Status = credentialRevoked
+		} else {
+			status.Status = credentialError
+			status.Error = strings.Split(orgsErr.Error(), "\n")[0]
+		}
+		return
+	}
+
+	status.Organizations = len(orgs)
+	status.Status = credentialValid
+
+	if status.OrganizationID == "" && len(orgs) == 1 {
+		status.OrganizationID = orgs[0].ID
+	}
+
+	if status.OrganizationID != "" {
+		found := false
+		for _, org := range orgs {
+			if org.ID == status.OrganizationID {
+				status.OrganizationName = org.Name
+				found = true
+			}
+		}
+		if !found {
+			status.Status = credentialNoAccess
+		}
+	} else if len(orgs) > 1 {
+		status.OrganizationName = fmt.Sprintf("(%d organizations)", len(orgs))
+	}
+
+	if keyError != nil {
+		logger.Debugf("Could not describe the API key for %s: %s", status.OrganizationID, keyError)
+		return
+	}
+
+	if key != nil {
+		status.described = true
+		status.Scopes = key.Scopes
+		status.ExpiresAt = key.ExpiresAt
+		if key.ExpiresAt != nil && key.ExpiresAt.Before(time.Now()) {
+			status.Status = credentialExpired
+		}
+	}
+}
+
+func printCurrentCredential(status *credentialStatus) {
+	profile := "none"
+	if len(status.Profiles) > 0 {
+		profile = strings.Join(status.Profiles, ", ")
+	}
+	if currentProfile != nil {
+		profile = currentProfile.Name
+	}
+
+	organization := status.OrganizationID
+	if status.OrganizationName != "" {
+		organization = fmt.Sprintf("%s (%s)", status.OrganizationName, status.OrganizationID)
+	}
+
+	fmt.Printf("Profile:       %s\n", profile)
+	fmt.Printf("Organization:  %s\n", organization)
+	fmt.Printf("Host:          %s\n", status.Host)
+	fmt.Printf("API key:       %s (%s)\n", status.APIKey, status.Source)
+	fmt.Printf("Scopes:        %s\n", status.formatScopes())
+	fmt.Printf("Expires:       %s\n", status.formatExpiry())
+
+	if status.Status == credentialValid {
+		fmt.Fprintf(writer, "Status:        %s\n", status.Status)
+	} else {
+		fmt.Fprintf(warningWriter, "Status:        %s\n", status.Status)
+	}
+}
+
+// Scopes and expiry are unknown when the API doesn't describe keys
+func (s *credentialStatus) formatScopes() string {
+	if !s.described {
+		return "unknown"
+	}
+	if len(s.Scopes) == 0 {
+		return "none"
+	}
+	return strings.Join(s.Scopes, ", ")
+}
+
+func (s *credentialStatus) formatExpiry() string {
+	if !s.described && s.ExpiresAt == nil {
+		return "unknown"
+	}
+
+	expiresAt := s.ExpiresAt
+	if expiresAt == nil {
+		return "never"
+	}
+
+	days := int(time.Until(*expiresAt).Hours() / 24)
+	switch {
+	case days < 0:
+		return expiresAt.Format("2006-01-02") + " (expired)"
+	case days == 0:
+		return expiresAt.Format("2006-01-02") + " (today)"
+	default:
+		return fmt.Sprintf("%s (in %d days)", expiresAt.Format("2006-01-02"), days)
+	}
+}
@@ -0,0 +1,701 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/urfave/cli.v1"
+)
+
+// Settings are read from these files, each taking precedence over the one
+// before it. Environment variables and flags take precedence over all of
+// them.
+var (
+	systemConfigPath      = "/etc/timber/config"
+	configFileName        = "config"
+	projectConfigFileName = ".timber.toml"
+)
+
+// Settings a project file can't change. A repository could otherwise point
+// the CLI at another host with the user's API key, or run a credential
+// helper of its choosing.
+var projectRestrictedSettings = []string{
+	"api-key",
+	"credential-helper",
+	"credential-store",
+	"credentials-key-file",
+	"host",
+	"profiles",
+}
+
+// configFile is a TOML file holding settings and profiles
+type configFile struct {
+	path   string
+	values map[string]interface{}
+
+	// Set for project files, their restricted settings are ignored
+	restricted bool
+}
+
+// The config files in use, loaded by loadConfig. projectConfig is nil when
+// there's no .timber.toml in the current directory or its parents.
+var (
+	configFiles   []*configFile
+	systemConfig  *configFile
+	userConfig    *configFile
+	projectConfig *configFile
+)
+
+// configSetting is a flag that can be set in config files, keys are named
+// after the flag
+type configSetting struct {
+	flag    cli.Flag
+	Name    string
+	EnvVar  string
+	Default string
+	Value   string
+	Origin  string
+	Global  bool
+}
+
+// Settings by name, in the order the flags are defined
+var (
+	configSettings     = map[string]*configSetting{}
+	configSettingNames = []string{}
+)
+
+// loadConfig reads the config files and uses their settings as the default
+// values of the app's flags. Global flags can be set, along with command flags
+// that can be set from the environment.
+func loadConfig(app *cli.App) error {
+	var err error
+
+	systemConfig, err = loadConfigFile(systemConfigPath)
+	if err != nil {
+		return err
+	}
+
+	timberDir, err := getTimberDirPath()
+	if err != nil {
+		return err
+	}
+
+	userConfig, err = loadConfigFile(path.Join(timberDir, configFileName))
+	if err != nil {
+		return err
+	}
+
+	configFiles = []*configFile{systemConfig, userConfig}
+
+	projectPath := findProjectConfigPath()
+	if projectPath != "" {
+		projectConfig, err = loadConfigFile(projectPath)
+		if err != nil {
+			return err
+		}
+
+		projectConfig.restricted = true
+		for _, name := range projectRestrictedSettings {
+			if _, ok := projectConfig.values[name]; ok {
+				fmt.Fprintf(os.Stderr, "Ignoring %s in %s, it can only be set in %s or %s\n", name, projectPath, userConfig.path, systemConfig.path)
+			}
+		}
+
+		configFiles = append(configFiles, projectConfig)
+	}
+
+	for _, flag := range app.Flags {
+		addConfigSetting(flag, true)
+	}
+	walkCommandFlags(app.Commands, func(flag cli.Flag) cli.Flag {
+		if flagEnvVar(flag) != "" {
+			addConfigSetting(flag, false)
+		}
+		return flag
+	})
+
+	for _, file := range configFiles {
+		for key, value := range file.Settings() {
+			if _, ok := value.(map[string]interface{}); ok {
+				continue
+			}
+
+			setting, ok := configSettings[key]
+			if !ok {
+				fmt.Fprintf(os.Stderr, "Ignoring unknown setting %s in %s\n", key, file.path)
+				continue
+			}
+
+			setting.Value = configValueString(value)
+			setting.Origin = file.path
+		}
+	}
+
+	apply := func(flag cli.Flag) (cli.Flag, error) {
+		setting, ok := configSettings[flagName(flag)]
+		if !ok || setting.Origin == "default" {
+			return flag, nil
+		}
+
+		flag, err := flagWithDefault(flag, setting.Value)
+		if err != nil {
+			message := fmt.Sprintf("Invalid value for %s in %s: %s", setting.Name, setting.Origin, err)
+			// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+			return nil, cli.NewExitError(message, 65)
+		}
+		return flag, nil
+	}
+
+	for i, flag := range app.Flags {
+		app.Flags[i], err = apply(flag)
+		if err != nil {
+			return err
+		}
+	}
+
+	walkCommandFlags(app.Commands, func(flag cli.Flag) cli.Flag {
+		if err != nil || flagEnvVar(flag) == "" {
+			return flag
+		}
+
+		var applied cli.Flag
+		applied, err = apply(flag)
+		if err != nil {
+			return flag
+		}
+		return applied
+	})
+
+	return err
+}
+
+// findProjectConfigPath looks for .timber.toml in the current directory and
+// its parents
+func findProjectConfigPath() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+
+	for {
+		filename := filepath.Join(dir, projectConfigFileName)
+		if _, err := os.Stat(filename); err == nil {
+			return filename
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+func addConfigSetting(flag cli.Flag, global bool) {
+	name := flagName(flag)
+	if name == "help" || name == "version" {
+		return
+	}
+
+	if _, ok := configSettings[name]; ok {
+		return
+	}
+
+	defaultValue := flagDefault(flag)
+	configSettings[name] = &configSetting{
+		flag:    flag,
+		Name:    name,
+		EnvVar:  flagEnvVar(flag),
+		Default: defaultValue,
+		Value:   defaultValue,
+		Origin:  "default",
+		Global:  global,
+	}
+	configSettingNames = append(configSettingNames, name)
+}
+
+func walkCommandFlags(commands []cli.Command, f func(cli.Flag) cli.Flag) {
+	for i := range commands {
+		for j, flag := range commands[i].Flags {
+			commands[i].Flags[j] = f(flag)
+		}
+		walkCommandFlags(commands[i].Subcommands, f)
+	}
+}
+
+// flagName returns the long name of a flag, e.g. host for "host, H"
+func flagName(flag cli.Flag) string {
+	return strings.TrimSpace(strings.Split(flag.GetName(), ",")[0])
+}
+
+func flagEnvVar(flag cli.Flag) string {
+	switch f := flag.(type) {
+	case cli.StringFlag:
+		return f.EnvVar
+	case cli.StringSliceFlag:
+		return f.EnvVar
+	case cli.IntFlag:
+		return f.EnvVar
+	case cli.BoolFlag:
+		return f.EnvVar
+	case cli.BoolTFlag:
+		return f.EnvVar
+	case cli.DurationFlag:
+		return f.EnvVar
+	}
+	return ""
+}
+
+func flagDefault(flag cli.Flag) string {
+	switch f := flag.(type) {
+	case cli.StringFlag:
+		return f.Value
+	case cli.StringSliceFlag:
+		if f.Value != nil {
+			return strings.Join(f.Value.Value(), ",")
+		}
+	case cli.IntFlag:
+		return strconv.Itoa(f.Value)
+	case cli.BoolFlag:
+		return "false"
+	case cli.BoolTFlag:
+		return "true"
+	case cli.DurationFlag:
+		if f.Value != 0 {
+			return f.Value.String()
+		}
+	}
+	return ""
+}
+
+// flagWithDefault returns a copy of the flag defaulting to value. String
+// slice flags are left as is since the library appends flag values to their
+// defaults, getLogSelection reads their setting instead.
+func flagWithDefault(flag cli.Flag, value string) (cli.Flag, error) {
+	switch f := flag.(type) {
+	case cli.StringFlag:
+		f.Value = value
+		return f, nil
+	case cli.IntFlag:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", value)
+		}
+		f.Value = i
+		return f, nil
+	case cli.DurationFlag:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a duration, such as 30s or 5m", value)
+		}
+		f.Value = d
+		return f, nil
+	case cli.BoolFlag, cli.BoolTFlag:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%q must be true or false", value)
+		}
+		if b {
+			return cli.BoolTFlag{Name: flag.GetName(), Usage: flagUsage(flag), EnvVar: flagEnvVar(flag)}, nil
+		}
+		return cli.BoolFlag{Name: flag.GetName(), Usage: flagUsage(flag), EnvVar: flagEnvVar(flag)}, nil
+	}
+	return flag, nil
+}
+
+func flagUsage(flag cli.Flag) string {
+	switch f := flag.(type) {
+	case cli.BoolFlag:
+		return f.Usage
+	case cli.BoolTFlag:
+		return f.Usage
+	}
+	return ""
+}
+
+// resolve returns the value of a setting and where it comes from, the flags
+// and environment variables taking precedence over the current profile and
+// the config files
+func (s *configSetting) resolve(ctx *cli.Context) (string, string) {
+	env := ""
+	if s.EnvVar != "" {
+		env = os.Getenv(s.EnvVar)
+	}
+
+	if s.Global && ctx.GlobalIsSet(s.Name) {
+		value := ctx.GlobalString(s.Name)
+		if env == "" || value != env {
+			return value, "flag --" + s.Name
+		}
+	}
+
+	if env != "" {
+		return env, "env " + s.EnvVar
+	}
+
+	if currentProfile != nil && isProfileSetting(s.Name) {
+		if value, ok := currentProfile.String(s.Name); ok {
+			return value, "profile " + currentProfile.Name
+		}
+	}
+
+	return s.Value, s.Origin
+}
+
+// isConfigured reports whether a config file sets the setting
+func isConfigured(name string) bool {
+	setting, ok := configSettings[name]
+	return ok && setting.Origin != "default"
+}
+
+func getConfigSetting(key string) (*configSetting, error) {
+	setting, ok := configSettings[key]
+	if !ok {
+		message := fmt.Sprintf("Unknown setting %q, run `timber config list` to list all settings", key)
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return nil, cli.NewExitError(message, 65)
+	}
+	return setting, nil
+}
+
+//
+// Commands
+//
+
+// configOutput is how a setting is listed
+type configOutput struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Origin string `json:"origin,omitempty"`
+}
+
+var configColumns = []column{
+	{"Name", func(i interface{}) string { return i.(*configOutput).Name }},
+	{"Value", func(i interface{}) string { return i.(*configOutput).Value }},
+}
+
+var configOriginColumn = column{"Origin", func(i interface{}) string { return i.(*configOutput).Origin }}
+
+func newConfigOutput(ctx *cli.Context, setting *configSetting, showOrigin bool) *configOutput {
+	value, origin := setting.resolve(ctx)
+	if setting.Name == "api-key" && value != "" {
+		value = maskAPIKey(value)
+	}
+
+	output := &configOutput{Name: setting.Name, Value: value}
+	if showOrigin {
+		output.Origin = origin
+	}
+	return output
+}
+
+func listConfig(ctx *cli.Context, showOrigin bool) error {
+	outputs := make([]*configOutput, len(configSettingNames))
+	for i, name := range configSettingNames {
+		outputs[i] = newConfigOutput(ctx, configSettings[name], showOrigin)
+	}
+
+	columns := configColumns
+	if showOrigin {
+		columns = append(columns[:len(columns):len(columns)], configOriginColumn)
+	}
+
+	return printList(os.Stdout, outputs, columns)
+}
+
+func getConfig(ctx *cli.Context, key string, showOrigin bool) error {
+	setting, err := getConfigSetting(key)
+	if err != nil {
+		return err
+	}
+
+	output := newConfigOutput(ctx, setting, showOrigin)
+	if showOrigin {
+		fmt.Printf("%s\t%s\n", output.Origin, output.Value)
+	} else {
+		fmt.Println(output.Value)
+	}
+	return nil
+}
+
+// Flags picking the file changed by config set and unset
+var configFileFlags = []cli.Flag{
+	cli.BoolFlag{
+		Name:  "system",
+		Usage: "Change " + systemConfigPath,
+	},
+	cli.BoolFlag{
+		Name:  "local",
+		Usage: "Change the " + projectConfigFileName + " of the current project",
+	},
+}
+
+// configTarget returns the file and table that set and unset change. With an
+// explicit --profile they change the profile in the user's config file.
+func configTarget(ctx *cli.Context) (*configFile, []string, error) {
+	if ctx.GlobalIsSet("profile") {
+		if ctx.Bool("system") || ctx.Bool("local") {
+			message := "Profiles can only be changed in " + userConfig.path
+			// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+			return nil, nil, cli.NewExitError(message, 65)
+		}
+		return userConfig, []string{"profiles", ctx.GlobalString("profile")}, nil
+	}
+
+	if ctx.Bool("system") {
+		return systemConfig, nil, nil
+	}
+
+	if ctx.Bool("local") {
+		if projectConfig != nil {
+			return projectConfig, nil, nil
+		}
+
+		dir, err := os.Getwd()
+		if err != nil {
+			return nil, nil, err
+		}
+		return &configFile{path: filepath.Join(dir, projectConfigFileName), values: map[string]interface{}{}}, nil, nil
+	}
+
+	return userConfig, nil, nil
+}
+
+func setConfig(ctx *cli.Context, key string, value string) error {
+	setting, err := getConfigSetting(key)
+	if err != nil {
+		return err
+	}
+
+	file, table, err := configTarget(ctx)
+	if err != nil {
+		return err
+	}
+
+	if table != nil && !isProfileSetting(key) {
+		message := fmt.Sprintf("%s can't be set in profiles, they can set %s", key, strings.Join(profileSettings, ", "))
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return cli.NewExitError(message, 65)
+	}
+
+	if ctx.Bool("local") && isProjectRestricted(key) {
+		message := fmt.Sprintf("%s can't be set in %s files", key, projectConfigFileName)
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return cli.NewExitError(message, 65)
+	}
+
+	typed, err := setting.parse(value)
+	if err != nil {
+		message := fmt.Sprintf("Invalid value for %s: %s", key, err)
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return cli.NewExitError(message, 65)
+	}
+
+	values, err := tomlTable(file.values, table)
+	if err != nil {
+		return err
+	}
+	values[key] = typed
+
+	return file.Save()
+}
+
+func unsetConfig(ctx *cli.Context, key string) error {
+	file, table, err := configTarget(ctx)
+	if err != nil {
+		return err
+	}
+
+	values := file.Table(table...)
+	if _, ok := values[key]; !ok {
+		message := fmt.Sprintf("%s is not set in %s", key, file.path)
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return cli.NewExitError(message, 65)
+	}
+
+	delete(values, key)
+	return file.Save()
+}
+
+// parse converts a value given on the command line to the type stored in
+// config files
+func (s *configSetting) parse(value string) (interface{}, error) {
+	switch s.flag.(type) {
+	case cli.IntFlag:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", value)
+		}
+		return i, nil
+	case cli.BoolFlag, cli.BoolTFlag:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%q must be true or false", value)
+		}
+		return b, nil
+	case cli.DurationFlag:
+		if _, err := time.ParseDuration(value); err != nil {
+			return nil, fmt.Errorf("%q is not a duration, such as 30s or 5m", value)
+		}
+	case cli.StringSliceFlag:
+		values := []interface{}{}
+		for _, element := range strings.Split(value, ",") {
+			values = append(values, strings.TrimSpace(element))
+		}
+		return values, nil
+	}
+
+	return value, nil
+}
+
+//
+// Files
+//
+
+// loadConfigFile reads a config file, a missing file is treated as empty
+func loadConfigFile(filename string) (*configFile, error) {
+	config := &configFile{path: filename, values: map[string]interface{}{}}
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	config.values, err = parseTOML(data)
+	if err != nil {
+		message := fmt.Sprintf("Could not parse %s: %s", filename, err)
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return nil, cli.NewExitError(message, 65)
+	}
+
+	return config, nil
+}
+
+// Save writes the config file back. Comments and formatting are not kept.
+func (c *configFile) Save() error {
+	var buf bytes.Buffer
+	err := encodeTOML(&buf, c.values)
+	if err != nil {
+		return err
+	}
+
+	// Profiles can hold API keys
+	return writeFileAtomic(c.path, buf.Bytes(), 0600)
+}
+
+// Table returns the table at the path keys, or nil if there isn't one
+func (c *configFile) Table(keys ...string) map[string]interface{} {
+	table := c.values
+	for _, key := range keys {
+		child, ok := table[key].(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		table = child
+	}
+	return table
+}
+
+// mergedConfig returns the settings of every config file merged together,
+// later files overriding earlier ones
+func mergedConfig() *configFile {
+	merged := &configFile{values: map[string]interface{}{}}
+	for _, file := range configFiles {
+		mergeConfigValues(merged.values, file.Settings())
+	}
+	return merged
+}
+
+// Settings returns the values of the file that are in effect
+func (c *configFile) Settings() map[string]interface{} {
+	if !c.restricted {
+		return c.values
+	}
+
+	values := map[string]interface{}{}
+	for key, value := range c.values {
+		if !isProjectRestricted(key) {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+func isProjectRestricted(name string) bool {
+	for _, restricted := range projectRestrictedSettings {
+		if restricted == name {
+			return true
+		}
+	}
+	return false
+}
+
+func mergeConfigValues(dst map[string]interface{}, src map[string]interface{}) {
+	for key, value := range src {
+		srcTable, srcIsTable := value.(map[string]interface{})
+		dstTable, dstIsTable := dst[key].(map[string]interface{})
+
+		if srcIsTable && dstIsTable {
+			mergeConfigValues(dstTable, srcTable)
+		} else if srcIsTable {
+			copied := map[string]interface{}{}
+			mergeConfigValues(copied, srcTable)
+			dst[key] = copied
+		} else {
+			dst[key] = value
+		}
+	}
+}
+
+func configValueString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []interface{}:
+		values := make([]string, len(v))
+		for i, element := range v {
+			values[i] = configValueString(element)
+		}
+		return strings.Join(values, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// configString returns a string setting, numbers and booleans are formatted
+func configString(values map[string]interface{}, key string) (string, bool) {
+	value, ok := values[key]
+	if !ok {
+		return "", false
+	}
+	if _, isTable := value.(map[string]interface{}); isTable {
+		return "", false
+	}
+	return configValueString(value), true
+}
+
+// configStrings returns a list setting, a single string is treated as a list
+// of one
+func configStrings(values map[string]interface{}, key string) ([]string, bool) {
+	switch value := values[key].(type) {
+	case nil, map[string]interface{}:
+		return nil, false
+	case []interface{}:
+		strings := make([]string, len(value))
+		for i, element := range value {
+			strings[i] = configValueString(element)
+		}
+		return strings, true
+	default:
+		return []string{configValueString(value)}, true
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/timberio/cli/api"
+)
+
+// contextOptions are the -A, -B and -C flags of tail and search
+type contextOptions struct {
+	Before      int
+	After       int
+	SameRequest bool // only lines with the context.http.request_id of the match
+}
+
+func (o *contextOptions) enabled() bool {
+	return o != nil && (o.Before > 0 || o.After > 0)
+}
+
+// Number of matches whose context lines are searched at once
+var contextConcurrency = 4
+
+// Number of printed log lines remembered so that context lines aren't
+// printed twice
+var contextTrackerCapacity = 1000
+
+// In a live tail the lines after a match usually aren't searchable yet when
+// it arrives. Matches are held for up to tailAfterContextWait while the lines
+// after them are searched again every tailAfterContextInterval.
+var (
+	tailAfterContextWait     = 3 * time.Second
+	tailAfterContextInterval = 500 * time.Millisecond
+)
+
+// logLineContext is the lines around a matched log line, oldest first
+type logLineContext struct {
+	before    []*api.LogLine
+	after     []*api.LogLine
+	separator bool // the lines don't follow the previously printed ones
+}
+
+// fetchContexts searches the lines around each of matches, by ID. Lines
+// without a source are searched for in sourceIds.
+func fetchContexts(ctx context.Context, options *contextOptions, sourceIds []string, matches []*api.LogLine) (map[string]*logLineContext, error) {
+	contexts := make([]*logLineContext, len(matches))
+	errs := make([]error, len(matches))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, contextConcurrency)
+	for i, line := range matches {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, line *api.LogLine) {
+			defer wg.Done()
+			contexts[i], errs[i] = fetchContext(ctx, options, sourceIds, line)
+			<-sem
+		}(i, line)
+	}
+	wg.Wait()
+
+	byID := make(map[string]*logLineContext, len(matches))
+	for i, line := range matches {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("Could not fetch the lines around a matched log line: %s", errs[i])
+		}
+		byID[line.ID] = contexts[i]
+	}
+
+	return byID, nil
+}
+
+func fetchContext(ctx context.Context, options *contextOptions, sourceIds []string, line *api.LogLine) (*logLineContext, error) {
+	c := &logLineContext{}
+
+	query, ok := contextQuery(options, line)
+	if !ok {
+		return c, nil
+	}
+
+	sourceIds = contextSourceIds(sourceIds, line)
+
+	if options.Before > 0 {
+		searchRequest := api.NewSearchRequest()
+		searchRequest.ApplicationIds = sourceIds
+		searchRequest.Query = query
+		searchRequest.DtLte = &line.Datetime
+		searchRequest.Sort = "dt.desc"
+		// The line itself is at the same time
+		searchRequest.Limit = options.Before + 1
+
+		logLines, err := client.SearchContext(ctx, searchRequest)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, logLine := range logLines {
+			if logLine.ID != line.ID && len(c.before) < options.Before {
+				c.before = append(c.before, logLine)
+			}
+		}
+		c.before = reversedLogLines(c.before)
+	}
+
+	if options.After > 0 {
+		after, err := fetchAfterContext(ctx, options, sourceIds, query, line)
+		if err != nil {
+			return nil, err
+		}
+		c.after = after
+	}
+
+	return c, nil
+}
+
+// contextQuery is the query context lines are searched with, ok is false
+// when --same-request is given and the line has no request ID
+func contextQuery(options *contextOptions, line *api.LogLine) (string, bool) {
+	if !options.SameRequest {
+		return "", true
+	}
+
+	requestID := findField([]string{"context", "http", "request_id"}, line.Fields)
+	if requestID == "" {
+		return "", false
+	}
+	return fmt.Sprintf("context.http.request_id:%q", requestID), true
+}
+
+// contextSourceIds is where the context lines of line are searched, lines
+// without a source are searched for in sourceIds
+func contextSourceIds(sourceIds []string, line *api.LogLine) []string {
+	if line.ApplicationID != "" {
+		return []string{line.ApplicationID}
+	}
+	return sourceIds
+}
+
+func fetchAfterContext(ctx context.Context, options *contextOptions, sourceIds []string, query string, line *api.LogLine) ([]*api.LogLine, error) {
+	searchRequest := api.NewSearchRequest()
+	searchRequest.ApplicationIds = sourceIds
+	searchRequest.Query = query
+	searchRequest.DtGt = &line.Datetime
+	searchRequest.Sort = "dt.asc"
+	searchRequest.Limit = options.After
+
+	logLines, err := client.SearchContext(ctx, searchRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	after := []*api.LogLine{}
+	for _, logLine := range logLines {
+		if logLine.ID != line.ID && len(after) < options.After {
+			after = append(after, logLine)
+		}
+	}
+	return after, nil
+}
+
+// awaitAfterContexts searches the lines after the matches of a live tail
+// again until each has options.After of them or tailAfterContextWait passes
+func awaitAfterContexts(ctx context.Context, options *contextOptions, sourceIds []string, matches []*api.LogLine, contexts map[string]*logLineContext) error {
+	deadline := time.After(tailAfterContextWait)
+
+	for {
+		pending := []*api.LogLine{}
+		for _, line := range matches {
+			if _, ok := contextQuery(options, line); ok && len(contexts[line.ID].after) < options.After {
+				pending = append(pending, line)
+			}
+		}
+
+		if len(pending) == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline:
+			return nil
+		case <-time.After(tailAfterContextInterval):
+		}
+
+		afters := make([][]*api.LogLine, len(pending))
+		errs := make([]error, len(pending))
+
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, contextConcurrency)
+		for i, line := range pending {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int, line *api.LogLine) {
+				defer wg.Done()
+				query, _ := contextQuery(options, line)
+				afters[i], errs[i] = fetchAfterContext(ctx, options, contextSourceIds(sourceIds, line), query, line)
+				<-sem
+			}(i, line)
+		}
+		wg.Wait()
+
+		for i, line := range pending {
+			if errs[i] != nil {
+				return fmt.Errorf("Could not fetch the lines after a matched log line: %s", errs[i])
+			}
+			contexts[line.ID].after = afters[i]
+		}
+	}
+}
+
+// contextTracker remembers the printed log lines so that overlapping
+// contexts are printed once, and decides where separators go
+type contextTracker struct {
+	seen    *api.IDWindow
+	printed bool
+}
+
+func newContextTracker() *contextTracker {
+	return &contextTracker{seen: api.NewIDWindow(contextTrackerCapacity)}
+}
+
+// trim is called with each match in the order they are printed. Its context
+// stops at lines already printed and at other matches, which are printed as
+// matches.
+func (t *contextTracker) trim(line *api.LogLine, c *logLineContext, matches map[string]*logLineContext) {
+	contiguous := t.seen.Has(line.ID)
+
+	for i := len(c.before) - 1; i >= 0; i-- {
+		id := c.before[i].ID
+		if t.seen.Has(id) || matches[id] != nil {
+			contiguous = contiguous || t.seen.Has(id)
+			c.before = c.before[i+1:]
+			break
+		}
+	}
+
+	for i, logLine := range c.after {
+		if t.seen.Has(logLine.ID) || matches[logLine.ID] != nil {
+			contiguous = contiguous || t.seen.Has(logLine.ID)
+			c.after = c.after[:i]
+			break
+		}
+	}
+
+	c.separator = t.printed && !contiguous
+	t.printed = true
+
+	for _, logLine := range c.before {
+		t.seen.Add(logLine.ID)
+	}
+	t.seen.Add(line.ID)
+	for _, logLine := range c.after {
+		t.seen.Add(logLine.ID)
+	}
+}
+
+// printWithContext prints a formatted match between its context lines,
+// dimmed. Like grep, -- separates lines that don't follow each other.
+// Newest first output prints the lines after the match first.
+func printWithContext(w io.Writer, formatter *logLineFormatter, formatted string, c *logLineContext, newestFirst bool) error {
+	if c.separator {
+		if _, err := fmt.Fprintln(w, formatter.dim("--")); err != nil {
+			return err
+		}
+	}
+
+	above, below := c.before, c.after
+	if newestFirst {
+		above, below = reversedLogLines(c.after), reversedLogLines(c.before)
+	}
+
+	err := printContextLines(w, formatter, above)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintln(w, formatted); err != nil {
+		return err
+	}
+
+	return printContextLines(w, formatter, below)
+}
+
+func printContextLines(w io.Writer, formatter *logLineFormatter, logLines []*api.LogLine) error {
+	for _, line := range logLines {
+		formatted, err := formatter.Format(line)
+		if err != nil {
+			return err
+		}
+
+		if _, err := fmt.Fprintln(w, formatter.dim(formatted)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func reversedLogLines(logLines []*api.LogLine) []*api.LogLine {
+	reversed := make([]*api.LogLine, len(logLines))
+	for i, line := range logLines {
+		reversed[len(logLines)-1-i] = line
+	}
+	return reversed
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/timberio/cli/api"
+)
+
+func TestAwaitAfterContextsSearchesUntilLinesAreLogged(t *testing.T) {
+	savedClient := client
+	savedWait, savedInterval := tailAfterContextWait, tailAfterContextInterval
+	tailAfterContextWait, tailAfterContextInterval = 5*time.Second, 10*time.Millisecond
+	defer func() {
+		client = savedClient
+		tailAfterContextWait, tailAfterContextInterval = savedWait, savedInterval
+	}()
+
+	// The lines after the match are only searchable from the third search
+	var mu sync.Mutex
+	searches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		searches++
+		logged := searches >= 3
+		mu.Unlock()
+
+		data := []map[string]string{}
+		if logged {
+			data = append(data,
+				map[string]string{"id": "2", "dt": "2019-03-20T15:04:06Z", "message": "after 1"},
+				map[string]string{"id": "3", "dt": "2019-03-20T15:04:07Z", "message": "after 2"},
+			)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+	defer server.Close()
+	client = api.NewClient(server.URL, "test-key")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	options := &contextOptions{After: 2}
+	match := &api.LogLine{ID: "1", Datetime: time.Date(2019, 3, 20, 15, 4, 5, 0, time.UTC)}
+
+	contexts, err := fetchContexts(ctx, options, []string{"1234"}, []*api.LogLine{match})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contexts["1"].after) != 0 {
+		t.Fatalf("expected no lines after the match yet, got %d", len(contexts["1"].after))
+	}
+
+	err = awaitAfterContexts(ctx, options, []string{"1234"}, []*api.LogLine{match}, contexts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after := contexts["1"].after
+	if len(after) != 2 || after[0].ID != "2" || after[1].ID != "3" {
+		t.Fatalf("expected the lines after the match, got %+v", after)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if searches != 3 {
+		t.Fatalf("expected to stop searching once the lines were found, got %d searches", searches)
+	}
+}
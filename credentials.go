@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/crypto/ssh/terminal"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// Credential store backends, selected with --credential-store
+const (
+	credentialStoreFile      = "file"
+	credentialStoreEncrypted = "encrypted"
+)
+
+var encryptedCredentialsFileName = "credentials.enc"
+
+// credentialStore persists the credentials of every organization the user has
+// authenticated with
+type credentialStore interface {
+	Load() ([]*Credential, error)
+	Save(credentials []*Credential) error
+	Name() string
+}
+
+// credentialStorage is the store in use, set by setCredentialStore
+var credentialStorage credentialStore
+
+func setCredentialStore(ctx *cli.Context) error {
+	timberDir, err := getTimberDirPath()
+	if err != nil {
+		return err
+	}
+
+	plaintextPath := path.Join(timberDir, credentialsFileName)
+
+	if helper := ctx.GlobalString("credential-helper"); helper != "" {
+		credentialStorage = &helperCredentialStore{command: helper}
+	} else {
+		switch ctx.GlobalString("credential-store") {
+		case credentialStoreFile, "":
+			credentialStorage = &fileCredentialStore{path: plaintextPath}
+		case credentialStoreEncrypted:
+			credentialStorage = &encryptedCredentialStore{
+				path:    path.Join(timberDir, encryptedCredentialsFileName),
+				keyFile: ctx.GlobalString("credentials-key-file"),
+			}
+		default:
+			message := fmt.Sprintf("Unknown credential store %q, must be %s or %s", ctx.GlobalString("credential-store"), credentialStoreFile, credentialStoreEncrypted)
+			// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+			return cli.NewExitError(message, 65)
+		}
+	}
+
+	if _, ok := credentialStorage.(*fileCredentialStore); !ok {
+		if _, err := os.Stat(plaintextPath); err == nil {
+			fmt.Fprintf(os.Stderr, "Plaintext credentials were found in %s, run `timber auth migrate` to move them to the %s\n", plaintextPath, credentialStorage.Name())
+		}
+	}
+
+	return nil
+}
+
+// migrateCredentials moves the credentials of the plaintext file into the
+// configured store, then removes the plaintext file
+func migrateCredentials() error {
+	if _, ok := credentialStorage.(*fileCredentialStore); ok {
+		message := "Credentials are already stored in a plaintext file, choose where to move them " +
+			"with `--credential-store encrypted` or `--credential-helper [helper]`"
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return cli.NewExitError(message, 65)
+	}
+
+	timberDir, err := getTimberDirPath()
+	if err != nil {
+		return err
+	}
+
+	plaintext := &fileCredentialStore{path: path.Join(timberDir, credentialsFileName)}
+	migrated, err := plaintext.Load()
+	if err != nil {
+		return err
+	}
+
+	if len(migrated) == 0 {
+		fmt.Fprintln(os.Stderr, "There are no plaintext credentials to migrate")
+		return nil
+	}
+
+	credentials, err := credentialStorage.Load()
+	if err != nil {
+		return err
+	}
+
+	// Credentials already in the store are kept over the plaintext ones
+	moved, skipped := 0, 0
+	for _, credential := range migrated {
+		found := false
+		for _, existing := range credentials {
+			if existing.Matches(credential.OrganizationID, credential.Host) {
+				found = true
+			}
+		}
+
+		if found {
+			skipped++
+			continue
+		}
+
+		credential.Active = credential.Active && getActive(credentials) == nil
+		credentials = append(credentials, credential)
+		moved++
+	}
+
+	err = credentialStorage.Save(credentials)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(plaintext.path)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(successWriter, "Moved %d credentials to the %s and removed %s\n", moved, credentialStorage.Name(), plaintext.path)
+	if skipped > 0 {
+		fmt.Fprintf(os.Stderr, "Dropped %d plaintext credentials for organizations already in the %s\n", skipped, credentialStorage.Name())
+	}
+	return nil
+}
+
+func getActive(credentials []*Credential) *Credential {
+	for _, credential := range credentials {
+		if credential.Active {
+			return credential
+		}
+	}
+	return nil
+}
+
+//
+// Plaintext file
+//
+
+// fileCredentialStore keeps credentials as JSON in a file only readable by
+// the user
+type fileCredentialStore struct {
+	path string
+}
+
+func (s *fileCredentialStore) Name() string {
+	return "credentials file"
+}
+
+func (s *fileCredentialStore) Load() ([]*Credential, error) {
+	var credentials []*Credential
+
+	credentialsJson, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return credentials, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Files written by older versions were readable by everyone
+	if info, err := os.Stat(s.path); err == nil && info.Mode().Perm()&0077 != 0 && runtime.GOOS != "windows" {
+		os.Chmod(s.path, 0600)
+	}
+
+	err = json.Unmarshal(credentialsJson, &credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	return credentials, nil
+}
+
+func (s *fileCredentialStore) Save(credentials []*Credential) error {
+	json, err := json.MarshalIndent(credentials, "", "	")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.path, json, 0600)
+}
+
+//
+// Encrypted file
+//
+
+// encryptedCredentialStore keeps credentials in a file sealed with NaCl's
+// secretbox. The key is either read from a key file or derived from a
+// passphrase with scrypt.
+type encryptedCredentialStore struct {
+	path    string
+	keyFile string
+
+	passphrase []byte
+}
+
+// encryptedCredentials is the format of the encrypted credentials file
+type encryptedCredentials struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"` // "scrypt", or "none" when a key file is used
+	Salt       []byte `json:"salt,omitempty"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// scrypt parameters recommended for interactive logins
+const (
+	scryptN      = 32768
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+)
+
+func (s *encryptedCredentialStore) Name() string {
+	return "encrypted credentials file"
+}
+
+func (s *encryptedCredentialStore) Load() ([]*Credential, error) {
+	var credentials []*Credential
+
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return credentials, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	file := &encryptedCredentials{}
+	err = json.Unmarshal(b, file)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read %s: %v", s.path, err)
+	}
+
+	if file.Version != 1 || len(file.Nonce) != 24 {
+		return nil, fmt.Errorf("Could not read %s, it was written by a newer version of the CLI", s.path)
+	}
+
+	key, err := s.key(file.KDF, file.Salt, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], file.Nonce)
+
+	plaintext, ok := secretbox.Open(nil, file.Ciphertext, &nonce, key)
+	if !ok {
+		s.passphrase = nil
+		return nil, errors.New("Could not decrypt the credentials, the passphrase or key is incorrect")
+	}
+
+	err = json.Unmarshal(plaintext, &credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	return credentials, nil
+}
+
+func (s *encryptedCredentialStore) Save(credentials []*Credential) error {
+	plaintext, err := json.Marshal(credentials)
+	if err != nil {
+		return err
+	}
+
+	file := &encryptedCredentials{Version: 1, KDF: "none", Nonce: make([]byte, 24)}
+
+	if s.keyFile == "" {
+		file.KDF = "scrypt"
+		file.Salt = make([]byte, 16)
+		if _, err := io.ReadFull(rand.Reader, file.Salt); err != nil {
+			return err
+		}
+	}
+
+	if _, err := io.ReadFull(rand.Reader, file.Nonce); err != nil {
+		return err
+	}
+
+	_, statErr := os.Stat(s.path)
+	key, err := s.key(file.KDF, file.Salt, os.IsNotExist(statErr))
+	if err != nil {
+		return err
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], file.Nonce)
+	file.Ciphertext = secretbox.Seal(nil, plaintext, &nonce, key)
+
+	b, err := json.MarshalIndent(file, "", "	")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.path, b, 0600)
+}
+
+// key returns the encryption key, confirm asks for the passphrase twice when
+// it is being set for the first time
+func (s *encryptedCredentialStore) key(kdf string, salt []byte, confirm bool) (*[32]byte, error) {
+	var key [32]byte
+
+	if kdf == "none" {
+		if s.keyFile == "" {
+			return nil, fmt.Errorf("%s is encrypted with a key file, set it with --credentials-key-file", s.path)
+		}
+
+		b, err := ioutil.ReadFile(s.keyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil || len(decoded) != 32 {
+			return nil, fmt.Errorf("%s must contain a base64 encoded 32 byte key, e.g. from `head -c 32 /dev/urandom | base64`", s.keyFile)
+		}
+
+		copy(key[:], decoded)
+		return &key, nil
+	}
+
+	passphrase, err := s.getPassphrase(confirm)
+	if err != nil {
+		return nil, err
+	}
+
+	derived, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return nil, err
+	}
+
+	copy(key[:], derived)
+	return &key, nil
+}
+
+// getPassphrase reads the passphrase from TIMBER_CREDENTIALS_PASSPHRASE or
+// asks for it, it is only asked once per run
+func (s *encryptedCredentialStore) getPassphrase(confirm bool) ([]byte, error) {
+	if s.passphrase != nil {
+		return s.passphrase, nil
+	}
+
+	if passphrase := os.Getenv("TIMBER_CREDENTIALS_PASSPHRASE"); passphrase != "" {
+		s.passphrase = []byte(passphrase)
+		return s.passphrase, nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return nil, errors.New("The credentials are encrypted, set TIMBER_CREDENTIALS_PASSPHRASE to decrypt them")
+	}
+
+	fmt.Fprint(os.Stderr, "Credentials passphrase: ")
+	passphrase, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(passphrase) == 0 {
+		return nil, errors.New("The passphrase cannot be blank")
+	}
+
+	if confirm {
+		fmt.Fprint(os.Stderr, "Confirm passphrase: ")
+		confirmation, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+
+		if !bytes.Equal(passphrase, confirmation) {
+			return nil, errors.New("The passphrases do not match")
+		}
+	}
+
+	s.passphrase = passphrase
+	return s.passphrase, nil
+}
+
+//
+// Credential helper
+//
+
+// helperCredentialStore delegates to an external program, in the spirit of
+// git's credential helpers. The helper is called with "get", printing the
+// credentials as JSON, or "store", reading them as JSON from stdin.
+//
+// A helper name such as "pass" runs `timber-credential-pass`, a path such as
+// "./my-helper" runs that program, and a value starting with "!" runs as a
+// shell command.
+type helperCredentialStore struct {
+	command string
+}
+
+func (s *helperCredentialStore) Name() string {
+	return fmt.Sprintf("credential helper %q", s.command)
+}
+
+func (s *helperCredentialStore) Load() ([]*Credential, error) {
+	var credentials []*Credential
+
+	out, err := s.run("get", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(bytes.TrimSpace(out)) == 0 {
+		return credentials, nil
+	}
+
+	err = json.Unmarshal(out, &credentials)
+	if err != nil {
+		return nil, fmt.Errorf("The %s returned invalid credentials: %v", s.Name(), err)
+	}
+
+	return credentials, nil
+}
+
+func (s *helperCredentialStore) Save(credentials []*Credential) error {
+	in, err := json.Marshal(credentials)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.run("store", in)
+	return err
+}
+
+func (s *helperCredentialStore) run(operation string, in []byte) ([]byte, error) {
+	var cmd *exec.Cmd
+
+	if strings.HasPrefix(s.command, "!") {
+		cmd = exec.Command("sh", "-c", strings.TrimPrefix(s.command, "!")+" "+operation)
+	} else {
+		args := strings.Fields(s.command)
+		if len(args) == 0 {
+			message := "The credential helper is empty, set it with `--credential-helper [helper]`"
+			// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+			return nil, cli.NewExitError(message, 65)
+		}
+
+		// Anything with a path separator is a path, relative or not
+		name := args[0]
+		if !strings.ContainsAny(name, "/"+string(filepath.Separator)) {
+			name = "timber-credential-" + name
+		}
+		cmd = exec.Command(name, append(args[1:], operation)...)
+	}
+
+	var stdout bytes.Buffer
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("The %s failed to %s credentials: %v", s.Name(), operation, err)
+	}
+
+	return stdout.Bytes(), nil
+}
+
+//
+// Util
+//
+
+// writeFileAtomic writes a file by renaming a temporary file over it, so that
+// the file is never left half written
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(filename)
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := f.Chmod(perm); err != nil && runtime.GOOS != "windows" {
+		f.Close()
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), filename)
+}
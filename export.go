@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/timberio/cli/api"
+	"github.com/tj/go-spin"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// Name of the manifest of an export, in the export directory
+const exportManifestName = "manifest.json"
+
+// Version of the manifest, incremented when its format changes
+const exportManifestVersion = 1
+
+const defaultExportSlice = time.Hour
+
+type exportOptions struct {
+	Dir       string
+	SourceIds []string // every source when empty
+	Query     string
+	Since     *time.Time
+	Until     *time.Time
+	Slice     time.Duration // defaultExportSlice when 0
+	Workers   int
+}
+
+// exportManifest describes an export and records which slices are done, it
+// is saved after every slice so that an interrupted export can be resumed
+type exportManifest struct {
+	Version     int            `json:"version"`
+	SourceIds   []string       `json:"source_ids"`
+	Query       string         `json:"query"`
+	Since       time.Time      `json:"since"`
+	Until       time.Time      `json:"until"`
+	Slice       string         `json:"slice"`
+	Chunks      []*exportChunk `json:"chunks"`
+	CompletedAt *time.Time     `json:"completed_at,omitempty"`
+}
+
+// exportChunk is a slice of the time range and the file its log lines were
+// written to. Slices without log lines have no file.
+type exportChunk struct {
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	Done   bool      `json:"done"`
+	File   string    `json:"file,omitempty"`
+	Lines  int       `json:"lines"`
+	Bytes  int64     `json:"bytes"`
+	SHA256 string    `json:"sha256,omitempty"`
+
+	// Timestamps shared by a page of log lines or more, some of the lines
+	// at them may be missing from the file
+	SkippedAt []time.Time `json:"skipped_at,omitempty"`
+}
+
+type exportResult struct {
+	index int
+	chunk *exportChunk
+	err   error
+}
+
+// export writes the log lines of a time range to gzip compressed NDJSON
+// files, one per slice, searching several slices at once. Running it again
+// with the same directory resumes an interrupted export, slices that were
+// being written when it stopped are exported again.
+func export(options *exportOptions) error {
+	manifestPath := filepath.Join(options.Dir, exportManifestName)
+
+	manifest, err := loadExportManifest(manifestPath)
+	if err != nil {
+		return err
+	}
+
+	if manifest == nil {
+		manifest, err = newExportManifest(options)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = checkExportResume(options, manifest, manifestPath)
+		if err != nil {
+			return err
+		}
+
+		if manifest.CompletedAt != nil {
+			fmt.Fprintf(infoWriter, "The export in %s is already complete\n", options.Dir)
+			return nil
+		}
+
+		checkExportFiles(options.Dir, manifest)
+		fmt.Fprintf(infoWriter, "Resuming the export of %s to %s from %s, %d of %d slices are done\n",
+			manifest.Since.Format(time.RFC3339), manifest.Until.Format(time.RFC3339), manifestPath,
+			exportDoneCount(manifest), len(manifest.Chunks))
+	}
+
+	err = os.MkdirAll(options.Dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	err = saveExportManifest(manifestPath, manifest)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(rootContext)
+	defer cancel()
+
+	// Chunks are only replaced by this goroutine, as results come in
+	todo := []int{}
+	for i, chunk := range manifest.Chunks {
+		if !chunk.Done {
+			todo = append(todo, i)
+		}
+	}
+
+	pending := make(chan int)
+	results := make(chan exportResult)
+
+	go func() {
+		defer close(pending)
+		for _, i := range todo {
+			select {
+			case pending <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < options.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range pending {
+				chunk := manifest.Chunks[index]
+				exported, err := exportSlice(ctx, options.Dir, manifest, chunk.From, chunk.To)
+				results <- exportResult{index, exported, err}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var exportErr error
+	s := spin.New()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for results != nil {
+		select {
+		case r, ok := <-results:
+			if !ok {
+				results = nil
+				continue
+			}
+
+			if r.err != nil {
+				if exportErr == nil {
+					exportErr = r.err
+					cancel()
+				}
+				continue
+			}
+
+			manifest.Chunks[r.index] = r.chunk
+			err = saveExportManifest(manifestPath, manifest)
+			if err != nil && exportErr == nil {
+				exportErr = err
+				cancel()
+			}
+
+		case <-ticker.C:
+			// The progress goes to stderr so that it stays out of redirected output
+			fmt.Fprintf(os.Stderr, "\r%s \033[36mExported %d of %d slices, %d log lines\033[m",
+				s.Next(), exportDoneCount(manifest), len(manifest.Chunks), exportLineCount(manifest))
+		}
+	}
+	clearSpinner()
+
+	if rootContext.Err() != nil {
+		message := fmt.Sprintf("Interrupted, %d of %d slices were exported. Run `timber export --dir %s` to resume",
+			exportDoneCount(manifest), len(manifest.Chunks), options.Dir)
+		return cli.NewExitError(message, exitCodeInterrupted)
+	}
+
+	if exportErr != nil {
+		return fmt.Errorf("%s\n%d of %d slices were exported, run `timber export --dir %s` to resume",
+			exportErr, exportDoneCount(manifest), len(manifest.Chunks), options.Dir)
+	}
+
+	now := time.Now().UTC()
+	manifest.CompletedAt = &now
+	err = saveExportManifest(manifestPath, manifest)
+	if err != nil {
+		return err
+	}
+
+	files := 0
+	for _, chunk := range manifest.Chunks {
+		if chunk.File != "" {
+			files++
+		}
+	}
+
+	fmt.Fprintf(infoWriter, "Exported %d log lines in %d files to %s\n", exportLineCount(manifest), files, options.Dir)
+
+	skipped := []time.Time{}
+	for _, chunk := range manifest.Chunks {
+		skipped = append(skipped, chunk.SkippedAt...)
+	}
+	warnSkipped(skipped, time.UTC)
+
+	return nil
+}
+
+func newExportManifest(options *exportOptions) (*exportManifest, error) {
+	if options.Since == nil {
+		message := "You must supply --since to start an export, or a --dir with an unfinished export to resume it"
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return nil, cli.NewExitError(message, 65)
+	}
+
+	until := time.Now()
+	if options.Until != nil {
+		until = *options.Until
+	}
+
+	if !options.Since.Before(until) {
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return nil, cli.NewExitError("--since must be before --until", 65)
+	}
+
+	slice := options.Slice
+	if slice == 0 {
+		slice = defaultExportSlice
+	}
+
+	sourceIds := options.SourceIds
+	if len(sourceIds) == 0 {
+		sources, err := client.ListSourcesContext(rootContext)
+		if err != nil {
+			return nil, err
+		}
+		for _, source := range sources {
+			sourceIds = append(sourceIds, source.ID)
+		}
+	}
+
+	manifest := &exportManifest{
+		Version:   exportManifestVersion,
+		SourceIds: sourceIds,
+		Query:     options.Query,
+		Since:     options.Since.UTC(),
+		Until:     until.UTC(),
+		Slice:     slice.String(),
+	}
+
+	for from := manifest.Since; from.Before(manifest.Until); from = from.Add(slice) {
+		to := from.Add(slice)
+		if to.After(manifest.Until) {
+			to = manifest.Until
+		}
+		manifest.Chunks = append(manifest.Chunks, &exportChunk{From: from, To: to})
+	}
+
+	return manifest, nil
+}
+
+// checkExportResume rejects the flags given to resume an export that differ
+// from its manifest, they would otherwise be silently ignored
+func checkExportResume(options *exportOptions, manifest *exportManifest, manifestPath string) error {
+	conflicts := []string{}
+
+	if len(options.SourceIds) > 0 && !sameSourceIds(options.SourceIds, manifest.SourceIds) {
+		conflicts = append(conflicts, "--source-id")
+	}
+	if options.Query != "" && options.Query != manifest.Query {
+		conflicts = append(conflicts, "--query")
+	}
+	if options.Since != nil && !options.Since.Equal(manifest.Since) {
+		conflicts = append(conflicts, "--since")
+	}
+	if options.Until != nil && !options.Until.Equal(manifest.Until) {
+		conflicts = append(conflicts, "--until")
+	}
+	if options.Slice != 0 && options.Slice.String() != manifest.Slice {
+		conflicts = append(conflicts, "--slice")
+	}
+
+	if len(conflicts) == 0 {
+		return nil
+	}
+
+	message := fmt.Sprintf("The export in %s was started with a different %s\n", manifestPath, strings.Join(conflicts, ", ")) +
+		fmt.Sprintf("Run `timber export --dir %s` without them to resume it, or export to another --dir", options.Dir)
+	// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+	return cli.NewExitError(message, 65)
+}
+
+func sameSourceIds(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// loadExportManifest returns nil when there is no manifest yet
+func loadExportManifest(filename string) (*exportManifest, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	manifest := &exportManifest{}
+	err = json.Unmarshal(data, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the export manifest %s: %s", filename, err)
+	}
+
+	if manifest.Version != exportManifestVersion {
+		message := fmt.Sprintf("%s was written by another version of the CLI, use another --dir", filename)
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return nil, cli.NewExitError(message, 65)
+	}
+
+	return manifest, nil
+}
+
+func saveExportManifest(filename string, manifest *exportManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filename, append(data, '\n'), 0644)
+}
+
+// checkExportFiles marks the slices whose file is missing or has changed as
+// not done, so that they are exported again
+func checkExportFiles(dir string, manifest *exportManifest) {
+	for _, chunk := range manifest.Chunks {
+		if !chunk.Done || chunk.File == "" {
+			continue
+		}
+
+		info, err := os.Stat(filepath.Join(dir, chunk.File))
+		if err != nil || info.Size() != chunk.Bytes {
+			logger.Debugf("Exporting %s again, the file is missing or was changed", chunk.File)
+			chunk.Done = false
+		}
+	}
+}
+
+// exportSlice writes the log lines between from and to to a temporary file
+// that is renamed once complete
+func exportSlice(ctx context.Context, dir string, manifest *exportManifest, from time.Time, to time.Time) (*exportChunk, error) {
+	chunk := &exportChunk{From: from, To: to}
+	name := fmt.Sprintf("logs-%s.ndjson.gz", from.UTC().Format("20060102T150405Z"))
+	filename := filepath.Join(dir, name)
+
+	f, err := os.OpenFile(filename+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	hash := sha256.New()
+	compressed := gzip.NewWriter(io.MultiWriter(f, hash))
+	buffered := bufio.NewWriter(compressed)
+
+	searchRequest := api.NewSearchRequest()
+	searchRequest.ApplicationIds = manifest.SourceIds
+	searchRequest.Query = manifest.Query
+	searchRequest.DtGte = &from
+	searchRequest.DtLt = &to
+	searchRequest.Sort = "dt.asc"
+
+	pager := client.NewSearchPager(searchRequest)
+
+	for {
+		logLines, err := pager.NextContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(logLines) == 0 {
+			break
+		}
+
+		for _, line := range logLines {
+			// Fields is the log line as it was received
+			data, err := json.Marshal(line.Fields)
+			if err != nil {
+				return nil, err
+			}
+
+			buffered.Write(data)
+			err = buffered.WriteByte('\n')
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		chunk.Lines += len(logLines)
+	}
+
+	chunk.Done = true
+	chunk.SkippedAt = pager.Skipped()
+	if chunk.Lines == 0 {
+		return chunk, nil
+	}
+
+	if err := buffered.Flush(); err != nil {
+		return nil, err
+	}
+	if err := compressed.Close(); err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	err = os.Rename(f.Name(), filename)
+	if err != nil {
+		return nil, err
+	}
+
+	chunk.File = name
+	chunk.Bytes = info.Size()
+	chunk.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return chunk, nil
+}
+
+func exportDoneCount(manifest *exportManifest) int {
+	done := 0
+	for _, chunk := range manifest.Chunks {
+		if chunk.Done {
+			done++
+		}
+	}
+	return done
+}
+
+func exportLineCount(manifest *exportManifest) int {
+	lines := 0
+	for _, chunk := range manifest.Chunks {
+		lines += chunk.Lines
+	}
+	return lines
+}
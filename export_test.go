@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/urfave/cli.v1"
+)
+
+func TestCheckExportResume(t *testing.T) {
+	since := time.Date(2019, 3, 20, 0, 0, 0, 0, time.UTC)
+	until := since.Add(24 * time.Hour)
+	otherTime := since.Add(time.Hour)
+
+	manifest := &exportManifest{
+		SourceIds: []string{"1", "2"},
+		Query:     "level:error",
+		Since:     since,
+		Until:     until,
+		Slice:     time.Hour.String(),
+	}
+
+	tests := []struct {
+		name     string
+		options  exportOptions
+		conflict bool
+	}{
+		{"no flags", exportOptions{}, false},
+		{"same flags", exportOptions{SourceIds: []string{"2", "1"}, Query: "level:error", Since: &since, Until: &until, Slice: time.Hour}, false},
+		{"source id", exportOptions{SourceIds: []string{"1"}}, true},
+		{"query", exportOptions{Query: "level:warn"}, true},
+		{"since", exportOptions{Since: &otherTime}, true},
+		{"until", exportOptions{Until: &otherTime}, true},
+		{"slice", exportOptions{Slice: time.Minute}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.options.Dir = "export"
+			err := checkExportResume(&test.options, manifest, "export/manifest.json")
+
+			if !test.conflict {
+				if err != nil {
+					t.Fatalf("expected no conflict, got %v", err)
+				}
+				return
+			}
+
+			exitErr, ok := err.(cli.ExitCoder)
+			if !ok || exitErr.ExitCode() != 65 {
+				t.Fatalf("expected an exit error with code 65, got %v", err)
+			}
+		})
+	}
+}
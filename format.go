@@ -0,0 +1,737 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/aybabtme/rgbterm"
+	"github.com/timberio/cli/api"
+)
+
+// The log line format is a small template language shared by `--log-format`
+// and the log_line_format of saved views. Literal text is copied as is and
+// actions are wrapped in {{ }}:
+//
+//	{{ message }}                          a field, dotted paths reach into context
+//	{{ message | truncate 80 }}            values can be piped through filters
+//	{{ dt | time "15:04:05" }}             filters can take string or number arguments
+//	{{ context.http.status | default "-" }}
+//	{{ if context.user.email }}user={{ context.user.email }}{{ else }}anonymous{{ end }}
+//
+// The special formatting of date, level and context.system.hostname that the
+// console applies is kept as long as no filters are given for them.
+
+var dateColor = [3]uint8{85, 79, 201}
+
+// logLineFormatter renders log lines, either as JSON or through a parsed log
+// line format.
+type logLineFormatter struct {
+	format     *logFormat // nil when rendering JSON
+	loc        *time.Location
+	colorScale *OrdinalColorScale
+	colorize   bool
+	highlights []*regexp.Regexp // set with --highlight
+}
+
+func newLogLineFormatter(format string, loc *time.Location, colorize bool) (*logLineFormatter, error) {
+	formatter := &logLineFormatter{
+		loc:        loc,
+		colorScale: NewOrdinalColorScale(ordinalScale),
+		colorize:   colorize,
+	}
+
+	if format != "json" {
+		parsed, err := parseLogFormat(format)
+		if err != nil {
+			return nil, err
+		}
+		formatter.format = parsed
+	}
+
+	return formatter, nil
+}
+
+// withoutColors returns a copy of the formatter that renders plain text. It
+// has its own color scale, so it can be used from another goroutine.
+func (f *logLineFormatter) withoutColors() *logLineFormatter {
+	plain := *f
+	plain.colorize = false
+	plain.colorScale = NewOrdinalColorScale(ordinalScale)
+	return &plain
+}
+
+// Format renders a single log line without a trailing newline
+func (f *logLineFormatter) Format(line *api.LogLine) (string, error) {
+	if f.format == nil {
+		json, err := json.Marshal(line)
+		if err != nil {
+			return "", err
+		}
+		return f.highlight(string(json)), nil
+	}
+
+	var buf bytes.Buffer
+	if err := f.format.execute(&buf, f, line); err != nil {
+		return "", err
+	}
+	return f.highlight(buf.String()), nil
+}
+
+func (f *logLineFormatter) Print(w io.Writer, line *api.LogLine) error {
+	formatted, err := f.Format(line)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(w, formatted)
+	return err
+}
+
+//
+// Highlighting
+//
+
+var colorCodeRegexp = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// Highlights are shown in reverse video so that they keep the color of the
+// text they cover
+const (
+	highlightStart = "\x1b[7m"
+	highlightEnd   = "\x1b[27m"
+)
+
+// stripColors removes the color codes from a rendered log line
+func stripColors(s string) string {
+	return colorCodeRegexp.ReplaceAllString(s, "")
+}
+
+// highlight marks the matches of the --highlight patterns in a rendered log
+// line
+func (f *logLineFormatter) highlight(s string) string {
+	if !f.colorize {
+		return s
+	}
+	return highlightMatches(s, f.highlights)
+}
+
+// dim renders context lines fainter than matched log lines, without colors
+func (f *logLineFormatter) dim(s string) string {
+	if !f.colorize {
+		return s
+	}
+	return "\x1b[2m" + stripColors(s) + "\x1b[22m"
+}
+
+// highlightMatches marks the matches of patterns in a rendered line. Patterns
+// are matched against the text without its color codes, and the highlight is
+// restored after every color code inside a match.
+func highlightMatches(s string, patterns []*regexp.Regexp) string {
+	if len(patterns) == 0 {
+		return s
+	}
+
+	codes := colorCodeRegexp.FindAllStringIndex(s, -1)
+	plain := stripColors(s)
+
+	marked := make([]bool, len(plain))
+	found := false
+	for _, re := range patterns {
+		for _, match := range re.FindAllStringIndex(plain, -1) {
+			for i := match[0]; i < match[1]; i++ {
+				marked[i] = true
+				found = true
+			}
+		}
+	}
+
+	if !found {
+		return s
+	}
+
+	var buf bytes.Buffer
+	inside := false
+	i := 0 // index in plain
+
+	for pos := 0; pos < len(s); {
+		if len(codes) > 0 && codes[0][0] == pos {
+			buf.WriteString(s[pos:codes[0][1]])
+			if inside {
+				buf.WriteString(highlightStart)
+			}
+			pos = codes[0][1]
+			codes = codes[1:]
+			continue
+		}
+
+		if marked[i] != inside {
+			inside = marked[i]
+			if inside {
+				buf.WriteString(highlightStart)
+			} else {
+				buf.WriteString(highlightEnd)
+			}
+		}
+
+		buf.WriteByte(s[pos])
+		pos++
+		i++
+	}
+
+	if inside {
+		buf.WriteString(highlightEnd)
+	}
+
+	return buf.String()
+}
+
+//
+// Template
+//
+
+type logFormat struct {
+	nodes []formatNode
+}
+
+type formatNode interface {
+	render(buf *bytes.Buffer, f *logLineFormatter, line *api.LogLine) error
+}
+
+type textNode string
+
+func (n textNode) render(buf *bytes.Buffer, f *logLineFormatter, line *api.LogLine) error {
+	buf.WriteString(string(n))
+	return nil
+}
+
+type actionNode struct {
+	pipeline *pipeline
+}
+
+func (n *actionNode) render(buf *bytes.Buffer, f *logLineFormatter, line *api.LogLine) error {
+	value, err := n.pipeline.eval(f, line, true)
+	if err != nil {
+		return err
+	}
+
+	buf.WriteString(value)
+	return nil
+}
+
+type ifNode struct {
+	condition *pipeline
+	then      []formatNode
+	otherwise []formatNode
+}
+
+func (n *ifNode) render(buf *bytes.Buffer, f *logLineFormatter, line *api.LogLine) error {
+	value, err := n.condition.eval(f, line, false)
+	if err != nil {
+		return err
+	}
+
+	nodes := n.otherwise
+	if value != "" {
+		nodes = n.then
+	}
+
+	for _, node := range nodes {
+		if err := node.render(buf, f, line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *logFormat) execute(buf *bytes.Buffer, f *logLineFormatter, line *api.LogLine) error {
+	for _, node := range t.nodes {
+		if err := node.render(buf, f, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pipeline is either a field path or a string literal followed by any number
+// of filters
+type pipeline struct {
+	field   string
+	literal *string
+	filters []*filterCall
+}
+
+type filterCall struct {
+	name string
+	fn   formatFilter
+	args []string
+}
+
+func (p *pipeline) eval(f *logLineFormatter, line *api.LogLine, style bool) (string, error) {
+	if p.literal != nil {
+		value := *p.literal
+		for _, filter := range p.filters {
+			value = filter.fn(value, filter.args, f)
+		}
+		return value, nil
+	}
+
+	if len(p.filters) == 0 {
+		return f.defaultField(p.field, line, style), nil
+	}
+
+	value := f.rawField(p.field, line)
+	for _, filter := range p.filters {
+		value = filter.fn(value, filter.args, f)
+	}
+
+	if style {
+		value = f.colorField(p.field, value, line)
+	}
+
+	return value, nil
+}
+
+// rawField returns the unformatted value of a field, dt and date are
+// returned in RFC 3339 so that they can be parsed again by filters
+func (f *logLineFormatter) rawField(field string, line *api.LogLine) string {
+	switch field {
+	case "date", "dt":
+		return line.Datetime.In(f.loc).Format(time.RFC3339Nano)
+	case "level":
+		return line.Level
+	case "message":
+		return line.Message
+	default:
+		return findField(strings.Split(field, "."), line.Fields)
+	}
+}
+
+// defaultField returns a field formatted the way the console displays it
+func (f *logLineFormatter) defaultField(field string, line *api.LogLine, style bool) string {
+	value := ""
+	switch field {
+	case "date":
+		value = line.Datetime.In(f.loc).Format("Jan 02 03:04:05.000pm")
+	case "context.system.hostname":
+		value = fmt.Sprintf("%-20s", f.rawField(field, line))
+	case "level":
+		value = fmt.Sprintf("%-4s", Level(line.Level).ShortName())
+	default:
+		return f.rawField(field, line)
+	}
+
+	if !style {
+		return value
+	}
+
+	return f.colorField(field, value, line)
+}
+
+func (f *logLineFormatter) colorField(field string, value string, line *api.LogLine) string {
+	if !f.colorize || value == "" {
+		return value
+	}
+
+	switch field {
+	case "date", "dt":
+		return rgbterm.FgString(value, dateColor[0], dateColor[1], dateColor[2])
+	case "context.system.hostname":
+		hostnameColor := f.colorScale.Get(value)
+		return rgbterm.FgString(value, hostnameColor[0], hostnameColor[1], hostnameColor[2])
+	case "level":
+		levelColor := Level(line.Level).Color()
+		return rgbterm.FgString(value, levelColor[0], levelColor[1], levelColor[2])
+	default:
+		return value
+	}
+}
+
+//
+// Filters
+//
+
+type formatFilter func(value string, args []string, f *logLineFormatter) string
+
+type filterSpec struct {
+	fn      formatFilter
+	minArgs int
+	maxArgs int
+	numeric bool // the first argument must be an integer
+}
+
+var formatFilters = map[string]filterSpec{
+	"truncate": {fn: truncateFilter, minArgs: 1, maxArgs: 2, numeric: true},
+	"time":     {fn: timeFilter, minArgs: 1, maxArgs: 1},
+	"default":  {fn: defaultFilter, minArgs: 1, maxArgs: 1},
+	"pad":      {fn: padFilter, minArgs: 1, maxArgs: 1, numeric: true},
+	"lpad":     {fn: lpadFilter, minArgs: 1, maxArgs: 1, numeric: true},
+	"upper":    {fn: upperFilter},
+	"lower":    {fn: lowerFilter},
+	"short":    {fn: shortFilter},
+	"color":    {fn: colorFilter},
+	"trim":     {fn: trimFilter},
+}
+
+// truncate N ["suffix"] cuts the value to N characters, appending "..."
+// (or the given suffix) when something was cut
+func truncateFilter(value string, args []string, f *logLineFormatter) string {
+	n, _ := strconv.Atoi(args[0])
+	suffix := "..."
+	if len(args) > 1 {
+		suffix = args[1]
+	}
+
+	if n < 0 || utf8.RuneCountInString(value) <= n {
+		return value
+	}
+
+	return string([]rune(value)[:n]) + suffix
+}
+
+// time "layout" reformats an RFC 3339 value with a Go time layout, in the
+// configured time zone
+func timeFilter(value string, args []string, f *logLineFormatter) string {
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return value
+	}
+
+	return t.In(f.loc).Format(args[0])
+}
+
+func defaultFilter(value string, args []string, f *logLineFormatter) string {
+	if value == "" {
+		return args[0]
+	}
+	return value
+}
+
+// pad N left aligns the value in a column of N characters
+func padFilter(value string, args []string, f *logLineFormatter) string {
+	n, _ := strconv.Atoi(args[0])
+	if n < 0 {
+		return lpadFilter(value, []string{strconv.Itoa(-n)}, f)
+	}
+
+	if count := utf8.RuneCountInString(value); count < n {
+		return value + strings.Repeat(" ", n-count)
+	}
+	return value
+}
+
+// lpad N right aligns the value in a column of N characters
+func lpadFilter(value string, args []string, f *logLineFormatter) string {
+	n, _ := strconv.Atoi(args[0])
+	if count := utf8.RuneCountInString(value); count < n {
+		return strings.Repeat(" ", n-count) + value
+	}
+	return value
+}
+
+func upperFilter(value string, args []string, f *logLineFormatter) string {
+	return strings.ToUpper(value)
+}
+
+func lowerFilter(value string, args []string, f *logLineFormatter) string {
+	return strings.ToLower(value)
+}
+
+func trimFilter(value string, args []string, f *logLineFormatter) string {
+	return strings.TrimSpace(value)
+}
+
+// short abbreviates a level to 4 characters, see Level.ShortName
+func shortFilter(value string, args []string, f *logLineFormatter) string {
+	return Level(value).ShortName()
+}
+
+// color gives each distinct value its own color
+func colorFilter(value string, args []string, f *logLineFormatter) string {
+	if !f.colorize || value == "" {
+		return value
+	}
+
+	c := f.colorScale.Get(strings.TrimSpace(value))
+	return rgbterm.FgString(value, c[0], c[1], c[2])
+}
+
+//
+// Parser
+//
+
+type formatParseError struct {
+	format string
+	pos    int
+	msg    string
+}
+
+func (e *formatParseError) Error() string {
+	return fmt.Sprintf("Invalid log format at character %d: %s\n  %s\n  %s^", e.pos+1, e.msg, e.format, strings.Repeat(" ", e.pos))
+}
+
+type formatParser struct {
+	format string
+	pos    int
+}
+
+func parseLogFormat(format string) (*logFormat, error) {
+	p := &formatParser{format: format}
+
+	nodes, terminator, err := p.parseNodes()
+	if err != nil {
+		return nil, err
+	}
+
+	if terminator != "" {
+		return nil, p.errorf(p.pos, "unexpected {{ %s }}", terminator)
+	}
+
+	return &logFormat{nodes: nodes}, nil
+}
+
+// parseNodes parses until the end of the format or an else/end action, which
+// is returned as the terminator
+func (p *formatParser) parseNodes() ([]formatNode, string, error) {
+	nodes := []formatNode{}
+
+	for p.pos < len(p.format) {
+		start := strings.Index(p.format[p.pos:], "{{")
+		if start < 0 {
+			nodes = append(nodes, textNode(p.format[p.pos:]))
+			p.pos = len(p.format)
+			break
+		}
+
+		if start > 0 {
+			nodes = append(nodes, textNode(p.format[p.pos:p.pos+start]))
+		}
+
+		actionStart := p.pos + start
+		contentStart := actionStart + 2
+
+		tokens, contentEnd, err := p.lex(contentStart)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if contentEnd < 0 {
+			return nil, "", p.errorf(actionStart, "unclosed action, missing }}")
+		}
+		p.pos = contentEnd + 2
+
+		if len(tokens) == 0 {
+			return nil, "", p.errorf(actionStart, "empty action")
+		}
+
+		switch tokens[0].text {
+		case "if":
+			if tokens[0].kind != tokenIdent {
+				break
+			}
+
+			condition, err := p.parsePipeline(tokens[1:], contentStart)
+			if err != nil {
+				return nil, "", err
+			}
+
+			then, terminator, err := p.parseNodes()
+			if err != nil {
+				return nil, "", err
+			}
+
+			node := &ifNode{condition: condition, then: then}
+
+			if terminator == "else" {
+				node.otherwise, terminator, err = p.parseNodes()
+				if err != nil {
+					return nil, "", err
+				}
+			}
+
+			if terminator != "end" {
+				return nil, "", p.errorf(actionStart, "{{ if }} is missing its {{ end }}")
+			}
+
+			nodes = append(nodes, node)
+			continue
+
+		case "else", "end":
+			if tokens[0].kind == tokenIdent && len(tokens) == 1 {
+				return nodes, tokens[0].text, nil
+			}
+		}
+
+		pipeline, err := p.parsePipeline(tokens, contentStart)
+		if err != nil {
+			return nil, "", err
+		}
+
+		nodes = append(nodes, &actionNode{pipeline: pipeline})
+	}
+
+	return nodes, "", nil
+}
+
+func (p *formatParser) parsePipeline(tokens []formatToken, pos int) (*pipeline, error) {
+	if len(tokens) == 0 {
+		return nil, p.errorf(pos, "expected a field name")
+	}
+
+	result := &pipeline{}
+
+	switch tokens[0].kind {
+	case tokenIdent:
+		result.field = tokens[0].text
+	case tokenString:
+		literal := tokens[0].text
+		result.literal = &literal
+	default:
+		return nil, p.errorf(tokens[0].pos, "expected a field name, got %q", tokens[0].text)
+	}
+
+	tokens = tokens[1:]
+
+	for len(tokens) > 0 {
+		if tokens[0].kind != tokenPipe {
+			return nil, p.errorf(tokens[0].pos, "expected | before %q", tokens[0].text)
+		}
+
+		if len(tokens) < 2 || tokens[1].kind != tokenIdent {
+			return nil, p.errorf(tokens[0].pos, "expected a filter name after |")
+		}
+
+		name := tokens[1].text
+		spec, ok := formatFilters[name]
+		if !ok {
+			return nil, p.errorf(tokens[1].pos, "unknown filter %q", name)
+		}
+
+		call := &filterCall{name: name, fn: spec.fn}
+		tokens = tokens[2:]
+
+		for len(tokens) > 0 && tokens[0].kind != tokenPipe {
+			if tokens[0].kind == tokenIdent {
+				return nil, p.errorf(tokens[0].pos, "filter arguments must be quoted strings or numbers, got %q", tokens[0].text)
+			}
+			call.args = append(call.args, tokens[0].text)
+			tokens = tokens[1:]
+		}
+
+		if len(call.args) < spec.minArgs || len(call.args) > spec.maxArgs {
+			return nil, p.errorf(pos, "wrong number of arguments for %s", name)
+		}
+
+		if spec.numeric {
+			if _, err := strconv.Atoi(call.args[0]); err != nil {
+				return nil, p.errorf(pos, "%s expects a number, got %q", name, call.args[0])
+			}
+		}
+
+		result.filters = append(result.filters, call)
+	}
+
+	return result, nil
+}
+
+type formatTokenKind int
+
+const (
+	tokenIdent formatTokenKind = iota
+	tokenString
+	tokenNumber
+	tokenPipe
+)
+
+type formatToken struct {
+	kind formatTokenKind
+	text string
+	pos  int
+}
+
+// lex tokenizes the action starting at start up to its closing }}, which is
+// only recognised outside of quoted arguments. The position of the closing }}
+// is returned, or -1 when the action is never closed.
+func (p *formatParser) lex(start int) ([]formatToken, int, error) {
+	tokens := []formatToken{}
+	s := p.format
+	end := len(s)
+	i := start
+
+	for i < end {
+		if strings.HasPrefix(s[i:], "}}") {
+			return tokens, i, nil
+		}
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+
+		case r == '|':
+			tokens = append(tokens, formatToken{kind: tokenPipe, text: "|", pos: i})
+			i += size
+
+		case r == '"' || r == '`':
+			j := i + 1
+			for j < end && s[j] != byte(r) {
+				if s[j] == '\\' && r == '"' {
+					j++
+				}
+				j++
+			}
+			if j >= end {
+				return nil, 0, p.errorf(i, "unterminated string")
+			}
+
+			text, err := strconv.Unquote(s[i : j+1])
+			if err != nil {
+				return nil, 0, p.errorf(i, "invalid string %s", s[i:j+1])
+			}
+
+			tokens = append(tokens, formatToken{kind: tokenString, text: text, pos: i})
+			i = j + 1
+
+		case r == '-' || unicode.IsDigit(r):
+			j := i + 1
+			for j < end && unicode.IsDigit(rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, formatToken{kind: tokenNumber, text: s[i:j], pos: i})
+			i = j
+
+		case isIdentRune(r):
+			j := i
+			for j < end {
+				r, size := utf8.DecodeRuneInString(s[j:])
+				if !isIdentRune(r) {
+					break
+				}
+				j += size
+			}
+			tokens = append(tokens, formatToken{kind: tokenIdent, text: s[i:j], pos: i})
+			i = j
+
+		default:
+			return nil, 0, p.errorf(i, "unexpected character %q", r)
+		}
+	}
+
+	return tokens, -1, nil
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || r == '.' || r == '$' || r == '@' || r == '-' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func (p *formatParser) errorf(pos int, format string, args ...interface{}) error {
+	return &formatParseError{format: p.format, pos: pos, msg: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/timberio/cli/api"
+)
+
+func testLogLine() *api.LogLine {
+	return &api.LogLine{
+		ID:       "1",
+		Datetime: time.Date(2019, 3, 20, 15, 4, 5, 0, time.UTC),
+		Level:    "error",
+		Message:  "  Request failed  ",
+		Fields: map[string]interface{}{
+			"context": map[string]interface{}{
+				"http": map[string]interface{}{"status": 500.0, "request_id": "abc"},
+				"user": map[string]interface{}{"email": "jane@example.com"},
+			},
+		},
+	}
+}
+
+func TestLogLineFormat(t *testing.T) {
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{"plain text", "plain text"},
+		{"{{ message }}", "  Request failed  "},
+		{"{{ context.http.status }}", "500"},
+		{"{{ context.user.missing }}!", "!"},
+		{"{{ date }}", "Mar 20 03:04:05.000pm"},
+		{"{{ level }}|", "err |"},
+		{`{{ "literal" | upper }}`, "LITERAL"},
+
+		// Filters
+		{"{{ message | trim | truncate 7 }}", "Request..."},
+		{`{{ message | trim | truncate 7 "~" }}`, "Request~"},
+		{"{{ message | trim | truncate 80 }}", "Request failed"},
+		{`{{ dt | time "15:04" }}`, "15:04"},
+		{`{{ context.http.method | default "-" }}`, "-"},
+		{`{{ context.http.status | default "-" }}`, "500"},
+		{"{{ level | pad 6 }}|", "error |"},
+		{"{{ level | pad -6 }}|", " error|"},
+		{"{{ level | lpad 6 }}|", " error|"},
+		{"{{ level | upper }}", "ERROR"},
+		{`{{ "MiXeD" | lower }}`, "mixed"},
+		{"{{ message | trim }}", "Request failed"},
+		{"{{ level | short }}", "err"},
+		{"{{ level | color }}", "error"},
+
+		// Closing braces inside quoted arguments don't end the action
+		{`{{ context.http.method | default "}}" }}`, "}}"},
+		{"{{ context.http.method | default `{{ }}` }}", "{{ }}"},
+
+		// Conditionals
+		{"{{ if context.user.email }}user={{ context.user.email }}{{ end }}", "user=jane@example.com"},
+		{"{{ if context.user.missing }}user{{ else }}anonymous{{ end }}", "anonymous"},
+		{"{{ if context.http.status }}{{ if context.user.missing }}a{{ else }}b{{ end }}{{ else }}c{{ end }}", "b"},
+		{"{{ if context.user.missing }}a{{ else }}{{ if context.http.status }}b{{ end }}{{ end }}", "b"},
+		{`{{ if context.user.missing | default "x" }}set{{ end }}`, "set"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			formatter, err := newLogLineFormatter(test.format, time.UTC, false)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			formatted, err := formatter.Format(testLogLine())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if formatted != test.expected {
+				t.Fatalf("expected %q, got %q", test.expected, formatted)
+			}
+		})
+	}
+}
+
+func TestLogLineFormatErrors(t *testing.T) {
+	tests := []struct {
+		format string
+		error  string
+	}{
+		{"{{ message", "unclosed action"},
+		{"{{ }}", "empty action"},
+		{"{{ message | }}", "expected a filter name"},
+		{"{{ message | nope }}", `unknown filter "nope"`},
+		{"{{ message | truncate }}", "wrong number of arguments for truncate"},
+		{"{{ message | upper 1 }}", "wrong number of arguments for upper"},
+		{`{{ message | truncate "x" }}`, "truncate expects a number"},
+		{"{{ message | default other }}", "filter arguments must be quoted"},
+		{"{{ message level }}", "expected | before"},
+		{`{{ message | default "x }}`, "unterminated string"},
+		{"{{ message ! }}", "unexpected character"},
+		{"{{ if message }}a", "is missing its {{ end }}"},
+		{"{{ if message }}a{{ else }}b", "is missing its {{ end }}"},
+		{"a{{ end }}", "unexpected {{ end }}"},
+		{"a{{ else }}", "unexpected {{ else }}"},
+		{"{{ if }}a{{ end }}", "expected a field name"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			_, err := newLogLineFormatter(test.format, time.UTC, false)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if !strings.Contains(err.Error(), test.error) {
+				t.Fatalf("expected an error containing %q, got %q", test.error, err)
+			}
+		})
+	}
+}
+
+func TestHighlightMatches(t *testing.T) {
+	patterns := []*regexp.Regexp{regexp.MustCompile("fail")}
+
+	tests := []struct {
+		s        string
+		expected string
+	}{
+		{"no match", "no match"},
+		{"request failed", "request " + highlightStart + "fail" + highlightEnd + "ed"},
+		// The highlight is restored after a color code inside the match
+		{"fa\x1b[31mil\x1b[0m", highlightStart + "fa\x1b[31m" + highlightStart + "il\x1b[0m" + highlightStart + highlightEnd},
+	}
+
+	for _, test := range tests {
+		if highlighted := highlightMatches(test.s, patterns); highlighted != test.expected {
+			t.Errorf("highlightMatches(%q): expected %q, got %q", test.s, test.expected, highlighted)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+var errInterrupted = errors.New("interrupted")
+
+// completeFunc returns the candidates for the word ending at pos, and the
+// position the word starts at
+type completeFunc func(line []rune, pos int) (start int, candidates []string)
+
+// lineEditor reads lines from a terminal with emacs style key bindings,
+// history and tab completion. When the input is not a terminal, lines are
+// read as is so that scripts can be piped in.
+type lineEditor struct {
+	in       *os.File
+	out      io.Writer
+	reader   *bufio.Reader
+	history  []string
+	complete completeFunc
+	terminal bool
+}
+
+func newLineEditor(in *os.File, out io.Writer) *lineEditor {
+	return &lineEditor{
+		in:       in,
+		out:      out,
+		reader:   bufio.NewReader(in),
+		terminal: terminal.IsTerminal(int(in.Fd())),
+	}
+}
+
+// AddHistory adds an entry to the history, repeated entries are only kept once
+func (e *lineEditor) AddHistory(entry string) {
+	if entry == "" || (len(e.history) > 0 && e.history[len(e.history)-1] == entry) {
+		return
+	}
+	e.history = append(e.history, entry)
+}
+
+// ReadLine reads a line, errInterrupted is returned on Ctrl-C and io.EOF on
+// Ctrl-D with an empty line
+func (e *lineEditor) ReadLine(prompt string) (string, error) {
+	if !e.terminal {
+		line, err := e.reader.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return strings.TrimRight(line, "\r\n"), err
+	}
+
+	state, err := terminal.MakeRaw(int(e.in.Fd()))
+	if err != nil {
+		return "", err
+	}
+	defer terminal.Restore(int(e.in.Fd()), state)
+
+	s := &editState{editor: e, prompt: prompt, historyIndex: len(e.history)}
+	s.refresh()
+
+	for {
+		r, _, err := e.reader.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			return string(s.line), nil
+		case 3: // Ctrl-C
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupted
+		case 4: // Ctrl-D
+			if len(s.line) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			s.delete()
+		case 1: // Ctrl-A
+			s.pos = 0
+		case 5: // Ctrl-E
+			s.pos = len(s.line)
+		case 2: // Ctrl-B
+			s.move(-1)
+		case 6: // Ctrl-F
+			s.move(1)
+		case 127, 8: // Backspace, Ctrl-H
+			if s.pos > 0 {
+				s.pos--
+				s.delete()
+			}
+		case 11: // Ctrl-K
+			s.line = s.line[:s.pos]
+		case 21: // Ctrl-U
+			s.line = s.line[s.pos:]
+			s.pos = 0
+		case 23: // Ctrl-W
+			start := s.pos
+			for start > 0 && unicode.IsSpace(s.line[start-1]) {
+				start--
+			}
+			for start > 0 && !unicode.IsSpace(s.line[start-1]) {
+				start--
+			}
+			s.line = append(s.line[:start], s.line[s.pos:]...)
+			s.pos = start
+		case 12: // Ctrl-L
+			fmt.Fprint(e.out, "\x1b[H\x1b[2J")
+		case 16: // Ctrl-P
+			s.historyMove(-1)
+		case 14: // Ctrl-N
+			s.historyMove(1)
+		case '\t':
+			s.completeWord()
+		case 27: // Escape sequences for the arrow, home, end and delete keys
+			s.escape()
+		default:
+			if unicode.IsPrint(r) {
+				s.insert(r)
+			}
+		}
+
+		s.refresh()
+	}
+}
+
+type editState struct {
+	editor       *lineEditor
+	prompt       string
+	line         []rune
+	pos          int
+	historyIndex int
+	draft        []rune
+}
+
+func (s *editState) refresh() {
+	out := s.editor.out
+	fmt.Fprintf(out, "\r%s%s\x1b[K", s.prompt, string(s.line))
+	if back := len(s.line) - s.pos; back > 0 {
+		fmt.Fprintf(out, "\x1b[%dD", back)
+	}
+}
+
+func (s *editState) insert(runes ...rune) {
+	line := make([]rune, 0, len(s.line)+len(runes))
+	line = append(line, s.line[:s.pos]...)
+	line = append(line, runes...)
+	s.line = append(line, s.line[s.pos:]...)
+	s.pos += len(runes)
+}
+
+func (s *editState) delete() {
+	if s.pos < len(s.line) {
+		s.line = append(s.line[:s.pos], s.line[s.pos+1:]...)
+	}
+}
+
+func (s *editState) move(delta int) {
+	s.pos += delta
+	if s.pos < 0 {
+		s.pos = 0
+	}
+	if s.pos > len(s.line) {
+		s.pos = len(s.line)
+	}
+}
+
+func (s *editState) historyMove(delta int) {
+	history := s.editor.history
+	index := s.historyIndex + delta
+	if index < 0 || index > len(history) {
+		return
+	}
+
+	if s.historyIndex == len(history) {
+		s.draft = s.line
+	}
+
+	s.historyIndex = index
+	if index == len(history) {
+		s.line = s.draft
+	} else {
+		s.line = []rune(history[index])
+	}
+	s.pos = len(s.line)
+}
+
+func (s *editState) escape() {
+	reader := s.editor.reader
+
+	r, _, err := reader.ReadRune()
+	if err != nil || (r != '[' && r != 'O') {
+		return
+	}
+
+	r, _, err = reader.ReadRune()
+	if err != nil {
+		return
+	}
+
+	// Sequences such as ESC [ 3 ~ carry a number
+	if r >= '0' && r <= '9' {
+		n := r
+		for (r >= '0' && r <= '9') || r == ';' {
+			r, _, err = reader.ReadRune()
+			if err != nil {
+				return
+			}
+		}
+
+		switch n {
+		case '1', '7':
+			s.pos = 0
+		case '4', '8':
+			s.pos = len(s.line)
+		case '3':
+			s.delete()
+		}
+		return
+	}
+
+	switch r {
+	case 'A':
+		s.historyMove(-1)
+	case 'B':
+		s.historyMove(1)
+	case 'C':
+		s.move(1)
+	case 'D':
+		s.move(-1)
+	case 'H':
+		s.pos = 0
+	case 'F':
+		s.pos = len(s.line)
+	}
+}
+
+func (s *editState) completeWord() {
+	if s.editor.complete == nil {
+		return
+	}
+
+	start, candidates := s.editor.complete(s.line, s.pos)
+	if len(candidates) == 0 {
+		return
+	}
+
+	word := string(s.line[start:s.pos])
+	prefix := commonPrefix(candidates)
+
+	if utf8.RuneCountInString(prefix) > utf8.RuneCountInString(word) || len(candidates) == 1 {
+		s.line = append(s.line[:start], s.line[s.pos:]...)
+		s.pos = start
+		s.insert([]rune(prefix)...)
+		return
+	}
+
+	s.editor.printCandidates(candidates)
+}
+
+func (e *lineEditor) printCandidates(candidates []string) {
+	width, _, err := terminal.GetSize(int(e.in.Fd()))
+	if err != nil || width <= 0 {
+		width = 80
+	}
+
+	sort.Strings(candidates)
+
+	columnWidth := 0
+	for _, candidate := range candidates {
+		if n := utf8.RuneCountInString(candidate) + 2; n > columnWidth {
+			columnWidth = n
+		}
+	}
+
+	perLine := width / columnWidth
+	if perLine < 1 {
+		perLine = 1
+	}
+
+	fmt.Fprint(e.out, "\r\n")
+	for i, candidate := range candidates {
+		fmt.Fprint(e.out, candidate)
+		if (i+1)%perLine == 0 || i == len(candidates)-1 {
+			fmt.Fprint(e.out, "\r\n")
+		} else {
+			fmt.Fprint(e.out, strings.Repeat(" ", columnWidth-utf8.RuneCountInString(candidate)))
+		}
+	}
+}
+
+// commonPrefix returns the longest prefix shared by all the candidates,
+// ignoring case
+func commonPrefix(candidates []string) string {
+	prefix := []rune(candidates[0])
+	for _, candidate := range candidates[1:] {
+		runes := []rune(candidate)
+		n := 0
+		for n < len(prefix) && n < len(runes) && unicode.ToLower(prefix[n]) == unicode.ToLower(runes[n]) {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	return string(prefix)
+}
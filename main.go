@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/aybabtme/rgbterm/rainbow"
 	"github.com/fatih/color"
@@ -24,10 +27,23 @@ var (
 	maxColumns      string
 	maxColumnLEngth string
 	maxPerPage      string
+	organizationID  string
 	timeZone        string
 	version         string
 )
 
+const defaultHost = "https://api.timber.io"
+
+// Exit codes for commands stopped before completing. 130 is what shells use
+// for processes interrupted with Ctrl-C and 124 matches timeout(1).
+const (
+	exitCodeTimeout     = 124
+	exitCodeInterrupted = 130
+)
+
+// Exit code of `timber assert` when a threshold is exceeded, errors exit with 1
+const exitCodeAssertFailed = 2
+
 // cribbed from fatih/color
 var colorize = os.Getenv("TERM") != "dumb" &&
 	(isatty.IsTerminal(os.Stdout.Fd()) || isatty.IsCygwinTerminal(os.Stdout.Fd()))
@@ -87,6 +103,8 @@ func init() {
 }
 
 func main() {
+	rootContext, interrupt, stopInterrupts = interruptContext(context.Background())
+
 	app := cli.NewApp()
 	app.Name = "timber"
 	app.Usage = "Command line interface for the Timber.io logging service"
@@ -112,7 +130,7 @@ func main() {
 		cli.IntFlag{
 			Name:   "max-column-length",
 			Usage:  "Maximum length of a single column value",
-			EnvVar: "TIMBER_MAX_COLUMNS",
+			EnvVar: "TIMBER_MAX_COLUMN_LENGTH",
 			Value:  20,
 		},
 		cli.IntFlag{
@@ -134,9 +152,50 @@ func main() {
 		cli.StringFlag{
 			Name:   "host, H",
 			Usage:  "Timber.io host, useful for testing",
-			Value:  "https://api.timber.io",
+			Value:  defaultHost,
 			EnvVar: "TIMBER_HOST",
 		},
+		cli.StringFlag{
+			Name:   "output, o",
+			Usage:  "Output format for lists: table, json, ndjson, yaml or csv",
+			EnvVar: "TIMBER_OUTPUT",
+			Value:  outputTable,
+		},
+		cli.StringFlag{
+			Name:   "columns",
+			Usage:  "Comma separated list of the columns to show in table and csv output, e.g. \"name,id\"",
+			EnvVar: "TIMBER_COLUMNS",
+		},
+		cli.StringFlag{
+			Name:  "template",
+			Usage: "Go template rendered for each item of a list, e.g. \"{{ .ID }} {{ .Name }}\"",
+		},
+		cli.StringFlag{
+			Name:   "credential-store",
+			Usage:  "Where API keys are stored: \"file\" for a plaintext file only readable by you, or \"encrypted\" for a file encrypted with a passphrase or key file",
+			Value:  credentialStoreFile,
+			EnvVar: "TIMBER_CREDENTIAL_STORE",
+		},
+		cli.StringFlag{
+			Name:   "credentials-key-file",
+			Usage:  "File holding a base64 encoded 32 byte key for the encrypted credential store, instead of a passphrase",
+			EnvVar: "TIMBER_CREDENTIALS_KEY_FILE",
+		},
+		cli.StringFlag{
+			Name:   "credential-helper",
+			Usage:  "Program storing API keys, called with \"get\" or \"store\" and exchanging credentials as JSON. \"name\" runs timber-credential-name, \"!command\" runs a shell command",
+			EnvVar: "TIMBER_CREDENTIAL_HELPER",
+		},
+		cli.StringFlag{
+			Name:   "organization-id",
+			Usage:  "Organization to use when the API key has access to several",
+			EnvVar: "TIMBER_ORGANIZATION_ID",
+		},
+		cli.StringFlag{
+			Name:   "profile, P",
+			Usage:  "Profile from ~/.timber/config providing the API key, host and defaults",
+			EnvVar: "TIMBER_PROFILE",
+		},
 		cli.StringFlag{
 			Name:   "time-zone, Z",
 			Usage:  "Time zone, such as \"Local\", \"UTC\", or \"America/New_York\"",
@@ -152,13 +211,26 @@ func main() {
 			ArgsUsage: "[api_key]",
 			Flags:     []cli.Flag{},
 			Action: func(ctx *cli.Context) error {
-				err := setHost(ctx)
+				err := setProfile(ctx, true)
+				if err != nil {
+					return err
+				}
+
+				err = setHost(ctx)
+				if err != nil {
+					return err
+				}
+
+				err = setCredentialStore(ctx)
 				if err != nil {
 					return err
 				}
 
 				apiKey := ctx.Args().Get(0)
 
+				// Keys with access to several organizations need --organization-id
+				organizationID = ctx.GlobalString("organization-id")
+
 				if apiKey == "" {
 					message := "The api_key argument is required: `timber auth [api_key]`\n" +
 						"Run `timber help auth` for more details"
@@ -171,12 +243,17 @@ func main() {
 					return err
 				}
 
+				added := "API key added and set to your active credential\n"
+				if currentProfile != nil {
+					added = fmt.Sprintf("API key added to the %s profile\n", currentProfile.Name)
+				}
+
 				message := fmt.Sprint(
-					"API key added and set to your active credential\n",
+					added,
 					"Organization ID: ", organization.ID, "\n",
 					"Organization Name: ", organization.Name, "\n",
 					"Run `timber auth list` to list all credentials.\n",
-					"Run `timber auth switch [org_id]` to switch active credentials.\n",
+					"Run `timber auth switch [org_id|profile]` to switch active credentials.\n",
 					"Run `timber help auth` for more details",
 				)
 				successWriter.Write([]byte(message))
@@ -184,18 +261,115 @@ func main() {
 				return nil
 			},
 			Subcommands: []cli.Command{
+				{
+					Name:  "login",
+					Usage: "log in with your browser instead of an API key",
+					Action: func(ctx *cli.Context) error {
+						err := setProfile(ctx, true)
+						if err != nil {
+							return err
+						}
+
+						err = setHost(ctx)
+						if err != nil {
+							return err
+						}
+
+						err = setCredentialStore(ctx)
+						if err != nil {
+							return err
+						}
+
+						// Users with access to several organizations need --organization-id
+						organizationID = ctx.GlobalString("organization-id")
+
+						organization, err := login()
+						if err != nil {
+							return err
+						}
+
+						loggedIn := "Logged in and set to your active credential\n"
+						if currentProfile != nil {
+							loggedIn = fmt.Sprintf("Logged in with the %s profile\n", currentProfile.Name)
+						}
+
+						message := fmt.Sprint(
+							loggedIn,
+							"Organization ID: ", organization.ID, "\n",
+							"Organization Name: ", organization.Name, "\n",
+							"Run `timber auth logout` to log out",
+						)
+						successWriter.Write([]byte(message))
+
+						return nil
+					},
+				},
+				{
+					Name:      "logout",
+					Usage:     "revoke the login of the active credential, or of an organization, and delete it",
+					ArgsUsage: "[org_id]",
+					Action: func(ctx *cli.Context) error {
+						err := setProfile(ctx, false)
+						if err != nil {
+							return err
+						}
+
+						err = setHost(ctx)
+						if err != nil {
+							return err
+						}
+
+						err = setCredentialStore(ctx)
+						if err != nil {
+							return err
+						}
+
+						orgID := ctx.Args().Get(0)
+						if orgID == "" && currentProfile != nil {
+							orgID, _ = currentProfile.String("organization-id")
+						}
+
+						credential, err := logout(orgID)
+						if err != nil {
+							return err
+						}
+
+						if credential.RefreshToken == "" {
+							fmt.Fprintf(warningWriter, "%s uses an API key, it was deleted but stays valid until it is revoked in the Timber app\n", credential.OrganizationID)
+						}
+
+						successWriter.Write([]byte(fmt.Sprintf("Logged out of %s", credential.OrganizationID)))
+
+						return nil
+					},
+				},
 				{
 					Name:  "list",
-					Usage: "list all credentials",
+					Usage: "list all credentials and profiles",
 					Action: func(ctx *cli.Context) error {
-						err := listCredentials()
+						err := setOutput(ctx)
+						if err != nil {
+							return err
+						}
+
+						err = setCredentialStore(ctx)
+						if err != nil {
+							return err
+						}
+
+						err = listCredentials()
 						if err != nil {
 							return err
 						}
 
+						if !isTableOutput() {
+							return nil
+						}
+
 						fmt.Println()
-						infoWriter.Write([]byte("Run `timber auth switch [org_id]` to switch active credentials\n" +
+						infoWriter.Write([]byte("Run `timber auth switch [org_id|profile]` to switch active credentials\n" +
 							"Run `timber auth [api_key]` to add a new credential\n" +
+							"Run `timber --profile [name] auth [api_key]` to add a profile\n" +
 							"Run `timber help auth` for more details"))
 
 						return nil
@@ -204,27 +378,54 @@ func main() {
 				},
 				{
 					Name:      "switch",
-					Usage:     "switch active credentials",
-					ArgsUsage: "[org_id]",
+					Usage:     "switch active credentials, or the default profile",
+					ArgsUsage: "[org_id|profile]",
 					Action: func(ctx *cli.Context) error {
-						orgID := ctx.Args().Get(0)
-						return switchActiveCredentials(orgID)
+						target := ctx.Args().Get(0)
+
+						if target == "" {
+							message := "You must supply an org_id or profile: timber auth switch [org_id|profile]"
+							// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+							return cli.NewExitError(message, 65)
+						}
+
+						err := setCredentialStore(ctx)
+						if err != nil {
+							return err
+						}
+
+						return switchActiveCredentials(target)
 					},
 				},
 				{
 					Name:      "delete",
-					Usage:     "delete a credential",
-					ArgsUsage: "[org_id]",
+					Usage:     "delete a credential or a profile",
+					ArgsUsage: "[org_id|profile]",
 					Action: func(ctx *cli.Context) error {
-						orgID := ctx.Args().Get(0)
+						target := ctx.Args().Get(0)
 
-						if orgID == "" {
-							message := "You must supply an org_id: timber auth delete [org_id]"
+						if target == "" {
+							message := "You must supply an org_id or profile: timber auth delete [org_id|profile]"
 							// Exit with 65, EX_DATAERR, to indicate input data was incorrect
 							return cli.NewExitError(message, 65)
 						}
 
-						err := deleteCredential(orgID)
+						deleted, err := deleteProfile(target)
+						if err != nil {
+							return err
+						}
+
+						if deleted {
+							successWriter.Write([]byte("Profile successfully deleted"))
+							return nil
+						}
+
+						err = setCredentialStore(ctx)
+						if err != nil {
+							return err
+						}
+
+						err = deleteCredential(target)
 						if err != nil {
 							return err
 						}
@@ -235,6 +436,44 @@ func main() {
 
 					},
 				},
+				{
+					Name:    "status",
+					Aliases: []string{"whoami"},
+					Usage:   "show the API key in use and check every stored credential against the API",
+					Action: func(ctx *cli.Context) error {
+						err := setAuthStatusVars(ctx)
+						if err != nil {
+							return err
+						}
+
+						return authStatus(ctx, false)
+					},
+				},
+				{
+					Name:  "migrate",
+					Usage: "move credentials from the plaintext credentials file to the configured credential store",
+					Action: func(ctx *cli.Context) error {
+						err := setCredentialStore(ctx)
+						if err != nil {
+							return err
+						}
+
+						return migrateCredentials()
+					},
+				},
+			},
+		},
+
+		{
+			Name:  "whoami",
+			Usage: "Show the profile, organization and API key in use",
+			Action: func(ctx *cli.Context) error {
+				err := setAuthStatusVars(ctx)
+				if err != nil {
+					return err
+				}
+
+				return authStatus(ctx, true)
 			},
 		},
 
@@ -261,7 +500,7 @@ func main() {
 				// TODO create a new view to get default format if not set
 				cli.StringFlag{
 					Name:   "log-format, f",
-					Usage:  "Template to format log output. Must be \"json\" or a custom format. For custom formats, wrap field identifiers with {{ }}. Ex: \"{{ dt }} {{ message }}\". Non-existent fields will be ignored.",
+					Usage:  "Template to format log output. Must be \"json\" or a custom format. For custom formats, wrap field identifiers with {{ }} and pipe them through filters (truncate, time, default, pad, lpad, upper, lower, short, color, trim). Ex: \"{{ dt | time \"15:04:05\" }} {{ context.http.status | default \"-\" }} {{ message | truncate 80 }}\". Conditionals are written {{ if field }}...{{ else }}...{{ end }}. Non-existent fields render as empty.",
 					EnvVar: "TIMBER_LOG_FORMAT",
 					Value:  defaultLogFormat,
 				},
@@ -270,6 +509,57 @@ func main() {
 					Usage:  "Color your logs with all the colors of the rainbow.",
 					EnvVar: "TIMBER_RAINBOW",
 				},
+				cli.StringFlag{
+					Name:   "transport",
+					Usage:  "How to receive new log lines: \"sse\" streams them from the server, \"poll\" searches for them every 500ms and \"auto\" streams when the server supports it.",
+					EnvVar: "TIMBER_TRANSPORT",
+					Value:  api.TransportAuto,
+				},
+				cli.StringFlag{
+					Name:   "where, w",
+					Usage:  "Only show log lines matching an expression, evaluated locally after --query. E.g. 'context.http.status >= 500 && message =~ /timeout/i'. Fields use the same paths as --log-format and combine with &&, ||, !, ==, !=, <, <=, >, >=, =~ and !~.",
+					EnvVar: "TIMBER_WHERE",
+				},
+				cli.StringSliceFlag{
+					Name:  "highlight",
+					Usage: "Highlight matches of a regular expression in the rendered log lines. Can be specified multiple times.",
+				},
+				cli.StringSliceFlag{
+					Name:  "exclude",
+					Usage: "Hide log lines whose rendered text matches a regular expression. Can be specified multiple times.",
+				},
+				cli.IntFlag{
+					Name:  "after-context, A",
+					Usage: "Print `N` log lines from the same source after each matched line, fetched with additional searches. Matched lines are held for up to 3 seconds while the lines after them are logged.",
+				},
+				cli.IntFlag{
+					Name:  "before-context, B",
+					Usage: "Print `N` log lines from the same source before each matched line.",
+				},
+				cli.IntFlag{
+					Name:  "context, C",
+					Usage: "Print `N` log lines from the same source before and after each matched line.",
+				},
+				cli.BoolFlag{
+					Name:  "same-request",
+					Usage: "Only print context lines with the same context.http.request_id as the matched line.",
+				},
+				cli.StringFlag{
+					Name:  "resume",
+					Usage: "Save the position of the tail under `NAME` in ~/.timber/state, and when a tail with that name ran before, first print the log lines it missed.",
+				},
+				cli.BoolFlag{
+					Name:  "list-cursors",
+					Usage: "List the positions saved with --resume.",
+				},
+				cli.BoolFlag{
+					Name:  "reset",
+					Usage: "Delete the position saved under the --resume name.",
+				},
+				cli.BoolFlag{
+					Name:  "tui",
+					Usage: "Show a full-screen terminal UI with one pane per source, or per view when --view-id lists several comma separated views. Panes can be paused, scrolled back, searched and have their query edited.",
+				},
 			},
 			Action: func(ctx *cli.Context) error {
 				err := setGlobalVars(ctx)
@@ -277,95 +567,641 @@ func main() {
 					return err
 				}
 
-				var w io.Writer = os.Stdout
-				if ctx.Bool("rainbow") {
-					w = rainbow.New(os.Stdout, 252, 255, 43)
-					colorize = false // disable colorization so that we don't get conflicting color codes
+				if ctx.Bool("list-cursors") {
+					return listTailCursors()
 				}
 
-				var (
-					sourceIds = []string{}
-					format    = defaultLogFormat
-					query     = ""
-				)
+				if ctx.Bool("reset") {
+					if ctx.String("resume") == "" {
+						// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+						return cli.NewExitError("--reset needs the name of the cursor: timber tail --resume [name] --reset", 65)
+					}
 
-				// pull defaults from view if specified
-				if ctx.IsSet("view-id") {
-					view, err := client.GetSavedView(ctx.String("view-id"))
+					err = resetTailCursor(ctx.String("resume"))
 					if err != nil {
 						return err
 					}
 
-					sourceIds = view.ConsoleSettings.SourceIds
-					format = view.ConsoleSettings.LogLineFormat
-					if view.ConsoleSettings.Query != nil {
-						query = *view.ConsoleSettings.Query
-					}
+					fmt.Fprintf(infoWriter, "The cursor %s was reset\n", ctx.String("resume"))
+					return nil
 				}
 
-				if ctx.IsSet("source-id") {
-					sourceIds = ctx.StringSlice("source-id")
+				contextOptions, err := getContextOptions(ctx)
+				if err != nil {
+					return err
 				}
 
-				if len(sourceIds) == 0 {
-					message := "You must supply at lease one source ID to tail\n" +
-						"1. Run `timber sources` to list all sources\n" +
-						"2. Run `timber tail --source-id [source_id]` with the ID of the source you want to tail"
-					// Exit with 65, EX_DATAERR, to indicate input data was incorrect
-					return cli.NewExitError(message, 65)
-				}
+				if ctx.Bool("tui") {
+					if contextOptions.enabled() || ctx.String("resume") != "" {
+						// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+						return cli.NewExitError("-A, -B, -C and --resume can't be used with --tui", 65)
+					}
 
-				if ctx.IsSet("log-format") {
-					format = ctx.String("log-format")
-				}
+					panes, err := getTUIPanes(ctx)
+					if err != nil {
+						return err
+					}
+
+					filter, err := getLogLineFilter(ctx, panes[0].formatter)
+					if err != nil {
+						return err
+					}
+					for _, pane := range panes[1:] {
+						pane.formatter.highlights = panes[0].formatter.highlights
+					}
 
-				if ctx.IsSet("query") {
-					query = ctx.String("query")
+					return tailTUI(panes, filter, ctx.String("transport"))
 				}
 
-				tail(w, sourceIds, query, format, colorize)
+				var w io.Writer = os.Stdout
+				if ctx.Bool("rainbow") {
+					w = rainbow.New(os.Stdout, 252, 255, 43)
+					colorize = false // disable colorization so that we don't get conflicting color codes
+				}
 
-				return nil
-			},
-		},
+				sourceIds, query, format, err := getLogSelection(ctx, "tail")
+				if err != nil {
+					return err
+				}
 
-		{
-			Name:  "sources",
-			Usage: "Manage your Timber sources",
-			Flags: []cli.Flag{},
-			Action: func(ctx *cli.Context) error {
-				err := setGlobalVars(ctx)
+				formatter, err := getLogLineFormatter(format)
 				if err != nil {
 					return err
 				}
 
-				err = listSources()
+				filter, err := getLogLineFilter(ctx, formatter)
 				if err != nil {
 					return err
 				}
 
-				return nil
+				options := &tailOptions{
+					SourceIds: sourceIds,
+					Query:     query,
+					Transport: ctx.String("transport"),
+					Context:   contextOptions,
+				}
+
+				if name := ctx.String("resume"); name != "" {
+					options.Cursor, err = loadTailCursor(name)
+					if err != nil {
+						return err
+					}
+
+					err = checkTailCursor(options.Cursor, sourceIds, query)
+					if err != nil {
+						return err
+					}
+				}
+
+				return tail(w, options, formatter, filter)
 			},
 		},
 
 		{
-			Name:  "sql-queries",
-			Usage: "Manage SQL queries",
-			Flags: []cli.Flag{},
+			Name:      "search",
+			Usage:     "Search historical logs",
+			ArgsUsage: " ",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:   "source-id, s",
+					Usage:  "The source id(s) to search. Can be specified multiple times.",
+					EnvVar: "TIMBER_SOURCE_ID",
+				},
+				cli.StringFlag{
+					Name:   "view-id, v",
+					Usage:  "The view id to search. If specified, this will set the default app ids, query, and format, but they can be overriden by the appropriate flags.",
+					EnvVar: "TIMBER_VIEW_ID",
+				},
+				cli.StringFlag{
+					Name:   "query, q",
+					Usage:  "Query to pass to filter log lines. E.g. level:error.",
+					EnvVar: "TIMBER_QUERY",
+				},
+				cli.StringFlag{
+					Name:  "since",
+					Usage: "Only show log lines at or after this time. Either a duration before now, such as 30m, 2h or 7d, or a timestamp such as 2019-03-20T15:04:05Z.",
+				},
+				cli.StringFlag{
+					Name:  "until",
+					Usage: "Only show log lines before this time, in the same format as --since.",
+				},
+				cli.IntFlag{
+					Name:  "limit, n",
+					Usage: "Maximum number of log lines to show, 0 shows all matching lines.",
+					Value: 1000,
+				},
+				cli.BoolFlag{
+					Name:  "reverse",
+					Usage: "Show the oldest log lines first.",
+				},
+				cli.StringFlag{
+					Name:   "log-format, f",
+					Usage:  "Template to format log output, see `timber help tail`.",
+					EnvVar: "TIMBER_LOG_FORMAT",
+					Value:  defaultLogFormat,
+				},
+				cli.IntFlag{
+					Name:  "after-context, A",
+					Usage: "Print `N` log lines from the same source after each matched line, fetched with additional searches.",
+				},
+				cli.IntFlag{
+					Name:  "before-context, B",
+					Usage: "Print `N` log lines from the same source before each matched line.",
+				},
+				cli.IntFlag{
+					Name:  "context, C",
+					Usage: "Print `N` log lines from the same source before and after each matched line.",
+				},
+				cli.BoolFlag{
+					Name:  "same-request",
+					Usage: "Only print context lines with the same context.http.request_id as the matched line.",
+				},
+			},
 			Action: func(ctx *cli.Context) error {
 				err := setGlobalVars(ctx)
 				if err != nil {
 					return err
 				}
 
-				err = listSQLQueries()
+				sourceIds, query, format, err := getLogSelection(ctx, "search")
 				if err != nil {
 					return err
 				}
 
-				return nil
-			},
-			Subcommands: []cli.Command{
+				formatter, err := getLogLineFormatter(format)
+				if err != nil {
+					return err
+				}
+
+				options := &searchOptions{
+					SourceIds: sourceIds,
+					Query:     query,
+					Limit:     ctx.Int("limit"),
+					Reverse:   ctx.Bool("reverse"),
+				}
+
+				options.Context, err = getContextOptions(ctx)
+				if err != nil {
+					return err
+				}
+
+				options.Since, options.Until, err = getTimeRange(ctx, formatter.loc)
+				if err != nil {
+					return err
+				}
+
+				return search(os.Stdout, options, formatter)
+			},
+		},
+
+		{
+			Name:      "trace",
+			Usage:     "Show the log lines of a request, from every source, as a timeline",
+			ArgsUsage: "[request_id]",
+			Description: "Searches for the log lines whose context.http.request_id is request_id and shows how long each step\n" +
+				"   took until the next line. Use --output json, ndjson, yaml or csv to get the steps for other tools.",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:   "source-id, s",
+					Usage:  "The source id(s) to search, every source by default. Can be specified multiple times.",
+					EnvVar: "TIMBER_SOURCE_ID",
+				},
+				cli.StringFlag{
+					Name:  "since",
+					Usage: "Only search log lines at or after this time, in the same format as `timber search --since`.",
+					Value: "24h",
+				},
+				cli.StringFlag{
+					Name:  "until",
+					Usage: "Only search log lines before this time.",
+				},
+				cli.IntFlag{
+					Name:  "limit, n",
+					Usage: "Maximum number of log lines to show, 0 shows all of them.",
+					Value: 1000,
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				err := setGlobalVars(ctx)
+				if err != nil {
+					return err
+				}
+
+				requestID := ctx.Args().Get(0)
+				if requestID == "" {
+					message := "You must supply a request id: timber trace [request_id]"
+					// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+					return cli.NewExitError(message, 65)
+				}
+
+				loc, err := time.LoadLocation(timeZone)
+				if err != nil {
+					return err
+				}
+
+				since, until, err := getTimeRange(ctx, loc)
+				if err != nil {
+					return err
+				}
+				if since == nil {
+					message := "--since can't be empty, the search needs a time window"
+					// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+					return cli.NewExitError(message, 65)
+				}
+
+				options := &traceOptions{
+					RequestID: requestID,
+					SourceIds: ctx.StringSlice("source-id"),
+					Since:     *since,
+					Until:     until,
+					Limit:     ctx.Int("limit"),
+				}
+
+				return trace(os.Stdout, options, loc)
+			},
+		},
+
+		{
+			Name:      "export",
+			Usage:     "Export the log lines of a time range to gzip compressed NDJSON files",
+			ArgsUsage: " ",
+			Description: "Splits the time range in slices and writes the log lines of each slice to its own file in --dir, along\n" +
+				"   with a manifest.json listing the files. The manifest is updated as slices are done, running the\n" +
+				"   command again with the same --dir resumes an interrupted export.",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "dir, d",
+					Usage: "Directory to write the files and the manifest to, it is created if needed.",
+				},
+				cli.StringSliceFlag{
+					Name:   "source-id, s",
+					Usage:  "The source id(s) to export, every source by default. Can be specified multiple times.",
+					EnvVar: "TIMBER_SOURCE_ID",
+				},
+				cli.StringFlag{
+					Name:  "query, q",
+					Usage: "Query to filter the exported log lines. E.g. level:error.",
+				},
+				cli.StringFlag{
+					Name:  "since",
+					Usage: "Export log lines at or after this time, in the same format as `timber search --since`. Not needed to resume an export.",
+				},
+				cli.StringFlag{
+					Name:  "until",
+					Usage: "Export log lines before this time, now by default.",
+				},
+				cli.DurationFlag{
+					Name:  "slice",
+					Usage: "Length of the time slices, each slice is written to a file.",
+					Value: defaultExportSlice,
+				},
+				cli.IntFlag{
+					Name:  "workers, j",
+					Usage: "Number of slices exported at once.",
+					Value: 4,
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				err := setGlobalVars(ctx)
+				if err != nil {
+					return err
+				}
+
+				if ctx.String("dir") == "" {
+					message := "You must supply a directory to export to: timber export --dir [dir]"
+					// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+					return cli.NewExitError(message, 65)
+				}
+
+				if ctx.Duration("slice") < time.Second || ctx.Int("workers") < 1 {
+					message := "--slice must be at least 1s and --workers at least 1"
+					// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+					return cli.NewExitError(message, 65)
+				}
+
+				loc, err := time.LoadLocation(timeZone)
+				if err != nil {
+					return err
+				}
+
+				options := &exportOptions{
+					Dir:       ctx.String("dir"),
+					SourceIds: ctx.StringSlice("source-id"),
+					Query:     ctx.String("query"),
+					Workers:   ctx.Int("workers"),
+				}
+
+				// A resumed export keeps its slices unless --slice is given
+				if ctx.IsSet("slice") {
+					options.Slice = ctx.Duration("slice")
+				}
+
+				options.Since, options.Until, err = getTimeRange(ctx, loc)
+				if err != nil {
+					return err
+				}
+
+				return export(options)
+			},
+		},
+
+		{
+			Name:      "agent",
+			Usage:     "Mirror sources to local files that are rotated, until interrupted",
+			ArgsUsage: " ",
+			Description: "Tails each mirror listed in the YAML config and appends its log lines to a file. Files are rotated by\n" +
+				"   size or every period, and rotated files are compressed and deleted past the retention limits. Each\n" +
+				"   mirror saves a checkpoint, named agent.<name> in `timber tail --list-cursors`, so a restarted agent\n" +
+				"   writes the lines it missed. Example config:\n\n" +
+				"   dir: /var/log/timber\n" +
+				"   rotate:\n" +
+				"     max-size: 100MB   # also every: 24h, compress: true, keep: 10 and max-age: 7d\n" +
+				"   mirrors:\n" +
+				"     - name: web-errors\n" +
+				"       source-id: [1234]\n" +
+				"       query: level:error\n" +
+				"     - name: payments\n" +
+				"       view-id: 5678\n" +
+				"       log-format: json\n" +
+				"       file: payments.ndjson",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "config, c",
+					Usage:  "Path of the agent config, ~/.timber/agent.yml by default.",
+					EnvVar: "TIMBER_AGENT_CONFIG",
+				},
+				cli.BoolFlag{
+					Name:  "check",
+					Usage: "Check the config and list the mirrors without starting them.",
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				err := setGlobalVars(ctx)
+				if err != nil {
+					return err
+				}
+
+				configPath := ctx.String("config")
+				if configPath == "" {
+					configPath, err = getAgentConfigPath()
+					if err != nil {
+						return err
+					}
+				}
+
+				return agent(&agentOptions{ConfigPath: configPath, Check: ctx.Bool("check")})
+			},
+		},
+
+		{
+			Name:      "assert",
+			Usage:     "Check that the number of log lines is below thresholds, e.g. to gate a deploy",
+			ArgsUsage: " ",
+			Description: "Counts the log lines matching --query between --since and --until and compares the count with\n" +
+				"   --max-count, its rate with --max-rate and its increase over an earlier window with --max-increase.\n" +
+				"   Prints a report, as JSON unless --output is set, and exits with 2 when a threshold is exceeded.\n" +
+				"   Large counts are faster with --sql, a query returning the count whose {{since}} and {{until}}\n" +
+				"   placeholders are replaced with the bounds of the window. E.g.\n\n" +
+				"   timber assert --source-id 1234 --query level:error --since 10m --max-count 5\n" +
+				"   timber assert --source-id 1234 --query level:error --max-increase 50% --compare-to previous-window",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:   "source-id, s",
+					Usage:  "The source id(s) to count log lines of. Can be specified multiple times.",
+					EnvVar: "TIMBER_SOURCE_ID",
+				},
+				cli.StringFlag{
+					Name:   "view-id, v",
+					Usage:  "A saved view providing the sources and query.",
+					EnvVar: "TIMBER_VIEW_ID",
+				},
+				cli.StringFlag{
+					Name:  "query, q",
+					Usage: "Query of the counted log lines. E.g. level:error.",
+				},
+				cli.StringFlag{
+					Name:  "sql",
+					Usage: "SQL query returning the count instead of searching, with {{since}} and {{until}} placeholders.",
+				},
+				cli.StringFlag{
+					Name:  "since",
+					Usage: "Start of the window, a duration before now such as 10m or a time.",
+					Value: "10m",
+				},
+				cli.StringFlag{
+					Name:  "until",
+					Usage: "End of the window, now by default.",
+				},
+				cli.Int64Flag{
+					Name:  "max-count",
+					Usage: "Fail when the window has more log lines.",
+				},
+				cli.StringFlag{
+					Name:  "max-rate",
+					Usage: "Fail when there are more log lines per second, minute or hour. E.g. 10/m, per minute by default.",
+				},
+				cli.StringFlag{
+					Name:  "max-increase",
+					Usage: "Fail when the count increased more than this percentage over the window of --compare-to. E.g. 50%.",
+				},
+				cli.StringFlag{
+					Name:  "compare-to",
+					Usage: "Window compared with --max-increase: previous-window, the window before, or a duration earlier such as 1d.",
+					Value: "previous-window",
+				},
+				cli.IntFlag{
+					Name:  "limit",
+					Usage: "Maximum number of log lines counted per window when searching.",
+					Value: 100000,
+				},
+				cli.DurationFlag{
+					Name:  "timeout",
+					Usage: "Exit with 124 if the log lines could not be counted within this duration, 0 for no limit.",
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				err := setGlobalVars(ctx)
+				if err != nil {
+					return err
+				}
+
+				if !ctx.GlobalIsSet("output") && !isConfigured("output") && globalStringWithProfile(ctx, "output") == outputTable {
+					output.Format = outputJSON
+				}
+
+				options, err := getAssertOptions(ctx)
+				if err != nil {
+					return err
+				}
+
+				return assert(os.Stdout, options)
+			},
+		},
+
+		{
+			Name:      "wait",
+			Usage:     "Wait until log lines matching a query are logged, e.g. in integration tests",
+			ArgsUsage: " ",
+			Description: "Tails the query and prints the matching log lines, then exits with 0 once --count lines matched, or\n" +
+				"   with 124 when --timeout passes first. Nothing else is printed, so the output can be used by scripts.\n" +
+				"   E.g. timber wait --source-id 1234 --query 'message:\"ready\"' --since 1m --timeout 5m",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:   "source-id, s",
+					Usage:  "The source id(s) to wait for log lines from. Can be specified multiple times.",
+					EnvVar: "TIMBER_SOURCE_ID",
+				},
+				cli.StringFlag{
+					Name:   "view-id, v",
+					Usage:  "A saved view providing the sources, query and format.",
+					EnvVar: "TIMBER_VIEW_ID",
+				},
+				cli.StringFlag{
+					Name:  "query, q",
+					Usage: "Query of the log lines to wait for. E.g. context.http.request_id:abc123.",
+				},
+				cli.StringFlag{
+					Name:  "where, w",
+					Usage: "Only match log lines matching an expression, evaluated locally after --query, see `timber help tail`.",
+				},
+				cli.StringSliceFlag{
+					Name:  "exclude",
+					Usage: "Don't match log lines whose rendered text matches a regular expression. Can be specified multiple times.",
+				},
+				cli.StringFlag{
+					Name:   "log-format, f",
+					Usage:  "Template to format the printed log lines, see `timber help tail`.",
+					EnvVar: "TIMBER_LOG_FORMAT",
+					Value:  defaultLogFormat,
+				},
+				cli.IntFlag{
+					Name:  "count, c",
+					Usage: "Number of matching log lines to wait for.",
+					Value: 1,
+				},
+				cli.DurationFlag{
+					Name:  "timeout",
+					Usage: "Exit with 124 if the log lines didn't arrive within this duration, 0 waits until interrupted.",
+					Value: 5 * time.Minute,
+				},
+				cli.StringFlag{
+					Name:  "since",
+					Usage: "Also match log lines logged since this time, e.g. 1m, so that lines logged before waiting started count.",
+				},
+				cli.StringFlag{
+					Name:   "transport",
+					Usage:  "How to receive new log lines: sse, poll or auto, see `timber help tail`.",
+					EnvVar: "TIMBER_TRANSPORT",
+					Value:  api.TransportAuto,
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				err := setGlobalVars(ctx)
+				if err != nil {
+					return err
+				}
+
+				if ctx.Int("count") < 1 || ctx.Duration("timeout") < 0 {
+					// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+					return cli.NewExitError("--count must be at least 1 and --timeout can't be negative", 65)
+				}
+
+				sourceIds, query, format, err := getLogSelection(ctx, "wait")
+				if err != nil {
+					return err
+				}
+
+				formatter, err := getLogLineFormatter(format)
+				if err != nil {
+					return err
+				}
+
+				filter, err := getLogLineFilter(ctx, formatter)
+				if err != nil {
+					return err
+				}
+
+				loc, err := time.LoadLocation(timeZone)
+				if err != nil {
+					return err
+				}
+
+				since, _, err := getTimeRange(ctx, loc)
+				if err != nil {
+					return err
+				}
+
+				options := &waitOptions{
+					SourceIds: sourceIds,
+					Query:     query,
+					Transport: ctx.String("transport"),
+					Count:     ctx.Int("count"),
+					Timeout:   ctx.Duration("timeout"),
+					Since:     since,
+				}
+
+				return wait(os.Stdout, options, formatter, filter)
+			},
+		},
+
+		{
+			Name:  "sources",
+			Usage: "Manage your Timber sources",
+			Flags: []cli.Flag{},
+			Action: func(ctx *cli.Context) error {
+				err := setGlobalVars(ctx)
+				if err != nil {
+					return err
+				}
+
+				err = listSources()
+				if err != nil {
+					return err
+				}
+
+				return nil
+			},
+		},
+
+		{
+			Name:  "sql-queries",
+			Usage: "Manage SQL queries",
+			Flags: []cli.Flag{},
+			Action: func(ctx *cli.Context) error {
+				err := setGlobalVars(ctx)
+				if err != nil {
+					return err
+				}
+
+				err = listSQLQueries()
+				if err != nil {
+					return err
+				}
+
+				return nil
+			},
+			Subcommands: []cli.Command{
+				{
+					Name:      "cancel",
+					Usage:     "Cancel a running SQL query",
+					ArgsUsage: "[sql_query_id]",
+					Action: func(ctx *cli.Context) error {
+						err := setGlobalVars(ctx)
+						if err != nil {
+							return err
+						}
+
+						id := ctx.Args().Get(0)
+						if id == "" {
+							message := "You must supply the ID of the SQL query to cancel\n" +
+								"Run `timber sql-queries` to list recent SQL queries"
+							// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+							return cli.NewExitError(message, 65)
+						}
+
+						return cancelSQLQuery(id)
+					},
+				},
 				{
 					Name:      "download",
 					Usage:     "Download the results of a SQL query",
@@ -384,7 +1220,7 @@ func main() {
 
 						id := ctx.Args().Get(0)
 
-						sqlQuery, err := client.GetSQLQuery(id)
+						sqlQuery, err := client.GetSQLQueryContext(rootContext, id)
 						if err != nil {
 							return err
 						}
@@ -405,17 +1241,37 @@ func main() {
 					Name:      "execute",
 					Usage:     "Execute a SQL query",
 					ArgsUsage: "[sql_query]",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "all, a",
+							Usage: "Fetch every page of results instead of only the first --max-per-page results.",
+						},
+						cli.StringFlag{
+							Name:  "format",
+							Usage: "Export results as csv, json, ndjson or parquet instead of displaying a table.",
+						},
+						cli.StringFlag{
+							Name:  "file",
+							Usage: "Write exported results to this file instead of stdout, requires --format.",
+						},
+						cli.DurationFlag{
+							Name:  "timeout",
+							Usage: "Cancel the query if it hasn't completed within this duration, e.g. 30s or 5m.",
+						},
+					},
 					Action: func(ctx *cli.Context) error {
 						err := setGlobalVars(ctx)
 						if err != nil {
 							return err
 						}
 
-						maxColumns := ctx.GlobalInt("max-columns")
-						maxColumnLength := ctx.GlobalInt("max-column-length")
-						maxPerPage := ctx.GlobalInt("max-per-page")
+						options, err := getSQLResultsOptions(ctx)
+						if err != nil {
+							return err
+						}
+
 						query := ctx.Args().Get(0)
-						return executeSQLQuery(query, maxColumns, maxColumnLength, maxPerPage)
+						return executeSQLQuery(query, options)
 					},
 				},
 				{
@@ -424,106 +1280,259 @@ func main() {
 					ArgsUsage: "[sql_query_id]",
 					Flags: []cli.Flag{
 						cli.BoolFlag{
-							Name:  "info, i",
-							Usage: "Prints query info.",
+							Name:  "info, i",
+							Usage: "Prints query info.",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						err := setGlobalVars(ctx)
+						if err != nil {
+							return err
+						}
+
+						id := ctx.Args().Get(0)
+
+						sqlQuery, err := client.GetSQLQueryContext(rootContext, id)
+						if err != nil {
+							return err
+						}
+
+						return printSQLQueryInfo(sqlQuery)
+					},
+				},
+				{
+					Name:      "results",
+					Usage:     "Get the results of a SQL query",
+					ArgsUsage: "[sql_query_id]",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "info, i",
+							Usage: "Prints query info.",
+						},
+						cli.BoolFlag{
+							Name:  "all, a",
+							Usage: "Fetch every page of results instead of only the first --max-per-page results.",
+						},
+						cli.StringFlag{
+							Name:  "format",
+							Usage: "Export results as csv, json, ndjson or parquet instead of displaying a table.",
+						},
+						cli.StringFlag{
+							Name:  "file",
+							Usage: "Write exported results to this file instead of stdout, requires --format.",
+						},
+						cli.DurationFlag{
+							Name:  "timeout",
+							Usage: "Cancel the query if it hasn't completed within this duration, e.g. 30s or 5m.",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						err := setGlobalVars(ctx)
+						if err != nil {
+							return err
+						}
+
+						options, err := getSQLResultsOptions(ctx)
+						if err != nil {
+							return err
+						}
+
+						id := ctx.Args().Get(0)
+
+						sqlQuery, err := client.GetSQLQueryContext(rootContext, id)
+						if err != nil {
+							return err
+						}
+
+						sqlQuery, err = awaitSQLQuery(rootContext, sqlQuery, options.Timeout)
+						if err != nil {
+							return err
+						}
+
+						if options.Format != "" {
+							return exportSQLQueryResults(sqlQuery, options)
+						}
+
+						fmt.Println()
+
+						if ctx.IsSet("info") {
+							err = printSQLQueryInfo(sqlQuery)
+							if err != nil {
+								return err
+							}
+
+							fmt.Println("Results:")
+							fmt.Println()
+						}
+
+						err = listSQLQueryResults(sqlQuery, options)
+						if err != nil {
+							return err
+						}
+
+						fmt.Println()
+						fmt.Println(separator)
+						fmt.Println()
+
+						fmt.Fprintln(infoWriter, "Add the `--max-columns` flag to adjust the number of columns shown (default 10)")
+						fmt.Fprintln(infoWriter, "Add the `--max-length` flag to adjust the max length of each column (default 10)")
+						fmt.Fprintln(infoWriter, "Add the `--max-results` flag to adjust the number of rows / results shown (default 25)")
+						fmt.Fprintln(infoWriter, "Run `timber help` for more details")
+
+						return nil
+					},
+				},
+			},
+		},
+
+		{
+			Name:  "sql",
+			Usage: "Start an interactive SQL shell",
+			Description: "Queries can span several lines and run once they end with a semicolon.\n" +
+				"   Type \\? in the shell for the list of commands.",
+			Action: func(ctx *cli.Context) error {
+				err := setGlobalVars(ctx)
+				if err != nil {
+					return err
+				}
+
+				// The shell only displays tables, so the export, --all and
+				// --timeout flags of the other sql commands don't apply
+				options := &sqlResultsOptions{
+					MaxColumns:      ctx.GlobalInt("max-columns"),
+					MaxColumnLength: ctx.GlobalInt("max-column-length"),
+					MaxResults:      ctx.GlobalInt("max-per-page"),
+				}
+
+				return runSQLShell(options)
+			},
+		},
+
+		{
+			Name:  "views",
+			Usage: "Manage your saved views (only console views are supported in the CLI)",
+			Flags: []cli.Flag{},
+			Action: func(ctx *cli.Context) error {
+				err := setGlobalVars(ctx)
+				if err != nil {
+					return err
+				}
+
+				return listSavedViews()
+			},
+		},
+
+		{
+			Name:      "config",
+			Usage:     "Show and change the settings of ~/.timber/config, /etc/timber/config and .timber.toml files",
+			ArgsUsage: " ",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "show-origin",
+					Usage: "Show where each value comes from",
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				err := setProfile(ctx, false)
+				if err != nil {
+					return err
+				}
+
+				err = setOutput(ctx)
+				if err != nil {
+					return err
+				}
+
+				return listConfig(ctx, ctx.Bool("show-origin"))
+			},
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "list every setting with its value",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "show-origin",
+							Usage: "Show where each value comes from",
 						},
 					},
 					Action: func(ctx *cli.Context) error {
-						err := setGlobalVars(ctx)
+						err := setProfile(ctx, false)
 						if err != nil {
 							return err
 						}
 
-						id := ctx.Args().Get(0)
-
-						sqlQuery, err := client.GetSQLQuery(id)
+						err = setOutput(ctx)
 						if err != nil {
 							return err
 						}
 
-						return printSQLQueryInfo(sqlQuery)
+						return listConfig(ctx, ctx.Bool("show-origin"))
 					},
 				},
 				{
-					Name:      "results",
-					Usage:     "Get the results of a SQL query",
-					ArgsUsage: "[sql_query_id]",
+					Name:      "get",
+					Usage:     "show the value of a setting",
+					ArgsUsage: "[name]",
 					Flags: []cli.Flag{
 						cli.BoolFlag{
-							Name:  "info, i",
-							Usage: "Prints query info.",
+							Name:  "show-origin",
+							Usage: "Show where the value comes from",
 						},
 					},
 					Action: func(ctx *cli.Context) error {
-						err := setGlobalVars(ctx)
-						if err != nil {
-							return err
-						}
+						name := ctx.Args().Get(0)
 
-						id := ctx.Args().Get(0)
-
-						sqlQuery, err := client.GetSQLQuery(id)
-						if err != nil {
-							return err
+						if name == "" {
+							message := "You must supply a setting name: timber config get [name]"
+							// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+							return cli.NewExitError(message, 65)
 						}
 
-						sqlQuery, err = waitForSQLQuery(sqlQuery)
+						err := setProfile(ctx, false)
 						if err != nil {
 							return err
 						}
 
-						fmt.Print("\r                                                                                     \r")
-
-						fmt.Println()
-
-						if ctx.IsSet("info") {
-							err = printSQLQueryInfo(sqlQuery)
-							if err != nil {
-								return err
-							}
+						return getConfig(ctx, name, ctx.Bool("show-origin"))
+					},
+				},
+				{
+					Name:      "set",
+					Usage:     "change a setting in ~/.timber/config, or in the profile given with --profile",
+					ArgsUsage: "[name] [value]",
+					Flags:     configFileFlags,
+					Action: func(ctx *cli.Context) error {
+						name := ctx.Args().Get(0)
 
-							fmt.Println("Results:")
-							fmt.Println()
+						if name == "" || ctx.NArg() < 2 {
+							message := "You must supply a setting name and value: timber config set [name] [value]"
+							// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+							return cli.NewExitError(message, 65)
 						}
 
-						maxColumns := ctx.GlobalInt("max-columns")
-						maxColumnLength := ctx.GlobalInt("max-column-length")
-						maxPerPage := ctx.GlobalInt("max-per-page")
+						return setConfig(ctx, name, ctx.Args().Get(1))
+					},
+				},
+				{
+					Name:      "unset",
+					Usage:     "remove a setting from ~/.timber/config, or from the profile given with --profile",
+					ArgsUsage: "[name]",
+					Flags:     configFileFlags,
+					Action: func(ctx *cli.Context) error {
+						name := ctx.Args().Get(0)
 
-						err = listSQLQueryResults(sqlQuery, maxColumns, maxColumnLength, maxPerPage)
-						if err != nil {
-							return err
+						if name == "" {
+							message := "You must supply a setting name: timber config unset [name]"
+							// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+							return cli.NewExitError(message, 65)
 						}
 
-						fmt.Println()
-						fmt.Println(separator)
-						fmt.Println()
-
-						fmt.Fprintln(infoWriter, "Add the `--max-columns` flag to adjust the number of columns shown (default 10)")
-						fmt.Fprintln(infoWriter, "Add the `--max-length` flag to adjust the max length of each column (default 10)")
-						fmt.Fprintln(infoWriter, "Add the `--max-results` flag to adjust the number of rows / results shown (default 25)")
-						fmt.Fprintln(infoWriter, "Run `timber help` for more details")
-
-						return nil
+						return unsetConfig(ctx, name)
 					},
 				},
 			},
 		},
 
-		{
-			Name:  "views",
-			Usage: "Manage your saved views (only console views are supported in the CLI)",
-			Flags: []cli.Flag{},
-			Action: func(ctx *cli.Context) error {
-				err := setGlobalVars(ctx)
-				if err != nil {
-					return err
-				}
-
-				return listSavedViews()
-			},
-		},
-
 		{
 			Name:      "api",
 			Usage:     "Issue authenticated requests to the Timber API (http://docs.api.timber.io)",
@@ -575,8 +1584,15 @@ func main() {
 	// 	return nil
 	// }
 
-	err := app.Run(os.Args)
-	if err != nil {
+	err := loadConfig(app)
+	if err == nil {
+		err = app.Run(os.Args)
+	}
+
+	if err != nil && rootContext.Err() != nil {
+		// Interrupted, the error is only the request being cancelled
+		os.Exit(exitCodeInterrupted)
+	} else if err != nil {
 		errWriter.Write([]byte(err.Error()))
 		// Exit with 1, EX_USAGE, to indicate a command line usage error
 		os.Exit(1)
@@ -588,7 +1604,12 @@ func main() {
 // default behavior that we do not want to override, so we call this method within
 // each action instead.
 func setGlobalVars(ctx *cli.Context) error {
-	err := setAPIKey(ctx)
+	err := setProfile(ctx, false)
+	if err != nil {
+		return err
+	}
+
+	err = setCredentialStore(ctx)
 	if err != nil {
 		return err
 	}
@@ -598,18 +1619,64 @@ func setGlobalVars(ctx *cli.Context) error {
 		return err
 	}
 
+	err = setAPIKey(ctx)
+	if err != nil {
+		return err
+	}
+
 	err = setTimeZone(ctx)
 	if err != nil {
 		return err
 	}
 
+	err = setOutput(ctx)
+	if err != nil {
+		return err
+	}
+
 	setClient(ctx)
 
 	return nil
 }
 
+// setAuthStatusVars is setGlobalVars without the API key, auth status reports
+// a missing key itself
+func setAuthStatusVars(ctx *cli.Context) error {
+	err := setProfile(ctx, false)
+	if err != nil {
+		return err
+	}
+
+	err = setCredentialStore(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = setHost(ctx)
+	if err != nil {
+		return err
+	}
+
+	return setOutput(ctx)
+}
+
 func setAPIKey(ctx *cli.Context) error {
 	apiKey = ctx.GlobalString("api-key")
+	organizationID = globalStringWithProfile(ctx, "organization-id")
+
+	if apiKey == "" && currentProfile != nil {
+		var err error
+		apiKey, err = currentProfile.APIKey(host)
+		if err != nil {
+			return err
+		}
+
+		if apiKey == "" {
+			message := fmt.Sprintf("The %s profile has no API key, run `timber --profile %s auth [api_key]` to add one", currentProfile.Name, currentProfile.Name)
+			// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+			return cli.NewExitError(message, 65)
+		}
+	}
 
 	if apiKey == "" {
 		credential, err := getActiveCredential()
@@ -617,7 +1684,21 @@ func setAPIKey(ctx *cli.Context) error {
 			return err
 		}
 		if credential != nil {
+			err = refreshCredential(credential)
+			if err != nil {
+				return err
+			}
+
 			apiKey = credential.APIKey
+
+			if !ctx.GlobalIsSet("organization-id") {
+				organizationID = credential.OrganizationID
+			}
+
+			// Credentials added with --host keep using that host
+			if credential.Host != "" && !ctx.GlobalIsSet("host") {
+				host = credential.Host
+			}
 		}
 	}
 
@@ -630,7 +1711,7 @@ func setAPIKey(ctx *cli.Context) error {
 }
 
 func setHost(ctx *cli.Context) error {
-	host = ctx.GlobalString("host")
+	host = globalStringWithProfile(ctx, "host")
 
 	if host == "" {
 		message := "Timber host is not set. The default is https://api.timber.io, it appears " +
@@ -644,7 +1725,7 @@ func setHost(ctx *cli.Context) error {
 }
 
 func setTimeZone(ctx *cli.Context) error {
-	timeZone = ctx.GlobalString("time-zone")
+	timeZone = globalStringWithProfile(ctx, "time-zone")
 
 	if timeZone == "" {
 		message := `Time zone is not set. The default is Local, it appears you've overridden "+
@@ -658,8 +1739,378 @@ func setTimeZone(ctx *cli.Context) error {
 }
 
 func setClient(ctx *cli.Context) {
-	client = api.NewClient(host, apiKey)
+	options := []api.ClientOption{}
 	if ctx.GlobalBool("debug") {
-		client.SetLogger(logger)
+		options = append(options, api.WithLogger(logger))
+	}
+
+	client = api.NewClient(host, apiKey, options...)
+}
+
+// getLogSelection resolves the source IDs, query and log format for commands
+// that read log lines. A saved view given with --view-id provides defaults
+// which the --source-id, --query and --log-format flags override.
+func getLogSelection(ctx *cli.Context, command string) ([]string, string, string, error) {
+	var (
+		sourceIds = []string{}
+		format    = defaultLogFormat
+		query     = ""
+	)
+
+	// pull defaults from the config files and the profile, then from the view
+	// if specified
+	if isConfigured("source-id") {
+		sourceIds = strings.Split(configSettings["source-id"].Value, ",")
+	}
+	if isConfigured("log-format") {
+		format = ctx.String("log-format")
+	}
+	if isConfigured("query") {
+		query = ctx.String("query")
+	}
+
+	if currentProfile != nil {
+		if profileSourceIds, ok := currentProfile.Strings("source-id"); ok {
+			sourceIds = profileSourceIds
+		}
+		if profileFormat, ok := currentProfile.String("log-format"); ok {
+			format = profileFormat
+		}
+	}
+
+	if ctx.IsSet("view-id") || isConfigured("view-id") {
+		view, err := client.GetSavedViewContext(rootContext, ctx.String("view-id"))
+		if err != nil {
+			return nil, "", "", err
+		}
+
+		sourceIds = view.ConsoleSettings.SourceIds
+		format = view.ConsoleSettings.LogLineFormat
+		if view.ConsoleSettings.Query != nil {
+			query = *view.ConsoleSettings.Query
+		}
+	}
+
+	if ctx.IsSet("source-id") {
+		sourceIds = ctx.StringSlice("source-id")
 	}
+
+	if len(sourceIds) == 0 {
+		message := fmt.Sprintf("You must supply at least one source ID to %s\n", command) +
+			"1. Run `timber sources` to list all sources\n" +
+			fmt.Sprintf("2. Run `timber %s --source-id [source_id]` with the ID of the source you want to %s", command, command)
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return nil, "", "", cli.NewExitError(message, 65)
+	}
+
+	if ctx.IsSet("log-format") {
+		format = ctx.String("log-format")
+	}
+
+	if ctx.IsSet("query") {
+		query = ctx.String("query")
+	}
+
+	return sourceIds, query, format, nil
+}
+
+// getTUIPanes returns a pane per view when --view-id lists several views,
+// followed by a pane per --source-id. Otherwise there is a pane per source of
+// the log selection.
+func getTUIPanes(ctx *cli.Context) ([]*tuiPane, error) {
+	panes := []*tuiPane{}
+
+	viewIds := []string{}
+	for _, id := range strings.Split(ctx.String("view-id"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			viewIds = append(viewIds, id)
+		}
+	}
+
+	if len(viewIds) > 1 {
+		for _, id := range viewIds {
+			view, err := client.GetSavedViewContext(rootContext, id)
+			if err != nil {
+				return nil, err
+			}
+
+			pane := &tuiPane{title: view.Name, sourceIds: view.ConsoleSettings.SourceIds, query: ctx.String("query")}
+			if !ctx.IsSet("query") && view.ConsoleSettings.Query != nil {
+				pane.query = *view.ConsoleSettings.Query
+			}
+
+			format := view.ConsoleSettings.LogLineFormat
+			if ctx.IsSet("log-format") || format == "" {
+				format = ctx.String("log-format")
+			}
+
+			pane.formatter, err = getLogLineFormatter(format)
+			if err != nil {
+				return nil, err
+			}
+
+			panes = append(panes, pane)
+		}
+
+		if !ctx.IsSet("source-id") {
+			return panes, nil
+		}
+	}
+
+	sourceIds, query, format := ctx.StringSlice("source-id"), ctx.String("query"), ctx.String("log-format")
+	if len(panes) == 0 {
+		var err error
+		sourceIds, query, format, err = getLogSelection(ctx, "tail")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Panes are titled with source names when they can be listed
+	names := map[string]string{}
+	if sources, err := client.ListSourcesContext(rootContext); err == nil {
+		for _, source := range sources {
+			names[source.ID] = source.Name
+		}
+	}
+
+	for _, id := range sourceIds {
+		title := id
+		if name, ok := names[id]; ok {
+			title = fmt.Sprintf("%s (%s)", name, id)
+		}
+
+		formatter, err := getLogLineFormatter(format)
+		if err != nil {
+			return nil, err
+		}
+
+		panes = append(panes, &tuiPane{title: title, sourceIds: []string{id}, query: query, formatter: formatter})
+	}
+
+	return panes, nil
+}
+
+func getLogLineFormatter(format string) (*logLineFormatter, error) {
+	loc, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return nil, err
+	}
+
+	formatter, err := newLogLineFormatter(format, loc, colorize)
+	if err != nil {
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return nil, cli.NewExitError(err.Error(), 65)
+	}
+
+	return formatter, nil
+}
+
+// getLogLineFilter parses --where and --exclude, and adds the --highlight
+// patterns to the formatter
+func getLogLineFilter(ctx *cli.Context, formatter *logLineFormatter) (*logLineFilter, error) {
+	for _, pattern := range ctx.StringSlice("highlight") {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			message := fmt.Sprintf("Invalid --highlight pattern %q: %s", pattern, err)
+			// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+			return nil, cli.NewExitError(message, 65)
+		}
+		formatter.highlights = append(formatter.highlights, re)
+	}
+
+	filter, err := newLogLineFilter(ctx.String("where"), ctx.StringSlice("exclude"), formatter.loc)
+	if err != nil {
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return nil, cli.NewExitError(err.Error(), 65)
+	}
+
+	return filter, nil
+}
+
+// getContextOptions parses -A, -B and -C. Like grep, -A and -B take
+// precedence over -C.
+func getContextOptions(ctx *cli.Context) (*contextOptions, error) {
+	options := &contextOptions{
+		Before:      ctx.Int("context"),
+		After:       ctx.Int("context"),
+		SameRequest: ctx.Bool("same-request"),
+	}
+
+	// IsSet only knows the name the flag was given with
+	if ctx.IsSet("before-context") || ctx.IsSet("B") {
+		options.Before = ctx.Int("before-context")
+	}
+	if ctx.IsSet("after-context") || ctx.IsSet("A") {
+		options.After = ctx.Int("after-context")
+	}
+
+	if options.Before < 0 || options.After < 0 {
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return nil, cli.NewExitError("The number of context lines can't be negative", 65)
+	}
+
+	if options.SameRequest && !options.enabled() {
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return nil, cli.NewExitError("--same-request needs -A, -B or -C", 65)
+	}
+
+	return options, nil
+}
+
+// getTimeRange parses the --since and --until flags, either may be nil when
+// the flag isn't set
+func getTimeRange(ctx *cli.Context, loc *time.Location) (*time.Time, *time.Time, error) {
+	var since, until *time.Time
+	now := time.Now()
+
+	for _, name := range []string{"since", "until"} {
+		if ctx.String(name) == "" {
+			continue
+		}
+
+		t, err := parseTime(ctx.String(name), now, loc)
+		if err != nil {
+			// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+			return nil, nil, cli.NewExitError(err.Error(), 65)
+		}
+
+		if name == "since" {
+			since = &t
+		} else {
+			until = &t
+		}
+	}
+
+	if since != nil && until != nil && !since.Before(*until) {
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return nil, nil, cli.NewExitError("--since must be before --until", 65)
+	}
+
+	return since, until, nil
+}
+
+func getAssertOptions(ctx *cli.Context) (*assertOptions, error) {
+	options := &assertOptions{
+		SQL:     ctx.String("sql"),
+		Limit:   ctx.Int("limit"),
+		Timeout: ctx.Duration("timeout"),
+	}
+
+	if options.SQL == "" {
+		sourceIds, query, _, err := getLogSelection(ctx, "assert")
+		if err != nil {
+			return nil, err
+		}
+		options.SourceIds, options.Query = sourceIds, query
+	}
+
+	loc, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return nil, err
+	}
+
+	since, until, err := getTimeRange(ctx, loc)
+	if err != nil {
+		return nil, err
+	}
+	if since == nil {
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return nil, cli.NewExitError("You must supply --since, the start of the window", 65)
+	}
+
+	options.Since, options.Until = *since, time.Now()
+	if until != nil {
+		options.Until = *until
+	}
+	if !options.Since.Before(options.Until) {
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return nil, cli.NewExitError("--since must be in the past", 65)
+	}
+
+	if ctx.IsSet("max-count") {
+		maxCount := ctx.Int64("max-count")
+		options.MaxCount = &maxCount
+	}
+
+	if ctx.String("max-rate") != "" {
+		rate, unit, err := parseAssertRate(ctx.String("max-rate"))
+		if err != nil {
+			// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+			return nil, cli.NewExitError(err.Error(), 65)
+		}
+		options.MaxRate, options.RateUnit = &rate, unit
+	}
+
+	if ctx.String("max-increase") != "" {
+		percent, err := parseAssertPercent(ctx.String("max-increase"))
+		if err != nil {
+			// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+			return nil, cli.NewExitError(err.Error(), 65)
+		}
+		options.MaxIncrease = &percent
+
+		if compareTo := ctx.String("compare-to"); compareTo == "previous-window" {
+			options.CompareTo = options.Until.Sub(options.Since)
+		} else {
+			options.CompareTo, err = parseDuration(compareTo)
+			if err != nil || options.CompareTo == 0 {
+				message := fmt.Sprintf("Invalid --compare-to %q, use previous-window or a duration such as 1d", compareTo)
+				// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+				return nil, cli.NewExitError(message, 65)
+			}
+		}
+
+		if options.SQL != "" && !assertSQLPlaceholderRegexp.MatchString(options.SQL) {
+			message := "--max-increase runs the --sql query for two windows, use {{since}} and {{until}} in the query"
+			// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+			return nil, cli.NewExitError(message, 65)
+		}
+	} else if ctx.IsSet("compare-to") {
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return nil, cli.NewExitError("--compare-to is used with --max-increase", 65)
+	}
+
+	if options.MaxCount == nil && options.MaxRate == nil && options.MaxIncrease == nil {
+		message := "You must supply a threshold: --max-count, --max-rate or --max-increase"
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return nil, cli.NewExitError(message, 65)
+	}
+
+	return options, nil
+}
+
+func getSQLResultsOptions(ctx *cli.Context) (*sqlResultsOptions, error) {
+	options := &sqlResultsOptions{
+		MaxColumns:      ctx.GlobalInt("max-columns"),
+		MaxColumnLength: ctx.GlobalInt("max-column-length"),
+		MaxResults:      ctx.GlobalInt("max-per-page"),
+		All:             ctx.Bool("all"),
+		Format:          strings.ToLower(ctx.String("format")),
+		File:            ctx.String("file"),
+		Timeout:         ctx.Duration("timeout"),
+	}
+
+	if options.File != "" && options.Format == "" {
+		message := "The --file flag requires an export format, e.g. `--format csv`"
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return nil, cli.NewExitError(message, 65)
+	}
+
+	if options.Format != "" {
+		valid := false
+		for _, format := range sqlExportFormats {
+			if options.Format == format {
+				valid = true
+			}
+		}
+
+		if !valid {
+			message := fmt.Sprintf("Unknown format %q, must be one of %s", options.Format, strings.Join(sqlExportFormats, ", "))
+			// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+			return nil, cli.NewExitError(message, 65)
+		}
+	}
+
+	return options, nil
 }
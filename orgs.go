@@ -1,23 +1,25 @@
 package main
 
 import (
-	"fmt"
 	"os"
-	"text/tabwriter"
+
+	"github.com/timberio/cli/api"
 )
 
+var organizationColumns = []column{
+	{"name", func(i interface{}) string { return i.(*api.Organization).Name }},
+	{"id", func(i interface{}) string { return i.(*api.Organization).ID }},
+	{"slug", func(i interface{}) string { return i.(*api.Organization).Slug }},
+}
+
 func listOrganizations() {
-	orgs, err := client.ListOrganizations()
+	orgs, err := client.ListOrganizationsContext(rootContext)
 	if err != nil {
 		logger.Fatal(err)
 	}
 
-	w := new(tabwriter.Writer)
-	w.Init(os.Stdout, 0, 8, 0, '\t', 0)
-
-	fmt.Fprintln(w, "name\tid\tslug")
-	for _, org := range orgs {
-		fmt.Fprintf(w, "%s\t%s\t%s\n", org.Name, org.ID, org.Slug)
+	err = printList(os.Stdout, orgs, organizationColumns)
+	if err != nil {
+		logger.Fatal(err)
 	}
-	w.Flush()
 }
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+
+	"gopkg.in/urfave/cli.v1"
+)
+
+// Output formats for commands that list resources
+const (
+	outputTable    = "table"
+	outputJSON     = "json"
+	outputNDJSON   = "ndjson"
+	outputYAML     = "yaml"
+	outputCSV      = "csv"
+	outputTemplate = "template"
+)
+
+var outputFormats = []string{outputTable, outputJSON, outputNDJSON, outputYAML, outputCSV}
+
+// outputOptions are set from the global --output, --columns and --template
+// flags
+type outputOptions struct {
+	Format   string
+	Columns  []string
+	Template *template.Template
+}
+
+var output = &outputOptions{Format: outputTable}
+
+// column is a single column of table and CSV output
+type column struct {
+	Name  string
+	Value func(item interface{}) string
+}
+
+func setOutput(ctx *cli.Context) error {
+	output = &outputOptions{Format: strings.ToLower(globalStringWithProfile(ctx, "output"))}
+
+	if output.Format == "" {
+		output.Format = outputTable
+	}
+
+	valid := false
+	for _, format := range outputFormats {
+		if output.Format == format {
+			valid = true
+		}
+	}
+
+	if !valid {
+		message := fmt.Sprintf("Unknown output format %q, must be one of %s", output.Format, strings.Join(outputFormats, ", "))
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return cli.NewExitError(message, 65)
+	}
+
+	if columns := ctx.GlobalString("columns"); columns != "" {
+		for _, name := range strings.Split(columns, ",") {
+			output.Columns = append(output.Columns, strings.TrimSpace(name))
+		}
+	}
+
+	if text := ctx.GlobalString("template"); text != "" {
+		tmpl, err := template.New("output").Funcs(template.FuncMap{
+			"json": func(v interface{}) (string, error) {
+				b, err := json.Marshal(v)
+				return string(b), err
+			},
+			"join": strings.Join,
+		}).Parse(text)
+		if err != nil {
+			// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+			return cli.NewExitError(err.Error(), 65)
+		}
+
+		output.Format = outputTemplate
+		output.Template = tmpl
+	}
+
+	return nil
+}
+
+// isTableOutput reports whether output is meant for humans, hints and other
+// messages should only be printed alongside table output so that structured
+// output stays parseable
+func isTableOutput() bool {
+	return output.Format == outputTable
+}
+
+// printList renders a slice of items in the selected output format. Table and
+// CSV output show the given columns, structured formats render the items
+// themselves.
+func printList(w io.Writer, items interface{}, columns []column) error {
+	values := reflect.ValueOf(items)
+	if values.Kind() != reflect.Slice {
+		return fmt.Errorf("printList expects a slice, got %T", items)
+	}
+
+	list := make([]interface{}, values.Len())
+	for i := range list {
+		list[i] = values.Index(i).Interface()
+	}
+
+	switch output.Format {
+	case outputJSON:
+		json, err := json.MarshalIndent(list, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", json)
+		return err
+
+	case outputNDJSON:
+		encoder := json.NewEncoder(w)
+		for _, item := range list {
+			if err := encoder.Encode(item); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case outputYAML:
+		return writeYAML(w, list)
+
+	case outputTemplate:
+		for _, item := range list {
+			if err := output.Template.Execute(w, item); err != nil {
+				return err
+			}
+			fmt.Fprintln(w)
+		}
+		return nil
+	}
+
+	columns, err := selectColumns(columns)
+	if err != nil {
+		return err
+	}
+
+	if output.Format == outputCSV {
+		csvWriter := csv.NewWriter(w)
+
+		header := make([]string, len(columns))
+		for i, column := range columns {
+			header[i] = column.Name
+		}
+		csvWriter.Write(header)
+
+		for _, item := range list {
+			record := make([]string, len(columns))
+			for i, column := range columns {
+				record[i] = column.Value(item)
+			}
+			csvWriter.Write(record)
+		}
+
+		csvWriter.Flush()
+		return csvWriter.Error()
+	}
+
+	tw := new(tabwriter.Writer)
+	tw.Init(w, 0, 8, 1, '\t', 0)
+
+	header := make([]string, len(columns))
+	for i, column := range columns {
+		header[i] = column.Name
+	}
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+
+	for _, item := range list {
+		row := make([]string, len(columns))
+		for i, column := range columns {
+			row[i] = column.Value(item)
+		}
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+
+	return tw.Flush()
+}
+
+// selectColumns picks the columns named with --columns, in the given order
+func selectColumns(columns []column) ([]column, error) {
+	if len(output.Columns) == 0 {
+		return columns, nil
+	}
+
+	selected := []column{}
+	for _, name := range output.Columns {
+		found := false
+		for _, column := range columns {
+			if strings.EqualFold(column.Name, name) {
+				selected = append(selected, column)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			names := make([]string, len(columns))
+			for i, column := range columns {
+				names[i] = column.Name
+			}
+			message := fmt.Sprintf("Unknown column %q, must be one of: %s", name, strings.Join(names, ", "))
+			// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+			return nil, cli.NewExitError(message, 65)
+		}
+	}
+
+	return selected, nil
+}
+
+//
+// YAML
+//
+
+// writeYAML renders a value as YAML. The value is marshalled to JSON first so
+// that keys follow the json struct tags and the order of the struct fields.
+func writeYAML(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+
+	value, err := decodeOrderedJSON(decoder)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	encodeYAML(&buf, value, 0, false)
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+type orderedKey struct {
+	Key   string
+	Value interface{}
+}
+
+// orderedObject is a JSON object with its keys in document order
+type orderedObject []orderedKey
+
+func decodeOrderedJSON(decoder *json.Decoder) (interface{}, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch token {
+	case json.Delim('{'):
+		object := orderedObject{}
+		for decoder.More() {
+			key, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+
+			value, err := decodeOrderedJSON(decoder)
+			if err != nil {
+				return nil, err
+			}
+
+			object = append(object, orderedKey{Key: key.(string), Value: value})
+		}
+		_, err = decoder.Token()
+		return object, err
+
+	case json.Delim('['):
+		array := []interface{}{}
+		for decoder.More() {
+			value, err := decodeOrderedJSON(decoder)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		_, err = decoder.Token()
+		return array, err
+
+	default:
+		return token, nil
+	}
+}
+
+func encodeYAML(buf *bytes.Buffer, value interface{}, indent int, inline bool) {
+	prefix := strings.Repeat("  ", indent)
+
+	switch v := value.(type) {
+	case orderedObject:
+		if len(v) == 0 {
+			buf.WriteString("{}\n")
+			return
+		}
+
+		for i, kv := range v {
+			if i > 0 || !inline {
+				buf.WriteString(prefix)
+			}
+			buf.WriteString(yamlScalar(kv.Key))
+			buf.WriteString(":")
+
+			switch child := kv.Value.(type) {
+			case orderedObject:
+				if len(child) == 0 {
+					buf.WriteString(" {}\n")
+				} else {
+					buf.WriteString("\n")
+					encodeYAML(buf, child, indent+1, false)
+				}
+			case []interface{}:
+				if len(child) == 0 {
+					buf.WriteString(" []\n")
+				} else {
+					buf.WriteString("\n")
+					encodeYAML(buf, child, indent, false)
+				}
+			default:
+				buf.WriteString(" ")
+				encodeYAML(buf, child, indent, true)
+			}
+		}
+
+	case []interface{}:
+		if len(v) == 0 {
+			buf.WriteString("[]\n")
+			return
+		}
+
+		for i, item := range v {
+			if i > 0 || !inline {
+				buf.WriteString(prefix)
+			}
+			buf.WriteString("- ")
+			encodeYAML(buf, item, indent+1, true)
+		}
+
+	default:
+		buf.WriteString(yamlScalar(v))
+		buf.WriteString("\n")
+	}
+}
+
+func yamlScalar(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case json.Number:
+		return v.String()
+	case string:
+		if yamlNeedsQuotes(v) {
+			return strconv.Quote(v)
+		}
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func yamlNeedsQuotes(s string) bool {
+	if s == "" || strings.TrimSpace(s) != s {
+		return true
+	}
+
+	switch strings.ToLower(s) {
+	case "null", "~", "true", "false", "yes", "no", "on", "off", "y", "n":
+		return true
+	}
+
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return true
+	}
+
+	if strings.ContainsAny(s[:1], "-?:,[]{}#&*!|>'\"%@`") {
+		return true
+	}
+
+	return strings.ContainsAny(s, "\n\t") || strings.Contains(s, ": ") || strings.Contains(s, " #")
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// parquetWriter writes a minimal Apache Parquet file
+// (https://github.com/apache/parquet-format): every column is an optional
+// UTF-8 string, values are PLAIN encoded and uncompressed, and each call to
+// WriteRowGroup writes one row group. Only the row group being written is
+// held in memory, which lets results be exported page by page.
+type parquetWriter struct {
+	w         *countingWriter
+	columns   []string
+	rowGroups [][]byte // thrift encoded RowGroup structs
+	numRows   int64
+}
+
+var parquetMagic = []byte("PAR1")
+
+// Parquet enum values used by the writer
+const (
+	parquetTypeByteArray        = 6
+	parquetRepetitionOptional   = 1
+	parquetConvertedTypeUTF8    = 0
+	parquetEncodingPlain        = 0
+	parquetEncodingRLE          = 3
+	parquetCodecUncompressed    = 0
+	parquetPageTypeDataPage     = 0
+	parquetFormatVersion        = 1
+	parquetCreatedBy            = "timber-cli"
+	parquetMaxDefinitionLevel   = 1
+	parquetDefinitionLevelWidth = 1
+)
+
+type countingWriter struct {
+	w     io.Writer
+	count int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.count += int64(n)
+	return n, err
+}
+
+func newParquetWriter(w io.Writer, columns []string) (*parquetWriter, error) {
+	p := &parquetWriter{w: &countingWriter{w: w}, columns: columns}
+
+	if _, err := p.w.Write(parquetMagic); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// WriteRowGroup writes rows as a row group, nil values are written as nulls
+func (p *parquetWriter) WriteRowGroup(rows [][]*string) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	chunks := &thriftWriter{}
+	chunks.listHeader(thriftStruct, len(p.columns))
+
+	var totalSize int64
+
+	for i, name := range p.columns {
+		page := encodeParquetPage(rows, i)
+
+		header := &thriftWriter{}
+		header.i32Field(1, parquetPageTypeDataPage)
+		header.i32Field(2, int32(len(page)))
+		header.i32Field(3, int32(len(page)))
+		header.structField(5)
+		header.i32Field(1, int32(len(rows)))
+		header.i32Field(2, parquetEncodingPlain)
+		header.i32Field(3, parquetEncodingRLE)
+		header.i32Field(4, parquetEncodingRLE)
+		header.endStruct()
+		header.endStruct()
+
+		offset := p.w.count
+		if _, err := p.w.Write(header.Bytes()); err != nil {
+			return err
+		}
+		if _, err := p.w.Write(page); err != nil {
+			return err
+		}
+
+		size := int64(header.Len() + len(page))
+		totalSize += size
+
+		// ColumnChunk
+		chunks.beginListStruct()
+		chunks.i64Field(2, offset)
+		chunks.structField(3)
+		chunks.i32Field(1, parquetTypeByteArray)
+		chunks.listField(2, thriftI32, 2)
+		chunks.varint(zigzag32(parquetEncodingPlain))
+		chunks.varint(zigzag32(parquetEncodingRLE))
+		chunks.listField(3, thriftBinary, 1)
+		chunks.binary([]byte(name))
+		chunks.i32Field(4, parquetCodecUncompressed)
+		chunks.i64Field(5, int64(len(rows)))
+		chunks.i64Field(6, size)
+		chunks.i64Field(7, size)
+		chunks.i64Field(9, offset)
+		chunks.endStruct()
+		chunks.endStruct()
+	}
+
+	// RowGroup, written as a list element of FileMetaData.row_groups
+	rowGroup := &thriftWriter{}
+	rowGroup.beginListStruct()
+	rowGroup.fieldHeader(1, thriftList)
+	rowGroup.Write(chunks.Bytes())
+	rowGroup.i64Field(2, totalSize)
+	rowGroup.i64Field(3, int64(len(rows)))
+	rowGroup.endStruct()
+
+	p.rowGroups = append(p.rowGroups, rowGroup.Bytes())
+	p.numRows += int64(len(rows))
+
+	return nil
+}
+
+// Close writes the file footer, it does not close the underlying writer
+func (p *parquetWriter) Close() error {
+	meta := &thriftWriter{}
+	meta.i32Field(1, parquetFormatVersion)
+
+	// Schema, a root element followed by one element per column
+	meta.listField(2, thriftStruct, len(p.columns)+1)
+	meta.beginListStruct()
+	meta.binaryField(4, []byte("schema"))
+	meta.i32Field(5, int32(len(p.columns)))
+	meta.endStruct()
+	for _, name := range p.columns {
+		meta.beginListStruct()
+		meta.i32Field(1, parquetTypeByteArray)
+		meta.i32Field(3, parquetRepetitionOptional)
+		meta.binaryField(4, []byte(name))
+		meta.i32Field(6, parquetConvertedTypeUTF8)
+		meta.endStruct()
+	}
+
+	meta.i64Field(3, p.numRows)
+
+	meta.listField(4, thriftStruct, len(p.rowGroups))
+	for _, rowGroup := range p.rowGroups {
+		meta.Write(rowGroup)
+	}
+
+	meta.binaryField(6, []byte(parquetCreatedBy))
+	meta.endStruct()
+
+	footer := meta.Bytes()
+	length := make([]byte, 4)
+	binary.LittleEndian.PutUint32(length, uint32(len(footer)))
+
+	for _, b := range [][]byte{footer, length, parquetMagic} {
+		if _, err := p.w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// encodeParquetPage encodes a column of a row group as the body of a v1 data
+// page: RLE encoded definition levels followed by the non null values
+func encodeParquetPage(rows [][]*string, column int) []byte {
+	levels := &bytes.Buffer{}
+	values := &bytes.Buffer{}
+
+	run := 0
+	runLevel := byte(0)
+	flush := func() {
+		if run > 0 {
+			writeUvarint(levels, uint64(run)<<1)
+			levels.WriteByte(runLevel)
+		}
+	}
+
+	for _, row := range rows {
+		level := byte(0)
+		if column < len(row) && row[column] != nil {
+			level = parquetMaxDefinitionLevel
+
+			length := make([]byte, 4)
+			binary.LittleEndian.PutUint32(length, uint32(len(*row[column])))
+			values.Write(length)
+			values.WriteString(*row[column])
+		}
+
+		if level != runLevel {
+			flush()
+			run = 0
+			runLevel = level
+		}
+		run++
+	}
+	flush()
+
+	page := &bytes.Buffer{}
+	length := make([]byte, 4)
+	binary.LittleEndian.PutUint32(length, uint32(levels.Len()))
+	page.Write(length)
+	page.Write(levels.Bytes())
+	page.Write(values.Bytes())
+
+	return page.Bytes()
+}
+
+//
+// Thrift compact protocol, just enough to write Parquet metadata
+//
+
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+type thriftWriter struct {
+	bytes.Buffer
+	lastField []int16
+	last      int16
+}
+
+func (t *thriftWriter) fieldHeader(id int16, fieldType byte) {
+	delta := id - t.last
+	if delta > 0 && delta <= 15 {
+		t.WriteByte(byte(delta)<<4 | fieldType)
+	} else {
+		t.WriteByte(fieldType)
+		t.varint(zigzag32(int32(id)))
+	}
+	t.last = id
+}
+
+func (t *thriftWriter) i32Field(id int16, v int32) {
+	t.fieldHeader(id, thriftI32)
+	t.varint(zigzag32(v))
+}
+
+func (t *thriftWriter) i64Field(id int16, v int64) {
+	t.fieldHeader(id, thriftI64)
+	t.varint(zigzag64(v))
+}
+
+func (t *thriftWriter) binaryField(id int16, b []byte) {
+	t.fieldHeader(id, thriftBinary)
+	t.binary(b)
+}
+
+func (t *thriftWriter) binary(b []byte) {
+	t.varint(uint64(len(b)))
+	t.Write(b)
+}
+
+func (t *thriftWriter) listField(id int16, elemType byte, size int) {
+	t.fieldHeader(id, thriftList)
+	t.listHeader(elemType, size)
+}
+
+func (t *thriftWriter) listHeader(elemType byte, size int) {
+	if size < 15 {
+		t.WriteByte(byte(size)<<4 | elemType)
+	} else {
+		t.WriteByte(0xf0 | elemType)
+		t.varint(uint64(size))
+	}
+}
+
+// structField starts a nested struct field, close it with endStruct
+func (t *thriftWriter) structField(id int16) {
+	t.fieldHeader(id, thriftStruct)
+	t.beginListStruct()
+}
+
+// beginListStruct starts a struct without a field header, as used for list
+// elements
+func (t *thriftWriter) beginListStruct() {
+	t.lastField = append(t.lastField, t.last)
+	t.last = 0
+}
+
+func (t *thriftWriter) endStruct() {
+	t.WriteByte(0)
+	if len(t.lastField) > 0 {
+		t.last = t.lastField[len(t.lastField)-1]
+		t.lastField = t.lastField[:len(t.lastField)-1]
+	}
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	writeUvarint(&t.Buffer, v)
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(b, v)
+	buf.Write(b[:n])
+}
+
+func zigzag32(v int32) uint64 {
+	return uint64(uint32((v << 1) ^ (v >> 31)))
+}
+
+func zigzag64(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
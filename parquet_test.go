@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// thriftReader decodes the Thrift compact protocol into maps of field id to
+// value, enough to check what parquetWriter writes
+type thriftReader struct {
+	*bytes.Reader
+}
+
+func (t *thriftReader) readStruct() (map[int16]interface{}, error) {
+	fields := map[int16]interface{}{}
+	last := int16(0)
+
+	for {
+		header, err := t.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if header == 0 {
+			return fields, nil
+		}
+
+		id := last + int16(header>>4)
+		if header>>4 == 0 {
+			v, err := binary.ReadUvarint(t)
+			if err != nil {
+				return nil, err
+			}
+			id = int16(unzigzag(v))
+		}
+		last = id
+
+		value, err := t.readValue(header & 0x0f)
+		if err != nil {
+			return nil, err
+		}
+		fields[id] = value
+	}
+}
+
+func (t *thriftReader) readValue(valueType byte) (interface{}, error) {
+	switch valueType {
+	case thriftI32, thriftI64:
+		v, err := binary.ReadUvarint(t)
+		return unzigzag(v), err
+	case thriftBinary:
+		length, err := binary.ReadUvarint(t)
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, length)
+		_, err = io.ReadFull(t, b)
+		return string(b), err
+	case thriftList:
+		header, err := t.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		size := uint64(header >> 4)
+		if size == 15 {
+			if size, err = binary.ReadUvarint(t); err != nil {
+				return nil, err
+			}
+		}
+		list := make([]interface{}, size)
+		for i := range list {
+			if list[i], err = t.readValue(header & 0x0f); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	case thriftStruct:
+		return t.readStruct()
+	default:
+		return nil, fmt.Errorf("unexpected thrift type %d", valueType)
+	}
+}
+
+func unzigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+// field follows a path of field ids and list indexes through decoded structs
+func field(t *testing.T, value interface{}, path ...int) interface{} {
+	t.Helper()
+
+	for _, key := range path {
+		switch v := value.(type) {
+		case map[int16]interface{}:
+			value = v[int16(key)]
+		case []interface{}:
+			if key >= len(v) {
+				t.Fatalf("list index %d out of range in %v", key, path)
+			}
+			value = v[key]
+		default:
+			t.Fatalf("can't follow %v through %T", path, value)
+		}
+	}
+	return value
+}
+
+func TestParquetWriter(t *testing.T) {
+	s := func(s string) *string { return &s }
+
+	buf := &bytes.Buffer{}
+	writer, err := newParquetWriter(buf, []string{"dt", "message"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rowGroups := [][][]*string{
+		{{s("2019-03-20T15:04:05Z"), s("started")}, {s("2019-03-20T15:04:06Z"), nil}},
+		{{s("2019-03-20T15:04:07Z"), s("stopped")}},
+	}
+	for _, rows := range rowGroups {
+		if err := writer.WriteRowGroup(rows); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file := buf.Bytes()
+	if !bytes.HasPrefix(file, parquetMagic) || !bytes.HasSuffix(file, parquetMagic) {
+		t.Fatal("expected the file to start and end with PAR1")
+	}
+
+	footerLength := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	footer := file[len(file)-8-footerLength : len(file)-8]
+	meta, err := (&thriftReader{bytes.NewReader(footer)}).readStruct()
+	if err != nil {
+		t.Fatalf("invalid footer: %v", err)
+	}
+
+	// Schema
+	schema := field(t, meta, 2).([]interface{})
+	if len(schema) != 3 || field(t, schema, 0, 4) != "schema" || field(t, schema, 0, 5) != int64(2) {
+		t.Fatalf("expected a root schema element with 2 columns, got %v", schema)
+	}
+	for i, name := range []string{"dt", "message"} {
+		element := field(t, schema, i+1)
+		if field(t, element, 4) != name ||
+			field(t, element, 1) != int64(parquetTypeByteArray) ||
+			field(t, element, 3) != int64(parquetRepetitionOptional) ||
+			field(t, element, 6) != int64(parquetConvertedTypeUTF8) {
+			t.Fatalf("expected column %d to be an optional UTF-8 string named %s, got %v", i, name, element)
+		}
+	}
+
+	// Row counts
+	if numRows := field(t, meta, 3); numRows != int64(3) {
+		t.Fatalf("expected 3 rows, got %v", numRows)
+	}
+	groups := field(t, meta, 4).([]interface{})
+	if len(groups) != 2 || field(t, groups, 0, 3) != int64(2) || field(t, groups, 1, 3) != int64(1) {
+		t.Fatalf("expected row groups of 2 and 1 rows, got %v", groups)
+	}
+
+	// Data page of the message column in the first row group
+	offset := field(t, groups, 0, 1, 1, 3, 9).(int64)
+	reader := &thriftReader{bytes.NewReader(file[offset:])}
+	header, err := reader.readStruct()
+	if err != nil {
+		t.Fatalf("invalid page header: %v", err)
+	}
+	if field(t, header, 5, 1) != int64(2) {
+		t.Fatalf("expected a page of 2 values, got %v", header)
+	}
+
+	page := make([]byte, field(t, header, 3).(int64))
+	if _, err := io.ReadFull(reader, page); err != nil {
+		t.Fatal(err)
+	}
+
+	// One run of a defined value then one run of a null, then the value
+	levelsLength := binary.LittleEndian.Uint32(page)
+	levels, values := page[4:4+levelsLength], page[4+levelsLength:]
+	if !bytes.Equal(levels, []byte{1 << 1, 1, 1 << 1, 0}) {
+		t.Fatalf("unexpected definition levels %v", levels)
+	}
+	if binary.LittleEndian.Uint32(values) != 7 || string(values[4:]) != "started" {
+		t.Fatalf("unexpected values %q", values)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"gopkg.in/urfave/cli.v1"
+)
+
+// A profile is a table under [profiles] in ~/.timber/config, e.g.
+//
+//	profile = "production"
+//
+//	[profiles.staging]
+//	host = "https://api.staging.timber.io"
+//	organization-id = "1234"
+//	time-zone = "UTC"
+//	source-id = ["5678"]
+//	log-format = "{{ dt }} {{ message }}"
+//	output = "json"
+//
+// Keys are named after the flags they provide defaults for. The API key is
+// either set with api-key or looked up in the credential store with
+// organization-id.
+type profile struct {
+	Name   string
+	values map[string]interface{}
+}
+
+// Settings profiles can set
+var profileSettings = []string{"api-key", "host", "log-format", "organization-id", "output", "source-id", "time-zone"}
+
+func isProfileSetting(name string) bool {
+	for _, setting := range profileSettings {
+		if setting == name {
+			return true
+		}
+	}
+	return false
+}
+
+// The profile in use, nil when none is selected
+var currentProfile *profile
+
+// setProfile selects the profile given with --profile, or the default profile
+// set in the config files. Profiles defined in several config files are
+// merged. A profile that doesn't exist yet is only accepted when create is
+// set.
+func setProfile(ctx *cli.Context, create bool) error {
+	currentProfile = nil
+
+	name := ctx.GlobalString("profile")
+	if name == "" {
+		return nil
+	}
+
+	currentProfile = mergedConfig().Profile(name)
+	if currentProfile != nil {
+		return nil
+	}
+
+	if create {
+		currentProfile = &profile{Name: name, values: map[string]interface{}{}}
+		return nil
+	}
+
+	message := fmt.Sprintf("Profile %q does not exist in %s\n", name, userConfig.path) +
+		fmt.Sprintf("Run `timber --profile %s auth [api_key]` to create it", name)
+	// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+	return cli.NewExitError(message, 65)
+}
+
+func (p *profile) String(key string) (string, bool) {
+	return configString(p.values, key)
+}
+
+func (p *profile) Strings(key string) ([]string, bool) {
+	return configStrings(p.values, key)
+}
+
+// APIKey returns the profile's api-key, or the key of its organization-id on
+// host from the credential store, refreshed if it is about to expire
+func (p *profile) APIKey(host string) (string, error) {
+	if apiKey, ok := p.String("api-key"); ok {
+		return apiKey, nil
+	}
+
+	credential, err := p.Credential(host)
+	if credential == nil || err != nil {
+		return "", err
+	}
+
+	err = refreshCredential(credential)
+	return credential.APIKey, err
+}
+
+// Credential returns the stored credential of the profile's organization-id
+// on host as it is, nil when there is none
+func (p *profile) Credential(host string) (*Credential, error) {
+	orgID, ok := p.String("organization-id")
+	if !ok {
+		return nil, nil
+	}
+
+	credentials, err := loadCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, credential := range credentials {
+		if credential.Matches(orgID, host) {
+			return credential, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// globalStringWithProfile returns a global flag, falling back to the current
+// profile when the flag is neither given on the command line nor in the
+// environment
+func globalStringWithProfile(ctx *cli.Context, name string) string {
+	if !ctx.GlobalIsSet(name) && currentProfile != nil {
+		if value, ok := currentProfile.String(name); ok {
+			return value
+		}
+	}
+	return ctx.GlobalString(name)
+}
+
+//
+// Config file
+//
+
+func (c *configFile) DefaultProfile() string {
+	name, _ := configString(c.values, "profile")
+	return name
+}
+
+func (c *configFile) Profile(name string) *profile {
+	values := c.Table("profiles", name)
+	if values == nil {
+		return nil
+	}
+	return &profile{Name: name, values: values}
+}
+
+func (c *configFile) ProfileNames() []string {
+	names := []string{}
+	for name, values := range c.Table("profiles") {
+		if _, ok := values.(map[string]interface{}); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ProfileTable returns the table of a profile, creating it if needed
+func (c *configFile) ProfileTable(name string) (map[string]interface{}, error) {
+	return tomlTable(c.values, []string{"profiles", name})
+}
+
+// DeleteProfile removes a profile, and unsets it as the default profile
+func (c *configFile) DeleteProfile(name string) bool {
+	profiles := c.Table("profiles")
+	if _, ok := profiles[name]; !ok {
+		return false
+	}
+
+	delete(profiles, name)
+	if c.DefaultProfile() == name {
+		delete(c.values, "profile")
+	}
+	return true
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// rotation is when a rotatingFile is rotated and how long rotated files are
+// kept. Zero values disable a limit.
+type rotation struct {
+	MaxSize  int64         // bytes
+	Every    time.Duration // rotated when the clock enters a new period, e.g. every hour at :00
+	Compress bool          // gzip rotated files
+	Keep     int           // rotated files kept
+	MaxAge   time.Duration // rotated files older than this are deleted
+}
+
+// rotatingFile appends lines to a file which is renamed with the time of the
+// rotation as a suffix, e.g. web.log.20190320T150405Z, once it is too large
+// or too old
+type rotatingFile struct {
+	path     string
+	rotation rotation
+	file     *os.File
+	buffered *bufio.Writer
+	size     int64
+	period   time.Time // of the current file, when rotating every period
+}
+
+// openRotatingFile appends to the file if it exists, rotating it first when
+// its period has already passed
+func openRotatingFile(path string, r rotation) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, rotation: r}
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	err = f.open(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	if f.size > 0 {
+		info, err := f.file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		f.period = f.periodOf(info.ModTime())
+	}
+
+	err = f.RotateIfDue(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return f, f.prune()
+}
+
+func (f *rotatingFile) open(now time.Time) error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.buffered = bufio.NewWriter(file)
+	f.size = info.Size()
+	f.period = f.periodOf(now)
+	return nil
+}
+
+func (f *rotatingFile) periodOf(t time.Time) time.Time {
+	if f.rotation.Every <= 0 {
+		return time.Time{}
+	}
+	return t.UTC().Truncate(f.rotation.Every)
+}
+
+// WriteLine appends a line, rotating the file first when the line would make
+// it larger than MaxSize
+func (f *rotatingFile) WriteLine(line string) error {
+	if f.rotation.MaxSize > 0 && f.size > 0 && f.size+int64(len(line))+1 > f.rotation.MaxSize {
+		if err := f.Rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := f.buffered.WriteString(line)
+	f.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	err = f.buffered.WriteByte('\n')
+	if err == nil {
+		f.size++
+	}
+	return err
+}
+
+// RotateIfDue rotates the file when now is in a later period than the
+// file. Empty files aren't rotated.
+func (f *rotatingFile) RotateIfDue(now time.Time) error {
+	if f.rotation.Every <= 0 || f.size == 0 || !f.periodOf(now).After(f.period) {
+		return nil
+	}
+	return f.Rotate()
+}
+
+// Rotate renames the file and starts a new one, then compresses the renamed
+// file and deletes the rotated files past the retention limits
+func (f *rotatingFile) Rotate() error {
+	err := f.Close()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	rotated := f.path + "." + now.UTC().Format("20060102T150405Z")
+	for i := 1; fileExists(rotated) || fileExists(rotated+".gz"); i++ {
+		rotated = fmt.Sprintf("%s.%s-%d", f.path, now.UTC().Format("20060102T150405Z"), i)
+	}
+
+	err = os.Rename(f.path, rotated)
+	if err != nil {
+		return err
+	}
+
+	err = f.open(now)
+	if err != nil {
+		return err
+	}
+
+	return f.prune()
+}
+
+func (f *rotatingFile) Flush() error {
+	return f.buffered.Flush()
+}
+
+func (f *rotatingFile) Close() error {
+	err := f.buffered.Flush()
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// prune compresses the rotated files, including ones left uncompressed by a
+// previous run that stopped while compressing, and applies Keep and MaxAge
+func (f *rotatingFile) prune() error {
+	pattern := regexp.MustCompile(`^` + regexp.QuoteMeta(filepath.Base(f.path)) + `\.\d{8}T\d{6}Z(-\d+)?(\.gz)?$`)
+
+	candidates, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return err
+	}
+
+	rotated := []os.FileInfo{}
+	for _, filename := range candidates {
+		if !pattern.MatchString(filepath.Base(filename)) {
+			continue
+		}
+
+		if f.rotation.Compress && !strings.HasSuffix(filename, ".gz") {
+			err = gzipFile(filename)
+			if err != nil {
+				return err
+			}
+			filename += ".gz"
+		}
+
+		info, err := os.Stat(filename)
+		if err != nil {
+			return err
+		}
+		rotated = append(rotated, info)
+	}
+
+	// Newest first, files are last written when they are rotated
+	sort.Slice(rotated, func(i, j int) bool {
+		if !rotated[i].ModTime().Equal(rotated[j].ModTime()) {
+			return rotated[i].ModTime().After(rotated[j].ModTime())
+		}
+		return rotated[i].Name() > rotated[j].Name()
+	})
+
+	for i, info := range rotated {
+		expired := f.rotation.Keep > 0 && i >= f.rotation.Keep
+		expired = expired || (f.rotation.MaxAge > 0 && time.Since(info.ModTime()) > f.rotation.MaxAge)
+
+		if expired {
+			filename := filepath.Join(filepath.Dir(f.path), info.Name())
+			logger.Debugf("Deleting the rotated file %s", filename)
+			if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// gzipFile replaces a file with a .gz file, keeping its modification time
+func gzipFile(filename string) error {
+	in, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(filename+".gz.tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	compressed := gzip.NewWriter(out)
+	if _, err := io.Copy(compressed, in); err != nil {
+		return err
+	}
+	if err := compressed.Close(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	err = os.Rename(out.Name(), filename+".gz")
+	if err != nil {
+		return err
+	}
+
+	os.Chtimes(filename+".gz", info.ModTime(), info.ModTime())
+	return os.Remove(filename)
+}
+
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/timberio/cli/api"
+)
+
+type searchOptions struct {
+	SourceIds []string
+	Query     string
+	Since     *time.Time
+	Until     *time.Time
+	Limit     int // 0 for no limit
+	Reverse   bool
+	Context   *contextOptions
+}
+
+// search pages through historical log lines and prints each page as soon as
+// it is received, so that large result sets aren't held in memory
+func search(w io.Writer, options *searchOptions, formatter *logLineFormatter) error {
+	searchRequest := api.NewSearchRequest()
+	searchRequest.ApplicationIds = options.SourceIds
+	searchRequest.Query = options.Query
+	searchRequest.DtGte = options.Since
+	searchRequest.DtLt = options.Until
+
+	if options.Reverse {
+		searchRequest.Sort = "dt.asc"
+	}
+
+	if options.Limit > 0 && options.Limit < searchRequest.Limit {
+		searchRequest.Limit = options.Limit
+	}
+
+	pager := client.NewSearchPager(searchRequest)
+	tracker := newContextTracker()
+	printed := 0
+
+	for {
+		logLines, err := pager.NextContext(rootContext)
+		if err != nil {
+			return err
+		}
+
+		if len(logLines) == 0 {
+			break
+		}
+
+		if options.Limit > 0 && printed+len(logLines) > options.Limit {
+			logLines = logLines[:options.Limit-printed]
+		}
+
+		if options.Context.enabled() {
+			err = printLogLinesWithContext(w, formatter, options, tracker, logLines)
+		} else {
+			err = printLogLines(w, formatter, nil, logLines)
+		}
+		if err != nil {
+			return err
+		}
+
+		printed += len(logLines)
+		if options.Limit > 0 && printed >= options.Limit {
+			break
+		}
+	}
+
+	if printed == 0 {
+		fmt.Fprintln(errWriter, "No log lines found")
+	}
+
+	warnSkipped(pager.Skipped(), formatter.loc)
+	return nil
+}
+
+// warnSkipped tells on stderr, so that output stays parseable, that log
+// lines sharing the timestamps may have been skipped by a SearchPager
+func warnSkipped(skipped []time.Time, loc *time.Location) {
+	if len(skipped) == 0 {
+		return
+	}
+
+	at := skipped[0].In(loc).Format("Jan 02 03:04:05.000pm")
+	if len(skipped) > 1 {
+		at += fmt.Sprintf(" and %d other timestamps", len(skipped)-1)
+	}
+	fmt.Fprintf(os.Stderr, "⚠  A page of log lines or more share %s, some of them may have been skipped\n", at)
+}
+
+// printLogLinesWithContext prints a page of log lines with the lines around
+// them, see -A, -B and -C
+func printLogLinesWithContext(w io.Writer, formatter *logLineFormatter, options *searchOptions, tracker *contextTracker, logLines []*api.LogLine) error {
+	contexts, err := fetchContexts(rootContext, options.Context, options.SourceIds, logLines)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range logLines {
+		formatted, err := formatter.Format(line)
+		if err != nil {
+			return err
+		}
+
+		c := contexts[line.ID]
+		tracker.trim(line, c, contexts)
+
+		err = printWithContext(w, formatter, formatted, c, !options.Reverse)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var relativeTimeRegexp = regexp.MustCompile(`^(\d+)(d|w)$`)
+
+// parseTime parses the value of flags such as --since and --until. Relative
+// values are durations before now, like "30m", "2h" or "7d". Absolute values
+// are RFC 3339 timestamps, or dates and times without an offset which are
+// read in the given location.
+func parseTime(value string, now time.Time, loc *time.Location) (time.Time, error) {
+	value = strings.TrimSpace(value)
+
+	if value == "now" {
+		return now, nil
+	}
+
+	if match := relativeTimeRegexp.FindStringSubmatch(value); match != nil {
+		n, _ := strconv.Atoi(match[1])
+		days := n
+		if match[2] == "w" {
+			days = n * 7
+		}
+		return now.AddDate(0, 0, -days), nil
+	}
+
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("Invalid time %q, use a duration such as 30m, 2h or 7d, or a timestamp such as 2019-03-20T15:04:05Z", value)
+}
+
+// parseDuration parses Go durations and the days and weeks accepted by
+// --since, e.g. 7d or 2w
+func parseDuration(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+
+	if match := relativeTimeRegexp.FindStringSubmatch(value); match != nil {
+		n, _ := strconv.Atoi(match[1])
+		if match[2] == "w" {
+			n *= 7
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q, use e.g. 30m, 24h or 7d", value)
+	}
+	return d, nil
+}
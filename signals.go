@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// rootContext is cancelled when the CLI is interrupted, commands pass it to
+// the API client so that requests, tails and SQL queries stop cleanly
+var rootContext = context.Background()
+
+// stopInterrupts restores the default handling of interrupts, for commands
+// such as the SQL shell that handle Ctrl-C themselves
+var stopInterrupts = func() {}
+
+// interrupt handles Ctrl-C as a SIGINT, for commands reading keys from a
+// terminal in raw mode where Ctrl-C doesn't send a signal
+var interrupt = func() {}
+
+// interruptContext returns a context that is cancelled on the first SIGINT or
+// SIGTERM. A second signal exits straight away in case cleaning up hangs.
+// Calling interrupt has the same effect as a SIGINT, calling stop restores
+// the default handling of signals.
+func interruptContext(parent context.Context) (context.Context, func(), func()) {
+	ctx, cancel := context.WithCancel(parent)
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	interrupt := func() {
+		select {
+		case signals <- os.Interrupt:
+		default:
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-done:
+			return
+		}
+
+		select {
+		case <-signals:
+			os.Exit(exitCodeInterrupted)
+		case <-done:
+		}
+	}()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			signal.Stop(signals)
+			close(done)
+		})
+	}
+
+	return ctx, interrupt, stop
+}
@@ -1,32 +1,24 @@
 package main
 
 import (
-	"fmt"
 	"os"
-	"strings"
-	"text/tabwriter"
+
+	"github.com/timberio/cli/api"
 )
 
+var sourceColumns = []column{
+	{"name", func(i interface{}) string { return i.(*api.Application).Name }},
+	{"id", func(i interface{}) string { return i.(*api.Application).ID }},
+	{"slug", func(i interface{}) string { return i.(*api.Application).Slug }},
+	{"environment", func(i interface{}) string { return i.(*api.Application).Environment }},
+	{"source type", func(i interface{}) string { return i.(*api.Application).SourceType }},
+}
+
 func listSources() error {
-	applications, err := client.ListSources()
+	applications, err := client.ListSourcesContext(rootContext)
 	if err != nil {
 		return err
 	}
 
-	w := new(tabwriter.Writer)
-	w.Init(os.Stdout, 0, 8, 0, '\t', 0)
-
-	fmt.Fprintln(w, "name\tid\tslug\tenvironment\tsource type")
-	for _, application := range applications {
-		fmt.Fprintln(w, strings.Join([]string{
-			application.Name,
-			application.ID,
-			application.Slug,
-			application.Environment,
-			application.SourceType,
-		}, "\t"))
-	}
-	w.Flush()
-
-	return nil
+	return printList(os.Stdout, applications, sourceColumns)
 }
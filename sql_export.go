@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/timberio/cli/api"
+)
+
+// Formats SQL query results can be exported in
+var sqlExportFormats = []string{"csv", "json", "ndjson", "parquet"}
+
+// Number of rows requested per page when exporting all results
+var sqlExportPageSize = 1000
+
+// sqlResultsWriter writes SQL query results one page at a time
+type sqlResultsWriter interface {
+	WritePage(columns []string, rows []*api.SQLRow) error
+	Close() error
+}
+
+func newSQLResultsWriter(w io.Writer, format string) (sqlResultsWriter, error) {
+	switch format {
+	case "csv":
+		return &csvResultsWriter{writer: csv.NewWriter(w)}, nil
+	case "json":
+		return &jsonResultsWriter{writer: w}, nil
+	case "ndjson":
+		return &ndjsonResultsWriter{encoder: json.NewEncoder(w)}, nil
+	case "parquet":
+		return &parquetResultsWriter{writer: w}, nil
+	default:
+		return nil, fmt.Errorf("Unknown format %q, must be one of %s", format, strings.Join(sqlExportFormats, ", "))
+	}
+}
+
+// exportSQLQueryResults streams the results of a query to a file, or stdout
+// when no file is given, requesting one page at a time so that large results
+// never need to fit in memory
+func exportSQLQueryResults(sqlQuery *api.SQLQuery, options *sqlResultsOptions) error {
+	if sqlQuery.Status == "FAILED" || sqlQuery.Status == "CANCELLED" {
+		return fmt.Errorf("SQL query %s has no results, its status is %s", sqlQuery.ID, sqlQuery.Status)
+	}
+
+	var out io.Writer = os.Stdout
+	if options.File != "" {
+		f, err := os.Create(options.File)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	buffered := bufio.NewWriter(out)
+	defer buffered.Flush()
+
+	resultsWriter, err := newSQLResultsWriter(buffered, options.Format)
+	if err != nil {
+		return err
+	}
+
+	request := &api.GetSQLQueryResultsRequest{MaxResults: options.MaxResults}
+	if options.All {
+		request.MaxResults = sqlExportPageSize
+	}
+
+	var columns []string
+	count := 0
+
+	for {
+		results, err := client.GetSQLQueryResultsContext(rootContext, sqlQuery.ID, request)
+		if err != nil {
+			return err
+		}
+
+		if columns == nil && len(results.Columns) > 0 {
+			columns = sqlColumnNames(results.Columns)
+		}
+
+		err = resultsWriter.WritePage(columns, results.Rows)
+		if err != nil {
+			return err
+		}
+
+		count += len(results.Rows)
+		nextToken := results.NextToken
+
+		if nextToken == "" || !options.All {
+			if nextToken != "" {
+				fmt.Fprintf(os.Stderr, "Only the first %v results were exported, add the `--all` flag to export all results\n", count)
+			}
+			break
+		}
+
+		request.NextToken = nextToken
+	}
+
+	if err := resultsWriter.Close(); err != nil {
+		return err
+	}
+
+	if options.File != "" {
+		fmt.Fprintf(successWriter, "Exported %v results to %s\n", count, options.File)
+	}
+
+	return nil
+}
+
+func sqlColumnNames(columns []*api.SQLColumn) []string {
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = column.Name
+	}
+	return names
+}
+
+// sqlResultValue renders a value as text, strings are kept as is and other
+// values are JSON encoded. Null values are returned as nil.
+func sqlResultValue(v interface{}) (*string, error) {
+	switch value := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return &value, nil
+	default:
+		json, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		s := string(json)
+		return &s, nil
+	}
+}
+
+type csvResultsWriter struct {
+	writer        *csv.Writer
+	headerWritten bool
+}
+
+func (c *csvResultsWriter) WritePage(columns []string, rows []*api.SQLRow) error {
+	if !c.headerWritten && columns != nil {
+		c.writer.Write(columns)
+		c.headerWritten = true
+	}
+
+	for _, row := range rows {
+		record := make([]string, len(columns))
+		for i, column := range columns {
+			v, _ := row.Get(column)
+			value, err := sqlResultValue(v)
+			if err != nil {
+				return err
+			}
+			if value != nil {
+				record[i] = *value
+			}
+		}
+		c.writer.Write(record)
+	}
+
+	c.writer.Flush()
+	return c.writer.Error()
+}
+
+func (c *csvResultsWriter) Close() error {
+	c.writer.Flush()
+	return c.writer.Error()
+}
+
+// jsonResultsWriter writes a single JSON array, row by row
+type jsonResultsWriter struct {
+	writer  io.Writer
+	started bool
+}
+
+func (j *jsonResultsWriter) WritePage(columns []string, rows []*api.SQLRow) error {
+	for _, row := range rows {
+		separator := ",\n  "
+		if !j.started {
+			separator = "[\n  "
+			j.started = true
+		}
+
+		json, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+
+		if _, err := fmt.Fprintf(j.writer, "%s%s", separator, json); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (j *jsonResultsWriter) Close() error {
+	if !j.started {
+		_, err := fmt.Fprintln(j.writer, "[]")
+		return err
+	}
+
+	_, err := fmt.Fprintln(j.writer, "\n]")
+	return err
+}
+
+type ndjsonResultsWriter struct {
+	encoder *json.Encoder
+}
+
+func (n *ndjsonResultsWriter) WritePage(columns []string, rows []*api.SQLRow) error {
+	for _, row := range rows {
+		if err := n.encoder.Encode(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *ndjsonResultsWriter) Close() error {
+	return nil
+}
+
+// parquetResultsWriter writes each page as a Parquet row group
+type parquetResultsWriter struct {
+	writer  io.Writer
+	parquet *parquetWriter
+}
+
+func (p *parquetResultsWriter) WritePage(columns []string, rows []*api.SQLRow) error {
+	if p.parquet == nil {
+		if columns == nil {
+			return nil
+		}
+
+		parquet, err := newParquetWriter(p.writer, columns)
+		if err != nil {
+			return err
+		}
+		p.parquet = parquet
+	}
+
+	records := make([][]*string, len(rows))
+	for i, row := range rows {
+		records[i] = make([]*string, len(columns))
+		for j, column := range columns {
+			v, _ := row.Get(column)
+			value, err := sqlResultValue(v)
+			if err != nil {
+				return err
+			}
+			records[i][j] = value
+		}
+	}
+
+	return p.parquet.WriteRowGroup(records)
+}
+
+func (p *parquetResultsWriter) Close() error {
+	if p.parquet == nil {
+		// A file without columns or rows is still a valid Parquet file
+		parquet, err := newParquetWriter(p.writer, []string{})
+		if err != nil {
+			return err
+		}
+		p.parquet = parquet
+	}
+
+	return p.parquet.Close()
+}
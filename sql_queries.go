@@ -1,39 +1,65 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"text/tabwriter"
 	"time"
+	"unicode/utf8"
 
 	"github.com/fatih/color"
 	"github.com/timberio/cli/api"
 	"github.com/tj/go-spin"
+	"gopkg.in/urfave/cli.v1"
 )
 
-func executeSQLQuery(query string, maxColumns int, maxColumnLength int, maxResults int) error {
+// sqlResultsOptions control how the results of a SQL query are shown
+type sqlResultsOptions struct {
+	MaxColumns      int
+	MaxColumnLength int
+	MaxResults      int
+
+	// Follow next tokens until every result has been shown
+	All bool
+
+	// Export format, results are displayed as a table when empty
+	Format string
+	File   string
+
+	// Cancel the query if it is still running after this long, 0 for no limit
+	Timeout time.Duration
+}
+
+func executeSQLQuery(query string, options *sqlResultsOptions) error {
 	organization, err := getCurrentOrganization(client)
 	if err != nil {
 		return err
 	}
 
-	sqlQuery, err := client.CreateSQLQuery(organization.ID, query)
+	sqlQuery, err := client.CreateSQLQueryContext(rootContext, organization.ID, query)
 	if err != nil {
 		return err
 	}
 
-	sqlQuery, err = waitForSQLQuery(sqlQuery)
+	sqlQuery, err = awaitSQLQuery(rootContext, sqlQuery, options.Timeout)
 	if err != nil {
 		return err
 	}
 
-	fmt.Print("\r                                                                                     \r")
+	if options.Format != "" {
+		return exportSQLQueryResults(sqlQuery, options)
+	}
 
 	fmt.Println()
 
-	err = listSQLQueryResults(sqlQuery, maxColumns, maxColumnLength, maxResults)
+	err = listSQLQueryResults(sqlQuery, options)
 	if err != nil {
 		return err
 	}
@@ -41,137 +67,263 @@ func executeSQLQuery(query string, maxColumns int, maxColumnLength int, maxResul
 	return nil
 }
 
-func listSQLQueryResults(sqlQuery *api.SQLQuery, maxColumns int, maxColumnLength int, maxResults int) error {
+func listSQLQueryResults(sqlQuery *api.SQLQuery, options *sqlResultsOptions) error {
 	if sqlQuery.Status == "FAILED" || sqlQuery.Status == "CANCELLED" {
 		return nil
 	}
 
+	loc, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return err
+	}
+
 	request := &api.GetSQLQueryResultsRequest{
-		MaxResults: maxResults,
+		MaxResults: options.MaxResults,
 	}
 
-	results, nextToken, err := client.GetSQLQueryResults(sqlQuery.ID, request)
+	results, err := client.GetSQLQueryResultsContext(rootContext, sqlQuery.ID, request)
 	if err != nil {
 		return err
 	}
 
-	if len(results) == 0 {
+	if len(results.Rows) == 0 {
 		fmt.Fprintln(errWriter, "No results")
 		return nil
 	}
 
-	w := new(tabwriter.Writer)
-	w.Init(os.Stdout, 0, 8, 0, '\t', 0)
+	// Grab columns up to maxColumns
+	columns := results.Columns
+	if len(columns) > options.MaxColumns+1 {
+		columns = columns[:options.MaxColumns+1]
+	}
+
+	row := 0
 
-	if len(results) > 0 {
+	for {
+		err = printSQLResultsTable(os.Stdout, columns, results.Rows, row, options.MaxColumnLength, loc, colorize)
+		if err != nil {
+			return err
+		}
 
-		// Grab keys up to maxColumns
-		var keys []string
-		i := 0
+		row += len(results.Rows)
 
-		for k := range results[0] {
-			if i > maxColumns {
-				break
-			}
+		if results.NextToken == "" || !options.All {
+			break
+		}
 
-			keys = append(keys, k)
-			i += 1
+		request.NextToken = results.NextToken
+		results, err = client.GetSQLQueryResultsContext(rootContext, sqlQuery.ID, request)
+		if err != nil {
+			return err
 		}
 
-		// Print keys
-		fmt.Fprint(w, "Row\t")
+		fmt.Println()
+	}
 
-		for _, k := range keys {
-			if len(k) > maxColumnLength {
-				fmt.Fprint(w, k[0:maxColumnLength]+"...\t")
-			} else {
-				fmt.Fprint(w, k+"\t")
-			}
-		}
+	fmt.Println()
 
-		fmt.Fprintln(w)
+	if results.NextToken != "" {
+		fmt.Fprintf(warningWriter, "⚠  Only %v results shown, add the `--all` flag to show all results or `--format` to export them\n", row)
+	} else {
+		fmt.Println("All results shown")
+	}
 
-		for range keys {
-			fmt.Fprint(w, "---\t")
-		}
+	return nil
+}
 
-		fmt.Fprintln(w)
+// printSQLResultsTable prints a page of results. Values are rendered by type:
+// numbers are right aligned, timestamps are shown in the configured time zone,
+// nulls are shown as NULL and nested values are collapsed to a single line.
+func printSQLResultsTable(w io.Writer, columns []*api.SQLColumn, rows []*api.SQLRow, firstRow int, maxColumnLength int, loc *time.Location, colorNulls bool) error {
+	header := []string{"Row"}
+	for _, column := range columns {
+		header = append(header, truncateSQLValue(column.Name, maxColumnLength))
+	}
 
-		for i, result := range results {
-			fmt.Fprintf(w, "%v\t", i)
+	cells := make([][]string, len(rows))
+	nulls := make([][]bool, len(rows))
+	numeric := make([]bool, len(header))
+	numeric[0] = true
 
-			var values []interface{}
-			i := 0
+	// Columns without a type are numeric when every value is a number
+	untyped := make([]bool, len(header))
+	for c, column := range columns {
+		numeric[c+1] = isNumericSQLType(column.Type) || column.Type == ""
+		untyped[c+1] = column.Type == ""
+	}
 
-			// Grab results up to maxColumns
-			for _, v := range result {
-				if i > maxColumns {
-					break
-				}
+	for r, row := range rows {
+		cells[r] = []string{strconv.Itoa(firstRow + r)}
+		nulls[r] = []bool{false}
 
-				values = append(values, v)
-				i += 1
+		for c, column := range columns {
+			value, _ := row.Get(column.Name)
+
+			if _, ok := value.(json.Number); !ok && value != nil && untyped[c+1] {
+				numeric[c+1] = false
 			}
 
-			// Print results
-			for _, v := range values {
-				json, err := json.Marshal(v)
-				if err != nil {
-					return err
-				}
+			cells[r] = append(cells[r], truncateSQLValue(formatSQLValue(value, column, loc), maxColumnLength))
+			nulls[r] = append(nulls[r], value == nil)
+		}
+	}
 
-				if len(json) > maxColumnLength {
-					fmt.Fprintf(w, "%s\t", string(json[0:maxColumnLength])+"...")
-				} else {
-					fmt.Fprintf(w, "%s\t", json)
-				}
+	widths := make([]int, len(header))
+	for c, name := range header {
+		widths[c] = utf8.RuneCountInString(name)
+	}
+	for _, row := range cells {
+		for c, cell := range row {
+			if width := utf8.RuneCountInString(cell); width > widths[c] {
+				widths[c] = width
 			}
+		}
+	}
 
-			fmt.Fprintln(w)
+	pad := func(s string, c int) string {
+		padding := strings.Repeat(" ", widths[c]-utf8.RuneCountInString(s))
+		if numeric[c] {
+			return padding + s
 		}
+		return s + padding
+	}
+
+	line := make([]string, len(header))
+	for c, name := range header {
+		line[c] = pad(name, c)
+	}
+	fmt.Fprintln(w, strings.TrimRight(strings.Join(line, "  "), " "))
 
-		fmt.Fprintln(w)
+	for c := range header {
+		line[c] = strings.Repeat("-", widths[c])
+	}
+	fmt.Fprintln(w, strings.Join(line, "  "))
 
-		if nextToken != "" {
-			fmt.Fprintf(warningWriter, "⚠  Only %v result shown, run `timber sql-queries download %v` to view all results\n", maxResults, sqlQuery.ID)
-		} else {
-			fmt.Fprintln(w, "All results shown")
+	for r, row := range cells {
+		for c, cell := range row {
+			line[c] = pad(cell, c)
+			if nulls[r][c] && colorNulls {
+				line[c] = faint(line[c])
+			}
 		}
+		fmt.Fprintln(w, strings.TrimRight(strings.Join(line, "  "), " "))
 	}
-	w.Flush()
 
 	return nil
 }
 
-func listSQLQueries() error {
-	request := api.NewListSQLQueriesRequest()
-	request.Sort = "inserted_at.desc"
-	sqlQueries, err := client.ListSQLQueries(request)
-	if err != nil {
-		return err
+var faint = color.New(color.Faint).SprintFunc()
+
+func isNumericSQLType(sqlType string) bool {
+	switch strings.ToLower(sqlType) {
+	case "tinyint", "smallint", "integer", "int", "bigint", "real", "double", "float", "decimal":
+		return true
 	}
+	return strings.HasPrefix(strings.ToLower(sqlType), "decimal")
+}
 
-	w := new(tabwriter.Writer)
-	w.Init(os.Stdout, 0, 8, 0, '\t', 0)
+func isTimestampSQLType(sqlType string) bool {
+	return strings.HasPrefix(strings.ToLower(sqlType), "timestamp") || strings.ToLower(sqlType) == "date"
+}
 
-	fmt.Fprintln(w, "id\tquery\tstatus")
-	for _, sqlQuery := range sqlQueries {
-		body := strings.ReplaceAll(sqlQuery.Body, "\n", " ")
+var sqlTimestampLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999", "2006-01-02 15:04:05.999999999 MST"}
+
+// formatSQLValue renders a single value of a result row
+func formatSQLValue(value interface{}, column *api.SQLColumn, loc *time.Location) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+
+	case json.Number:
+		return v.String()
+
+	case string:
+		// Timestamps come back as strings, they are parsed if the schema says
+		// so or if they look like one
+		if column.Type == "" || isTimestampSQLType(column.Type) {
+			for _, layout := range sqlTimestampLayouts {
+				if t, err := time.Parse(layout, v); err == nil {
+					return t.In(loc).Format("2006-01-02 15:04:05.000 MST")
+				}
+			}
+		}
+		return strings.ReplaceAll(v, "\n", " ")
+
+	case map[string]interface{}, []interface{}:
+		return collapseJSON(v)
+
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// collapseJSON renders a nested value on a single line, with spaces after
+// separators to keep it readable
+func collapseJSON(value interface{}) string {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		parts := make([]string, len(keys))
+		for i, key := range keys {
+			parts[i] = key + ": " + collapseJSON(v[key])
+		}
+		return "{" + strings.Join(parts, ", ") + "}"
+
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, item := range v {
+			parts[i] = collapseJSON(item)
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+
+	case string:
+		json, _ := json.Marshal(v)
+		return string(json)
+
+	case nil:
+		return "null"
+
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func truncateSQLValue(s string, maxLength int) string {
+	if maxLength > 0 && utf8.RuneCountInString(s) > maxLength {
+		return string([]rune(s)[:maxLength]) + "..."
+	}
+	return s
+}
+
+var sqlQueryColumns = []column{
+	{"id", func(i interface{}) string { return i.(*api.SQLQuery).ID }},
+	{"query", func(i interface{}) string {
+		body := strings.ReplaceAll(i.(*api.SQLQuery).Body, "\n", " ")
 
 		maxBodyLength := 75
 		if len(body) > maxBodyLength {
 			body = body[0:maxBodyLength] + "..."
 		}
 
-		fmt.Fprintln(w, strings.Join([]string{
-			sqlQuery.ID,
-			body,
-			sqlQuery.Status,
-		}, "\t"))
+		return body
+	}},
+	{"status", func(i interface{}) string { return i.(*api.SQLQuery).Status }},
+}
+
+func listSQLQueries() error {
+	request := api.NewListSQLQueriesRequest()
+	request.Sort = "inserted_at.desc"
+	sqlQueries, err := client.ListSQLQueriesContext(rootContext, request)
+	if err != nil {
+		return err
 	}
-	w.Flush()
 
-	return nil
+	return printList(os.Stdout, sqlQueries, sqlQueryColumns)
 }
 
 func printSQLQueryResultsURL(sqlQuery *api.SQLQuery) error {
@@ -230,22 +382,106 @@ func printSQLQueryInfo(sqlQuery *api.SQLQuery) error {
 // Util
 //
 
-func waitForSQLQuery(sqlQuery *api.SQLQuery) (*api.SQLQuery, error) {
-	var err error
-	for {
-		sqlQuery, err = client.GetSQLQuery(sqlQuery.ID)
+var errSQLQueryCancelled = errors.New("SQL query cancelled")
+
+// awaitSQLQuery waits for a query to complete. The query is cancelled server
+// side if it runs longer than timeout, or if the CLI is interrupted, so that
+// it doesn't keep scanning after the CLI exits.
+func awaitSQLQuery(ctx context.Context, sqlQuery *api.SQLQuery, timeout time.Duration) (*api.SQLQuery, error) {
+	waitCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	id := sqlQuery.ID
+	sqlQuery, err := waitForSQLQuery(waitCtx, sqlQuery)
+	clearSpinner()
+
+	if err == errSQLQueryCancelled {
+		if ctx.Err() == nil {
+			message := fmt.Sprintf("SQL query %s did not complete within %v and was cancelled", id, timeout)
+			return nil, cli.NewExitError(message, exitCodeTimeout)
+		}
+
+		message := fmt.Sprintf("Interrupted, SQL query %s was cancelled", id)
+		return nil, cli.NewExitError(message, exitCodeInterrupted)
+	}
+
+	return sqlQuery, err
+}
+
+func cancelSQLQuery(id string) error {
+	sqlQuery, err := client.GetSQLQueryContext(rootContext, id)
+	if err != nil {
+		return err
+	}
+
+	if sqlQuery.Status == "SUCCEEDED" || sqlQuery.Status == "CANCELLED" || sqlQuery.Status == "FAILED" {
+		message := fmt.Sprintf("SQL query %s has already completed, its status is %s", id, sqlQuery.Status)
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return cli.NewExitError(message, 65)
+	}
+
+	_, err = client.CancelSQLQueryContext(rootContext, id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(successWriter, "SQL query %s cancelled\n", id)
+	return nil
+}
+
+// Time allowed to cancel a query once waiting for it has been cancelled
+var sqlQueryCancelTimeout = 10 * time.Second
+
+// waitForSQLQuery polls a query until it completes. When ctx is done the
+// query is cancelled server side and errSQLQueryCancelled is returned.
+func waitForSQLQuery(ctx context.Context, sqlQuery *api.SQLQuery) (*api.SQLQuery, error) {
+	id := sqlQuery.ID
+	s := spin.New()
+
+	cancel := func() (*api.SQLQuery, error) {
+		clearSpinner()
+
+		// ctx is already done, cancelling needs a context of its own
+		cancelCtx, done := context.WithTimeout(context.Background(), sqlQueryCancelTimeout)
+		defer done()
+
+		cancelled, err := client.CancelSQLQueryContext(cancelCtx, id)
 		if err != nil {
 			return nil, err
 		}
 
+		return cancelled, errSQLQueryCancelled
+	}
+
+	for {
+		sqlQuery, err := client.GetSQLQueryContext(ctx, id)
+		if err != nil && ctx.Err() != nil {
+			return cancel()
+		} else if err != nil {
+			return nil, err
+		}
+
 		if sqlQuery.Status == "SUCCEEDED" || sqlQuery.Status == "CANCELLED" || sqlQuery.Status == "FAILED" {
 			return sqlQuery, nil
 		}
 
-		s := spin.New()
+		// The spinner goes to stderr so that results written to stdout can be piped
 		for i := 0; i < 5; i++ {
-			fmt.Printf("\r%s \033[36mWaiting for query to complete, bytes scanned: %v, execution time: %vms\033[m", s.Next(), sqlQuery.BytesScanned, sqlQuery.MillisecondsExecuted)
-			time.Sleep(100 * time.Millisecond)
+			fmt.Fprintf(os.Stderr, "\r%s \033[36mWaiting for query to complete, bytes scanned: %v, execution time: %vms\033[m", s.Next(), sqlQuery.BytesScanned, sqlQuery.MillisecondsExecuted)
+
+			select {
+			case <-ctx.Done():
+				return cancel()
+			case <-time.After(100 * time.Millisecond):
+			}
 		}
 	}
 }
+
+func clearSpinner() {
+	fmt.Fprint(os.Stderr, "\r                                                                                     \r")
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/timberio/cli/api"
+)
+
+const sqlHistoryFileName = "sql_history"
+
+// Number of history entries loaded when the shell starts
+var sqlHistorySize = 1000
+
+var sqlShellHelp = `Enter SQL queries ending with a semicolon, they can span several lines.
+
+  \timing [on|off]  show how long queries take
+  \x [on|off]       show each row as a list of column and value pairs
+  \o [file]         write results to a file, or back to stdout without one
+  \?                show this help
+  \q                quit
+
+Ctrl-C cancels the running query, Ctrl-D quits.`
+
+// sqlShell is an interactive SQL prompt
+type sqlShell struct {
+	options      *sqlResultsOptions
+	organization *api.Organization
+	editor       *lineEditor
+	completer    *sqlCompleter
+	loc          *time.Location
+
+	out      io.Writer
+	outFile  *os.File
+	timing   bool
+	expanded bool
+}
+
+func runSQLShell(options *sqlResultsOptions) error {
+	organization, err := getCurrentOrganization(client)
+	if err != nil {
+		return err
+	}
+
+	loc, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return err
+	}
+
+	// Interrupts are handled per query so that Ctrl-C doesn't end the shell
+	stopInterrupts()
+
+	shell := &sqlShell{
+		options:      options,
+		organization: organization,
+		editor:       newLineEditor(os.Stdin, os.Stdout),
+		completer:    &sqlCompleter{},
+		loc:          loc,
+		out:          os.Stdout,
+	}
+	defer shell.closeOutput()
+
+	if shell.editor.terminal {
+		shell.editor.complete = shell.completer.Complete
+		shell.loadHistory()
+
+		// Table and field names are loaded in the background so that the
+		// prompt shows up straight away
+		go shell.completer.Load()
+
+		fmt.Fprintf(os.Stdout, "Connected to %s, type \\? for help\n\n", organization.Name)
+	}
+
+	return shell.run()
+}
+
+func (s *sqlShell) run() error {
+	var statement []string
+
+	for {
+		prompt := "timber=> "
+		if len(statement) > 0 {
+			prompt = "timber-> "
+		}
+
+		line, err := s.editor.ReadLine(prompt)
+		if err == errInterrupted {
+			statement = nil
+			continue
+		} else if err == io.EOF {
+			if len(statement) > 0 && !s.editor.terminal {
+				// Run a trailing query without a semicolon when reading a script
+				return s.execute(strings.Join(statement, "\n"))
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		trimmed := strings.TrimSpace(line)
+
+		if len(statement) == 0 && strings.HasPrefix(trimmed, "\\") {
+			s.addHistory(trimmed)
+
+			quit, err := s.command(trimmed)
+			if err != nil {
+				fmt.Fprintln(errWriter, err.Error())
+			}
+			if quit {
+				return nil
+			}
+			continue
+		}
+
+		if trimmed == "" && len(statement) == 0 {
+			continue
+		}
+
+		statement = append(statement, line)
+		if !strings.HasSuffix(trimmed, ";") {
+			continue
+		}
+
+		query := strings.Join(statement, "\n")
+		statement = nil
+
+		s.addHistory(strings.Join(strings.Fields(query), " "))
+
+		err = s.execute(query)
+		if err != nil {
+			fmt.Fprintln(errWriter, err.Error())
+		}
+	}
+}
+
+// command runs a backslash command, it returns true when the shell should
+// exit
+func (s *sqlShell) command(line string) (bool, error) {
+	fields := strings.Fields(line)
+	name, args := fields[0], fields[1:]
+
+	toggle := func(value bool) (bool, error) {
+		if len(args) == 0 {
+			return !value, nil
+		}
+		switch strings.ToLower(args[0]) {
+		case "on":
+			return true, nil
+		case "off":
+			return false, nil
+		}
+		return value, fmt.Errorf("%s expects on or off, got %q", name, args[0])
+	}
+
+	var err error
+
+	switch name {
+	case "\\q":
+		return true, nil
+
+	case "\\?", "\\h":
+		fmt.Println(sqlShellHelp)
+
+	case "\\timing":
+		s.timing, err = toggle(s.timing)
+		if err == nil {
+			fmt.Printf("Timing is %s\n", onOff(s.timing))
+		}
+
+	case "\\x":
+		s.expanded, err = toggle(s.expanded)
+		if err == nil {
+			fmt.Printf("Expanded display is %s\n", onOff(s.expanded))
+		}
+
+	case "\\o":
+		s.closeOutput()
+		if len(args) > 0 {
+			file := strings.Join(args, " ")
+			s.outFile, err = os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err == nil {
+				s.out = s.outFile
+				fmt.Printf("Writing results to %s\n", file)
+			}
+		}
+
+	default:
+		err = fmt.Errorf("Unknown command %s, type \\? for help", name)
+	}
+
+	return false, err
+}
+
+func onOff(value bool) string {
+	if value {
+		return "on"
+	}
+	return "off"
+}
+
+func (s *sqlShell) closeOutput() {
+	if s.outFile != nil {
+		s.outFile.Close()
+		s.outFile = nil
+	}
+	s.out = os.Stdout
+}
+
+// execute runs a query and prints its first page of results. Ctrl-C cancels
+// the query server side.
+func (s *sqlShell) execute(query string) error {
+	query = strings.TrimSuffix(strings.TrimSpace(query), ";")
+	start := time.Now()
+
+	sqlQuery, err := client.CreateSQLQuery(s.organization.ID, query)
+	if err != nil {
+		return err
+	}
+
+	// Ctrl-C only cancels the running query, the shell keeps going
+	ctx, _, stop := interruptContext(context.Background())
+	defer stop()
+
+	sqlQuery, err = waitForSQLQuery(ctx, sqlQuery)
+	clearSpinner()
+	if err == errSQLQueryCancelled {
+		fmt.Fprintln(warningWriter, "Query cancelled")
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	switch sqlQuery.Status {
+	case "FAILED":
+		return errors.New(sqlQuery.FailureReason)
+	case "CANCELLED":
+		fmt.Fprintln(warningWriter, "Query was cancelled")
+		return nil
+	}
+
+	results, err := client.GetSQLQueryResults(sqlQuery.ID, &api.GetSQLQueryResultsRequest{MaxResults: s.options.MaxResults})
+	if err != nil {
+		return err
+	}
+
+	colorNulls := colorize && s.outFile == nil
+
+	if s.expanded {
+		err = printSQLResultsExpanded(s.out, results.Columns, results.Rows, s.loc, colorNulls)
+	} else if len(results.Rows) > 0 {
+		err = printSQLResultsTable(s.out, results.Columns, results.Rows, 0, s.options.MaxColumnLength, s.loc, colorNulls)
+	}
+	if err != nil {
+		return err
+	}
+
+	if results.NextToken != "" {
+		fmt.Fprintf(s.out, "(first %d rows, run `timber sql-queries results --all %s` for the rest)\n\n", len(results.Rows), sqlQuery.ID)
+	} else if len(results.Rows) == 1 {
+		fmt.Fprint(s.out, "(1 row)\n\n")
+	} else {
+		fmt.Fprintf(s.out, "(%d rows)\n\n", len(results.Rows))
+	}
+
+	if s.timing {
+		fmt.Printf("Time: %v, execution time: %vms, bytes scanned: %v\n\n", time.Since(start).Round(time.Millisecond), sqlQuery.MillisecondsExecuted, sqlQuery.BytesScanned)
+	}
+
+	return nil
+}
+
+// printSQLResultsExpanded prints each row as a list of columns and values
+func printSQLResultsExpanded(w io.Writer, columns []*api.SQLColumn, rows []*api.SQLRow, loc *time.Location, colorNulls bool) error {
+	width := 0
+	for _, column := range columns {
+		if n := utf8.RuneCountInString(column.Name); n > width {
+			width = n
+		}
+	}
+
+	for r, row := range rows {
+		fmt.Fprintf(w, "-[ RECORD %d ]%s\n", r+1, strings.Repeat("-", width))
+
+		for _, column := range columns {
+			value, _ := row.Get(column.Name)
+			text := formatSQLValue(value, column, loc)
+			if value == nil && colorNulls {
+				text = faint(text)
+			}
+
+			padding := strings.Repeat(" ", width-utf8.RuneCountInString(column.Name))
+			fmt.Fprintf(w, "%s%s | %s\n", column.Name, padding, text)
+		}
+	}
+
+	return nil
+}
+
+//
+// History
+//
+
+func (s *sqlShell) addHistory(entry string) {
+	// Scripts piped into the shell are not recorded
+	if !s.editor.terminal {
+		return
+	}
+
+	s.editor.AddHistory(entry)
+
+	timberDir, err := getTimberDirPath()
+	if err != nil {
+		return
+	}
+
+	err = os.MkdirAll(timberDir, os.ModePerm)
+	if err != nil {
+		return
+	}
+
+	f, err := os.OpenFile(path.Join(timberDir, sqlHistoryFileName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	fmt.Fprintln(f, entry)
+}
+
+func (s *sqlShell) loadHistory() {
+	timberDir, err := getTimberDirPath()
+	if err != nil {
+		return
+	}
+
+	f, err := os.Open(path.Join(timberDir, sqlHistoryFileName))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	entries := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entries = append(entries, scanner.Text())
+	}
+
+	if len(entries) > sqlHistorySize {
+		entries = entries[len(entries)-sqlHistorySize:]
+	}
+
+	for _, entry := range entries {
+		s.editor.AddHistory(entry)
+	}
+}
+
+//
+// Completion
+//
+
+var sqlKeywords = []string{
+	"ALL", "AND", "AS", "ASC", "AVG", "BETWEEN", "BY", "CASE", "CAST", "COUNT",
+	"DESC", "DISTINCT", "ELSE", "END", "FROM", "GROUP", "HAVING", "IN", "INNER",
+	"IS", "JOIN", "LEFT", "LIKE", "LIMIT", "MAX", "MIN", "NOT", "NULL", "ON",
+	"OR", "ORDER", "OUTER", "RIGHT", "SELECT", "SUM", "THEN", "UNION", "WHEN",
+	"WHERE", "WITH",
+}
+
+// sqlCompleter completes SQL keywords along with the table and field names of
+// the organization's sources
+type sqlCompleter struct {
+	mutex sync.Mutex
+	names []string
+}
+
+// Load fetches the schema of every source, sources that fail to load are
+// left out of completions
+func (c *sqlCompleter) Load() {
+	sources, err := client.ListSources()
+	if err != nil {
+		logger.Debugf("Could not list sources for completion: %s", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, source := range sources {
+		wg.Add(1)
+		go func(source *api.Application) {
+			defer wg.Done()
+
+			schema, err := client.GetSourceSchema(source.ID)
+			if err != nil {
+				logger.Debugf("Could not load the schema of source %s: %s", source.ID, err)
+				return
+			}
+
+			names := []string{schema.TableName}
+			for _, field := range schema.Fields {
+				names = append(names, field.Name)
+			}
+
+			c.mutex.Lock()
+			c.names = append(c.names, names...)
+			c.mutex.Unlock()
+		}(source)
+	}
+	wg.Wait()
+}
+
+func (c *sqlCompleter) Complete(line []rune, pos int) (int, []string) {
+	start := pos
+	for start > 0 && isSQLWordRune(line[start-1]) {
+		start--
+	}
+
+	word := string(line[start:pos])
+	if word == "" {
+		return start, nil
+	}
+
+	lowerWord := strings.ToLower(word)
+	upper := word == strings.ToUpper(word) && word != lowerWord
+
+	seen := map[string]bool{}
+	candidates := []string{}
+	add := func(candidate string) {
+		if !seen[candidate] && strings.HasPrefix(strings.ToLower(candidate), lowerWord) {
+			seen[candidate] = true
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	for _, keyword := range sqlKeywords {
+		if upper {
+			add(keyword)
+		} else {
+			add(strings.ToLower(keyword))
+		}
+	}
+
+	c.mutex.Lock()
+	for _, name := range c.names {
+		add(name)
+	}
+	c.mutex.Unlock()
+
+	sort.Strings(candidates)
+	return start, candidates
+}
+
+func isSQLWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.' || r == '"'
+}
@@ -1,14 +1,12 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"io"
-	"regexp"
-	"strings"
+	"os"
 	"time"
 
-	"github.com/aybabtme/rgbterm"
 	"github.com/timberio/cli/api"
 	"github.com/tj/go-spin"
 )
@@ -31,6 +29,30 @@ const (
 	Debug           = "debug"
 )
 
+// Severity orders levels from debug to emergency, unknown levels are lowest
+func (l Level) Severity() int {
+	switch l {
+	case Emergency:
+		return 7
+	case Alert:
+		return 6
+	case Critical:
+		return 5
+	case Error:
+		return 4
+	case Warning:
+		return 3
+	case Notice:
+		return 2
+	case Info:
+		return 1
+	case Debug:
+		return 0
+	default:
+		return -1
+	}
+}
+
 // shortened to 4 characters to not take as much width (given warning is 7)
 func (l Level) ShortName() string {
 	switch l {
@@ -89,151 +111,479 @@ var ordinalScale = [][3]uint8{
 	{158, 83, 221},
 }
 
-var tokenRegexp = regexp.MustCompile(`{{\s*(.*?)\s*}}`)
+// Number of log lines kept in memory to scroll back through
+var tailScrollback = 10000
+
+type tailOptions struct {
+	SourceIds []string
+	Query     string
+	Transport string
+	Context   *contextOptions
+	Cursor    *tailCursor // set by --resume
+}
+
+// tailSession is a running tail. In interactive terminals it can be paused,
+// paged back through and have its query, level filter and rendering changed,
+// see tail_interactive.go.
+type tailSession struct {
+	out       io.Writer // log lines
+	info      io.Writer // markers such as a changed query
+	warn      io.Writer // skipped log lines
+	appIds    []string
+	query     string
+	transport string
+
+	formatter      *logLineFormatter
+	jsonFormatter  *logLineFormatter
+	matchFormatter *logLineFormatter // used by the stream goroutine
+	json           bool
+	filter         *logLineFilter
+	minLevel       Level // "" shows every level
+
+	contextOptions *contextOptions
+	contexts       *contextTracker
+
+	cursor        *tailCursor
+	cursorPrinted int // value of printed when the cursor was saved
+	cursorSavedAt time.Time
+	resumeFrom    *time.Time    // where the first stream backfills from
+	seen          *api.IDWindow // lines printed before resuming, or backfilled
+
+	buffer  *logLineRing
+	printed int // number of the next buffered line to print
+	gaps    []*api.Gap
+
+	interactive bool
+	paused      bool
+	pageStart   int // lines shown while paging back
+	pageEnd     int
+	prompt      bool
+	promptInput []rune
+	message     string // shown in the status line until the next key
+
+	results    chan tailResult
+	generation int
+	cancel     context.CancelFunc
+}
+
+// tailResult is a batch of log lines, or the error that ended a stream
+type tailResult struct {
+	generation int
+	batch      *api.LogBatch
+	contexts   map[string]*logLineContext // by ID of the matched lines
+	err        error
+}
+
+// tailLine is a buffered log line, with the lines around it when it matched
+// and -A, -B or -C were given
+type tailLine struct {
+	*api.LogLine
+	context *logLineContext
+}
 
 // TODO fallback to 16 colors
-// TODO implement format parser
-//	Currently only supports a format made of identifiers, space delimited
-func tail(w io.Writer, appIds []string, query string, format string, colorize bool) error {
-	fields := []string{}
-	for _, match := range tokenRegexp.FindAllStringSubmatch(format, -1) {
-		fields = append(fields, match[1])
+func tail(w io.Writer, options *tailOptions, formatter *logLineFormatter, filter *logLineFilter) error {
+	s := &tailSession{
+		out:            w,
+		info:           infoWriter,
+		warn:           warningWriter,
+		appIds:         options.SourceIds,
+		query:          options.Query,
+		transport:      options.Transport,
+		formatter:      formatter,
+		matchFormatter: formatter.withoutColors(),
+		filter:         filter,
+		contextOptions: options.Context,
+		contexts:       newContextTracker(),
+		cursor:         options.Cursor,
+		buffer:         newLogLineRing(tailScrollback),
+		results:        make(chan tailResult),
 	}
 
-	colorScale := NewOrdinalColorScale(ordinalScale)
+	if s.cursor != nil && s.cursor.Dt != nil {
+		s.resumeFrom = s.cursor.Dt
+		s.seen = api.NewIDWindow(tailScrollback)
+		for _, id := range s.cursor.SeenIDs {
+			s.seen.Add(id)
+		}
+
+		fmt.Fprintf(s.info, "Resuming %s from %s\n", s.cursor.Name,
+			s.cursor.Dt.In(formatter.loc).Format("Jan 02 03:04:05.000pm"))
+	}
 
-	loc, err := time.LoadLocation(timeZone)
+	keys, restore, err := s.startInteractive()
 	if err != nil {
 		return err
 	}
+	defer restore()
 
-	searchRequest := api.NewSearchRequest()
-	searchRequest.ApplicationIds = appIds
-	searchRequest.Limit = 250
-	searchRequest.Query = query
-	searchRequest.Sort = "dt.desc"
+	defer func() {
+		if err := s.saveCursor(true); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not save the cursor %s: %s\n", s.cursor.Name, err)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(rootContext)
+	defer cancel()
+	s.start(ctx)
 
-	emptyAttempt := 0
+	spinner := spin.New()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	lastLine := time.Now()
 
 	for {
-		logLines, err := client.Search(searchRequest)
-		if err != nil {
-			return err
-		}
+		select {
+		case <-ctx.Done():
+			s.clearStatus()
+			return ctx.Err()
+
+		case r := <-s.results:
+			if r.generation != s.generation {
+				continue
+			}
+			if r.err != nil {
+				s.clearStatus()
+				return r.err
+			}
+
+			if r.batch.Gap != nil {
+				s.gaps = append(s.gaps, r.batch.Gap)
+			}
 
-		if len(logLines) > 0 {
-			logLines = reverse(logLines)
-			fmt.Print("\r")
-			err = printLogLines(w, colorScale, loc, logLines, format, fields)
+			for _, line := range r.batch.LogLines {
+				if s.seen != nil && !s.seen.Add(line.ID) {
+					continue
+				}
+
+				// Lines after a match can arrive once they were printed
+				// as its context
+				if s.contexts.seen.Has(line.ID) {
+					continue
+				}
+
+				c := r.contexts[line.ID]
+				if c != nil {
+					s.contexts.trim(line, c, r.contexts)
+				}
+				s.buffer.Add(&tailLine{line, c})
+			}
+
+			if !s.holding() {
+				err = s.flush()
+				if err != nil {
+					return err
+				}
+			}
+
+			if len(r.batch.LogLines) > 0 {
+				lastLine = time.Now()
+			}
+
+		case key := <-keys:
+			quit, err := s.handleKey(ctx, key)
+			if quit || err != nil {
+				s.clearStatus()
+				return err
+			}
+			s.drawStatus(spinner.Next(), false)
+
+		case <-ticker.C:
+			err = s.saveCursor(false)
 			if err != nil {
 				return err
 			}
-			searchRequest.DtGt = logLines[len(logLines)-1].Datetime
-			emptyAttempt = 0
-			time.Sleep(500 * time.Millisecond)
-		} else {
-			if emptyAttempt > 3 {
-				s := spin.New()
-				for i := 0; i < 10; i++ {
-					fmt.Printf("\r%s \033[36mListening for incoming logs\033[m", s.Next())
-					time.Sleep(100 * time.Millisecond)
-				}
-			} else {
-				time.Sleep(500 * time.Millisecond)
+
+			idle := time.Since(lastLine) > 2*time.Second
+			if idle || s.holding() {
+				s.drawStatus(spinner.Next(), idle)
 			}
-			emptyAttempt += 1
 		}
 	}
 }
 
-func printLogLines(w io.Writer, colorScale *OrdinalColorScale, loc *time.Location, logLines []*api.LogLine, format string, fields []string) error {
-	// Example:
-	// Dec 14 09:50:16am info ec2-54-175-235-51 Frame batch read, size: 41, iterator_age_ms: 0
+// start tails the query, replacing the stream of a previous query
+func (s *tailSession) start(parent context.Context) {
+	if s.cancel != nil {
+		s.cancel()
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	s.cancel = cancel
+	s.generation++
+	generation := s.generation
+
+	send := func(batch *api.LogBatch, err error) bool {
+		// Searching for context lines here keeps keys responsive. The batch
+		// is held while the lines after its matches are logged.
+		var contexts map[string]*logLineContext
+		if err == nil && s.contextOptions.enabled() {
+			matches := s.matches(batch.LogLines)
+			contexts, err = fetchContexts(ctx, s.contextOptions, s.appIds, matches)
+			if err == nil && s.contextOptions.After > 0 {
+				err = awaitAfterContexts(ctx, s.contextOptions, s.appIds, matches, contexts)
+			}
+		}
+
+		select {
+		case s.results <- tailResult{generation, batch, contexts, err}:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	// Only the first stream of a resumed tail backfills, a changed query
+	// starts from now
+	appIds, query, since := s.appIds, s.query, s.resumeFrom
+	s.resumeFrom = nil
+
+	go func() {
+		if since != nil {
+			newest, ok := backfillLogBatches(ctx, appIds, query, *since, send)
+			if !ok {
+				return
+			}
+			since = &newest
+		}
+
+		streamLogBatches(ctx, appIds, query, s.transport, since, send)
+	}()
+}
+
+// matches returns the log lines shown by --where and --exclude. It is called
+// from the stream goroutine, so the interactive level filter and rendering
+// aren't used, and lines are rendered with a formatter of its own.
+func (s *tailSession) matches(logLines []*api.LogLine) []*api.LogLine {
+	var matches []*api.LogLine
 	for _, line := range logLines {
-		switch format {
-		case "json":
-			json, err := json.Marshal(line)
+		text := ""
+		if s.filter.needsText() {
+			formatted, err := s.matchFormatter.Format(line)
 			if err != nil {
-				return err
+				continue
 			}
-			fmt.Fprintln(w, string(json))
+			text = formatted
+		}
 
-		default:
-			if err := printCustomLineFormat(w, line, fields, loc, colorScale, colorize); err != nil {
-				return err
-			}
+		if s.filter.Match(line, text) {
+			matches = append(matches, line)
 		}
+	}
+	return matches
+}
+
+// holding reports whether new lines are buffered instead of printed
+func (s *tailSession) holding() bool {
+	return s.paused || s.prompt
+}
+
+// flush prints the buffered lines that haven't been printed yet
+func (s *tailSession) flush() error {
+	if len(s.gaps) == 0 && s.printed == s.buffer.Next() {
+		return nil
+	}
+
+	s.clearStatus()
 
+	for _, gap := range s.gaps {
+		printGap(s.warn, gap, s.formatter)
+	}
+	s.gaps = nil
+
+	if dropped := s.buffer.First() - s.printed; dropped > 0 {
+		fmt.Fprintf(s.warn, "⚠  %d log lines were dropped from the buffer while paused\n", dropped)
+		s.printed = s.buffer.First()
+	}
+
+	for ; s.printed < s.buffer.Next(); s.printed++ {
+		err := s.print(s.buffer.Get(s.printed))
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func reverse(logLines []*api.LogLine) []*api.LogLine {
-	for i := 0; i < len(logLines)/2; i++ {
-		j := len(logLines) - i - 1
-		logLines[i], logLines[j] = logLines[j], logLines[i]
+// print prints a log line unless it is filtered out, between its context
+// lines when it has any
+func (s *tailSession) print(line *tailLine) error {
+	formatted, ok, err := s.render(line.LogLine)
+	if err != nil || !ok {
+		return err
+	}
+
+	if line.context != nil {
+		return printWithContext(s.out, s.lineFormatter(), formatted, line.context, false)
 	}
-	return logLines
+
+	_, err = fmt.Fprintln(s.out, formatted)
+	return err
 }
 
-// TODO this is taking a lot of arguments...
-func printCustomLineFormat(w io.Writer, line *api.LogLine, fields []string, loc *time.Location, colorScale *OrdinalColorScale, colorize bool) error {
-	for _, field := range fields {
-		formattedField := ""
-		switch field {
-		case "date":
-			formattedField = line.Datetime.In(loc).Format("Jan 02 03:04:05.000pm")
-			if colorize {
-				formattedField = rgbterm.FgString(formattedField, 85, 79, 201)
-			}
-		case "context.system.hostname":
-			formattedField = fmt.Sprintf("%-20s", findField(strings.Split(field, "."), line.Fields))
-			if colorize {
-				hostnameColor := colorScale.Get(formattedField)
-				formattedField = rgbterm.FgString(formattedField, hostnameColor[0], hostnameColor[1], hostnameColor[2])
-			}
-		case "level":
-			level := Level(line.Level)
-			formattedField = fmt.Sprintf("%-4s", level.ShortName())
-			if colorize {
-				levelColor := level.Color()
-				formattedField = rgbterm.FgString(formattedField, levelColor[0], levelColor[1], levelColor[2])
-			}
-		case "message":
-			formattedField = line.Message
-		default:
-			formattedField = findField(strings.Split(field, "."), line.Fields)
+// render formats a log line, ok is false when the line is filtered out by
+// --where, --exclude or the level filter
+func (s *tailSession) render(line *api.LogLine) (string, bool, error) {
+	if s.minLevel != "" && Level(line.Level).Severity() < s.minLevel.Severity() {
+		return "", false, nil
+	}
+
+	formatted, err := s.lineFormatter().Format(line)
+	if err != nil {
+		return "", false, err
+	}
+
+	text := ""
+	if s.filter.needsText() {
+		text = stripColors(formatted)
+	}
+
+	return formatted, s.filter.Match(line, text), nil
+}
+
+func (s *tailSession) lineFormatter() *logLineFormatter {
+	if s.json {
+		return s.jsonFormatter
+	}
+	return s.formatter
+}
+
+// streamLogBatches tails the log lines of the sources matching query, handing
+// each batch to send until send returns false or the stream fails. The
+// stream starts at since when it is set, or at the most recent lines.
+func streamLogBatches(ctx context.Context, appIds []string, query string, transport string, since *time.Time, send func(*api.LogBatch, error) bool) {
+	searchRequest := api.NewSearchRequest()
+	searchRequest.ApplicationIds = appIds
+	searchRequest.Limit = 250
+	searchRequest.Query = query
+	searchRequest.Sort = "dt.desc"
+	searchRequest.DtGte = since
+
+	stream, err := client.TailContext(ctx, searchRequest, transport)
+	if err != nil {
+		send(nil, err)
+		return
+	}
+	defer stream.Close()
+
+	for {
+		batch, err := stream.Next()
+		if !send(batch, err) || err != nil {
+			return
 		}
+	}
+}
+
+// logLineRing keeps the last log lines tailed. Lines are numbered in the
+// order they were added so that numbers stay valid as old lines are dropped.
+type logLineRing struct {
+	lines []*tailLine
+	next  int
+}
+
+func newLogLineRing(capacity int) *logLineRing {
+	return &logLineRing{lines: make([]*tailLine, capacity)}
+}
 
-		fmt.Fprintf(w, "%s ", formattedField)
+func (r *logLineRing) Add(line *tailLine) {
+	r.lines[r.next%len(r.lines)] = line
+	r.next++
+}
+
+// First returns the number of the oldest line kept
+func (r *logLineRing) First() int {
+	if r.next > len(r.lines) {
+		return r.next - len(r.lines)
 	}
+	return 0
+}
+
+// Next returns the number the next line added will get
+func (r *logLineRing) Next() int {
+	return r.next
+}
+
+// Get returns a line numbered between First and Next
+func (r *logLineRing) Get(n int) *tailLine {
+	return r.lines[n%len(r.lines)]
+}
+
+// printLogLines prints the log lines kept by filter, which may be nil
+func printLogLines(w io.Writer, formatter *logLineFormatter, filter *logLineFilter, logLines []*api.LogLine) error {
+	// Example:
+	// Dec 14 09:50:16am info ec2-54-175-235-51 Frame batch read, size: 41, iterator_age_ms: 0
+	for _, line := range logLines {
+		formatted, err := formatter.Format(line)
+		if err != nil {
+			return err
+		}
+
+		text := ""
+		if filter.needsText() {
+			text = stripColors(formatted)
+		}
+
+		if !filter.Match(line, text) {
+			continue
+		}
 
-	fmt.Fprintln(w)
+		if _, err := fmt.Fprintln(w, formatted); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
+// printGap prints a visible marker where log lines were skipped because a
+// burst was too large to catch up with
+func printGap(w io.Writer, gap *api.Gap, formatter *logLineFormatter) {
+	fmt.Fprintln(w, gapMessage(gap, formatter.loc))
+}
+
+func gapMessage(gap *api.Gap, loc *time.Location) string {
+	layout := "Jan 02 03:04:05.000pm"
+	from, to := gap.From.In(loc).Format(layout), gap.To.In(loc).Format(layout)
+
+	// Gaps without a count are lines sharing a timestamp beyond a page
+	if gap.Skipped == 0 {
+		return fmt.Sprintf("⚠  Log lines may have been skipped between %s and %s, a page of them or more share a timestamp", from, to)
+	}
+	return fmt.Sprintf("⚠  About %d log lines skipped between %s and %s, the burst was too large to fetch", gap.Skipped, from, to)
+}
+
 // given a path in the form of []string{"path", "to", "value"}, extract this value from fields
 // if the value cannot be found at the path, returns ""
 func findField(path []string, fields map[string]interface{}) string {
-	if len(path) == 0 {
+	v, ok := lookupField(path, fields)
+	if !ok {
 		return ""
 	}
 
+	return fmt.Sprintf("%v", v)
+}
+
+// lookupField is findField returning the value as decoded from JSON, ok is
+// false when there is no value at the path
+func lookupField(path []string, fields map[string]interface{}) (interface{}, bool) {
+	if len(path) == 0 {
+		return nil, false
+	}
+
 	v, ok := fields[path[0]]
 	if !ok {
-		return ""
+		return nil, false
 	}
 
 	if len(path) == 1 {
-		return fmt.Sprintf("%v", v)
+		return v, true
 	}
 
 	fields, ok = v.(map[string]interface{})
 	if !ok {
-		return ""
+		return nil, false
 	}
 
-	return findField(path[1:], fields)
+	return lookupField(path[1:], fields)
 }
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/timberio/cli/api"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// Directory in ~/.timber with the cursors of `timber tail --resume`
+const stateDirName = "state"
+
+// Minimum time between two saves of a cursor while tailing
+var tailCursorSaveInterval = time.Second
+
+var tailCursorNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// tailCursor is where a tail started with --resume stopped printing, so that
+// the next tail with the same name prints the log lines it missed
+type tailCursor struct {
+	Name      string     `json:"name"`
+	SourceIds []string   `json:"source_ids"`
+	Query     string     `json:"query"`
+	Dt        *time.Time `json:"dt,omitempty"` // of the last line printed
+	// The lines printed at Dt, resuming searches from Dt included
+	SeenIDs   []string  `json:"seen_ids"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+var tailCursorColumns = []column{
+	{"name", func(i interface{}) string { return i.(*tailCursor).Name }},
+	{"position", func(i interface{}) string {
+		if dt := i.(*tailCursor).Dt; dt != nil {
+			return dt.Format(time.RFC3339Nano)
+		}
+		return ""
+	}},
+	{"sources", func(i interface{}) string { return strings.Join(i.(*tailCursor).SourceIds, ",") }},
+	{"query", func(i interface{}) string { return i.(*tailCursor).Query }},
+	{"updated", func(i interface{}) string { return i.(*tailCursor).UpdatedAt.Format(time.RFC3339) }},
+}
+
+func getTailCursorPath(name string) (string, error) {
+	if !tailCursorNameRegexp.MatchString(name) {
+		message := fmt.Sprintf("Invalid cursor name %q, use letters, digits, _, . and -", name)
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return "", cli.NewExitError(message, 65)
+	}
+
+	timberDir, err := getTimberDirPath()
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(timberDir, stateDirName, "tail-"+name+".json"), nil
+}
+
+// loadTailCursor returns an empty cursor when there is none with this name
+func loadTailCursor(name string) (*tailCursor, error) {
+	filename, err := getTailCursorPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return &tailCursor{Name: name}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	cursor := &tailCursor{}
+	err = json.Unmarshal(data, cursor)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the cursor %s: %s", filename, err)
+	}
+
+	return cursor, nil
+}
+
+// checkTailCursor fails when the cursor was saved by a tail of other log
+// lines, resuming from its position would skip or repeat lines
+func checkTailCursor(cursor *tailCursor, sourceIds []string, query string) error {
+	if cursor.Dt == nil {
+		return nil
+	}
+
+	conflicts := []string{}
+	if !sameSourceIds(sourceIds, cursor.SourceIds) {
+		conflicts = append(conflicts, "--source-id")
+	}
+	if query != cursor.Query {
+		conflicts = append(conflicts, "--query")
+	}
+
+	if len(conflicts) == 0 {
+		return nil
+	}
+
+	message := fmt.Sprintf("The cursor %s was saved by a tail with a different %s\n", cursor.Name, strings.Join(conflicts, ", ")) +
+		fmt.Sprintf("Run `timber tail --resume %s --reset` to start it over, or resume under another name", cursor.Name)
+	// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+	return cli.NewExitError(message, 65)
+}
+
+func saveTailCursor(cursor *tailCursor) error {
+	filename, err := getTailCursorPath(cursor.Name)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(cursor, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filename, append(data, '\n'), 0600)
+}
+
+func listTailCursors() error {
+	timberDir, err := getTimberDirPath()
+	if err != nil {
+		return err
+	}
+
+	filenames, err := filepath.Glob(path.Join(timberDir, stateDirName, "tail-*.json"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(filenames)
+
+	cursors := []*tailCursor{}
+	for _, filename := range filenames {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(filename), "tail-"), ".json")
+		cursor, err := loadTailCursor(name)
+		if err != nil {
+			return err
+		}
+		cursors = append(cursors, cursor)
+	}
+
+	return printList(os.Stdout, cursors, tailCursorColumns)
+}
+
+func resetTailCursor(name string) error {
+	filename, err := getTailCursorPath(name)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(filename)
+	if os.IsNotExist(err) {
+		message := fmt.Sprintf("There is no cursor named %q, run `timber tail --list-cursors` to list them", name)
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return cli.NewExitError(message, 65)
+	}
+
+	return err
+}
+
+// saveCursor records the last printed line in the cursor given with
+// --resume. Unless force is set it is saved at most once per
+// tailCursorSaveInterval.
+func (s *tailSession) saveCursor(force bool) error {
+	if s.cursor == nil || s.printed <= s.buffer.First() || s.printed == s.cursorPrinted {
+		return nil
+	}
+	if !force && time.Since(s.cursorSavedAt) < tailCursorSaveInterval {
+		return nil
+	}
+
+	last := s.buffer.Get(s.printed - 1)
+	seen := []string{}
+	for i := s.printed - 1; i >= s.buffer.First(); i-- {
+		line := s.buffer.Get(i)
+		if !line.Datetime.Equal(last.Datetime) {
+			break
+		}
+		seen = append(seen, line.ID)
+	}
+
+	dt := last.Datetime
+	s.cursor.Dt = &dt
+	s.cursor.SeenIDs = seen
+	s.cursor.SourceIds = s.appIds
+	s.cursor.Query = s.query
+	s.cursor.UpdatedAt = time.Now().UTC()
+
+	s.cursorPrinted = s.printed
+	s.cursorSavedAt = time.Now()
+	return saveTailCursor(s.cursor)
+}
+
+// backfillLogBatches sends the log lines from since until now, oldest first,
+// one page at a time. It returns the time of the newest line to go live
+// from, and false when send stopped it or the search failed.
+func backfillLogBatches(ctx context.Context, appIds []string, query string, since time.Time, send func(*api.LogBatch, error) bool) (time.Time, bool) {
+	searchRequest := api.NewSearchRequest()
+	searchRequest.ApplicationIds = appIds
+	searchRequest.Query = query
+	searchRequest.DtGte = &since
+	searchRequest.Sort = "dt.asc"
+
+	pager := client.NewSearchPager(searchRequest)
+	newest := since
+	skipped := 0
+
+	for {
+		logLines, err := pager.NextContext(ctx)
+		if err != nil {
+			send(nil, err)
+			return newest, false
+		}
+
+		batch := &api.LogBatch{LogLines: logLines}
+
+		// Lines sharing a timestamp may have been skipped before this page
+		if s := pager.Skipped(); len(s) > skipped {
+			batch.Gap = &api.Gap{From: s[skipped], To: s[len(s)-1]}
+			skipped = len(s)
+		}
+
+		if len(logLines) == 0 {
+			if batch.Gap != nil && !send(batch, nil) {
+				return newest, false
+			}
+			return newest, true
+		}
+
+		newest = logLines[len(logLines)-1].Datetime
+		if !send(batch, nil) {
+			return newest, false
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckTailCursor(t *testing.T) {
+	dt := time.Date(2019, 3, 20, 15, 4, 5, 0, time.UTC)
+	cursor := &tailCursor{Name: "errors", SourceIds: []string{"1", "2"}, Query: "level:error", Dt: &dt}
+
+	tests := []struct {
+		name      string
+		sourceIds []string
+		query     string
+		conflict  bool
+	}{
+		{"same selection", []string{"1", "2"}, "level:error", false},
+		{"sources in another order", []string{"2", "1"}, "level:error", false},
+		{"other sources", []string{"1"}, "level:error", true},
+		{"other query", []string{"1", "2"}, "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkTailCursor(cursor, test.sourceIds, test.query)
+			if !test.conflict && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.conflict {
+				expectExitCode(t, err, 65)
+			}
+		})
+	}
+
+	// A cursor that was never saved has no position to get wrong
+	if err := checkTailCursor(&tailCursor{Name: "new"}, []string{"1"}, ""); err != nil {
+		t.Fatalf("unexpected error for a new cursor: %v", err)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/fatih/color"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Levels the l key cycles through, lines below the level are hidden
+var tailLevelFilters = []Level{"", Info, Warning, Error}
+
+// startInteractive reads keys from the terminal when both stdin and stdout
+// are terminals. The terminal is put in raw mode until restore is called.
+func (s *tailSession) startInteractive() (<-chan tuiKey, func(), error) {
+	in := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(in) || !terminal.IsTerminal(int(os.Stdout.Fd())) {
+		return nil, func() {}, nil
+	}
+
+	state, err := terminal.MakeRaw(in)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Raw mode doesn't turn \n into \r\n
+	s.out = &rawTerminalWriter{s.out}
+	s.info = &coloredWriter{Color: color.FgBlue, writer: &rawTerminalWriter{os.Stdout}}
+	s.warn = &coloredWriter{Color: color.FgYellow, writer: &rawTerminalWriter{os.Stdout}}
+	s.interactive = true
+
+	jsonFormatter, err := newLogLineFormatter("json", s.formatter.loc, s.formatter.colorize)
+	if err != nil {
+		terminal.Restore(in, state)
+		return nil, nil, err
+	}
+	jsonFormatter.highlights = s.formatter.highlights
+	s.jsonFormatter = jsonFormatter
+
+	keys := make(chan tuiKey)
+	go readTUIKeys(bufio.NewReader(os.Stdin), keys)
+
+	return keys, func() { terminal.Restore(in, state) }, nil
+}
+
+// handleKey returns true to quit
+func (s *tailSession) handleKey(ctx context.Context, key tuiKey) (bool, error) {
+	s.message = ""
+
+	if s.prompt {
+		s.handlePromptKey(ctx, key)
+		return false, nil
+	}
+
+	switch {
+	case key.r == 'q':
+		return true, nil
+	case key.name == "ctrl-c":
+		// Raw mode turns Ctrl-C into a key, tail stops as on a SIGINT
+		interrupt()
+	case key.r == ' ':
+		if s.paused {
+			return false, s.resume()
+		}
+		s.pause()
+	case key.r == 'G' || key.name == "end":
+		return false, s.resume()
+	case key.r == 'b' || key.name == "up" || key.name == "pgup":
+		return false, s.pageBack()
+	case key.r == 'f' || key.name == "down" || key.name == "pgdn":
+		return false, s.pageForward()
+	case key.r == '/':
+		s.prompt = true
+		s.promptInput = []rune(s.query)
+	case key.r == 'l':
+		for i, level := range tailLevelFilters {
+			if level == s.minLevel {
+				s.minLevel = tailLevelFilters[(i+1)%len(tailLevelFilters)]
+				break
+			}
+		}
+		if s.minLevel == "" {
+			s.notice("── showing every level ──")
+		} else {
+			s.notice(fmt.Sprintf("── showing %s and above ──", s.minLevel))
+		}
+	case key.r == 'j':
+		s.json = !s.json
+		if s.json {
+			s.notice("── rendering log lines as JSON ──")
+		} else {
+			s.notice("── rendering log lines with the log format ──")
+		}
+	case key.r == '?':
+		s.message = "space pause  b/f page back/forward  G resume  / query  l level  j json  q quit"
+	}
+
+	return false, nil
+}
+
+func (s *tailSession) handlePromptKey(ctx context.Context, key tuiKey) {
+	switch key.name {
+	case "esc", "ctrl-c":
+		s.prompt = false
+	case "backspace":
+		if len(s.promptInput) > 0 {
+			s.promptInput = s.promptInput[:len(s.promptInput)-1]
+		}
+	case "ctrl-u":
+		s.promptInput = nil
+	case "enter":
+		s.prompt = false
+		query := string(s.promptInput)
+		if query == s.query {
+			return
+		}
+
+		s.query = query
+		if query == "" {
+			s.notice("── query cleared ──")
+		} else {
+			s.notice(fmt.Sprintf("── query changed to %q ──", query))
+		}
+		s.start(ctx)
+	default:
+		if key.r != 0 {
+			s.promptInput = append(s.promptInput, key.r)
+		}
+	}
+}
+
+// pause stops printing new lines, they are buffered until resume
+func (s *tailSession) pause() {
+	s.paused = true
+	s.pageEnd = s.printed
+	s.pageStart = s.walkBack(s.printed, s.pageSize())
+}
+
+func (s *tailSession) resume() error {
+	if !s.paused {
+		return nil
+	}
+	s.paused = false
+	return s.flush()
+}
+
+// pageBack shows the page of buffered lines before the one shown, pausing
+// first if needed
+func (s *tailSession) pageBack() error {
+	if !s.paused {
+		s.pause()
+	}
+
+	if s.pageStart <= s.buffer.First() {
+		s.message = "Start of the buffer"
+		return nil
+	}
+
+	s.pageEnd = s.pageStart
+	s.pageStart = s.walkBack(s.pageEnd, s.pageSize())
+	return s.drawPage()
+}
+
+// pageForward shows the page of buffered lines after the one shown, lines
+// received while paused included
+func (s *tailSession) pageForward() error {
+	if !s.paused {
+		return nil
+	}
+
+	if s.pageEnd >= s.buffer.Next() {
+		s.message = "End of the buffer, press space to resume"
+		return nil
+	}
+
+	s.pageStart = s.pageEnd
+	s.pageEnd = s.walkForward(s.pageStart, s.pageSize())
+	if s.pageEnd > s.printed {
+		s.printed = s.pageEnd
+	}
+	return s.drawPage()
+}
+
+// walkBack returns the number of the line n shown lines before end
+func (s *tailSession) walkBack(end int, n int) int {
+	i := end
+	for i > s.buffer.First() && n > 0 {
+		i--
+		if _, ok, _ := s.render(s.buffer.Get(i).LogLine); ok {
+			n--
+		}
+	}
+	return i
+}
+
+// walkForward returns the number of the line n shown lines after start
+func (s *tailSession) walkForward(start int, n int) int {
+	i := start
+	for i < s.buffer.Next() && n > 0 {
+		if _, ok, _ := s.render(s.buffer.Get(i).LogLine); ok {
+			n--
+		}
+		i++
+	}
+	return i
+}
+
+func (s *tailSession) drawPage() error {
+	fmt.Fprint(os.Stdout, "\x1b[H\x1b[2J")
+
+	if s.pageStart < s.buffer.First() {
+		s.pageStart = s.buffer.First()
+	}
+
+	for i := s.pageStart; i < s.pageEnd; i++ {
+		err := s.print(s.buffer.Get(i))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pageSize is the number of lines that fit above the status line
+func (s *tailSession) pageSize() int {
+	_, height, err := terminal.GetSize(int(os.Stdout.Fd()))
+	if err != nil || height < 2 {
+		return 20
+	}
+	return height - 1
+}
+
+// notice prints a marker between log lines
+func (s *tailSession) notice(message string) {
+	s.clearStatus()
+	fmt.Fprintln(s.info, message)
+}
+
+// drawStatus shows the spinner, or in interactive terminals what is going on
+// and the keys that can be pressed
+func (s *tailSession) drawStatus(frame string, idle bool) {
+	if !s.interactive {
+		if idle {
+			fmt.Printf("\r%s \033[36mListening for incoming logs\033[m", frame)
+		}
+		return
+	}
+
+	status := ""
+	switch {
+	case s.prompt:
+		status = "query: " + string(s.promptInput) + "█"
+	case s.message != "":
+		status = s.message
+	case s.paused:
+		status = fmt.Sprintf("⏸  Paused, %d new lines │ space resume  b/f page back/forward  / query  q quit", s.buffer.Next()-s.printed)
+	case idle:
+		status = fmt.Sprintf("%s \033[36mListening for incoming logs\033[m  (space pause  / query  l level  j json  ? keys)", frame)
+	default:
+		return
+	}
+
+	width, _, err := terminal.GetSize(int(os.Stdout.Fd()))
+	if err == nil && width > 0 {
+		status = truncateColored(status, width-1)
+	}
+	fmt.Printf("\r%s\x1b[0m\x1b[K", status)
+}
+
+func (s *tailSession) clearStatus() {
+	if s.interactive {
+		fmt.Print("\r\x1b[K")
+	} else {
+		fmt.Print("\r")
+	}
+}
+
+// rawTerminalWriter writes \r\n for \n, terminals in raw mode only move down
+// a line on \n
+type rawTerminalWriter struct {
+	w io.Writer
+}
+
+func (w *rawTerminalWriter) Write(p []byte) (int, error) {
+	_, err := w.w.Write(bytes.Replace(p, []byte("\n"), []byte("\r\n"), -1))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
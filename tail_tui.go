@@ -0,0 +1,666 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/aybabtme/rgbterm"
+	"github.com/timberio/cli/api"
+	"golang.org/x/crypto/ssh/terminal"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// tuiPane tails one source or view
+type tuiPane struct {
+	title     string
+	sourceIds []string
+	query     string
+	formatter *logLineFormatter
+
+	lines  *lineBuffer
+	offset int // lines scrolled back from the newest line, 0 follows new lines
+	paused bool
+	err    error
+
+	received     int
+	lastReceived int
+	rate         float64 // lines per second over the last second
+
+	cancel     context.CancelFunc
+	generation int // bumped when the stream is restarted, to drop stale batches
+}
+
+type tuiLine struct {
+	text  string // with color codes
+	plain string
+}
+
+// lineBuffer keeps the last lines added to it
+type lineBuffer struct {
+	lines []tuiLine
+	start int
+	size  int
+}
+
+func newLineBuffer(capacity int) *lineBuffer {
+	return &lineBuffer{lines: make([]tuiLine, capacity)}
+}
+
+// Add appends a line, dropping the oldest line when the buffer is full
+func (b *lineBuffer) Add(line tuiLine) {
+	if b.size < len(b.lines) {
+		b.lines[(b.start+b.size)%len(b.lines)] = line
+		b.size++
+		return
+	}
+
+	b.lines[b.start] = line
+	b.start = (b.start + 1) % len(b.lines)
+}
+
+func (b *lineBuffer) Len() int {
+	return b.size
+}
+
+// Get returns the i-th line, 0 being the oldest
+func (b *lineBuffer) Get(i int) tuiLine {
+	return b.lines[(b.start+i)%len(b.lines)]
+}
+
+type tuiBatch struct {
+	pane       *tuiPane
+	generation int
+	batch      *api.LogBatch
+	err        error
+}
+
+type tuiKey struct {
+	r    rune   // set for printable keys
+	name string // set for other keys, e.g. "up" or "enter"
+}
+
+// Prompts shown in the status bar
+const (
+	tuiPromptNone = iota
+	tuiPromptSearch
+	tuiPromptQuery
+)
+
+// tui is the full-screen `tail --tui`: panes are stacked on top of each
+// other, each with a header, and a status bar sits at the bottom
+type tui struct {
+	panes     []*tuiPane
+	focus     int
+	filter    *logLineFilter
+	transport string
+	out       *bufio.Writer
+
+	width  int
+	height int
+	dirty  bool
+
+	prompt      int
+	promptInput []rune
+	search      *regexp.Regexp
+	message     string // shown in the status bar until the next key
+
+	batches chan tuiBatch
+}
+
+var tuiTitleColors = NewOrdinalColorScale(ordinalScale)
+
+// tailTUI tails every pane until q or Ctrl-C is pressed
+func tailTUI(panes []*tuiPane, filter *logLineFilter, transport string) error {
+	in := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(in) || !terminal.IsTerminal(int(os.Stdout.Fd())) {
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return cli.NewExitError("--tui needs a terminal, run tail without it to pipe log lines", 65)
+	}
+
+	state, err := terminal.MakeRaw(in)
+	if err != nil {
+		return err
+	}
+	defer terminal.Restore(in, state)
+
+	t := &tui{
+		panes:     panes,
+		filter:    filter,
+		transport: transport,
+		out:       bufio.NewWriterSize(os.Stdout, 64*1024),
+		dirty:     true,
+		batches:   make(chan tuiBatch),
+	}
+
+	// Switch to the alternate screen and hide the cursor
+	fmt.Fprint(os.Stdout, "\x1b[?1049h\x1b[?25l")
+	defer fmt.Fprint(os.Stdout, "\x1b[?25h\x1b[?1049l")
+
+	ctx, cancel := context.WithCancel(rootContext)
+	defer cancel()
+
+	for _, pane := range t.panes {
+		pane.lines = newLineBuffer(tailScrollback)
+		t.start(ctx, pane)
+	}
+
+	keys := make(chan tuiKey)
+	go readTUIKeys(bufio.NewReader(os.Stdin), keys)
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	lastRate := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case b := <-t.batches:
+			if b.generation != b.pane.generation {
+				continue
+			}
+			t.receive(b)
+
+		case key := <-keys:
+			if !t.handleKey(ctx, key) {
+				return nil
+			}
+			t.dirty = true
+
+		case now := <-ticker.C:
+			if elapsed := now.Sub(lastRate); elapsed >= time.Second {
+				for _, pane := range t.panes {
+					pane.rate = float64(pane.received-pane.lastReceived) / elapsed.Seconds()
+					pane.lastReceived = pane.received
+				}
+				lastRate = now
+				t.dirty = true
+			}
+
+			width, height, err := terminal.GetSize(int(os.Stdout.Fd()))
+			if err == nil && (width != t.width || height != t.height) {
+				t.width, t.height = width, height
+				t.dirty = true
+			}
+
+			if t.dirty {
+				t.draw()
+				t.dirty = false
+			}
+		}
+	}
+}
+
+// start opens the stream of a pane, replacing the previous one
+func (t *tui) start(parent context.Context, pane *tuiPane) {
+	if pane.cancel != nil {
+		pane.cancel()
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	pane.cancel = cancel
+	pane.generation++
+	pane.err = nil
+	generation := pane.generation
+
+	go streamLogBatches(ctx, pane.sourceIds, pane.query, t.transport, nil, func(batch *api.LogBatch, err error) bool {
+		select {
+		case t.batches <- tuiBatch{pane: pane, generation: generation, batch: batch, err: err}:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	})
+}
+
+func (t *tui) receive(b tuiBatch) {
+	pane := b.pane
+
+	if b.err != nil {
+		if b.err != context.Canceled {
+			pane.err = b.err
+			t.dirty = true
+		}
+		return
+	}
+
+	if b.batch.Gap != nil {
+		text := gapMessage(b.batch.Gap, pane.formatter.loc)
+		t.add(pane, tuiLine{text: text, plain: text})
+	}
+
+	for _, line := range b.batch.LogLines {
+		pane.received++
+
+		text, err := pane.formatter.Format(line)
+		if err != nil {
+			pane.err = err
+			continue
+		}
+
+		plain := stripColors(text)
+		if !t.filter.Match(line, plain) {
+			continue
+		}
+
+		t.add(pane, tuiLine{text: text, plain: plain})
+	}
+
+	t.dirty = true
+}
+
+// add appends a line to a pane, keeping the view in place when the pane is
+// paused or scrolled back
+func (t *tui) add(pane *tuiPane, line tuiLine) {
+	pane.lines.Add(line)
+	if (pane.offset > 0 || pane.paused) && pane.offset < pane.lines.Len()-1 {
+		pane.offset++
+	}
+}
+
+// handleKey returns false to quit
+func (t *tui) handleKey(ctx context.Context, key tuiKey) bool {
+	t.message = ""
+
+	if t.prompt != tuiPromptNone {
+		t.handlePromptKey(ctx, key)
+		return true
+	}
+
+	pane := t.panes[t.focus]
+	page := t.bodyHeight(t.focus)
+	if page < 1 {
+		page = 1
+	}
+
+	switch {
+	case key.r == 'q' || key.name == "ctrl-c":
+		return false
+	case key.name == "tab" || key.r == 'l':
+		t.focus = (t.focus + 1) % len(t.panes)
+	case key.name == "shift-tab" || key.r == 'h':
+		t.focus = (t.focus + len(t.panes) - 1) % len(t.panes)
+	case key.r >= '1' && key.r <= '9':
+		if i := int(key.r - '1'); i < len(t.panes) {
+			t.focus = i
+		}
+	case key.r == 'p' || key.r == ' ':
+		pane.paused = !pane.paused
+		if !pane.paused {
+			pane.offset = 0
+		}
+	case key.name == "up" || key.r == 'k':
+		t.scroll(pane, 1)
+	case key.name == "down" || key.r == 'j':
+		t.scroll(pane, -1)
+	case key.name == "pgup" || key.name == "ctrl-b":
+		t.scroll(pane, page)
+	case key.name == "pgdn" || key.name == "ctrl-f":
+		t.scroll(pane, -page)
+	case key.name == "home" || key.r == 'g':
+		t.scroll(pane, pane.lines.Len())
+	case key.name == "end" || key.r == 'G':
+		pane.offset = 0
+		pane.paused = false
+	case key.r == '/':
+		t.prompt = tuiPromptSearch
+		t.promptInput = nil
+	case key.r == 'n':
+		t.findMatch(pane, 1)
+	case key.r == 'N':
+		t.findMatch(pane, -1)
+	case key.name == "esc":
+		t.search = nil
+	case key.r == 'e':
+		t.prompt = tuiPromptQuery
+		t.promptInput = []rune(pane.query)
+	case key.r == 'c':
+		pane.lines = newLineBuffer(tailScrollback)
+		pane.offset = 0
+	}
+
+	return true
+}
+
+func (t *tui) handlePromptKey(ctx context.Context, key tuiKey) {
+	switch key.name {
+	case "esc", "ctrl-c":
+		t.prompt = tuiPromptNone
+	case "backspace":
+		if len(t.promptInput) > 0 {
+			t.promptInput = t.promptInput[:len(t.promptInput)-1]
+		}
+	case "ctrl-u":
+		t.promptInput = nil
+	case "enter":
+		input := string(t.promptInput)
+		prompt := t.prompt
+		t.prompt = tuiPromptNone
+		pane := t.panes[t.focus]
+
+		switch prompt {
+		case tuiPromptSearch:
+			if input == "" {
+				t.search = nil
+				return
+			}
+
+			re, err := regexp.Compile("(?i)" + input)
+			if err != nil {
+				re = regexp.MustCompile("(?i)" + regexp.QuoteMeta(input))
+			}
+			t.search = re
+
+			// Start from the newest line in view
+			pane.paused = true
+			t.findMatch(pane, 0)
+
+		case tuiPromptQuery:
+			if input == pane.query {
+				return
+			}
+			pane.query = input
+			marker := fmt.Sprintf("── query changed to %q ──", input)
+			t.add(pane, tuiLine{text: marker, plain: marker})
+			t.start(ctx, pane)
+		}
+	default:
+		if key.r != 0 {
+			t.promptInput = append(t.promptInput, key.r)
+		}
+	}
+}
+
+func (t *tui) scroll(pane *tuiPane, delta int) {
+	pane.offset += delta
+	if max := pane.lines.Len() - 1; pane.offset > max {
+		pane.offset = max
+	}
+	if pane.offset < 0 {
+		pane.offset = 0
+	}
+	pane.paused = pane.paused || pane.offset > 0
+}
+
+// findMatch scrolls to the next line matching the search, older lines with a
+// positive direction and newer lines with a negative one. With 0 the line at
+// the bottom of the view is tried first.
+func (t *tui) findMatch(pane *tuiPane, direction int) {
+	if t.search == nil {
+		return
+	}
+
+	n := pane.lines.Len()
+	bottom := n - 1 - pane.offset
+	step := -1
+	if direction < 0 {
+		step = 1
+	}
+
+	i := bottom
+	if direction != 0 {
+		i += step
+	}
+
+	for ; i >= 0 && i < n; i += step {
+		if t.search.MatchString(pane.lines.Get(i).plain) {
+			pane.offset = n - 1 - i
+			pane.paused = true
+			return
+		}
+	}
+
+	t.message = "No more matches"
+}
+
+// bodyHeight returns the number of log lines shown by a pane, panes share the
+// screen evenly and each has a one line header
+func (t *tui) bodyHeight(i int) int {
+	available := t.height - 1 // status bar
+	n := len(t.panes)
+	if available < 2*n {
+		// Only the focused pane fits
+		if i == t.focus {
+			return available - 1
+		}
+		return -1
+	}
+
+	height := available / n
+	if i < available%n {
+		height++
+	}
+	return height - 1
+}
+
+func (t *tui) draw() {
+	if t.width <= 0 || t.height <= 0 {
+		return
+	}
+
+	var buf bytes.Buffer
+	row := 1
+
+	var highlights []*regexp.Regexp
+	if t.search != nil {
+		highlights = []*regexp.Regexp{t.search}
+	}
+
+	for i, pane := range t.panes {
+		body := t.bodyHeight(i)
+		if body < 0 {
+			continue
+		}
+
+		fmt.Fprintf(&buf, "\x1b[%d;1H%s\x1b[K", row, t.header(i))
+		row++
+
+		n := pane.lines.Len()
+		bottom := n - 1 - pane.offset
+		first := bottom - body + 1
+		for j := first; j <= bottom; j++ {
+			fmt.Fprintf(&buf, "\x1b[%d;1H", row)
+			if j >= 0 {
+				text := truncateColored(pane.lines.Get(j).text, t.width)
+				buf.WriteString(highlightMatches(text, highlights))
+			}
+			buf.WriteString("\x1b[0m\x1b[K")
+			row++
+		}
+	}
+
+	fmt.Fprintf(&buf, "\x1b[%d;1H\x1b[7m%s\x1b[0m\x1b[K", t.height, padRight(t.statusBar(), t.width))
+
+	t.out.Write(buf.Bytes())
+	t.out.Flush()
+}
+
+func (t *tui) header(i int) string {
+	pane := t.panes[i]
+
+	parts := []string{fmt.Sprintf(" %d %s", i+1, pane.title)}
+	if pane.query != "" {
+		parts = append(parts, "query: "+pane.query)
+	}
+	parts = append(parts, fmt.Sprintf("%.1f lines/s", pane.rate))
+	if pane.offset > 0 {
+		parts = append(parts, fmt.Sprintf("+%d", pane.offset))
+	}
+	if pane.paused {
+		parts = append(parts, "PAUSED")
+	}
+	if pane.err != nil {
+		parts = append(parts, "error: "+strings.Split(pane.err.Error(), "\n")[0])
+	}
+
+	text := padRight(strings.Join(parts, " │ "), t.width)
+	if i == t.focus {
+		return "\x1b[7m" + text + "\x1b[0m"
+	}
+
+	color := tuiTitleColors.Get(pane.title)
+	return rgbterm.FgString(text, color[0], color[1], color[2])
+}
+
+func (t *tui) statusBar() string {
+	switch t.prompt {
+	case tuiPromptSearch:
+		return "/" + string(t.promptInput) + "█"
+	case tuiPromptQuery:
+		return fmt.Sprintf("query for %s: %s█", t.panes[t.focus].title, string(t.promptInput))
+	}
+
+	rate := 0.0
+	for _, pane := range t.panes {
+		rate += pane.rate
+	}
+
+	status := fmt.Sprintf(" %.1f lines/s", rate)
+	if t.message != "" {
+		return status + " │ " + t.message
+	}
+	return status + " │ tab focus  p pause  ↑↓ scroll  / search  n/N older/newer  e query  c clear  q quit"
+}
+
+// truncateColored cuts a rendered line to width characters, keeping its color
+// codes
+func truncateColored(s string, width int) string {
+	codes := colorCodeRegexp.FindAllStringIndex(s, -1)
+
+	var buf bytes.Buffer
+	visible := 0
+	for pos := 0; pos < len(s); {
+		if len(codes) > 0 && codes[0][0] == pos {
+			buf.WriteString(s[pos:codes[0][1]])
+			pos = codes[0][1]
+			codes = codes[1:]
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(s[pos:])
+		pos += size
+
+		if r == '\t' {
+			r = ' '
+		} else if !unicode.IsPrint(r) {
+			continue
+		}
+
+		if visible >= width {
+			continue
+		}
+		buf.WriteRune(r)
+		visible++
+	}
+
+	return buf.String()
+}
+
+func padRight(s string, width int) string {
+	n := utf8.RuneCountInString(s)
+	if n >= width {
+		return string([]rune(s)[:width])
+	}
+	return s + strings.Repeat(" ", width-n)
+}
+
+// readTUIKeys decodes the keys read from the terminal in raw mode
+func readTUIKeys(reader *bufio.Reader, keys chan<- tuiKey) {
+	for {
+		r, _, err := reader.ReadRune()
+		if err != nil {
+			return
+		}
+
+		key := tuiKey{}
+		switch r {
+		case 3:
+			key.name = "ctrl-c"
+		case 2:
+			key.name = "ctrl-b"
+		case 6:
+			key.name = "ctrl-f"
+		case 21:
+			key.name = "ctrl-u"
+		case '\t':
+			key.name = "tab"
+		case '\r', '\n':
+			key.name = "enter"
+		case 127, 8:
+			key.name = "backspace"
+		case 27:
+			key.name = readTUIEscape(reader)
+		default:
+			if !unicode.IsPrint(r) {
+				continue
+			}
+			key.r = r
+		}
+
+		keys <- key
+	}
+}
+
+// readTUIEscape decodes the escape sequences of the arrow, page and home/end
+// keys. A lone escape is the Esc key.
+func readTUIEscape(reader *bufio.Reader) string {
+	if reader.Buffered() == 0 {
+		return "esc"
+	}
+
+	r, _, err := reader.ReadRune()
+	if err != nil || (r != '[' && r != 'O') {
+		return "esc"
+	}
+
+	r, _, err = reader.ReadRune()
+	if err != nil {
+		return "esc"
+	}
+
+	// Sequences such as ESC [ 5 ~ carry a number
+	if r >= '0' && r <= '9' {
+		n := r
+		for (r >= '0' && r <= '9') || r == ';' {
+			r, _, err = reader.ReadRune()
+			if err != nil {
+				return "esc"
+			}
+		}
+
+		switch n {
+		case '1', '7':
+			return "home"
+		case '4', '8':
+			return "end"
+		case '5':
+			return "pgup"
+		case '6':
+			return "pgdn"
+		}
+		return ""
+	}
+
+	switch r {
+	case 'A':
+		return "up"
+	case 'B':
+		return "down"
+	case 'H':
+		return "home"
+	case 'F':
+		return "end"
+	case 'Z':
+		return "shift-tab"
+	}
+	return ""
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// parseTOML parses the subset of TOML used by the config files: tables,
+// dotted keys, strings, integers, floats, booleans, arrays and inline tables.
+// Tables are returned as map[string]interface{} and arrays as
+// []interface{}.
+func parseTOML(data []byte) (map[string]interface{}, error) {
+	p := &tomlParser{input: string(data), line: 1}
+	root := map[string]interface{}{}
+	table := root
+
+	for {
+		p.skipBlank()
+		if p.eof() {
+			return root, nil
+		}
+
+		if p.peek() == '[' {
+			p.next()
+			if p.peek() == '[' {
+				return nil, p.errorf("arrays of tables are not supported")
+			}
+
+			p.skipSpace()
+			keys, err := p.parseKeys()
+			if err != nil {
+				return nil, err
+			}
+			p.skipSpace()
+			if p.peek() != ']' {
+				return nil, p.errorf("expected ] after the table name")
+			}
+			p.next()
+
+			table, err = tomlTable(root, keys)
+			if err != nil {
+				return nil, p.errorf("%s", err)
+			}
+		} else {
+			keys, err := p.parseKeys()
+			if err != nil {
+				return nil, err
+			}
+
+			p.skipSpace()
+			if p.peek() != '=' {
+				return nil, p.errorf("expected = after %s", strings.Join(keys, "."))
+			}
+			p.next()
+			p.skipSpace()
+
+			value, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+
+			err = tomlSet(table, keys, value)
+			if err != nil {
+				return nil, p.errorf("%s", err)
+			}
+		}
+
+		p.skipSpace()
+		p.skipComment()
+		if !p.eof() && p.peek() != '\n' && p.peek() != '\r' {
+			return nil, p.errorf("unexpected %q at the end of the line", p.peek())
+		}
+	}
+}
+
+// tomlTable returns the table at the path keys, creating it if needed
+func tomlTable(root map[string]interface{}, keys []string) (map[string]interface{}, error) {
+	table := root
+	for i, key := range keys {
+		switch existing := table[key].(type) {
+		case nil:
+			child := map[string]interface{}{}
+			table[key] = child
+			table = child
+		case map[string]interface{}:
+			table = existing
+		default:
+			return nil, fmt.Errorf("%s is already set to a value", strings.Join(keys[:i+1], "."))
+		}
+	}
+	return table, nil
+}
+
+func tomlSet(table map[string]interface{}, keys []string, value interface{}) error {
+	table, err := tomlTable(table, keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+
+	key := keys[len(keys)-1]
+	if _, ok := table[key]; ok {
+		return fmt.Errorf("%s is defined twice", strings.Join(keys, "."))
+	}
+
+	table[key] = value
+	return nil
+}
+
+type tomlParser struct {
+	input string
+	pos   int
+	line  int
+}
+
+func (p *tomlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+func (p *tomlParser) eof() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *tomlParser) peek() rune {
+	if p.eof() {
+		return 0
+	}
+	r, _ := utf8.DecodeRuneInString(p.input[p.pos:])
+	return r
+}
+
+func (p *tomlParser) next() rune {
+	if p.eof() {
+		return 0
+	}
+	r, size := utf8.DecodeRuneInString(p.input[p.pos:])
+	p.pos += size
+	if r == '\n' {
+		p.line++
+	}
+	return r
+}
+
+func (p *tomlParser) skipSpace() {
+	for p.peek() == ' ' || p.peek() == '\t' {
+		p.next()
+	}
+}
+
+func (p *tomlParser) skipComment() {
+	if p.peek() != '#' {
+		return
+	}
+	for !p.eof() && p.peek() != '\n' {
+		p.next()
+	}
+}
+
+// skipBlank skips whitespace, newlines and comments
+func (p *tomlParser) skipBlank() {
+	for !p.eof() {
+		switch p.peek() {
+		case ' ', '\t', '\r', '\n':
+			p.next()
+		case '#':
+			p.skipComment()
+		default:
+			return
+		}
+	}
+}
+
+func (p *tomlParser) parseKeys() ([]string, error) {
+	keys := []string{}
+	for {
+		key, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+
+		p.skipSpace()
+		if p.peek() != '.' {
+			return keys, nil
+		}
+		p.next()
+		p.skipSpace()
+	}
+}
+
+func (p *tomlParser) parseKey() (string, error) {
+	switch p.peek() {
+	case '"':
+		return p.parseBasicString()
+	case '\'':
+		return p.parseLiteralString()
+	}
+
+	start := p.pos
+	for isBareKeyRune(p.peek()) {
+		p.next()
+	}
+	if p.pos == start {
+		return "", p.errorf("expected a key, got %q", p.peek())
+	}
+	return p.input[start:p.pos], nil
+}
+
+func isBareKeyRune(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == '-'
+}
+
+func (p *tomlParser) parseValue() (interface{}, error) {
+	switch r := p.peek(); {
+	case r == '"':
+		if strings.HasPrefix(p.input[p.pos:], `"""`) {
+			return nil, p.errorf("multi-line strings are not supported")
+		}
+		return p.parseBasicString()
+	case r == '\'':
+		return p.parseLiteralString()
+	case r == '[':
+		return p.parseArray()
+	case r == '{':
+		return p.parseInlineTable()
+	case r == 't' || r == 'f':
+		word := p.parseWord()
+		switch word {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+		return nil, p.errorf("invalid value %q", word)
+	case r == '+' || r == '-' || (r >= '0' && r <= '9'):
+		word := strings.Replace(p.parseWord(), "_", "", -1)
+		if i, err := strconv.ParseInt(word, 10, 64); err == nil {
+			return i, nil
+		}
+		if f, err := strconv.ParseFloat(word, 64); err == nil {
+			return f, nil
+		}
+		return nil, p.errorf("invalid number %q", word)
+	case r == 0:
+		return nil, p.errorf("expected a value")
+	default:
+		return nil, p.errorf("invalid value starting with %q", r)
+	}
+}
+
+// parseWord reads up to the next delimiter, for booleans and numbers
+func (p *tomlParser) parseWord() string {
+	start := p.pos
+	for !p.eof() && !strings.ContainsRune(" \t\r\n,]}#", p.peek()) {
+		p.next()
+	}
+	return p.input[start:p.pos]
+}
+
+func (p *tomlParser) parseBasicString() (string, error) {
+	p.next()
+
+	var b bytes.Buffer
+	for {
+		// The newline isn't consumed so that the error is on the string's line
+		if p.peek() == '\n' {
+			return "", p.errorf("unterminated string")
+		}
+
+		r := p.next()
+		switch r {
+		case 0:
+			return "", p.errorf("unterminated string")
+		case '"':
+			return b.String(), nil
+		case '\\':
+			escaped := p.next()
+			switch escaped {
+			case 'b':
+				b.WriteRune('\b')
+			case 't':
+				b.WriteRune('\t')
+			case 'n':
+				b.WriteRune('\n')
+			case 'f':
+				b.WriteRune('\f')
+			case 'r':
+				b.WriteRune('\r')
+			case '"', '\\':
+				b.WriteRune(escaped)
+			case 'u', 'U':
+				size := 4
+				if escaped == 'U' {
+					size = 8
+				}
+				if p.pos+size > len(p.input) {
+					return "", p.errorf("invalid unicode escape")
+				}
+				code, err := strconv.ParseUint(p.input[p.pos:p.pos+size], 16, 32)
+				if err != nil {
+					return "", p.errorf("invalid unicode escape")
+				}
+				p.pos += size
+				b.WriteRune(rune(code))
+			default:
+				return "", p.errorf("invalid escape \\%c", escaped)
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+}
+
+func (p *tomlParser) parseLiteralString() (string, error) {
+	p.next()
+	start := p.pos
+	for {
+		switch p.peek() {
+		case 0, '\n':
+			return "", p.errorf("unterminated string")
+		case '\'':
+			s := p.input[start:p.pos]
+			p.next()
+			return s, nil
+		}
+		p.next()
+	}
+}
+
+func (p *tomlParser) parseArray() ([]interface{}, error) {
+	p.next()
+	values := []interface{}{}
+
+	for {
+		p.skipBlank()
+		if p.peek() == ']' {
+			p.next()
+			return values, nil
+		}
+
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+
+		p.skipBlank()
+		switch p.next() {
+		case ',':
+		case ']':
+			return values, nil
+		default:
+			return nil, p.errorf("expected , or ] in array")
+		}
+	}
+}
+
+func (p *tomlParser) parseInlineTable() (map[string]interface{}, error) {
+	p.next()
+	table := map[string]interface{}{}
+
+	p.skipSpace()
+	if p.peek() == '}' {
+		p.next()
+		return table, nil
+	}
+
+	for {
+		p.skipSpace()
+		keys, err := p.parseKeys()
+		if err != nil {
+			return nil, err
+		}
+
+		p.skipSpace()
+		if p.peek() != '=' {
+			return nil, p.errorf("expected = after %s", strings.Join(keys, "."))
+		}
+		p.next()
+		p.skipSpace()
+
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+
+		err = tomlSet(table, keys, value)
+		if err != nil {
+			return nil, p.errorf("%s", err)
+		}
+
+		p.skipSpace()
+		switch p.peek() {
+		case ',':
+			p.next()
+		case '}':
+			p.next()
+			return table, nil
+		default:
+			return nil, p.errorf("expected , or } in inline table")
+		}
+	}
+}
+
+// encodeTOML writes values as TOML, with the keys of each table sorted and
+// nested maps written as tables
+func encodeTOML(w io.Writer, values map[string]interface{}) error {
+	var buf bytes.Buffer
+	encodeTOMLTable(&buf, nil, values)
+	_, err := w.Write(bytes.TrimLeft(buf.Bytes(), "\n"))
+	return err
+}
+
+func encodeTOMLTable(buf *bytes.Buffer, path []string, table map[string]interface{}) {
+	keys := make([]string, 0, len(table))
+	for key := range table {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	header := false
+	for _, key := range keys {
+		if _, ok := table[key].(map[string]interface{}); ok {
+			continue
+		}
+
+		// Tables only holding other tables don't need a header
+		if !header && len(path) > 0 {
+			fmt.Fprintf(buf, "\n[%s]\n", encodeTOMLKeys(path))
+		}
+		header = true
+
+		fmt.Fprintf(buf, "%s = %s\n", encodeTOMLKey(key), encodeTOMLValue(table[key]))
+	}
+
+	for _, key := range keys {
+		if child, ok := table[key].(map[string]interface{}); ok {
+			encodeTOMLTable(buf, append(path[:len(path):len(path)], key), child)
+		}
+	}
+}
+
+func encodeTOMLKeys(keys []string) string {
+	encoded := make([]string, len(keys))
+	for i, key := range keys {
+		encoded[i] = encodeTOMLKey(key)
+	}
+	return strings.Join(encoded, ".")
+}
+
+func encodeTOMLKey(key string) string {
+	if key == "" {
+		return `""`
+	}
+	for _, r := range key {
+		if !isBareKeyRune(r) {
+			return encodeTOMLString(key)
+		}
+	}
+	return key
+}
+
+func encodeTOMLValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return encodeTOMLString(v)
+	case bool:
+		return strconv.FormatBool(v)
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		s := strconv.FormatFloat(v, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eEn") {
+			s += ".0"
+		}
+		return s
+	case []string:
+		encoded := make([]string, len(v))
+		for i, s := range v {
+			encoded[i] = encodeTOMLString(s)
+		}
+		return "[" + strings.Join(encoded, ", ") + "]"
+	case []interface{}:
+		encoded := make([]string, len(v))
+		for i, element := range v {
+			encoded[i] = encodeTOMLValue(element)
+		}
+		return "[" + strings.Join(encoded, ", ") + "]"
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		encoded := make([]string, len(keys))
+		for i, key := range keys {
+			encoded[i] = encodeTOMLKey(key) + " = " + encodeTOMLValue(v[key])
+		}
+		return "{ " + strings.Join(encoded, ", ") + " }"
+	default:
+		return encodeTOMLString(fmt.Sprint(v))
+	}
+}
+
+func encodeTOMLString(s string) string {
+	var b bytes.Buffer
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&b, `\u%04X`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
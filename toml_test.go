@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected map[string]interface{}
+	}{
+		{"empty", "", map[string]interface{}{}},
+		{"comments", "# comment\n\nkey = 1 # trailing\n", map[string]interface{}{"key": int64(1)}},
+		{"windows newlines", "a = 1\r\nb = 2\r\n", map[string]interface{}{"a": int64(1), "b": int64(2)}},
+		{"scalars", "s = \"x\"\ni = -12\nn = 1_000\nf = 1.5\ne = 1e3\nt = true\nno = false\n", map[string]interface{}{
+			"s": "x", "i": int64(-12), "n": int64(1000), "f": 1.5, "e": 1000.0, "t": true, "no": false,
+		}},
+
+		// Quoting and escapes
+		{"escapes", `s = "tab\tquote\"slash\\nl\n"`, map[string]interface{}{"s": "tab\tquote\"slash\\nl\n"}},
+		{"unicode escapes", `s = "\u00e9\U0001F600"`, map[string]interface{}{"s": "é😀"}},
+		{"literal string", `s = 'C:\path\n # not a comment'`, map[string]interface{}{"s": `C:\path\n # not a comment`}},
+		{"hash in string", `s = "a # b" # comment`, map[string]interface{}{"s": "a # b"}},
+		{"quoted keys", "\"a.b\" = 1\n'c d' = 2\n", map[string]interface{}{"a.b": int64(1), "c d": int64(2)}},
+
+		// Arrays
+		{"array", `a = [1, "two", true]`, map[string]interface{}{"a": []interface{}{int64(1), "two", true}}},
+		{"empty array", `a = []`, map[string]interface{}{"a": []interface{}{}}},
+		{"multi-line array", "a = [\n  1, # one\n  2,\n]\n", map[string]interface{}{"a": []interface{}{int64(1), int64(2)}}},
+		{"nested array", `a = [[1], []]`, map[string]interface{}{"a": []interface{}{[]interface{}{int64(1)}, []interface{}{}}}},
+
+		// Nesting
+		{"tables", "[a]\nx = 1\n[a.b]\ny = 2\n[c]\n", map[string]interface{}{
+			"a": map[string]interface{}{"x": int64(1), "b": map[string]interface{}{"y": int64(2)}},
+			"c": map[string]interface{}{},
+		}},
+		{"dotted keys", "a.b = 1\na.c = 2\n", map[string]interface{}{"a": map[string]interface{}{"b": int64(1), "c": int64(2)}}},
+		{"quoted table name", `[ "a b" . c ]`, map[string]interface{}{"a b": map[string]interface{}{"c": map[string]interface{}{}}}},
+		{"inline table", `t = { a = 1, b.c = "x" }`, map[string]interface{}{
+			"t": map[string]interface{}{"a": int64(1), "b": map[string]interface{}{"c": "x"}},
+		}},
+		{"empty inline table", `t = {}`, map[string]interface{}{"t": map[string]interface{}{}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parsed, err := parseTOML([]byte(test.input))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(parsed, test.expected) {
+				t.Fatalf("expected %#v, got %#v", test.expected, parsed)
+			}
+		})
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		error string
+	}{
+		{"missing equals", "a 1", "line 1: expected = after a"},
+		{"missing value", "a =", "line 1: expected a value"},
+		{"missing key", "= 1", `line 1: expected a key, got '='`},
+		{"invalid value", "a = yes", `line 1: invalid value starting with 'y'`},
+		{"invalid boolean", "a = truthy", `line 1: invalid value "truthy"`},
+		{"invalid number", "a = 1.2.3", `line 1: invalid number "1.2.3"`},
+		{"trailing garbage", "a = 1 2", `line 1: unexpected '2' at the end of the line`},
+		{"unterminated string", "a = 1\nb = \"x\nc = 2", "line 2: unterminated string"},
+		{"unterminated literal string", "a = 1\nb = 'x\nc = 2", "line 2: unterminated string"},
+		{"invalid escape", `a = "\q"`, `line 1: invalid escape \q`},
+		{"invalid unicode escape", `a = "\u12"`, "line 1: invalid unicode escape"},
+		{"multi-line string", `a = """x"""`, "line 1: multi-line strings are not supported"},
+		{"unclosed array", "a = [1,\n2\n", "line 3: expected , or ] in array"},
+		{"unclosed inline table", "a = { b = 1\nc = 2", "line 1: expected , or } in inline table"},
+		{"key without a value", "a\nb = 1", "line 1: expected = after a"},
+		{"unclosed table name", "[a\nb = 1", "line 1: expected ] after the table name"},
+		{"array of tables", "[[a]]", "line 1: arrays of tables are not supported"},
+		{"duplicate key", "a = 1\n\na = 2", "line 3: a is defined twice"},
+		{"duplicate dotted key", "[a]\nb = 1\n[a]\nb = 2", "line 4: b is defined twice"},
+		{"table over a value", "a = 1\n[a.b]", "line 2: a is already set to a value"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseTOML([]byte(test.input))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if err.Error() != test.error {
+				t.Fatalf("expected %q, got %q", test.error, err)
+			}
+		})
+	}
+}
+
+func TestEncodeTOML(t *testing.T) {
+	values := map[string]interface{}{
+		"name":  "quote \" and\ttab",
+		"count": int64(2),
+		"ratio": 1.0,
+		"tags":  []string{"a", "b"},
+		"profiles": map[string]interface{}{
+			"default": map[string]interface{}{"host": "https://api.timber.io", "a.b": true},
+		},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := encodeTOML(buf, values); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := strings.Join([]string{
+		`count = 2`,
+		`name = "quote \" and\ttab"`,
+		`ratio = 1.0`,
+		`tags = ["a", "b"]`,
+		``,
+		`[profiles.default]`,
+		`"a.b" = true`,
+		`host = "https://api.timber.io"`,
+		``,
+	}, "\n")
+	if buf.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+
+	// The encoded file parses back to the same values, arrays aside
+	parsed, err := parseTOML(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	values["tags"] = []interface{}{"a", "b"}
+	if !reflect.DeepEqual(parsed, values) {
+		t.Fatalf("expected %#v, got %#v", values, parsed)
+	}
+}
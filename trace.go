@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aybabtme/rgbterm"
+	"github.com/timberio/cli/api"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Width of the waterfall bars of `timber trace`
+var traceWaterfallWidth = 30
+
+type traceOptions struct {
+	RequestID string
+	SourceIds []string // every source when empty
+	Since     time.Time
+	Until     *time.Time
+	Limit     int
+}
+
+// traceStep is a log line of a request and the time until the next one
+type traceStep struct {
+	Dt         time.Time `json:"dt"`
+	OffsetMs   float64   `json:"offset_ms"`
+	DurationMs float64   `json:"duration_ms"`
+	RequestID  string    `json:"request_id"`
+	SourceID   string    `json:"source_id"`
+	Source     string    `json:"source"`
+	Level      string    `json:"level"`
+	Message    string    `json:"message"`
+
+	offset   time.Duration
+	duration time.Duration
+}
+
+var traceStepColumns = []column{
+	{"dt", func(i interface{}) string { return i.(*traceStep).Dt.Format(time.RFC3339Nano) }},
+	{"offset", func(i interface{}) string { return formatTraceDuration(i.(*traceStep).offset) }},
+	{"duration", func(i interface{}) string { return formatTraceDuration(i.(*traceStep).duration) }},
+	{"source", func(i interface{}) string { return i.(*traceStep).Source }},
+	{"level", func(i interface{}) string { return i.(*traceStep).Level }},
+	{"message", func(i interface{}) string { return i.(*traceStep).Message }},
+}
+
+// trace searches every source for the log lines of a request and shows them
+// as a waterfall, or as a list of steps in structured output formats
+func trace(w io.Writer, options *traceOptions, loc *time.Location) error {
+	sources, err := client.ListSourcesContext(rootContext)
+	if err != nil {
+		return err
+	}
+
+	names := map[string]string{}
+	for _, source := range sources {
+		names[source.ID] = source.Name
+	}
+
+	sourceIds := options.SourceIds
+	if len(sourceIds) == 0 {
+		for _, source := range sources {
+			sourceIds = append(sourceIds, source.ID)
+		}
+	}
+
+	logLines, truncated, err := searchRequestLines(sourceIds, options, loc)
+	if err != nil {
+		return err
+	}
+
+	steps := traceSteps(logLines, options.RequestID, names)
+
+	if !isTableOutput() {
+		return printList(w, steps, traceStepColumns)
+	}
+
+	if len(steps) == 0 {
+		fmt.Fprintf(errWriter, "No log lines found for request %s since %s\n",
+			options.RequestID, options.Since.In(loc).Format("Jan 02 03:04:05pm"))
+		return nil
+	}
+
+	printWaterfall(w, steps, loc)
+
+	if truncated {
+		fmt.Fprintf(warningWriter, "⚠  Only the first %d log lines of the request are shown, use --limit to show more\n", options.Limit)
+	}
+
+	return nil
+}
+
+// searchRequestLines returns the log lines with the request ID, oldest
+// first. truncated is true when there were more than the limit.
+func searchRequestLines(sourceIds []string, options *traceOptions, loc *time.Location) ([]*api.LogLine, bool, error) {
+	searchRequest := api.NewSearchRequest()
+	searchRequest.ApplicationIds = sourceIds
+	searchRequest.Query = fmt.Sprintf("context.http.request_id:%q", options.RequestID)
+	searchRequest.DtGte = &options.Since
+	searchRequest.DtLt = options.Until
+	searchRequest.Sort = "dt.asc"
+
+	pager := client.NewSearchPager(searchRequest)
+	requestID := []string{"context", "http", "request_id"}
+	logLines := []*api.LogLine{}
+
+	for {
+		page, err := pager.NextContext(rootContext)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if len(page) == 0 {
+			warnSkipped(pager.Skipped(), loc)
+			return logLines, false, nil
+		}
+
+		for _, line := range page {
+			// The query also matches request IDs containing this one
+			if findField(requestID, line.Fields) != options.RequestID {
+				continue
+			}
+
+			if options.Limit > 0 && len(logLines) == options.Limit {
+				return logLines, true, nil
+			}
+			logLines = append(logLines, line)
+		}
+	}
+}
+
+// traceSteps computes the offset of each line from the first one, and the
+// duration of each step until the next line
+func traceSteps(logLines []*api.LogLine, requestID string, names map[string]string) []*traceStep {
+	steps := make([]*traceStep, len(logLines))
+
+	for i, line := range logLines {
+		step := &traceStep{
+			Dt:        line.Datetime,
+			RequestID: requestID,
+			SourceID:  line.ApplicationID,
+			Source:    names[line.ApplicationID],
+			Level:     line.Level,
+			Message:   line.Message,
+			offset:    line.Datetime.Sub(logLines[0].Datetime),
+		}
+
+		if step.Source == "" {
+			step.Source = line.ApplicationID
+		}
+
+		if i+1 < len(logLines) {
+			step.duration = logLines[i+1].Datetime.Sub(line.Datetime)
+		}
+
+		step.OffsetMs = durationMs(step.offset)
+		step.DurationMs = durationMs(step.duration)
+		steps[i] = step
+	}
+
+	return steps
+}
+
+// printWaterfall prints a line per step with a bar spanning the time until
+// the next step, relative to the duration of the whole request
+func printWaterfall(w io.Writer, steps []*traceStep, loc *time.Location) {
+	total := steps[len(steps)-1].offset
+
+	sourceWidth := 0
+	sources := map[string]bool{}
+	for _, step := range steps {
+		if len(step.Source) > sourceWidth {
+			sourceWidth = len(step.Source)
+		}
+		sources[step.Source] = true
+	}
+
+	fmt.Fprintf(w, "Request %s, %d log lines from %d sources over %s, started %s\n\n",
+		steps[0].RequestID, len(steps), len(sources), formatTraceDuration(total),
+		steps[0].Dt.In(loc).Format("Jan 02 03:04:05.000pm"))
+
+	width := 0
+	if terminal.IsTerminal(int(os.Stdout.Fd())) {
+		width, _, _ = terminal.GetSize(int(os.Stdout.Fd()))
+	}
+
+	scale := NewOrdinalColorScale(ordinalScale)
+
+	for _, step := range steps {
+		source := fmt.Sprintf("%-*s", sourceWidth, step.Source)
+		level := fmt.Sprintf("%-4s", Level(step.Level).ShortName())
+		bar := waterfallBar(step.offset, step.duration, total, traceWaterfallWidth)
+
+		if colorize {
+			sourceColor := scale.Get(step.Source)
+			levelColor := Level(step.Level).Color()
+			source = rgbterm.FgString(source, sourceColor[0], sourceColor[1], sourceColor[2])
+			level = rgbterm.FgString(level, levelColor[0], levelColor[1], levelColor[2])
+			bar = rgbterm.FgString(bar, sourceColor[0], sourceColor[1], sourceColor[2])
+		}
+
+		line := fmt.Sprintf("%9s %9s  %s  %s  %s  %s", "+"+formatTraceDuration(step.offset),
+			formatTraceDuration(step.duration), source, level, bar, step.Message)
+		if width > 0 {
+			line = truncateColored(line, width)
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+// waterfallBar draws a step as █ between its offset and the next step, every
+// step is at least one character wide
+func waterfallBar(offset time.Duration, duration time.Duration, total time.Duration, width int) string {
+	start, length := 0, 1
+	if total > 0 {
+		start = int(float64(offset) / float64(total) * float64(width))
+		length = int(float64(duration)/float64(total)*float64(width) + 0.5)
+	}
+
+	if start >= width {
+		start = width - 1
+	}
+	if length < 1 {
+		length = 1
+	}
+	if start+length > width {
+		length = width - start
+	}
+
+	return strings.Repeat("·", start) + strings.Repeat("█", length) + strings.Repeat("·", width-start-length)
+}
+
+func formatTraceDuration(d time.Duration) string {
+	if d < time.Millisecond {
+		return fmt.Sprintf("%dms", d/time.Millisecond)
+	}
+	return d.Round(time.Millisecond).String()
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
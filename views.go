@@ -4,34 +4,32 @@ import (
 	"fmt"
 	"os"
 	"strings"
-	"text/tabwriter"
+
+	"github.com/timberio/cli/api"
 )
 
+var savedViewColumns = []column{
+	{"name", func(i interface{}) string { return i.(*api.SavedView).Name }},
+	{"id", func(i interface{}) string { return i.(*api.SavedView).ID }},
+	{"source ids", func(i interface{}) string { return strings.Join(i.(*api.SavedView).ConsoleSettings.SourceIds, ",") }},
+	{"facets", func(i interface{}) string { return strings.Join(i.(*api.SavedView).ConsoleSettings.Facets, ",") }},
+	{"query", func(i interface{}) string {
+		query := i.(*api.SavedView).ConsoleSettings.Query
+		if query == nil {
+			return ""
+		}
+		return *query
+	}},
+	{"format", func(i interface{}) string {
+		return fmt.Sprintf(`"%s"`, i.(*api.SavedView).ConsoleSettings.LogLineFormat)
+	}},
+}
+
 func listSavedViews() error {
-	savedViews, err := client.ListSavedViews()
+	savedViews, err := client.ListSavedViewsContext(rootContext)
 	if err != nil {
 		return err
 	}
 
-	w := new(tabwriter.Writer)
-	w.Init(os.Stdout, 0, 8, 0, '\t', 0)
-
-	fmt.Fprintln(w, "name\tid\tsource ids\tfacets\tquery\tformat")
-	for _, savedView := range savedViews {
-		query := ""
-		if savedView.ConsoleSettings.Query != nil {
-			query = *savedView.ConsoleSettings.Query
-		}
-		fmt.Fprintln(w, strings.Join([]string{
-			savedView.Name,
-			savedView.ID,
-			strings.Join(savedView.ConsoleSettings.SourceIds, ","),
-			strings.Join(savedView.ConsoleSettings.Facets, ","),
-			query,
-			fmt.Sprintf(`"%s"`, savedView.ConsoleSettings.LogLineFormat),
-		}, "\t"))
-	}
-	w.Flush()
-
-	return nil
+	return printList(os.Stdout, savedViews, savedViewColumns)
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/timberio/cli/api"
+	"gopkg.in/urfave/cli.v1"
+)
+
+type waitOptions struct {
+	SourceIds []string
+	Query     string
+	Transport string
+	Count     int
+	Timeout   time.Duration // 0 waits until interrupted
+	Since     *time.Time    // also match lines logged before waiting, when set
+}
+
+// wait tails the query until Count log lines match, printing them as they
+// arrive. It prints nothing else so that scripts can use its output, and
+// returns an exit error with exitCodeTimeout when the timeout passes first.
+func wait(w io.Writer, options *waitOptions, formatter *logLineFormatter, filter *logLineFilter) error {
+	ctx, cancel := context.WithCancel(rootContext)
+	defer cancel()
+	if options.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, options.Timeout)
+		defer cancel()
+	}
+
+	var waitErr error
+	matched := 0
+	seen := api.NewIDWindow(tailScrollback)
+
+	send := func(batch *api.LogBatch, err error) bool {
+		if err != nil {
+			waitErr = err
+			return false
+		}
+
+		for _, line := range batch.LogLines {
+			if !seen.Add(line.ID) {
+				continue
+			}
+
+			formatted, err := formatter.Format(line)
+			if err != nil {
+				waitErr = err
+				return false
+			}
+
+			text := ""
+			if filter.needsText() {
+				text = stripColors(formatted)
+			}
+			if !filter.Match(line, text) {
+				continue
+			}
+
+			if _, err := fmt.Fprintln(w, formatted); err != nil {
+				waitErr = err
+				return false
+			}
+
+			matched++
+			if matched == options.Count {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	// Unlike tail, the stream doesn't start with the most recent lines. Lines
+	// logged since --since are searched first, then the stream starts from
+	// the newest one.
+	since, ok := time.Now(), true
+	if options.Since != nil {
+		since, ok = backfillLogBatches(ctx, options.SourceIds, options.Query, *options.Since, send)
+	}
+
+	if ok {
+		streamLogBatches(ctx, options.SourceIds, options.Query, options.Transport, &since, send)
+	}
+
+	if matched == options.Count {
+		return nil
+	}
+
+	if ctx.Err() == context.DeadlineExceeded && rootContext.Err() == nil {
+		message := fmt.Sprintf("Timed out after %s, %d of %d log lines matched", options.Timeout, matched, options.Count)
+		return cli.NewExitError(message, exitCodeTimeout)
+	}
+
+	return waitErr
+}
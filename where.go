@@ -0,0 +1,597 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/timberio/cli/api"
+)
+
+// `--where` filters log lines locally with a small expression language:
+//
+//	context.http.status >= 500                  fields use the same dotted paths as --log-format
+//	message =~ /timeout/i && level != "debug"   regexps are written /.../, i ignores case
+//	!(context.user.email) || dt > "10m"         a bare field is true when it is set and not empty,
+//	                                            false or 0, times accept the same values as --since
+//
+// Comparisons are numeric when either side is a number, and a field that
+// isn't set only equals null.
+
+// logLineFilter keeps the log lines matching --where and drops the ones
+// matching an --exclude pattern
+type logLineFilter struct {
+	where   whereNode // nil when --where isn't set
+	exclude []*regexp.Regexp
+	loc     *time.Location
+}
+
+func newLogLineFilter(where string, exclude []string, loc *time.Location) (*logLineFilter, error) {
+	filter := &logLineFilter{loc: loc}
+
+	if strings.TrimSpace(where) != "" {
+		node, err := parseWhere(where)
+		if err != nil {
+			return nil, err
+		}
+		filter.where = node
+	}
+
+	for _, pattern := range exclude {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid --exclude pattern %q: %s", pattern, err)
+		}
+		filter.exclude = append(filter.exclude, re)
+	}
+
+	return filter, nil
+}
+
+// Match reports whether a log line should be shown, text is the line as
+// rendered without colors. A nil filter matches every line.
+func (f *logLineFilter) Match(line *api.LogLine, text string) bool {
+	if f == nil {
+		return true
+	}
+
+	for _, re := range f.exclude {
+		if re.MatchString(text) {
+			return false
+		}
+	}
+
+	return f.where == nil || f.where.match(line, f.loc)
+}
+
+// Filtering only needs the rendered text when there are --exclude patterns
+func (f *logLineFilter) needsText() bool {
+	return f != nil && len(f.exclude) > 0
+}
+
+//
+// Evaluation
+//
+
+type whereNode interface {
+	match(line *api.LogLine, loc *time.Location) bool
+}
+
+type whereAnd struct{ left, right whereNode }
+type whereOr struct{ left, right whereNode }
+type whereNot struct{ node whereNode }
+
+func (n *whereAnd) match(line *api.LogLine, loc *time.Location) bool {
+	return n.left.match(line, loc) && n.right.match(line, loc)
+}
+
+func (n *whereOr) match(line *api.LogLine, loc *time.Location) bool {
+	return n.left.match(line, loc) || n.right.match(line, loc)
+}
+
+func (n *whereNot) match(line *api.LogLine, loc *time.Location) bool {
+	return !n.node.match(line, loc)
+}
+
+// whereOperand is either a field or a literal
+type whereOperand struct {
+	field   string
+	literal interface{} // string, float64, bool or nil
+	regexp  *regexp.Regexp
+}
+
+func (o *whereOperand) value(line *api.LogLine) (interface{}, bool) {
+	if o.field == "" {
+		return o.literal, true
+	}
+
+	switch o.field {
+	case "date", "dt":
+		return line.Datetime, true
+	case "level":
+		return line.Level, true
+	case "message":
+		return line.Message, true
+	default:
+		return lookupField(strings.Split(o.field, "."), line.Fields)
+	}
+}
+
+// whereTruthy is a bare operand, e.g. `context.user.email`
+type whereTruthy struct{ operand *whereOperand }
+
+func (n *whereTruthy) match(line *api.LogLine, loc *time.Location) bool {
+	v, ok := n.operand.value(line)
+	if !ok {
+		return false
+	}
+
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	default:
+		return true
+	}
+}
+
+type whereCompare struct {
+	op          string
+	left, right *whereOperand
+}
+
+func (n *whereCompare) match(line *api.LogLine, loc *time.Location) bool {
+	left, leftOk := n.left.value(line)
+	if !leftOk {
+		left = nil
+	}
+
+	if n.op == "=~" || n.op == "!~" {
+		matched := left != nil && n.right.regexp.MatchString(fmt.Sprintf("%v", left))
+		return matched == (n.op == "=~")
+	}
+
+	right, rightOk := n.right.value(line)
+	if !rightOk {
+		right = nil
+	}
+
+	if left == nil || right == nil {
+		equal := left == nil && right == nil
+		switch n.op {
+		case "==":
+			return equal
+		case "!=":
+			return !equal
+		default:
+			return false
+		}
+	}
+
+	cmp, ok := compareWhereValues(left, right, loc)
+	if !ok {
+		return n.op == "!="
+	}
+
+	switch n.op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// compareWhereValues returns -1, 0 or 1, ok is false when the values can't
+// be compared
+func compareWhereValues(left interface{}, right interface{}, loc *time.Location) (int, bool) {
+	if t, ok := left.(time.Time); ok {
+		other, err := whereTime(right, loc)
+		if err != nil {
+			return 0, false
+		}
+		return compareTimes(t, other), true
+	}
+	if t, ok := right.(time.Time); ok {
+		other, err := whereTime(left, loc)
+		if err != nil {
+			return 0, false
+		}
+		return compareTimes(other, t), true
+	}
+
+	_, leftNumber := left.(float64)
+	_, rightNumber := right.(float64)
+	if leftNumber || rightNumber {
+		l, lok := whereNumber(left)
+		r, rok := whereNumber(right)
+		if !lok || !rok {
+			return 0, false
+		}
+		switch {
+		case l < r:
+			return -1, true
+		case l > r:
+			return 1, true
+		default:
+			return 0, true
+		}
+	}
+
+	_, leftBool := left.(bool)
+	_, rightBool := right.(bool)
+	if leftBool || rightBool {
+		if left == right {
+			return 0, true
+		}
+		return 0, false
+	}
+
+	return strings.Compare(fmt.Sprintf("%v", left), fmt.Sprintf("%v", right)), true
+}
+
+func whereNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+func whereTime(v interface{}, loc *time.Location) (time.Time, error) {
+	switch v := v.(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		return parseTime(v, time.Now(), loc)
+	default:
+		return time.Time{}, fmt.Errorf("%v is not a time", v)
+	}
+}
+
+func compareTimes(a time.Time, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	default:
+		return 0
+	}
+}
+
+//
+// Parsing
+//
+
+type whereParseError struct {
+	expr string
+	pos  int
+	msg  string
+}
+
+func (e *whereParseError) Error() string {
+	return fmt.Sprintf("Invalid --where expression at character %d: %s\n  %s\n  %s^", e.pos+1, e.msg, e.expr, strings.Repeat(" ", e.pos))
+}
+
+type whereTokenKind int
+
+const (
+	whereTokenField whereTokenKind = iota
+	whereTokenString
+	whereTokenNumber
+	whereTokenRegexp
+	whereTokenOperator
+)
+
+type whereToken struct {
+	kind whereTokenKind
+	text string
+	pos  int
+}
+
+type whereParser struct {
+	expr   string
+	tokens []whereToken
+	next   int
+}
+
+// Operators, longest first so that <= is not read as <
+var whereOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "!~", "<", ">", "!", "(", ")"}
+
+func parseWhere(expr string) (whereNode, error) {
+	p := &whereParser{expr: expr}
+
+	err := p.lex()
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.next < len(p.tokens) {
+		token := p.tokens[p.next]
+		return nil, p.errorf(token.pos, "unexpected %q", token.text)
+	}
+
+	return node, nil
+}
+
+func (p *whereParser) parseOr() (whereNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &whereOr{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *whereParser) parseAnd() (whereNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.accept("&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &whereAnd{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *whereParser) parseUnary() (whereNode, error) {
+	if p.accept("!") {
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &whereNot{node}, nil
+	}
+
+	if p.accept("(") {
+		start := p.tokens[p.next-1].pos
+
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if !p.accept(")") {
+			return nil, p.errorf(start, "unclosed (")
+		}
+		return node, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *whereParser) parseComparison() (whereNode, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	if left.regexp != nil {
+		return nil, p.errorf(p.tokens[p.next-1].pos, "a regexp can only follow =~ or !~")
+	}
+
+	if p.next >= len(p.tokens) || p.tokens[p.next].kind != whereTokenOperator {
+		return &whereTruthy{left}, nil
+	}
+
+	op := p.tokens[p.next]
+	switch op.text {
+	case "==", "!=", "<", "<=", ">", ">=", "=~", "!~":
+		p.next++
+	default:
+		return &whereTruthy{left}, nil
+	}
+
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	regexpOp := op.text == "=~" || op.text == "!~"
+	if regexpOp && right.regexp == nil {
+		return nil, p.errorf(op.pos, "%s expects a regexp such as /timeout/", op.text)
+	}
+	if !regexpOp && right.regexp != nil {
+		return nil, p.errorf(op.pos, "regexps can only be matched with =~ or !~")
+	}
+
+	return &whereCompare{op: op.text, left: left, right: right}, nil
+}
+
+func (p *whereParser) parseOperand() (*whereOperand, error) {
+	if p.next >= len(p.tokens) {
+		return nil, p.errorf(len(p.expr), "expected a field or a value")
+	}
+
+	token := p.tokens[p.next]
+	p.next++
+
+	switch token.kind {
+	case whereTokenField:
+		switch token.text {
+		case "true":
+			return &whereOperand{literal: true}, nil
+		case "false":
+			return &whereOperand{literal: false}, nil
+		case "null":
+			return &whereOperand{literal: nil}, nil
+		}
+		return &whereOperand{field: token.text}, nil
+
+	case whereTokenString:
+		return &whereOperand{literal: token.text}, nil
+
+	case whereTokenNumber:
+		f, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, p.errorf(token.pos, "invalid number %q", token.text)
+		}
+		return &whereOperand{literal: f}, nil
+
+	case whereTokenRegexp:
+		re, err := regexp.Compile(token.text)
+		if err != nil {
+			return nil, p.errorf(token.pos, "invalid regexp: %s", err)
+		}
+		return &whereOperand{regexp: re}, nil
+	}
+
+	return nil, p.errorf(token.pos, "expected a field or a value, got %q", token.text)
+}
+
+func (p *whereParser) accept(operator string) bool {
+	if p.next < len(p.tokens) && p.tokens[p.next].kind == whereTokenOperator && p.tokens[p.next].text == operator {
+		p.next++
+		return true
+	}
+	return false
+}
+
+func (p *whereParser) lex() error {
+	s := p.expr
+	i := 0
+
+	for i < len(s) {
+		r, size := utf8.DecodeRuneInString(s[i:])
+
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+
+		case r == '"' || r == '\'':
+			j := i + 1
+			for j < len(s) && s[j] != byte(r) {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return p.errorf(i, "unterminated string")
+			}
+
+			text := s[i+1 : j]
+			if r == '"' {
+				unquoted, err := strconv.Unquote(s[i : j+1])
+				if err != nil {
+					return p.errorf(i, "invalid string %s", s[i:j+1])
+				}
+				text = unquoted
+			} else {
+				text = strings.Replace(text, `\'`, `'`, -1)
+			}
+
+			p.tokens = append(p.tokens, whereToken{kind: whereTokenString, text: text, pos: i})
+			i = j + 1
+
+		case r == '/':
+			j := i + 1
+			for j < len(s) && s[j] != '/' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return p.errorf(i, "unterminated regexp")
+			}
+
+			pattern := strings.Replace(s[i+1:j], `\/`, `/`, -1)
+			j++
+
+			// Flags follow the closing slash, only i is supported
+			if j < len(s) && s[j] == 'i' {
+				pattern = "(?i)" + pattern
+				j++
+			}
+
+			p.tokens = append(p.tokens, whereToken{kind: whereTokenRegexp, text: pattern, pos: i})
+			i = j
+
+		case unicode.IsDigit(r) || r == '-' && i+1 < len(s) && unicode.IsDigit(rune(s[i+1])):
+			j := i + 1
+			for j < len(s) && (unicode.IsDigit(rune(s[j])) || s[j] == '.') {
+				j++
+			}
+			p.tokens = append(p.tokens, whereToken{kind: whereTokenNumber, text: s[i:j], pos: i})
+			i = j
+
+		case isIdentRune(r):
+			j := i
+			for j < len(s) {
+				r, size := utf8.DecodeRuneInString(s[j:])
+				if !isIdentRune(r) {
+					break
+				}
+				j += size
+			}
+			p.tokens = append(p.tokens, whereToken{kind: whereTokenField, text: s[i:j], pos: i})
+			i = j
+
+		default:
+			operator := ""
+			for _, op := range whereOperators {
+				if strings.HasPrefix(s[i:], op) {
+					operator = op
+					break
+				}
+			}
+			if operator == "" {
+				return p.errorf(i, "unexpected character %q", r)
+			}
+
+			p.tokens = append(p.tokens, whereToken{kind: whereTokenOperator, text: operator, pos: i})
+			i += len(operator)
+		}
+	}
+
+	if len(p.tokens) == 0 {
+		return p.errorf(0, "empty expression")
+	}
+
+	return nil
+}
+
+func (p *whereParser) errorf(pos int, format string, args ...interface{}) error {
+	return &whereParseError{expr: p.expr, pos: pos, msg: fmt.Sprintf(format, args...)}
+}
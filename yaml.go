@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseYAML parses the subset of YAML used by the agent config: mappings and
+// sequences nested by indentation, flow sequences of scalars such as
+// [a, "b"], quoted and plain scalars, and comments. Mappings are returned as
+// map[string]interface{}, sequences as []interface{}, null as nil and every
+// other scalar as a string, the caller decides what type a value has.
+func parseYAML(data []byte) (interface{}, error) {
+	p := &yamlParser{}
+
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, " \t\r")
+
+		text := strings.TrimLeft(line, " ")
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("line %d: tabs can't be used for indentation", i+1)
+		}
+
+		text = stripYAMLComment(text)
+		if text == "" || (text == "---" && len(p.lines) == 0) {
+			continue
+		}
+
+		p.lines = append(p.lines, yamlLine{number: i + 1, indent: len(line) - len(strings.TrimLeft(line, " ")), text: text})
+	}
+
+	if len(p.lines) == 0 {
+		return nil, nil
+	}
+
+	value, err := p.parseBlock(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.eof() && p.lines[p.pos].indent == p.lines[0].indent {
+		return nil, p.errorf("list items and keys can't be mixed")
+	} else if !p.eof() {
+		return nil, p.errorf("unexpected indentation")
+	}
+
+	return value, nil
+}
+
+// yamlLine is a line without its indentation and comment
+type yamlLine struct {
+	number int
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func (p *yamlParser) errorf(format string, args ...interface{}) error {
+	line := p.lines[len(p.lines)-1].number
+	if !p.eof() {
+		line = p.lines[p.pos].number
+	}
+	return fmt.Errorf("line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func (p *yamlParser) eof() bool {
+	return p.pos >= len(p.lines)
+}
+
+// parseBlock parses the mapping or sequence starting at the current line
+func (p *yamlParser) parseBlock(indent int) (interface{}, error) {
+	if isYAMLSequenceItem(p.lines[p.pos].text) {
+		return p.parseSequence(indent)
+	}
+	return p.parseMapping(indent)
+}
+
+func (p *yamlParser) parseSequence(indent int) ([]interface{}, error) {
+	items := []interface{}{}
+
+	for !p.eof() && p.lines[p.pos].indent == indent && isYAMLSequenceItem(p.lines[p.pos].text) {
+		line := p.lines[p.pos]
+		rest := strings.TrimLeft(line.text[1:], " ")
+
+		if rest == "" {
+			p.pos++
+			if !p.eof() && p.lines[p.pos].indent > indent {
+				item, err := p.parseBlock(p.lines[p.pos].indent)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, item)
+			} else {
+				items = append(items, nil)
+			}
+			continue
+		}
+
+		if _, _, ok := splitYAMLKey(rest); ok || isYAMLSequenceItem(rest) {
+			// "- key: value" starts a mapping indented like its first key,
+			// parse the rest of the line as a line of its own
+			p.lines[p.pos] = yamlLine{number: line.number, indent: indent + len(line.text) - len(rest), text: rest}
+			item, err := p.parseBlock(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+			continue
+		}
+
+		item, err := p.parseScalar(rest)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		p.pos++
+	}
+
+	if !p.eof() && p.lines[p.pos].indent > indent {
+		return nil, p.errorf("unexpected indentation")
+	}
+
+	return items, nil
+}
+
+func (p *yamlParser) parseMapping(indent int) (map[string]interface{}, error) {
+	mapping := map[string]interface{}{}
+
+	for !p.eof() && p.lines[p.pos].indent == indent {
+		line := p.lines[p.pos]
+		if isYAMLSequenceItem(line.text) {
+			return nil, p.errorf("expected a key, not a list item")
+		}
+
+		key, rest, ok := splitYAMLKey(line.text)
+		if !ok {
+			return nil, p.errorf("expected key: value")
+		}
+		if _, ok := mapping[key]; ok {
+			return nil, p.errorf("%s is set twice", key)
+		}
+
+		if rest != "" {
+			value, err := p.parseScalar(rest)
+			if err != nil {
+				return nil, err
+			}
+			mapping[key] = value
+			p.pos++
+			continue
+		}
+
+		p.pos++
+		mapping[key] = nil
+
+		// Lists may be indented like their key
+		if !p.eof() && (p.lines[p.pos].indent > indent ||
+			(p.lines[p.pos].indent == indent && isYAMLSequenceItem(p.lines[p.pos].text))) {
+			value, err := p.parseBlock(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			mapping[key] = value
+		}
+	}
+
+	if !p.eof() && p.lines[p.pos].indent > indent {
+		return nil, p.errorf("unexpected indentation")
+	}
+
+	return mapping, nil
+}
+
+func (p *yamlParser) parseScalar(text string) (interface{}, error) {
+	switch text[0] {
+	case '[':
+		return p.parseFlowSequence(text)
+	case '{':
+		return nil, p.errorf("inline mappings are not supported")
+	case '|', '>':
+		return nil, p.errorf("multi-line strings are not supported")
+	case '&', '*', '!':
+		return nil, p.errorf("anchors, aliases and tags are not supported")
+	case '"', '\'':
+		s, rest, err := parseYAMLQuoted(text)
+		if err != nil {
+			return nil, p.errorf("%s", err)
+		}
+		if rest != "" {
+			return nil, p.errorf("unexpected %q after the string", rest)
+		}
+		return s, nil
+	}
+
+	if text == "~" || text == "null" {
+		return nil, nil
+	}
+	return text, nil
+}
+
+func (p *yamlParser) parseFlowSequence(text string) ([]interface{}, error) {
+	if !strings.HasSuffix(text, "]") {
+		return nil, p.errorf("expected ] at the end of the list")
+	}
+
+	items := []interface{}{}
+	rest := strings.TrimSpace(text[1 : len(text)-1])
+
+	for rest != "" {
+		var item string
+		if rest[0] == '"' || rest[0] == '\'' {
+			s, after, err := parseYAMLQuoted(rest)
+			if err != nil {
+				return nil, p.errorf("%s", err)
+			}
+			item, rest = s, after
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			item, rest = strings.TrimSpace(rest[:end]), rest[end:]
+			if strings.ContainsAny(item, "[]{}") {
+				return nil, p.errorf("nested lists and mappings are not supported")
+			}
+		}
+
+		items = append(items, item)
+
+		if rest != "" {
+			if rest[0] != ',' {
+				return nil, p.errorf("expected , between list items")
+			}
+			rest = strings.TrimSpace(rest[1:])
+		}
+	}
+
+	return items, nil
+}
+
+// parseYAMLQuoted parses a quoted string at the start of text, returning
+// what follows it
+func parseYAMLQuoted(text string) (string, string, error) {
+	quote := text[0]
+
+	var b bytes.Buffer
+	for i := 1; i < len(text); i++ {
+		c := text[i]
+
+		switch {
+		case c == quote && quote == '\'' && i+1 < len(text) && text[i+1] == '\'':
+			b.WriteByte('\'')
+			i++
+		case c == quote:
+			return b.String(), strings.TrimSpace(text[i+1:]), nil
+		case c == '\\' && quote == '"' && i+1 < len(text):
+			i++
+			switch text[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '"', '\\', '/':
+				b.WriteByte(text[i])
+			case 'u':
+				if i+5 > len(text) {
+					return "", "", fmt.Errorf("invalid unicode escape")
+				}
+				code, err := strconv.ParseUint(text[i+1:i+5], 16, 32)
+				if err != nil {
+					return "", "", fmt.Errorf("invalid unicode escape")
+				}
+				b.WriteRune(rune(code))
+				i += 4
+			default:
+				return "", "", fmt.Errorf("invalid escape \\%c", text[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return "", "", fmt.Errorf("unterminated string")
+}
+
+// splitYAMLKey splits "key: value" lines, the value is empty when it is on
+// the following lines
+func splitYAMLKey(text string) (string, string, bool) {
+	if text[0] == '"' || text[0] == '\'' {
+		key, rest, err := parseYAMLQuoted(text)
+		if err != nil || !strings.HasPrefix(rest, ":") {
+			return "", "", false
+		}
+		return key, strings.TrimSpace(rest[1:]), true
+	}
+
+	for i := 0; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), i > 0
+		}
+	}
+
+	return "", "", false
+}
+
+func isYAMLSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// stripYAMLComment removes a # comment, which starts a line or follows a
+// space outside of quotes
+func stripYAMLComment(text string) string {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || strings.ContainsRune(" [,:-", rune(text[i-1])) {
+				quote = c
+			}
+		case c == '#' && (i == 0 || text[i-1] == ' '):
+			return strings.TrimRight(text[:i], " ")
+		}
+	}
+	return text
+}
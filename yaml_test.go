@@ -0,0 +1,107 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected interface{}
+	}{
+		{"empty", "", nil},
+		{"only comments", "# comment\n\n  # indented\n", nil},
+		{"document start", "---\na: 1\n", map[string]interface{}{"a": "1"}},
+		{"scalars", "s: text with spaces\nn: 12\nnull: ~\nalso-null: null\nempty:\n", map[string]interface{}{
+			"s": "text with spaces", "n": "12", "null": nil, "also-null": nil, "empty": nil,
+		}},
+		{"windows newlines", "a: 1\r\nb: 2\r\n", map[string]interface{}{"a": "1", "b": "2"}},
+		{"colons in values", "url: http://localhost:8080\ntime: 15:04", map[string]interface{}{
+			"url": "http://localhost:8080", "time": "15:04",
+		}},
+
+		// Comments
+		{"trailing comment", "a: b # comment", map[string]interface{}{"a": "b"}},
+		{"hash without space", "a: b#c", map[string]interface{}{"a": "b#c"}},
+		{"hash in quotes", `a: "b # c" # comment`, map[string]interface{}{"a": "b # c"}},
+
+		// Quoting and escapes
+		{"double quotes", `a: "tab\tquote\"slash\\ \u00e9"`, map[string]interface{}{"a": "tab\tquote\"slash\\ é"}},
+		{"single quotes", `a: 'it''s \n'`, map[string]interface{}{"a": `it's \n`}},
+		{"quoted null", `a: "null"`, map[string]interface{}{"a": "null"}},
+		{"quoted key", `"a: b": c`, map[string]interface{}{"a: b": "c"}},
+
+		// Sequences
+		{"flow sequence", `a: [x, "y, z", 'w']`, map[string]interface{}{"a": []interface{}{"x", "y, z", "w"}}},
+		{"empty flow sequence", "a: []", map[string]interface{}{"a": []interface{}{}}},
+		{"block sequence", "- a\n- \"b\"\n-\n", []interface{}{"a", "b", nil}},
+		{"sequence indented like its key", "a:\n- 1\n- 2\nb: 3", map[string]interface{}{
+			"a": []interface{}{"1", "2"}, "b": "3",
+		}},
+		{"nested sequences", "- - a\n  - b\n- c", []interface{}{[]interface{}{"a", "b"}, "c"}},
+
+		// Nesting
+		{"nested mappings", "a:\n  b:\n    c: 1\n  d: 2\ne: 3", map[string]interface{}{
+			"a": map[string]interface{}{"b": map[string]interface{}{"c": "1"}, "d": "2"}, "e": "3",
+		}},
+		{"sequence of mappings", "mirrors:\n  - file: a.log\n    query: level:error\n  - file: b.log\n", map[string]interface{}{
+			"mirrors": []interface{}{
+				map[string]interface{}{"file": "a.log", "query": "level:error"},
+				map[string]interface{}{"file": "b.log"},
+			},
+		}},
+		{"mapping under an empty item", "-\n  a: 1", []interface{}{map[string]interface{}{"a": "1"}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parsed, err := parseYAML([]byte(test.input))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(parsed, test.expected) {
+				t.Fatalf("expected %#v, got %#v", test.expected, parsed)
+			}
+		})
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		error string
+	}{
+		{"tab indentation", "a:\n\tb: 1", "line 2: tabs can't be used for indentation"},
+		{"not a mapping", "a: 1\nb", "line 2: expected key: value"},
+		{"duplicate key", "a: 1\n# comment\na: 2", "line 3: a is set twice"},
+		{"mixed items and keys", "a: 1\n- b", "line 2: expected a key, not a list item"},
+		{"keys after items", "- a\nb: 1", "line 2: list items and keys can't be mixed"},
+		{"unexpected indentation", "a: 1\n  b: 2", "line 2: unexpected indentation"},
+		{"unexpected indentation in a sequence", "- a\n  - b", "line 2: unexpected indentation"},
+		{"unterminated string", "a: 1\nb: \"c", "line 2: unterminated string"},
+		{"text after a string", `a: "b" c`, `line 1: unexpected "c" after the string`},
+		{"invalid escape", `a: "\q"`, `line 1: invalid escape \q`},
+		{"invalid unicode escape", `a: "\u12"`, "line 1: invalid unicode escape"},
+		{"unclosed flow sequence", "a:\n  b: [1, 2", "line 2: expected ] at the end of the list"},
+		{"nested flow sequence", "a: [[1]]", "line 1: nested lists and mappings are not supported"},
+		{"missing comma", `a: ["b" "c"]`, "line 1: expected , between list items"},
+		{"inline mapping", "a: {b: 1}", "line 1: inline mappings are not supported"},
+		{"block string", "a: |\n  text", "line 1: multi-line strings are not supported"},
+		{"anchor", "a: &anchor 1", "line 1: anchors, aliases and tags are not supported"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseYAML([]byte(test.input))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if err.Error() != test.error {
+				t.Fatalf("expected %q, got %q", test.error, err)
+			}
+		})
+	}
+}